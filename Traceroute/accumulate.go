@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// hopStats accumulates the probes of one TTL over repeated rounds of a trace
+type hopStats struct {
+	TTL      int
+	Sent     int
+	Received int
+	Last     time.Duration
+	Best     time.Duration
+	Worst    time.Duration
+	total    time.Duration
+	Peers    []net.Addr
+
+	// Replies from addresses left out of Peers once a -max-hop-peers or -max-total-peers cap was hit
+	Untracked int
+
+	// Rounds in which each address answered the TTL, and probes it answered over all of them
+	answered map[string]int
+	probes   map[string]int
+}
+
+// Adds a round of the TTL; a new address is only kept while track allows it
+func (s *hopStats) add(hop HopResult, track func() bool) {
+	s.Sent += hop.Sent
+	for _, rtt := range hop.RTTs {
+		if s.Received == 0 || rtt < s.Best {
+			s.Best = rtt
+		}
+		if rtt > s.Worst {
+			s.Worst = rtt
+		}
+		s.Received++
+		s.total += rtt
+		s.Last = rtt
+	}
+	for _, peer := range hop.Peers {
+		if containsAddr(s.Peers, peer) {
+			continue
+		}
+		if !track() {
+			s.Untracked++
+			continue
+		}
+		s.Peers = append(s.Peers, peer)
+	}
+	if s.answered == nil {
+		s.answered = make(map[string]int)
+		s.probes = make(map[string]int)
+	}
+	// Untracked addresses are not counted either, so the map stays as small as Peers
+	counted := make(map[string]bool)
+	for _, peer := range hop.Peers {
+		if !containsAddr(s.Peers, peer) {
+			continue
+		}
+		s.probes[peer.String()]++
+		if !counted[peer.String()] {
+			counted[peer.String()] = true
+			s.answered[peer.String()]++
+		}
+	}
+}
+
+// Notes the replies from addresses left untracked, if any, for the hop's list of responders
+func (s *hopStats) untrackedNote() string {
+	if s.Untracked == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (+%d replies from untracked addresses)", s.Untracked)
+}
+
+// Returns the share of the rounds in percent in which the hop's most frequent address answered
+func (s *hopStats) Stability(rounds int) float64 {
+	var most int = 0
+	for _, count := range s.answered {
+		if count > most {
+			most = count
+		}
+	}
+	if rounds == 0 {
+		return 0
+	}
+	return 100 * float64(most) / float64(rounds)
+}
+
+// Returns how many rounds the address answered the TTL in
+func (s *hopStats) AnsweredBy(peer net.Addr) int {
+	return s.answered[peer.String()]
+}
+
+// Returns how many probes the address answered over all rounds of the TTL
+func (s *hopStats) ProbesBy(peer net.Addr) int {
+	return s.probes[peer.String()]
+}
+
+func (s *hopStats) Avg() time.Duration {
+	if s.Received == 0 {
+		return 0
+	}
+	return s.total / time.Duration(s.Received)
+}
+
+// Returns the share of lost probes in percent
+func (s *hopStats) Loss() float64 {
+	return lossPercent(s.Sent, s.Received)
+}
+
+func containsAddr(peersArray []net.Addr, peer net.Addr) bool {
+	for _, p := range peersArray {
+		if p.String() == peer.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// pathStats accumulates every round of a continuously repeated trace
+type pathStats struct {
+	Rounds int
+	hops   map[int]*hopStats
+	// Hops beyond the destination are dropped once it is known
+	reachedAt int
+
+	// Caps on the distinct addresses kept per hop and over all hops, 0 for none; heavily
+	// load-balanced or spoofed paths would otherwise grow them with every round
+	maxHopPeers   int
+	maxTotalPeers int
+	trackedPeers  int
+}
+
+func newPathStats() *pathStats {
+	return &pathStats{hops: make(map[int]*hopStats), maxHopPeers: *maxHopPeers, maxTotalPeers: *maxTotalPeers}
+}
+
+func (p *pathStats) add(hop HopResult) {
+	stats, ok := p.hops[hop.TTL]
+	if !ok {
+		stats = &hopStats{TTL: hop.TTL}
+		p.hops[hop.TTL] = stats
+	}
+	stats.add(hop, func() bool {
+		if (p.maxHopPeers > 0 && len(stats.Peers) >= p.maxHopPeers) || (p.maxTotalPeers > 0 && p.trackedPeers >= p.maxTotalPeers) {
+			return false
+		}
+		p.trackedPeers++
+		return true
+	})
+	if hop.Reached && (p.reachedAt == 0 || hop.TTL < p.reachedAt) {
+		p.reachedAt = hop.TTL
+	}
+}
+
+// Returns the accumulated hops ordered by TTL
+func (p *pathStats) sorted() []*hopStats {
+	var hopsArray []*hopStats
+	for ttl, stats := range p.hops {
+		if p.reachedAt == 0 || ttl <= p.reachedAt {
+			hopsArray = append(hopsArray, stats)
+		}
+	}
+	sort.Slice(hopsArray, func(i, j int) bool {
+		return hopsArray[i].TTL < hopsArray[j].TTL
+	})
+	return hopsArray
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// Returns a round of the TTL answered once by each of the responders, 10.ttl.round.i
+func roundOfResponders(ttl int, round int, responders int) HopResult {
+	hop := HopResult{TTL: ttl, Sent: responders}
+	for i := 0; i < responders; i++ {
+		hop.Peers = append(hop.Peers, &net.IPAddr{IP: net.ParseIP(fmt.Sprintf("10.%d.%d.%d", ttl, round, i))})
+		hop.RTTs = append(hop.RTTs, time.Millisecond)
+	}
+	return hop
+}
+
+func TestPeerCaps(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxHopPeers   int
+		maxTotalPeers int
+		// Every round answers hops 1 to 3 from responders addresses never seen before
+		rounds     int
+		responders int
+		// Addresses kept and replies left untracked per hop
+		wantPeers     []int
+		wantUntracked []int
+	}{
+		{name: "under the caps", maxHopPeers: 32, maxTotalPeers: 1024, rounds: 2, responders: 3, wantPeers: []int{6, 6, 6}, wantUntracked: []int{0, 0, 0}},
+		{name: "per hop cap", maxHopPeers: 5, rounds: 4, responders: 3, wantPeers: []int{5, 5, 5}, wantUntracked: []int{7, 7, 7}},
+		{name: "total cap", maxTotalPeers: 8, rounds: 4, responders: 3, wantPeers: []int{3, 3, 2}, wantUntracked: []int{9, 9, 10}},
+		{name: "both caps", maxHopPeers: 5, maxTotalPeers: 12, rounds: 100, responders: 3, wantPeers: []int{5, 4, 3}, wantUntracked: []int{295, 296, 297}},
+		{name: "no caps", rounds: 100, responders: 3, wantPeers: []int{300, 300, 300}, wantUntracked: []int{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, maxHopPeers, tt.maxHopPeers)
+			setFlag(t, maxTotalPeers, tt.maxTotalPeers)
+			path := newPathStats()
+			for round := 0; round < tt.rounds; round++ {
+				for ttl := 1; ttl <= 3; ttl++ {
+					path.add(roundOfResponders(ttl, round, tt.responders))
+				}
+			}
+
+			for i, stats := range path.sorted() {
+				if len(stats.Peers) != tt.wantPeers[i] || stats.Untracked != tt.wantUntracked[i] {
+					t.Errorf("hop %d kept %d addresses with %d untracked replies, want %d and %d",
+						stats.TTL, len(stats.Peers), stats.Untracked, tt.wantPeers[i], tt.wantUntracked[i])
+				}
+				// Untracked replies still count towards loss and RTT
+				if stats.Received != tt.rounds*tt.responders || stats.Loss() != 0 {
+					t.Errorf("hop %d received %d replies with %.0f%% loss, want %d and none", stats.TTL, stats.Received, stats.Loss(), tt.rounds*tt.responders)
+				}
+				if len(stats.answered) > len(stats.Peers) {
+					t.Errorf("hop %d counts %d addresses' rounds for %d kept", stats.TTL, len(stats.answered), len(stats.Peers))
+				}
+			}
+		})
+	}
+}
+
+func TestUntrackedRepliesNoted(t *testing.T) {
+	tests := []struct {
+		name      string
+		untracked int
+		want      string
+	}{
+		{name: "all tracked", untracked: 0, want: ""},
+		{name: "one untracked", untracked: 1, want: " (+1 replies from untracked addresses)"},
+		{name: "many untracked", untracked: 295, want: " (+295 replies from untracked addresses)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := &hopStats{Untracked: tt.untracked}
+			if got := stats.untrackedNote(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCappedHopKeepsCountingKnownPeers(t *testing.T) {
+	setFlag(t, maxHopPeers, 2)
+	setFlag(t, maxTotalPeers, 0)
+	path := newPathStats()
+	known := roundOfResponders(1, 0, 2)
+	for round := 0; round < 3; round++ {
+		path.add(known)
+		path.add(roundOfResponders(1, round+1, 1))
+	}
+
+	stats := path.hops[1]
+	for _, peer := range known.Peers {
+		if got := stats.AnsweredBy(peer); got != 3 {
+			t.Errorf("%v answered %d rounds, want 3", peer, got)
+		}
+	}
+	if stats.Untracked != 3 {
+		t.Errorf("%d untracked replies, want 3", stats.Untracked)
+	}
+}
+
+func TestProbesByResponder(t *testing.T) {
+	tests := []struct {
+		name   string
+		rounds []HopResult
+		// Rounds and probes answered by 10.0.0.1 and 10.0.0.2
+		wantRounds []int
+		wantProbes []int
+	}{
+		{name: "stable", rounds: []HopResult{
+			{TTL: 3, Sent: 3, Peers: addrs("10.0.0.1", "10.0.0.1", "10.0.0.1")},
+			{TTL: 3, Sent: 3, Peers: addrs("10.0.0.1", "10.0.0.1")},
+		}, wantRounds: []int{2, 0}, wantProbes: []int{5, 0}},
+		{name: "split every round", rounds: []HopResult{
+			{TTL: 3, Sent: 3, Peers: addrs("10.0.0.1", "10.0.0.2", "10.0.0.1")},
+			{TTL: 3, Sent: 3, Peers: addrs("10.0.0.2", "10.0.0.1", "10.0.0.2")},
+		}, wantRounds: []int{2, 2}, wantProbes: []int{3, 3}},
+		{name: "path changed", rounds: []HopResult{
+			{TTL: 3, Sent: 3, Peers: addrs("10.0.0.1", "10.0.0.2", "10.0.0.1")},
+			{TTL: 3, Sent: 3, Peers: addrs("10.0.0.2", "10.0.0.2", "10.0.0.2")},
+		}, wantRounds: []int{1, 2}, wantProbes: []int{2, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := &hopStats{TTL: 3}
+			for _, round := range tt.rounds {
+				stats.add(round, func() bool { return true })
+			}
+			for i, peer := range addrs("10.0.0.1", "10.0.0.2") {
+				if rounds, probes := stats.AnsweredBy(peer), stats.ProbesBy(peer); rounds != tt.wantRounds[i] || probes != tt.wantProbes[i] {
+					t.Errorf("%v answered %d probes in %d rounds, want %d in %d", peer, probes, rounds, tt.wantProbes[i], tt.wantRounds[i])
+				}
+			}
+			if stats.Sent != 3*len(tt.rounds) {
+				t.Errorf("%d probes sent, want %d", stats.Sent, 3*len(tt.rounds))
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"time"
+)
+
+// The RTTs of a hop are steady when they spread over less than this share of their mean,
+// or over less than settledJitter, as the RTTs of nearby hops vary a lot relative to their size
+const (
+	settledSpread = 0.5
+	settledJitter = time.Millisecond
+)
+
+// Reports whether the probes sent to a hop so far give a reliable answer: every one of them
+// was answered, with steady RTTs. A single answered probe has nothing to vary yet.
+func settledHop(rttsArray []time.Duration, sent int) bool {
+	if len(rttsArray) < sent {
+		return false
+	}
+	min, avg, max := rttStats(rttsArray)
+	spread := max - min
+	return spread < settledJitter || float64(spread) < settledSpread*float64(avg)
+}
+
+// Probes one TTL one probe at a time with -adaptive-probes: at least tracer.minProbes, then more
+// while the hop loses probes or its RTTs vary, up to tracer.maxProbes. A hop that answered none
+// of its first minProbes probes is given up as silent, which costs no more waiting than a fixed
+// exchange. Returns the replies merged as socketExchange would and the number of probes sent;
+// lost probes only count as sent unless nothing answered.
+func adaptiveExchange(tracer *Tracer, ttl int) (exchangeResult, int, error) {
+	// Like a fixed exchange only the first probe of the hop is retried for ARP
+	defer func(retry bool) { tracer.arpRetry = retry }(tracer.arpRetry)
+
+	var result exchangeResult
+	var lastErr error
+	var lastSend time.Time
+	sizesArray := tracer.payloadSizes()
+	sent := 0
+	for sent < tracer.maxProbes {
+		if sent >= tracer.minProbes && (len(result.RTTs) == 0 || settledHop(result.RTTs, sent)) {
+			break
+		}
+		if sent > 0 && tracer.interval > 0 {
+			waitUntil(lastSend.Add(tracer.interval), tracer.precise)
+		}
+		lastSend = time.Now()
+		exchange, err := socketExchange(tracer, []int{sizesArray[sent%len(sizesArray)]}, ttl, 1)
+		sent++
+		tracer.arpRetry = false
+		if err != nil {
+			if !isTimeout(err) {
+				return exchangeResult{}, sent, err
+			}
+			lastErr = err
+			continue
+		}
+		result.merge(exchange)
+	}
+
+	if len(result.RTTs) == 0 {
+		return exchangeResult{}, sent, lastErr
+	}
+	return result, sent, nil
+}
+
+// Adds the replies of a later exchange with the same TTL; what socketExchange keeps of the last
+// reply, such as its type and TOS, is taken from the later exchange when it has it
+func (r *exchangeResult) merge(other exchangeResult) {
+	r.RTTs = append(r.RTTs, other.RTTs...)
+	r.Peers = append(r.Peers, other.Peers...)
+	r.Sizes = append(r.Sizes, other.Sizes...)
+	r.Timings = append(r.Timings, other.Timings...)
+	r.Replies = append(r.Replies, other.Replies...)
+	r.Advisories = append(r.Advisories, other.Advisories...)
+	r.Retried = r.Retried || other.Retried
+	r.NonTargetEcho = r.NonTargetEcho || other.NonTargetEcho
+	r.Duplicates += other.Duplicates
+	r.Reordered += other.Reordered
+	r.Mangled += other.Mangled
+	r.Truncated += other.Truncated
+
+	if other.Type != nil {
+		r.Type = other.Type
+		r.TerminalReply = other.TerminalReply
+	}
+	if isEchoReply(other.Type) {
+		r.ReplyCode = other.ReplyCode
+	}
+	if other.TOSKnown {
+		r.ReplyTOS, r.TOSKnown = other.ReplyTOS, true
+	}
+	if other.TTLKnown {
+		r.ReplyTTL, r.TTLKnown = other.ReplyTTL, true
+	}
+	if len(other.Timestamps) > 0 || other.TimestampOverflow > 0 {
+		r.Timestamps, r.TimestampOverflow = other.Timestamps, other.TimestampOverflow
+	}
+}
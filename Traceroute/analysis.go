@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// rateLimitParams tunes the rate-limited hop heuristic.
+//
+// Routers answer traceroute probes from a slow path that is often rate
+// limited, so a hop may show high or erratic RTTs that say nothing about
+// the forwarding latency. A real bottleneck delays every hop behind it, so a
+// hop is suspicious when it is slower than some later hop, or when it is the
+// slowest hop of the path and its samples vary a lot.
+type rateLimitParams struct {
+	// How much a hop's minimum RTT must exceed the minimum RTT of a later hop
+	Margin time.Duration
+	// Ratio of standard deviation to mean above which the hop's RTTs count as erratic
+	MaxVariation float64
+}
+
+// Marks hops that look rate-limited and returns them
+func markRateLimited(hopsArray []HopResult, params rateLimitParams) []HopResult {
+	var slowest int = -1
+	var slowestAvg time.Duration = 0
+	for i, hop := range hopsArray {
+		if !hop.Responded() || hop.Reached {
+			continue
+		}
+		if _, avg, _ := rttStats(hop.RTTs); avg > slowestAvg {
+			slowest = i
+			slowestAvg = avg
+		}
+	}
+
+	var marked []HopResult
+	for i := range hopsArray {
+		hop := &hopsArray[i]
+		if !hop.Responded() || hop.Reached {
+			continue
+		}
+
+		min, avg, _ := rttStats(hop.RTTs)
+
+		fasterLater := false
+		for _, later := range hopsArray[i+1:] {
+			if !later.Responded() {
+				continue
+			}
+			if laterMin, _, _ := rttStats(later.RTTs); laterMin+params.Margin < min {
+				fasterLater = true
+				break
+			}
+		}
+
+		erratic := avg > 0 && float64(rttStdDev(hop.RTTs))/float64(avg) > params.MaxVariation
+
+		if fasterLater || (i == slowest && erratic) {
+			hop.RateLimited = true
+			marked = append(marked, *hop)
+		}
+	}
+	return marked
+}
+
+// latencyStep is the rise of the minimum RTT between two consecutive responding hops
+type latencyStep struct {
+	From, To       HopResult
+	FromRTT, ToRTT time.Duration
+}
+
+func (s latencyStep) Increase() time.Duration {
+	return s.ToRTT - s.FromRTT
+}
+
+func (s latencyStep) String() string {
+	return fmt.Sprintf("largest latency increase between hop %d (%s) and hop %d (%s): +%s",
+		s.From.TTL, humanDuration(s.FromRTT), s.To.TTL, humanDuration(s.ToRTT), humanDuration(s.Increase()))
+}
+
+// Finds the largest latency increase along the path, the likely bottleneck link.
+// Minimum RTTs are compared since queueing and slow-path noise only ever add delay;
+// timed out hops and hops that look rate-limited are skipped, so the step may span them.
+// ok is false when fewer than two hops are usable or the latency never rises.
+func largestLatencyStep(hopsArray []HopResult, params rateLimitParams) (step latencyStep, ok bool) {
+	checkedArray := append([]HopResult{}, hopsArray...)
+	markRateLimited(checkedArray, params)
+
+	var previous *HopResult
+	var previousRTT time.Duration
+	for i := range checkedArray {
+		hop := &checkedArray[i]
+		if !hop.Responded() || len(hop.RTTs) == 0 || hop.RateLimited {
+			continue
+		}
+		rtt, _, _ := rttStats(hop.RTTs)
+		if previous != nil && rtt-previousRTT > step.Increase() {
+			step = latencyStep{From: *previous, To: *hop, FromRTT: previousRTT, ToRTT: rtt}
+			ok = true
+		}
+		previous, previousRTT = hop, rtt
+	}
+	return step, ok
+}
+
+// Returns the first answering hop, up to untilHop unless it is 0, whose best RTT is above threshold
+func latencyAlert(hopsArray []HopResult, threshold time.Duration, untilHop int, method string) (HopResult, time.Duration, bool) {
+	for _, hop := range hopsArray {
+		if untilHop > 0 && hop.TTL > untilHop {
+			break
+		}
+		if !hop.Responded() || len(hop.RTTs) == 0 {
+			continue
+		}
+		if rtt := bestRTT(hop.RTTs, method); rtt > threshold {
+			return hop, rtt, true
+		}
+	}
+	return HopResult{}, 0, false
+}
+
+// egressBoundary is where the path leaves private address space for public addresses
+type egressBoundary struct {
+	From, To HopResult
+	// Some hop before the boundary answered from the shared address space of carrier-grade NAT
+	CGNAT bool
+}
+
+func (b egressBoundary) String() string {
+	text := fmt.Sprintf("NAT/egress boundary appears between hop %d and %d", b.From.TTL, b.To.TTL)
+	if b.CGNAT {
+		text += " (behind carrier-grade NAT)"
+	}
+	return text
+}
+
+// Finds the first step from a hop answering from a private, CGNAT or other non-public address
+// to one answering from a public address. Silent hops are skipped, so the step may span them.
+func findEgressBoundary(hopsArray []HopResult) (egressBoundary, bool) {
+	var boundary egressBoundary
+	var private *HopResult
+	for i := range hopsArray {
+		hop := &hopsArray[i]
+		if !hop.Responded() {
+			continue
+		}
+		ipAddr, ok := hop.Peers[0].(*net.IPAddr)
+		if !ok {
+			continue
+		}
+		if !isPublicIP(ipAddr.IP) {
+			private = hop
+			boundary.CGNAT = boundary.CGNAT || cgnatNet.Contains(ipAddr.IP)
+			continue
+		}
+		if private != nil {
+			boundary.From, boundary.To = *private, *hop
+			return boundary, true
+		}
+	}
+	return egressBoundary{}, false
+}
+
+// networkSpan is a run of consecutive answering hops whose first responders share a network
+type networkSpan struct {
+	Network           *net.IPNet
+	FirstTTL, LastTTL int
+	// Hops of the span that answered; silent hops inside it do not end it
+	Answered int
+}
+
+func (s networkSpan) String() string {
+	if s.FirstTTL == s.LastTTL {
+		return fmt.Sprintf("%-20s hop %d", s.Network, s.FirstTTL)
+	}
+	return fmt.Sprintf("%-20s hops %d-%d (%d answering)", s.Network, s.FirstTTL, s.LastTTL, s.Answered)
+}
+
+// Groups the path by the networks of the given prefix lengths its hops answer from, in path order.
+// A hop is placed by its first responder; silent hops are skipped, so a span may cover them, and a
+// network the path leaves and enters again gets a span for each visit.
+func aggregateNetworks(hopsArray []HopResult, prefix4 int, prefix6 int) []networkSpan {
+	var spansArray []networkSpan
+	for _, hop := range hopsArray {
+		if !hop.Responded() {
+			continue
+		}
+		ipAddr, ok := hop.Peers[0].(*net.IPAddr)
+		if !ok {
+			continue
+		}
+		mask := net.CIDRMask(prefix6, 8*net.IPv6len)
+		ip := ipAddr.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			mask, ip = net.CIDRMask(prefix4, 8*net.IPv4len), ip4
+		}
+		network := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+
+		if last := len(spansArray) - 1; last >= 0 && spansArray[last].Network.String() == network.String() {
+			spansArray[last].LastTTL = hop.TTL
+			spansArray[last].Answered++
+			continue
+		}
+		spansArray = append(spansArray, networkSpan{Network: network, FirstTTL: hop.TTL, LastTTL: hop.TTL, Answered: 1})
+	}
+	return spansArray
+}
+
+// lossThresholds are the loss percentages above which a trace fails, negative ones disabled
+type lossThresholds struct {
+	Overall     float64
+	Hop         float64
+	Destination float64
+}
+
+// Returns the share of lost probes in percent
+func lossPercent(sent int, received int) float64 {
+	if sent == 0 {
+		return 0
+	}
+	return 100 * float64(sent-received) / float64(sent)
+}
+
+// Checks the loss of the trace against the thresholds and describes every one exceeded.
+// Hops that never answered are silent routers rather than loss, so the per-hop check skips them;
+// an unreached destination counts as having lost every probe.
+func lossAlerts(result *TraceResult, thresholds lossThresholds) []string {
+	var alertsArray []string
+	var sent, received int = 0, 0
+	for _, hop := range result.Hops {
+		sent += hop.Sent
+		received += len(hop.RTTs)
+		if hop.Reached || !hop.Responded() || thresholds.Hop < 0 {
+			continue
+		}
+		if loss := lossPercent(hop.Sent, len(hop.RTTs)); loss > thresholds.Hop {
+			alertsArray = append(alertsArray, fmt.Sprintf("hop %d %s lost %.1f%% of its probes, above %.1f%%",
+				hop.TTL, createPeersString(hop.Peers), loss, thresholds.Hop))
+		}
+	}
+
+	if loss := lossPercent(sent, received); thresholds.Overall >= 0 && loss > thresholds.Overall {
+		alertsArray = append(alertsArray, fmt.Sprintf("%.1f%% of all probes were lost, above %.1f%%", loss, thresholds.Overall))
+	}
+
+	if thresholds.Destination >= 0 {
+		var loss float64 = 100
+		if result.Reached && len(result.Hops) > 0 {
+			last := result.Hops[len(result.Hops)-1]
+			loss = lossPercent(last.Sent, len(last.RTTs))
+		}
+		if loss > thresholds.Destination {
+			alertsArray = append(alertsArray, fmt.Sprintf("the destination lost %.1f%% of its probes, above %.1f%%", loss, thresholds.Destination))
+		}
+	}
+	return alertsArray
+}
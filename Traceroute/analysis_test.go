@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLossAlertsOnPartlyAnsweredHops(t *testing.T) {
+	tests := []struct {
+		name       string
+		thresholds lossThresholds
+		path       func(probe fakeProbe) []fakeReply
+		want       []string
+	}{
+		{
+			name:       "hop loss",
+			thresholds: lossThresholds{Overall: -1, Hop: 10, Destination: -1},
+			path: func(probe fakeProbe) []fakeReply {
+				if probe.TTL == 1 && probe.Number() == 1 {
+					return nil
+				}
+				return fakePath("10.9.9.9", "10.0.0.1")(probe)
+			},
+			want: []string{"hop 1 [10.0.0.1] lost 33.3% of its probes, above 10.0%"},
+		},
+		{
+			name:       "destination loss",
+			thresholds: lossThresholds{Overall: -1, Hop: -1, Destination: 50},
+			path:       lossyDestination("10.9.9.9", 0, 2),
+			want:       []string{"the destination lost 66.7% of its probes, above 50.0%"},
+		},
+		{
+			name:       "within the thresholds",
+			thresholds: lossThresholds{Overall: 40, Hop: 40, Destination: 40},
+			path:       lossyDestination("10.9.9.9", 1),
+			want:       nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			offlineDNS(t, nil)
+			useFakeNetwork(t, newFakeConn(tt.path))
+
+			result, err := tracert("10.9.9.9", traceConfig{MaxTTL: 4, Method: "icmp"}, &recordingReporter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := lossAlerts(result, tt.thresholds)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got alerts %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// originInfo is what Team Cymru's IP to ASN DNS service reports for an address.
+// The country is the one the prefix is registered in, not a geolocation.
+type originInfo struct {
+	ASN     string
+	Prefix  string
+	Country string
+}
+
+var originCache = struct {
+	sync.Mutex
+	m map[string]originInfo
+}{m: make(map[string]originInfo)}
+
+// Looks up the origin AS and country of ip, e.g. "15169 | 8.8.8.0/24 | US | arin | 2023-12-28"
+func lookupOrigin(ip net.IP) (originInfo, error) {
+	key := ip.String()
+	originCache.Lock()
+	info, ok := originCache.m[key]
+	originCache.Unlock()
+	if ok {
+		return info, nil
+	}
+
+	ctx, cancel := context.WithTimeout(enrichmentContext(), *resolveTimeout)
+	defer cancel()
+	records, err := hopResolver.LookupTXT(ctx, originQuery(ip))
+	if err != nil {
+		return originInfo{}, err
+	}
+	if len(records) == 0 {
+		return originInfo{}, fmt.Errorf("no origin record for %s", key)
+	}
+
+	fields := strings.Split(records[0], "|")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if len(fields) < 3 {
+		return originInfo{}, fmt.Errorf("malformed origin record %q", records[0])
+	}
+	// Addresses announced by several ASes list them separated by spaces
+	info = originInfo{ASN: strings.Fields(fields[0])[0], Prefix: fields[1], Country: fields[2]}
+
+	originCache.Lock()
+	originCache.m[key] = info
+	originCache.Unlock()
+	return info, nil
+}
+
+// Builds the reversed-address query name, by octet for IPv4 and by nibble for IPv6
+func originQuery(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.origin.asn.cymru.com", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+
+	var nibbles []string
+	ip16 := ip.To16()
+	for i := len(ip16) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x", ip16[i]&0x0f), fmt.Sprintf("%x", ip16[i]>>4))
+	}
+	return strings.Join(nibbles, ".") + ".origin6.asn.cymru.com"
+}
+
+var cgnatNet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// Reports whether ip is publicly routable, so registry data means something for it
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() ||
+		ip.IsMulticast() || cgnatNet.Contains(ip))
+}
+
+// Annotates every responding hop with the origin AS and country of its first responder, as the
+// "asn" and "geoip" enrichers find them; the built-in ones only know public addresses
+func annotateOrigins(result *TraceResult) {
+	for i := range result.Hops {
+		hop := &result.Hops[i]
+		if !hop.Responded() {
+			continue
+		}
+		ipAddr, ok := hop.Peers[0].(*net.IPAddr)
+		if !ok {
+			continue
+		}
+		hop.ASN = enrichedValues("asn", ipAddr.IP)["asn"]
+		hop.Country = enrichedValues("geoip", ipAddr.IP)["country"]
+	}
+}
+
+// countryMarker marks the hop where the path enters another country
+type countryMarker struct {
+	TTL     int
+	Country string
+}
+
+func (m countryMarker) String() string {
+	return fmt.Sprintf("--- entering %s at hop %d ---", m.Country, m.TTL)
+}
+
+// Finds the country changes along the path; hops without a country are skipped
+func countryMarkers(result *TraceResult) []countryMarker {
+	var markersArray []countryMarker
+	current := ""
+	for _, hop := range result.Hops {
+		if hop.Country == "" || hop.Country == current {
+			continue
+		}
+		current = hop.Country
+		markersArray = append(markersArray, countryMarker{TTL: hop.TTL, Country: hop.Country})
+	}
+	return markersArray
+}
+
+// Returns the ASes of the responding hops in path order, consecutive repeats collapsed,
+// with "*" for hops of unknown or private origin, and how many distinct ASes there are
+func asPath(result *TraceResult) ([]string, int) {
+	var pathArray []string
+	distinct := make(map[string]bool)
+	for _, hop := range result.Hops {
+		if !hop.Responded() {
+			continue
+		}
+		asn := "*"
+		if hop.ASN != "" {
+			asn = hop.ASN
+			distinct[asn] = true
+		}
+		if len(pathArray) == 0 || pathArray[len(pathArray)-1] != asn {
+			pathArray = append(pathArray, asn)
+		}
+	}
+	return pathArray, len(distinct)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Width of the RTT profile when the terminal's is unknown
+const defaultTerminalWidth = 80
+
+// Prints a bar per answering hop scaled to the slowest hop's average RTT:
+// '=' up to the hop's minimum RTT and '-' on to its average
+func printRTTBars(hopsArray []HopResult) {
+	var slowest time.Duration = 0
+	for _, hop := range hopsArray {
+		if _, avg, _ := rttStats(hop.RTTs); hop.Responded() && avg > slowest {
+			slowest = avg
+		}
+	}
+	if slowest == 0 {
+		return
+	}
+
+	width := terminalWidth()
+	if width == 0 {
+		width = defaultTerminalWidth
+	}
+	// TTL and average columns, and the two bar ends
+	width -= 3 + 1 + 10 + 1 + 2
+	if width < 10 {
+		width = 10
+	}
+
+	for _, hop := range hopsArray {
+		if !hop.Responded() {
+			fmt.Printf("%3d %10s |%s|\n", hop.TTL, "*", strings.Repeat(" ", width))
+			continue
+		}
+		min, avg, _ := rttStats(hop.RTTs)
+		minLength := int(int64(width) * int64(min) / int64(slowest))
+		avgLength := int(int64(width) * int64(avg) / int64(slowest))
+		bar := strings.Repeat("=", minLength) + strings.Repeat("-", avgLength-minLength) + strings.Repeat(" ", width-avgLength)
+		fmt.Printf("%3d %10s |%s|\n", hop.TTL, humanDuration(avg), bar)
+	}
+}
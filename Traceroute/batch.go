@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sync"
+)
+
+// reporterCall is one call a bufferedReporter received
+type reporterCall struct {
+	start   bool
+	target  string
+	maxTTL  int
+	traceID string
+	hop     *HopResult
+	note    string
+	end     *TraceResult
+}
+
+// bufferedReporter keeps the output of a trace run alongside others, so it can be
+// passed on to the real reporter once the traces before it are shown
+type bufferedReporter struct {
+	mutex      sync.Mutex
+	callsArray []reporterCall
+}
+
+func (r *bufferedReporter) Start(target string, maxTTL int, traceID string) {
+	r.record(reporterCall{start: true, target: target, maxTTL: maxTTL, traceID: traceID})
+}
+
+func (r *bufferedReporter) Hop(hop HopResult) {
+	r.record(reporterCall{hop: &hop})
+}
+
+func (r *bufferedReporter) Note(text string) {
+	r.record(reporterCall{note: text})
+}
+
+func (r *bufferedReporter) End(result *TraceResult) {
+	r.record(reporterCall{end: result})
+}
+
+func (r *bufferedReporter) record(call reporterCall) {
+	r.mutex.Lock()
+	r.callsArray = append(r.callsArray, call)
+	r.mutex.Unlock()
+}
+
+// Passes the recorded calls on in the order they were made
+func (r *bufferedReporter) flush(reporter Reporter) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, call := range r.callsArray {
+		switch {
+		case call.start:
+			reporter.Start(call.target, call.maxTTL, call.traceID)
+		case call.hop != nil:
+			reporter.Hop(*call.hop)
+		case call.end != nil:
+			reporter.End(call.end)
+		default:
+			reporter.Note(call.note)
+		}
+	}
+	r.callsArray = nil
+}
+
+// batchTrace is a target of the batch and, once done is closed, the outcome of its trace
+type batchTrace struct {
+	target targetSpec
+	output *bufferedReporter
+	result *TraceResult
+	err    error
+	done   chan struct{}
+}
+
+// batch traces the targets of a run with up to -batch-concurrency of them at once, every trace
+// on its own socket and echo identifier, while their output and results are still taken in the
+// order the targets were given
+type batch struct {
+	tracesArray []*batchTrace
+	reporter    Reporter
+	workers     int
+	trace       func(target targetSpec, reporter Reporter) (*TraceResult, error)
+
+	mutex   sync.Mutex
+	stopped bool
+}
+
+func newBatch(targetsArray []targetSpec, workers int, reporter Reporter) *batch {
+	b := &batch{reporter: reporter, workers: workers, trace: func(target targetSpec, reporter Reporter) (*TraceResult, error) {
+		return tracert(target.Host, target.Config, reporter)
+	}}
+	for _, target := range targetsArray {
+		b.tracesArray = append(b.tracesArray, &batchTrace{target: target, output: &bufferedReporter{}, done: make(chan struct{})})
+	}
+	return b
+}
+
+// Starts the workers; one at a time the traces run when result asks for them, as before batching
+func (b *batch) start() {
+	if b.workers <= 1 {
+		return
+	}
+	pending := make(chan *batchTrace, len(b.tracesArray))
+	for _, trace := range b.tracesArray {
+		pending <- trace
+	}
+	close(pending)
+
+	for w := 0; w < b.workers; w++ {
+		go func() {
+			for trace := range pending {
+				b.mutex.Lock()
+				stopped := b.stopped
+				b.mutex.Unlock()
+				if !stopped {
+					trace.result, trace.err = b.trace(trace.target, trace.output)
+				}
+				close(trace.done)
+			}
+		}()
+	}
+}
+
+// Returns the trace of the i-th target, waiting for it and showing its output first
+func (b *batch) result(i int) (*TraceResult, error) {
+	trace := b.tracesArray[i]
+	if b.workers <= 1 {
+		return b.trace(trace.target, b.reporter)
+	}
+	<-trace.done
+	trace.output.flush(b.reporter)
+	return trace.result, trace.err
+}
+
+// Keeps the targets not started yet from being traced, e.g. after -fail-fast gave up
+func (b *batch) stop() {
+	b.mutex.Lock()
+	b.stopped = true
+	b.mutex.Unlock()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// eventReporter records every call in the order it was made
+type eventReporter struct {
+	eventsArray []string
+}
+
+func (r *eventReporter) Start(target string, maxTTL int, traceID string) {
+	r.eventsArray = append(r.eventsArray, "start "+target)
+}
+func (r *eventReporter) Hop(hop HopResult) {
+	r.eventsArray = append(r.eventsArray, fmt.Sprintf("hop %d", hop.TTL))
+}
+func (r *eventReporter) Note(text string) { r.eventsArray = append(r.eventsArray, text) }
+func (r *eventReporter) End(result *TraceResult) {
+	r.eventsArray = append(r.eventsArray, "end "+result.Target)
+}
+
+func batchTargets(count int) []targetSpec {
+	var targetsArray []targetSpec
+	for i := 0; i < count; i++ {
+		targetsArray = append(targetsArray, targetSpec{Host: fmt.Sprintf("t%d", i)})
+	}
+	return targetsArray
+}
+
+func TestBatchConcurrency(t *testing.T) {
+	tests := []struct {
+		name     string
+		targets  int
+		workers  int
+		wantPeak int32
+	}{
+		{name: "one at a time", targets: 4, workers: 1, wantPeak: 1},
+		{name: "fewer workers than targets", targets: 6, workers: 3, wantPeak: 3},
+		{name: "a worker per target", targets: 4, workers: 4, wantPeak: 4},
+		{name: "more workers than targets", targets: 2, workers: 8, wantPeak: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targetsArray := batchTargets(tt.targets)
+			out := &eventReporter{}
+			traces := newBatch(targetsArray, tt.workers, out)
+			var running, peak int32
+			traces.trace = func(target targetSpec, reporter Reporter) (*TraceResult, error) {
+				n := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+				for p := atomic.LoadInt32(&peak); n > p && !atomic.CompareAndSwapInt32(&peak, p, n); p = atomic.LoadInt32(&peak) {
+				}
+				reporter.Start(target.Host, 5, "")
+				// The later targets finish first
+				var index int
+				fmt.Sscanf(target.Host, "t%d", &index)
+				time.Sleep(time.Duration(tt.targets-index) * 10 * time.Millisecond)
+				reporter.Hop(HopResult{TTL: 1})
+				reporter.Note("note " + target.Host)
+				result := &TraceResult{Target: target.Host}
+				reporter.End(result)
+				return result, nil
+			}
+
+			traces.start()
+			var wantEvents []string
+			for i, target := range targetsArray {
+				result, err := traces.result(i)
+				if err != nil || result.Target != target.Host {
+					t.Fatalf("result %d is %+v, %v, want the trace of %s", i, result, err, target.Host)
+				}
+				wantEvents = append(wantEvents, "start "+target.Host, "hop 1", "note "+target.Host, "end "+target.Host)
+			}
+			if peak != tt.wantPeak {
+				t.Errorf("%d traces ran at once, want %d", peak, tt.wantPeak)
+			}
+			if !reflect.DeepEqual(out.eventsArray, wantEvents) {
+				t.Errorf("output %q, want it grouped by target in order %q", out.eventsArray, wantEvents)
+			}
+		})
+	}
+}
+
+func TestBatchStop(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		// Targets traced when the batch is stopped while they run
+		wantTraced int32
+	}{
+		{name: "one at a time", workers: 1, wantTraced: 1},
+		{name: "concurrent", workers: 2, wantTraced: 2},
+		{name: "worker per target", workers: 5, wantTraced: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			traces := newBatch(batchTargets(5), tt.workers, &eventReporter{})
+			var traced int32
+			var started sync.WaitGroup
+			started.Add(int(tt.wantTraced))
+			release := make(chan struct{})
+			traces.trace = func(target targetSpec, reporter Reporter) (*TraceResult, error) {
+				atomic.AddInt32(&traced, 1)
+				started.Done()
+				<-release
+				if target.Host == "t0" {
+					return nil, errors.New("cannot resolve t0")
+				}
+				return &TraceResult{Target: target.Host}, nil
+			}
+
+			// Stopped with the first traces running, like -fail-fast does once the first one fails
+			if tt.workers > 1 {
+				traces.start()
+				started.Wait()
+				traces.stop()
+				close(release)
+			} else {
+				close(release)
+			}
+			if _, err := traces.result(0); err == nil {
+				t.Fatal("the failed trace returned no error")
+			}
+			if tt.workers > 1 {
+				for i := 1; i < 5; i++ {
+					traces.result(i)
+				}
+			} else {
+				traces.stop()
+			}
+			if got := atomic.LoadInt32(&traced); got != tt.wantTraced {
+				t.Errorf("%d targets traced, want %d", got, tt.wantTraced)
+			}
+		})
+	}
+}
+
+func TestBatchOnFakeNetwork(t *testing.T) {
+	offlineDNS(t, nil)
+	setFlag(t, timeoutBase, 20*time.Millisecond)
+	setFlag(t, timeoutMax, 20*time.Millisecond)
+	var mu sync.Mutex
+	var connsArray []*fakeConn
+	saved := openTraceSocket
+	openTraceSocket = func(iface string, useIPv6 bool) (*icmpConn, error) {
+		conn := newFakeConn(fakePath("10.9.9.9", "10.0.0.1", ""))
+		mu.Lock()
+		connsArray = append(connsArray, conn)
+		mu.Unlock()
+		return &icmpConn{PacketConn: conn}, nil
+	}
+	defer func() { openTraceSocket = saved }()
+
+	targetsArray := []targetSpec{{Host: "10.9.9.9", Config: traceConfig{MaxTTL: 5, Method: "icmp"}}}
+	targetsArray = append(targetsArray, targetsArray[0], targetsArray[0])
+	out := &eventReporter{}
+	traces := newBatch(targetsArray, 3, out)
+	traces.start()
+	for i := range targetsArray {
+		result, err := traces.result(i)
+		if err != nil || !result.Reached || len(result.Hops) != 3 {
+			t.Fatalf("trace %d: %+v, %v", i, result, err)
+		}
+	}
+
+	// Every trace probes through its own socket with its own identifier
+	ids := make(map[int]bool)
+	for _, conn := range connsArray {
+		probesArray := conn.sent()
+		if len(probesArray) == 0 {
+			t.Fatal("a socket sent nothing")
+		}
+		ids[probesArray[0].ID] = true
+	}
+	if len(connsArray) != 3 || len(ids) != 3 {
+		t.Errorf("%d sockets with %d identifiers, want 3 of each", len(connsArray), len(ids))
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+// A -binary stream starts with this magic and a version byte, followed by one record per trace.
+// Records and the hops in them are length prefixed and hold varints and length prefixed strings
+// in a fixed order, so new fields can be appended within a version and older readers skip them;
+// the version only changes when an existing field changes, and newer versions are refused.
+const (
+	binaryMagic   = "TRB"
+	binaryVersion = 1
+)
+
+// Bits of the flags varint of a hop
+const (
+	binaryReached = 1 << iota
+	binaryNonTarget
+	binaryARPRetry
+	binaryConfirmed
+	binaryRateLimited
+	binaryTimeout
+)
+
+// binaryEncoder writes traces to a -binary stream, the header before the first one
+type binaryEncoder struct {
+	out    io.Writer
+	header bool
+}
+
+func newBinaryEncoder(out io.Writer) *binaryEncoder {
+	return &binaryEncoder{out: out}
+}
+
+func (e *binaryEncoder) encode(result *TraceResult) error {
+	var record binaryBuffer
+	record.string(result.Target)
+	record.string(result.TraceID)
+	destination := ""
+	if result.Destination != nil {
+		destination = result.Destination.String()
+	}
+	record.string(destination)
+	record.bool(result.Reached)
+	record.int(int64(result.FirstResponse))
+	for _, count := range []int{result.Counters.Sent, result.Counters.Replies, result.Counters.Timeouts, result.Counters.Foreign, result.Counters.Duplicates} {
+		record.int(int64(count))
+	}
+	record.int(int64(len(result.Hops)))
+	for _, hop := range result.Hops {
+		hopRecord := encodeBinaryHop(hop)
+		record.bytes(hopRecord.Bytes())
+	}
+	source := ""
+	if result.Source != nil {
+		source = result.Source.String()
+	}
+	record.string(source)
+
+	var out binaryBuffer
+	if !e.header {
+		out.Write([]byte{binaryMagic[0], binaryMagic[1], binaryMagic[2], binaryVersion})
+	}
+	out.bytes(record.Bytes())
+	if _, err := e.out.Write(out.Bytes()); err != nil {
+		return err
+	}
+	e.header = true
+	return nil
+}
+
+func encodeBinaryHop(hop HopResult) *binaryBuffer {
+	var b binaryBuffer
+	flags := 0
+	for bit, set := range map[int]bool{binaryReached: hop.Reached, binaryNonTarget: hop.NonTargetEcho, binaryARPRetry: hop.ARPRetry, binaryConfirmed: hop.Confirmed, binaryRateLimited: hop.RateLimited, binaryTimeout: isTimeout(hop.Err)} {
+		if set {
+			flags |= bit
+		}
+	}
+	b.int(int64(hop.TTL))
+	b.int(int64(hop.Sent))
+	b.int(int64(flags))
+	b.time(hop.Time)
+
+	// Hops are mostly answered by one address, so the peers are an address table and an index per reply
+	addressesArray := uniquePeers(hop.Peers)
+	b.int(int64(len(addressesArray)))
+	for _, address := range addressesArray {
+		b.bytes(compactIP(net.ParseIP(address)))
+	}
+	b.int(int64(len(hop.Peers)))
+	for _, peer := range hop.Peers {
+		for i, address := range addressesArray {
+			if address == peer.String() {
+				b.int(int64(i))
+				break
+			}
+		}
+	}
+	b.int(int64(len(hop.RTTs)))
+	for _, rtt := range hop.RTTs {
+		b.int(int64(rtt))
+	}
+	b.int(int64(len(hop.Sizes)))
+	for _, size := range hop.Sizes {
+		b.int(int64(size))
+	}
+	b.int(int64(len(hop.Timings)))
+	for _, timing := range hop.Timings {
+		b.time(timing.Sent)
+		b.time(timing.Received)
+	}
+	b.int(int64(len(hop.SourcePorts)))
+	for _, port := range hop.SourcePorts {
+		b.int(int64(port))
+	}
+	b.int(int64(len(hop.Replies)))
+	for _, reply := range hop.Replies {
+		b.int(int64(reply.Type))
+		b.int(int64(reply.Code))
+	}
+
+	errorText := ""
+	if hop.Err != nil {
+		errorText = hop.Err.Error()
+	}
+	b.string(errorText)
+	b.string(hop.ASN)
+	b.string(hop.Country)
+	b.int(int64(hop.Duplicates))
+	b.int(int64(hop.Reordered))
+	b.int(int64(hop.Mangled))
+	b.int(int64(hop.ReplyCode))
+	b.string(hop.TerminalReply)
+	b.int(int64(len(hop.Advisories)))
+	for _, advisory := range hop.Advisories {
+		b.string(advisory)
+	}
+	b.int(int64(hop.Truncated))
+	b.string(hop.Role)
+	// Annotations in key order, so the same hop always encodes the same
+	keysArray := make([]string, 0, len(hop.Annotations))
+	for key := range hop.Annotations {
+		keysArray = append(keysArray, key)
+	}
+	sort.Strings(keysArray)
+	b.int(int64(len(keysArray)))
+	for _, key := range keysArray {
+		b.string(key)
+		b.string(hop.Annotations[key])
+	}
+	return &b
+}
+
+// Returns the 4 byte form of IPv4 addresses
+func compactIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// Reports whether the data starts like a -binary stream
+func isBinaryTrace(data []byte) bool {
+	return len(data) > len(binaryMagic) && bytes.HasPrefix(data, []byte(binaryMagic))
+}
+
+// Reads every trace of a -binary stream
+func decodeBinaryTraces(in io.Reader) ([]*TraceResult, error) {
+	reader := bufio.NewReader(in)
+	header := make([]byte, len(binaryMagic)+1)
+	if _, err := io.ReadFull(reader, header); err != nil || string(header[:len(binaryMagic)]) != binaryMagic {
+		return nil, fmt.Errorf("not a binary trace stream")
+	}
+	if header[len(binaryMagic)] > binaryVersion {
+		return nil, fmt.Errorf("binary trace format version %d is newer than the supported %d", header[len(binaryMagic)], binaryVersion)
+	}
+
+	var resultsArray []*TraceResult
+	for {
+		length, err := binary.ReadUvarint(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errTruncatedBinary
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, errTruncatedBinary
+		}
+		result, err := decodeBinaryTrace(&binaryReader{data: data})
+		if err != nil {
+			return nil, err
+		}
+		resultsArray = append(resultsArray, result)
+	}
+	if len(resultsArray) == 0 {
+		return nil, fmt.Errorf("binary trace stream holds no trace")
+	}
+	return resultsArray, nil
+}
+
+var errTruncatedBinary = errors.New("binary trace stream is truncated")
+
+func decodeBinaryTrace(r *binaryReader) (*TraceResult, error) {
+	result := &TraceResult{Target: r.string(), TraceID: r.string()}
+	if destination := r.string(); destination != "" {
+		ip := net.ParseIP(destination)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid destination address %q", destination)
+		}
+		result.Destination = &net.IPAddr{IP: ip}
+	}
+	result.Reached = r.bool()
+	result.FirstResponse = time.Duration(r.int())
+	result.Counters = ProbeCounters{Sent: int(r.int()), Replies: int(r.int()), Timeouts: int(r.int()), Foreign: int(r.int()), Duplicates: int(r.int())}
+	for count := r.count(); count > 0 && r.err == nil; count-- {
+		hop, err := decodeBinaryHop(&binaryReader{data: r.bytes()})
+		if err != nil {
+			return nil, err
+		}
+		result.Hops = append(result.Hops, hop)
+	}
+	if source := r.string(); source != "" {
+		ip := net.ParseIP(source)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source address %q", source)
+		}
+		result.Source = &net.IPAddr{IP: ip}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return result, nil
+}
+
+// Fields past the ones known here were appended by a newer writer and are skipped
+func decodeBinaryHop(r *binaryReader) (HopResult, error) {
+	hop := HopResult{TTL: int(r.int()), Sent: int(r.int())}
+	flags := r.int()
+	hop.Reached = flags&binaryReached != 0
+	hop.NonTargetEcho = flags&binaryNonTarget != 0
+	hop.ARPRetry = flags&binaryARPRetry != 0
+	hop.Confirmed = flags&binaryConfirmed != 0
+	hop.RateLimited = flags&binaryRateLimited != 0
+	hop.Time = r.time()
+
+	var addressesArray []net.Addr
+	for count := r.count(); count > 0 && r.err == nil; count-- {
+		addressesArray = append(addressesArray, &net.IPAddr{IP: net.IP(r.bytes())})
+	}
+	for count := r.count(); count > 0 && r.err == nil; count-- {
+		index := r.int()
+		if index < 0 || index >= int64(len(addressesArray)) {
+			r.err = fmt.Errorf("invalid peer index %d in binary trace", index)
+			break
+		}
+		hop.Peers = append(hop.Peers, addressesArray[index])
+	}
+	for count := r.count(); count > 0 && r.err == nil; count-- {
+		hop.RTTs = append(hop.RTTs, time.Duration(r.int()))
+	}
+	for count := r.count(); count > 0 && r.err == nil; count-- {
+		hop.Sizes = append(hop.Sizes, int(r.int()))
+	}
+	for count := r.count(); count > 0 && r.err == nil; count-- {
+		hop.Timings = append(hop.Timings, ProbeTiming{Sent: r.time(), Received: r.time()})
+	}
+	for count := r.count(); count > 0 && r.err == nil; count-- {
+		hop.SourcePorts = append(hop.SourcePorts, int(r.int()))
+	}
+	for count := r.count(); count > 0 && r.err == nil; count-- {
+		hop.Replies = append(hop.Replies, ICMPReply{Type: int(r.int()), Code: int(r.int())})
+	}
+
+	if errorText := r.string(); errorText != "" {
+		hop.Err = &savedError{text: errorText, timeout: flags&binaryTimeout != 0}
+	}
+	hop.ASN = r.string()
+	hop.Country = r.string()
+	hop.Duplicates = int(r.int())
+	hop.Reordered = int(r.int())
+	hop.Mangled = int(r.int())
+	hop.ReplyCode = int(r.int())
+	hop.TerminalReply = r.string()
+	for count := r.count(); count > 0 && r.err == nil; count-- {
+		hop.Advisories = append(hop.Advisories, r.string())
+	}
+	hop.Truncated = int(r.int())
+	hop.Role = r.string()
+	for count := r.count(); count > 0 && r.err == nil; count-- {
+		if hop.Annotations == nil {
+			hop.Annotations = make(map[string]string)
+		}
+		key := r.string()
+		hop.Annotations[key] = r.string()
+	}
+	return hop, r.err
+}
+
+// binaryBuffer appends the fields of a record
+type binaryBuffer struct {
+	bytes.Buffer
+}
+
+func (b *binaryBuffer) int(value int64) {
+	b.Write(binary.AppendVarint(nil, value))
+}
+
+func (b *binaryBuffer) bool(value bool) {
+	if value {
+		b.int(1)
+		return
+	}
+	b.int(0)
+}
+
+func (b *binaryBuffer) bytes(value []byte) {
+	b.Write(binary.AppendUvarint(nil, uint64(len(value))))
+	b.Write(value)
+}
+
+func (b *binaryBuffer) string(value string) {
+	b.bytes([]byte(value))
+}
+
+// Times are Unix nanoseconds, 0 for the zero time
+func (b *binaryBuffer) time(value time.Time) {
+	if value.IsZero() {
+		b.int(0)
+		return
+	}
+	b.int(value.UnixNano())
+}
+
+// binaryReader reads the fields of a record; past its end every field reads as zero,
+// and the first malformed field sets err
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) int() int64 {
+	if len(r.data) == 0 || r.err != nil {
+		return 0
+	}
+	value, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = errTruncatedBinary
+		return 0
+	}
+	r.data = r.data[n:]
+	return value
+}
+
+// Reads a count of elements, which cannot exceed the bytes left
+func (r *binaryReader) count() int {
+	count := r.int()
+	if count < 0 || count > int64(len(r.data)) {
+		if r.err == nil {
+			r.err = errTruncatedBinary
+		}
+		return 0
+	}
+	return int(count)
+}
+
+func (r *binaryReader) bool() bool {
+	return r.int() != 0
+}
+
+func (r *binaryReader) bytes() []byte {
+	if len(r.data) == 0 || r.err != nil {
+		return nil
+	}
+	length, n := binary.Uvarint(r.data)
+	if n <= 0 || length > uint64(len(r.data)-n) {
+		r.err = errTruncatedBinary
+		return nil
+	}
+	value := r.data[n : n+int(length)]
+	r.data = r.data[n+int(length):]
+	return value
+}
+
+func (r *binaryReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *binaryReader) time() time.Time {
+	nanoseconds := r.int()
+	if nanoseconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanoseconds)
+}
+
+// binaryReporter writes every trace to stdout in the -binary format when it ends
+type binaryReporter struct {
+	encoder *binaryEncoder
+}
+
+func (r *binaryReporter) Start(target string, maxTTL int, traceID string) {}
+
+func (r *binaryReporter) Hop(hop HopResult) {}
+
+// Notes go to stderr so stdout stays a valid stream
+func (r *binaryReporter) Note(text string) {
+	fmt.Fprintf(os.Stderr, "%s\n", text)
+}
+
+func (r *binaryReporter) End(result *TraceResult) {
+	if err := r.encoder.encode(result); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMachineOutputKeepsStdoutClean(t *testing.T) {
+	reportersArray := []struct {
+		name  string
+		new   func() Reporter
+		valid func(stdout string) error
+	}{
+		{"binary", func() Reporter { return &binaryReporter{encoder: newBinaryEncoder(osStdout{})} }, func(stdout string) error {
+			if stdout == "" {
+				return nil
+			}
+			_, err := decodeBinaryTraces(strings.NewReader(stdout))
+			return err
+		}},
+		{"json", func() Reporter { return jsonReporter{} }, func(stdout string) error {
+			if stdout == "" {
+				return nil
+			}
+			var decoded interface{}
+			return json.Unmarshal([]byte(stdout), &decoded)
+		}},
+	}
+	scenariosArray := []struct {
+		name     string
+		target   string
+		failOpen bool
+		message  string
+	}{
+		{"unresolvable target", "no-such-host.invalid", false, "Invalid address no-such-host.invalid"},
+		{"socket fails to open", "10.9.9.9", true, "Cannot open socket"},
+		{"trace", "10.9.9.9", false, ""},
+	}
+	for _, output := range reportersArray {
+		for _, scenario := range scenariosArray {
+			t.Run(output.name+" "+scenario.name, func(t *testing.T) {
+				setFlag(t, timeoutBase, 20*time.Millisecond)
+				setFlag(t, timeoutMax, 20*time.Millisecond)
+				offlineDNS(t, nil)
+				useFakeNetwork(t, newFakeConn(fakePath("10.9.9.9", "10.0.0.1")))
+				if scenario.failOpen {
+					openTraceSocket = func(iface string, useIPv6 bool) (*icmpConn, error) {
+						return nil, &socketError{Err: errors.New("operation not permitted")}
+					}
+				}
+
+				stdout, stderr := captureOutput(t, func() {
+					tracert(scenario.target, traceConfig{MaxTTL: 4, Method: "icmp"}, output.new())
+				})
+				if err := output.valid(stdout); err != nil {
+					t.Errorf("stdout is no valid %s output: %v\n%q", output.name, err, stdout)
+				}
+				if scenario.message != "" && !strings.Contains(stderr, scenario.message) {
+					t.Errorf("stderr %q lacks %q", stderr, scenario.message)
+				}
+			})
+		}
+	}
+}
+
+// osStdout writes to whatever os.Stdout is when written to, so the encoder follows captureOutput
+type osStdout struct{}
+
+func (osStdout) Write(b []byte) (int, error) {
+	return os.Stdout.Write(b)
+}
+
+func TestBinaryHopRole(t *testing.T) {
+	tests := []struct {
+		name string
+		role string
+		// Rewrites the encoded hop, as a writer of another version would have written it
+		rewrite func(record []byte) []byte
+		want    string
+	}{
+		{"with a role", roleEndpoint, nil, roleEndpoint},
+		{"without a role", "", nil, ""},
+		// The role and the empty annotations after it cut off
+		{"written before roles", roleFirewall, func(record []byte) []byte {
+			return record[:len(record)-len(roleFirewall)-2]
+		}, ""},
+		{"with a field appended by a newer writer", roleRouter, func(record []byte) []byte {
+			var extra binaryBuffer
+			extra.string("future")
+			return append(record, extra.Bytes()...)
+		}, roleRouter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hop := HopResult{TTL: 3, Sent: 3, Peers: []net.Addr{ip4("10.0.0.1")}, RTTs: []time.Duration{time.Millisecond}, Role: tt.role}
+			record := encodeBinaryHop(hop).Bytes()
+			if tt.rewrite != nil {
+				record = tt.rewrite(record)
+			}
+			decoded, err := decodeBinaryHop(&binaryReader{data: record})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Role != tt.want || decoded.TTL != 3 || len(decoded.RTTs) != 1 {
+				t.Errorf("decoded role %q of hop %d with %d RTTs, want %q", decoded.Role, decoded.TTL, len(decoded.RTTs), tt.want)
+			}
+		})
+	}
+}
+
+func TestBinaryHopAnnotations(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+	}{
+		{"none", nil},
+		{"one", map[string]string{"ptr": "core1.example.net"}},
+		{"several", map[string]string{"asn": "64500", "prefix": "192.0.2.0/24", "country": "FR", "rack": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hop := HopResult{TTL: 2, Sent: 3, Peers: []net.Addr{ip4("192.0.2.1")}, RTTs: []time.Duration{time.Millisecond}, Role: roleRouter, Annotations: tt.annotations}
+			record := encodeBinaryHop(hop).Bytes()
+			if again := encodeBinaryHop(hop).Bytes(); string(again) != string(record) {
+				t.Errorf("the same hop encoded differently")
+			}
+			decoded, err := decodeBinaryHop(&binaryReader{data: record})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded.Annotations, tt.annotations) || decoded.Role != roleRouter {
+				t.Errorf("decoded %v with role %q, want %v", decoded.Annotations, decoded.Role, tt.annotations)
+			}
+		})
+	}
+}
+
+func TestTruncatedRepliesSaved(t *testing.T) {
+	tests := []struct {
+		name      string
+		truncated int
+		wantJSON  string
+	}{
+		{"none", 0, ""},
+		{"some", 2, `"truncated":2`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hop := HopResult{TTL: 2, Sent: 3, Peers: []net.Addr{ip4("10.0.0.1")}, RTTs: []time.Duration{time.Millisecond}, Truncated: tt.truncated}
+			decoded, err := decodeBinaryHop(&binaryReader{data: encodeBinaryHop(hop).Bytes()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Truncated != tt.truncated {
+				t.Errorf("-binary kept %d truncated replies, want %d", decoded.Truncated, tt.truncated)
+			}
+
+			data, err := json.Marshal(hop)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (tt.wantJSON == "" && strings.Contains(string(data), `"truncated"`)) || !strings.Contains(string(data), tt.wantJSON) {
+				t.Errorf("JSON %s, want %s", data, tt.wantJSON)
+			}
+			var saved HopResult
+			if err := json.Unmarshal(data, &saved); err != nil {
+				t.Fatal(err)
+			}
+			if saved.Truncated != tt.truncated {
+				t.Errorf("JSON kept %d truncated replies, want %d", saved.Truncated, tt.truncated)
+			}
+		})
+	}
+}
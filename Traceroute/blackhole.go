@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// IP and ICMP header bytes in front of the echo payload
+const (
+	echoOverheadIPv4 = ipv4.HeaderLen + 8
+	echoOverheadIPv6 = ipv6.HeaderLen + 8
+)
+
+// Outcome of the large DF probes at one hop
+type blackHoleProbe int
+
+const (
+	largeAnswered    blackHoleProbe = iota
+	largeTooBig                     // a router reported the packet as too big
+	largeTooBigLocal                // the packet does not fit the local interface
+	largeVanished                   // every large probe timed out
+	largeFailed
+)
+
+// Probes the hop at ttl with packets of size bytes that may not be fragmented.
+//
+// A router that cannot forward such a packet must answer Fragmentation Needed (Packet Too Big on IPv6).
+// A black hole drops it silently instead. So when the small probes of a hop were answered but all
+// AttemptsCount large ones time out with no such message, the large packets are most likely lost
+// between the previous hop and this one. Single losses are ruled out by requiring every attempt to fail.
+func probeLarge(tracer *Tracer, ttl int, size int) blackHoleProbe {
+	overhead := echoOverheadIPv4
+	if tracer.ipv6 {
+		overhead = echoOverheadIPv6
+	}
+
+	var timeouts int = 0
+	for i := 0; i < AttemptsCount; i++ {
+		_, err := socketExchange(tracer, []int{size - overhead}, ttl, 1)
+		var icmpErr *unexpectedICMPError
+		switch {
+		case err == nil:
+			return largeAnswered
+		case isTimeout(err):
+			timeouts++
+		case errors.Is(err, syscall.EMSGSIZE):
+			return largeTooBigLocal
+		case errors.As(err, &icmpErr) && isTooBig(icmpErr.Message):
+			return largeTooBig
+		default:
+			return largeFailed
+		}
+	}
+	if timeouts == AttemptsCount {
+		return largeVanished
+	}
+	return largeFailed
+}
+
+// Reports whether msg is a Fragmentation Needed or Packet Too Big message
+func isTooBig(msg *icmp.Message) bool {
+	return (msg.Type == ipv4.ICMPTypeDestinationUnreachable && msg.Code == 4) || msg.Type == ipv6.ICMPTypePacketTooBig
+}
+
+// blackHoleDetector follows the large probes along the trace and tells about the first anomaly
+type blackHoleDetector struct {
+	size int
+	done bool
+}
+
+// Probes a hop whose small probes were answered, returning a note once the outcome is known
+func (d *blackHoleDetector) check(tracer *Tracer, hop HopResult) string {
+	if d.done || !hop.Responded() {
+		return ""
+	}
+	switch probeLarge(tracer, hop.TTL, d.size) {
+	case largeTooBigLocal:
+		d.done = true
+		return fmt.Sprintf("%d-byte DF probes exceed the local interface MTU, black hole detection skipped", d.size)
+	case largeTooBig:
+		d.done = true
+		return fmt.Sprintf("%d-byte DF probes are too big at hop %d, the path MTU is reported correctly", d.size, hop.TTL)
+	case largeVanished:
+		d.done = true
+		return fmt.Sprintf("likely MTU black hole before hop %d %s: %d-byte DF probes vanish without Fragmentation Needed",
+			hop.TTL, createPeersString(hop.Peers), d.size)
+	}
+	return ""
+}
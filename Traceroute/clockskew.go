@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// ICMP Timestamp messages (RFC 792), which golang.org/x/net/icmp only knows by number
+const (
+	ICMPTypeTimestamp      ipv4.ICMPType = 13
+	ICMPTypeTimestampReply ipv4.ICMPType = 14
+
+	// Identifier and sequence number, then the originate, receive and transmit timestamps
+	timestampBodyLength = 4 + 3*4
+
+	millisPerDay = 24 * 60 * 60 * 1000
+)
+
+// Returns the milliseconds since midnight UT that Timestamp messages carry
+func millisSinceMidnight(t time.Time) uint32 {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return uint32(t.Sub(midnight) / time.Millisecond)
+}
+
+// Builds an ICMP Timestamp request stamped with the send time
+func buildTimestampRequest(id int, seq int, sent time.Time) ([]byte, error) {
+	data := make([]byte, timestampBodyLength)
+	binary.BigEndian.PutUint16(data[0:2], uint16(id))
+	binary.BigEndian.PutUint16(data[2:4], uint16(seq))
+	binary.BigEndian.PutUint32(data[4:8], millisSinceMidnight(sent))
+	message := icmp.Message{Type: ICMPTypeTimestamp, Body: &icmp.RawBody{Data: data}}
+	return message.Marshal(nil)
+}
+
+// Returns the receive and transmit timestamps of a Timestamp reply to the request id/seq
+func timestampReply(msg *icmp.Message, id int, seq int) (uint32, uint32, bool) {
+	body, ok := msg.Body.(*icmp.RawBody)
+	if msg.Type != ICMPTypeTimestampReply || !ok || len(body.Data) < timestampBodyLength {
+		return 0, 0, false
+	}
+	if int(binary.BigEndian.Uint16(body.Data[0:2])) != id || int(binary.BigEndian.Uint16(body.Data[2:4])) != seq {
+		return 0, 0, false
+	}
+	// The high bit marks a clock that is not in milliseconds since midnight UT
+	received, transmitted := binary.BigEndian.Uint32(body.Data[8:12]), binary.BigEndian.Uint32(body.Data[12:16])
+	if received&0x80000000 != 0 || transmitted&0x80000000 != 0 {
+		return 0, 0, false
+	}
+	return received, transmitted, true
+}
+
+// Returns a-b in milliseconds, taking the shorter way round midnight
+func millisDifference(a uint32, b uint32) int64 {
+	difference := (int64(a) - int64(b)) % millisPerDay
+	switch {
+	case difference > millisPerDay/2:
+		difference -= millisPerDay
+	case difference < -millisPerDay/2:
+		difference += millisPerDay
+	}
+	return difference
+}
+
+// Estimates how far the remote clock is ahead of the local one from the four timestamps of an exchange,
+// assuming the path takes as long both ways: ((received - originate) + (transmit - back)) / 2
+func clockSkew(originate uint32, received uint32, transmitted uint32, back uint32) time.Duration {
+	return time.Duration(millisDifference(received, originate)+millisDifference(transmitted, back)) * time.Millisecond / 2
+}
+
+// Sends an ICMP Timestamp request to the destination at the full TTL and reports the skew of its clock.
+// Timestamps have millisecond resolution, so the skew is only as good as that.
+// Destinations that do not answer get their echo RTT reported instead.
+func measureClockSkew(tracer *Tracer, reporter Reporter) {
+	if tracer.ipv6 {
+		reporter.Note("clock skew: unavailable, ICMPv6 has no Timestamp messages")
+		return
+	}
+
+	seq := probeSeq(tracer.maxTTL, tracer.sent)
+	tracer.sent++
+	tracer.counters.Sent++
+	if _, err := egressLimit.wait(tracer.ctx, 4+timestampBodyLength); err != nil {
+		reporter.Note(fmt.Sprintf("clock skew: unavailable: %v", err))
+		return
+	}
+	sent := time.Now()
+	request, err := buildTimestampRequest(tracer.id, seq, sent)
+	if err == nil {
+		err = tracer.conn.SetTTL(tracer.maxTTL)
+	}
+	if err == nil {
+		err = tracer.conn.SetReadDeadline(sent.Add(tracer.timeout(tracer.maxTTL)))
+	}
+	if err == nil {
+		_, err = tracer.conn.WriteTo(request, tracer.dest)
+	}
+	if err != nil {
+		reporter.Note(fmt.Sprintf("clock skew: unavailable: %v", err))
+		return
+	}
+
+	reply := make([]byte, replyBufferSize(timestampBodyLength))
+	for {
+		replyLength, peer, err := tracer.conn.ReadFrom(reply)
+		if err != nil {
+			if isTimeout(err) {
+				tracer.counters.Timeouts++
+			}
+			break
+		}
+		back := time.Now()
+		msg, err := icmp.ParseMessage(ProtocolIPv4ICMP, reply[:replyLength])
+		if err != nil || !sameIP(peer, tracer.dest) {
+			tracer.counters.Foreign++
+			continue
+		}
+		received, transmitted, ok := timestampReply(msg, tracer.id, seq)
+		if !ok {
+			tracer.counters.Foreign++
+			continue
+		}
+		tracer.counters.Replies++
+
+		skew := clockSkew(millisSinceMidnight(sent), received, transmitted, millisSinceMidnight(back))
+		if skew == 0 {
+			reporter.Note(fmt.Sprintf("clock skew: none at millisecond resolution (timestamp RTT %s)", humanDuration(back.Sub(sent))))
+			return
+		}
+		direction := "ahead of"
+		if skew < 0 {
+			skew, direction = -skew, "behind"
+		}
+		reporter.Note(fmt.Sprintf("clock skew: destination clock %s %s the local one (timestamp RTT %s)", humanDuration(skew), direction, humanDuration(back.Sub(sent))))
+		return
+	}
+
+	// Many hosts and firewalls drop Timestamp requests, the echo RTT is the next best thing
+	exchange, err := socketExchange(tracer, []int{MsgLength}, tracer.maxTTL, 1)
+	if err != nil || !isEchoReply(exchange.Type) {
+		reporter.Note("clock skew: unavailable, the destination answered neither timestamp nor echo requests")
+		return
+	}
+	reporter.Note(fmt.Sprintf("clock skew: unavailable, the destination does not answer timestamp requests (echo RTT %s)", humanDuration(exchange.RTTs[0])))
+}
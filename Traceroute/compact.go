@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// compactReporter prints one line per trace when it ends, for logs that are tailed by dashboards
+type compactReporter struct {
+	// Most hops listed in path=, 0 for all
+	maxPath int
+}
+
+func (r *compactReporter) Start(target string, maxTTL int, traceID string) {}
+
+func (r *compactReporter) Hop(hop HopResult) {}
+
+func (r *compactReporter) Note(text string) {
+	fmt.Fprintf(os.Stderr, "%s\n", text)
+}
+
+func (r *compactReporter) End(result *TraceResult) {
+	var pathArray []string
+	var rtt, best time.Duration = 0, 0
+	for _, hop := range result.Hops {
+		peer := "*"
+		if hop.Responded() {
+			peer = hop.Peers[0].String()
+			_, rtt, _ = rttStats(hop.RTTs)
+			best = bestRTT(hop.RTTs, *bestMethod)
+		}
+		pathArray = append(pathArray, peer)
+	}
+	if r.maxPath > 0 && len(pathArray) > r.maxPath {
+		pathArray = append(pathArray[:r.maxPath], "...")
+	}
+
+	// rtt= and best= are the average and best of the last hop that answered, the destination when reached
+	fmt.Printf("target=%s trace_id=%s reached=%t hops=%d rtt=%sms best=%sms path=%s\n", result.Target, result.TraceID, result.Reached, len(result.Hops),
+		formatMillis(rtt, 2), formatMillis(best, 2), strings.Join(pathArray, ">"))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Probes the TTLs of a trace in the given order with up to workers sockets at once.
+// Every worker has its own echo identifier, so replies are matched to the worker that sent the probe.
+// TTLs beyond one known to reach the destination are not started, nor any once ctx is done.
+// Returns when the earliest reply of all workers arrived.
+func concurrentTrace(ctx context.Context, destination *net.IPAddr, ttlsArray []int, maxTTL int, workers int, result *TraceResult, reporter Reporter) (time.Time, error) {
+	tracersArray := make([]*Tracer, workers)
+	for w := range tracersArray {
+		connection, err := openTraceSocket(*sourceIface, *useIPv6)
+		if err != nil {
+			return time.Time{}, err
+		}
+		defer connection.Close()
+
+		tracer := newTracer(connection, destination, *useIPv6)
+		tracer.ctx = ctx
+		tracer.maxTTL = maxTTL
+		if *bpfFilter {
+			connection.attachFilter(tracer.id)
+		}
+		tracersArray[w] = tracer
+	}
+
+	var mutex sync.Mutex
+	var reachedAt int = 0
+	var hopsArray []HopResult
+	ttls := make(chan int)
+	var wg sync.WaitGroup
+	for _, tracer := range tracersArray {
+		wg.Add(1)
+		go func(tracer *Tracer) {
+			defer wg.Done()
+			for ttl := range ttls {
+				mutex.Lock()
+				skip := (reachedAt != 0 && ttl > reachedAt) || ctx.Err() != nil
+				mutex.Unlock()
+				if skip {
+					continue
+				}
+
+				hop := ping(tracer, ttl)
+				mutex.Lock()
+				hopsArray = append(hopsArray, hop)
+				if hop.Reached && (reachedAt == 0 || ttl < reachedAt) {
+					reachedAt = ttl
+				}
+				mutex.Unlock()
+			}
+		}(tracer)
+	}
+	for _, ttl := range ttlsArray {
+		ttls <- ttl
+	}
+	close(ttls)
+	wg.Wait()
+
+	sortHops(hopsArray)
+	var duplicates int
+	hopsArray, duplicates = collapseDestination(hopsArray)
+	for _, hop := range hopsArray {
+		reporter.Hop(hop)
+	}
+	if duplicates > 0 {
+		reporter.Note(fmt.Sprintf("destination also answered at %d higher TTLs; its distance is %d hops", duplicates, reachedAt))
+	}
+	result.Hops = hopsArray
+	result.Reached = reachedAt != 0
+
+	var earliest time.Time
+	for _, tracer := range tracersArray {
+		result.Counters.add(tracer.counters)
+		if !tracer.firstReply.IsZero() && (earliest.IsZero() || tracer.firstReply.Before(earliest)) {
+			earliest = tracer.firstReply
+		}
+	}
+	return earliest, nil
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+)
+
+// Prints a raw ICMP message in hex to stderr for -print-sent-bytes
+func dumpPacket(direction string, b []byte, peer net.Addr) {
+	fmt.Fprintf(os.Stderr, "%s %v, %d bytes\n%s", direction, peer, len(b), hex.Dump(b))
+}
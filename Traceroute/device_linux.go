@@ -0,0 +1,30 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Returns the control function that binds a socket to the device (SO_BINDTODEVICE). A tunnel's
+// address alone does not steer the probes into it when the route to the target leads elsewhere.
+func deviceControl(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = bindToDevice(int(fd), name)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+func bindToDevice(fd int, name string) error {
+	if err := syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name); err != nil {
+		return fmt.Errorf("cannot bind to interface %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// Elsewhere the socket is only bound to the tunnel's address
+func deviceControl(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return nil
+	}
+}
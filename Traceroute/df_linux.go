@@ -0,0 +1,35 @@
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+)
+
+// Path MTU discovery modes from linux/in.h and linux/in6.h; PROBE sets DF but ignores the cached path MTU
+const (
+	ipPMTUDiscProbe   = 3
+	ipv6MTUDiscover   = 23
+	ipv6PMTUDiscProbe = 3
+)
+
+// Makes the kernel send every probe unfragmented, with DF set on IPv4
+func (c *icmpConn) setDontFragment() error {
+	rawConn, err := c.PacketConn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if c.p6 != nil {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6MTUDiscover, ipv6PMTUDiscProbe)
+		} else {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, ipPMTUDiscProbe)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func (c *icmpConn) setDontFragment() error {
+	return errors.New("setting DF is only supported on Linux")
+}
@@ -0,0 +1,220 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Origins of an extended socket error, from linux/errqueue.h
+const (
+	soEEOriginICMP  = 2
+	soEEOriginICMP6 = 3
+)
+
+// Opens an unprivileged ICMP datagram socket (a "ping socket"), which the system allows
+// to the groups in net.ipv4.ping_group_range, bound like the raw socket would be
+func openDatagramSocket(source string, useIPv6 bool) (*icmpConn, error) {
+	family, protocol, level, option := syscall.AF_INET, syscall.IPPROTO_ICMP, syscall.IPPROTO_IP, syscall.IP_RECVERR
+	var sockaddr syscall.Sockaddr
+	ip := net.ParseIP(source)
+	if useIPv6 {
+		family, protocol, level, option = syscall.AF_INET6, syscall.IPPROTO_ICMPV6, syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR
+		address := &syscall.SockaddrInet6{}
+		copy(address.Addr[:], ip.To16())
+		sockaddr = address
+	} else {
+		address := &syscall.SockaddrInet4{}
+		copy(address.Addr[:], ip.To4())
+		sockaddr = address
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, protocol)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	// The time exceeded messages of routers are only delivered through the error queue
+	if err := syscall.SetsockoptInt(fd, level, option, 1); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if *socketMark != 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, *socketMark); err != nil {
+			syscall.Close(fd)
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if *sourceIface != "" && tunnelInterface(*sourceIface) {
+		if err := bindToDevice(fd, *sourceIface); err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+	}
+	// Binding to port 0 makes the kernel pick a free echo identifier
+	if err := syscall.Bind(fd, sockaddr); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	file := os.NewFile(uintptr(fd), "icmp datagram socket")
+	connection, err := net.FilePacketConn(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	c := &icmpConn{PacketConn: connection, dgram: true, id: connection.LocalAddr().(*net.UDPAddr).Port}
+	if useIPv6 {
+		c.p6 = ipv6.NewPacketConn(connection)
+	} else {
+		c.p = ipv4.NewPacketConn(connection)
+	}
+	return c, nil
+}
+
+// Reads the next reply to the socket's probes. Echo replies are read as usual, while an ICMP error is
+// taken from the error queue, which holds only the quoted echo request, and rebuilt into the message
+// a router sent, a made-up IP header included, so replies are matched the same way on either socket.
+func (c *icmpConn) readDatagram(b []byte) (int, net.Addr, error) {
+	rawConn, err := c.PacketConn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var n int
+	var peer net.Addr
+	var readErr error
+	quote := make([]byte, len(b))
+	oob := make([]byte, 512)
+	err = rawConn.Read(func(fd uintptr) bool {
+		var pending error
+		for {
+			length, from, err := syscall.Recvfrom(int(fd), b, syscall.MSG_DONTWAIT)
+			if err == nil {
+				n, peer = length, &net.IPAddr{IP: sockaddrIP(from)}
+				c.lastTruncated = length == len(b)
+				return true
+			}
+			// A queued ICMP error is also reported once as the socket's error, e.g. no route to host,
+			// which reading clears; only an error that persists is returned
+			if err != syscall.EAGAIN {
+				if pending != nil {
+					readErr = os.NewSyscallError("recvfrom", err)
+					return true
+				}
+				pending = err
+			}
+
+			length, oobLength, _, from, err := syscall.Recvmsg(int(fd), quote, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+			if err == syscall.EAGAIN {
+				if pending != nil {
+					continue
+				}
+				return false
+			}
+			if err != nil {
+				readErr = os.NewSyscallError("recvmsg", err)
+				return true
+			}
+			// Errors raised locally, e.g. a probe too large to send, answer nothing and are skipped
+			var ok bool
+			if n, peer, ok = c.queuedError(b, quote[:length], oob[:oobLength], sockaddrIP(from)); ok {
+				// The rebuilt message adds headers to the quote, so it is cut where the quote filled its buffer
+				c.lastTruncated = length == len(quote) || n == len(b)
+				return true
+			}
+		}
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, peer, readErr
+}
+
+// Rebuilds into b the ICMP error described by the extended error control message, quoting the
+// given part of the probe sent to dest, and returns its length and sender
+func (c *icmpConn) queuedError(b []byte, quote []byte, oob []byte, dest net.IP) (int, net.Addr, bool) {
+	messagesArray, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, nil, false
+	}
+	for _, message := range messagesArray {
+		isV4Error := message.Header.Level == syscall.IPPROTO_IP && message.Header.Type == syscall.IP_RECVERR
+		isV6Error := message.Header.Level == syscall.IPPROTO_IPV6 && message.Header.Type == syscall.IPV6_RECVERR
+		if !isV4Error && !isV6Error {
+			continue
+		}
+		// struct sock_extended_err followed by the address of the sender
+		data := message.Data
+		if len(data) < 18 || (data[4] != soEEOriginICMP && data[4] != soEEOriginICMP6) {
+			return 0, nil, false
+		}
+		var offender net.IP
+		switch family := binary.NativeEndian.Uint16(data[16:]); {
+		case family == syscall.AF_INET && len(data) >= 24:
+			offender = net.IP(append([]byte{}, data[20:24]...))
+		case family == syscall.AF_INET6 && len(data) >= 40:
+			offender = net.IP(append([]byte{}, data[24:40]...))
+		default:
+			return 0, nil, false
+		}
+
+		header := make([]byte, 8)
+		header[0], header[1] = data[5], data[6]
+		info := binary.NativeEndian.Uint32(data[8:12])
+		switch {
+		case isV4Error && data[5] == byte(ipv4.ICMPTypeDestinationUnreachable) && data[6] == 4:
+			// Next-hop MTU of fragmentation needed
+			binary.BigEndian.PutUint16(header[6:8], uint16(info))
+		case isV6Error && data[5] == byte(ipv6.ICMPTypePacketTooBig):
+			binary.BigEndian.PutUint32(header[4:8], info)
+		}
+
+		packet := append(header, quotedHeader(c.localIP(), dest, len(quote), isV6Error)...)
+		packet = append(packet, quote...)
+		return copy(b, packet), &net.IPAddr{IP: offender}, true
+	}
+	return 0, nil, false
+}
+
+// Returns an IP header of a probe from source to dest with an ICMP message of the given length
+func quotedHeader(source net.IP, dest net.IP, length int, useIPv6 bool) []byte {
+	if useIPv6 {
+		header := make([]byte, ipv6.HeaderLen)
+		header[0] = 6 << 4
+		binary.BigEndian.PutUint16(header[4:6], uint16(length))
+		header[6] = ProtocolIPv6ICMP
+		copy(header[8:24], source.To16())
+		copy(header[24:40], dest.To16())
+		return header
+	}
+	header := make([]byte, ipv4.HeaderLen)
+	header[0] = 4<<4 | ipv4.HeaderLen>>2
+	binary.BigEndian.PutUint16(header[2:4], uint16(ipv4.HeaderLen+length))
+	header[9] = ProtocolIPv4ICMP
+	copy(header[12:16], source.To4())
+	copy(header[16:20], dest.To4())
+	return header
+}
+
+func (c *icmpConn) localIP() net.IP {
+	if local, ok := c.LocalAddr().(*net.UDPAddr); ok {
+		return local.IP
+	}
+	return nil
+}
+
+func sockaddrIP(sockaddr syscall.Sockaddr) net.IP {
+	switch address := sockaddr.(type) {
+	case *syscall.SockaddrInet4:
+		return net.IP(append([]byte{}, address.Addr[:]...))
+	case *syscall.SockaddrInet6:
+		return net.IP(append([]byte{}, address.Addr[:]...))
+	}
+	return nil
+}
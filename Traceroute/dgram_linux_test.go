@@ -0,0 +1,82 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// localAddrConn is the socket below a datagram icmpConn, bound to the wildcard address
+type localAddrConn struct{ net.PacketConn }
+
+func (localAddrConn) LocalAddr() net.Addr { return &net.UDPAddr{IP: net.IPv4zero} }
+
+// Returns the IP_RECVERR control message of an ICMP error of the given origin, type and code from offender
+func extendedError(origin, typ, code byte, info uint32, offender string) []byte {
+	ext := make([]byte, 16+16)
+	ext[4], ext[5], ext[6] = origin, typ, code
+	binary.NativeEndian.PutUint32(ext[8:12], info)
+	binary.NativeEndian.PutUint16(ext[16:], syscall.AF_INET)
+	copy(ext[20:24], net.ParseIP(offender).To4())
+	oob := make([]byte, syscall.CmsgSpace(len(ext)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level, h.Type = syscall.IPPROTO_IP, syscall.IP_RECVERR
+	h.SetLen(syscall.CmsgLen(len(ext)))
+	copy(oob[syscall.CmsgLen(0):], ext)
+	return oob
+}
+
+func TestQueuedErrorRebuilt(t *testing.T) {
+	probe, err := buildEchoRequest(ipv4.ICMPTypeEcho, 0, 4242, 56, probeSeq(2, 7), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		oob     []byte
+		want    bool
+		wantMTU int
+	}{
+		{name: "time exceeded", oob: extendedError(soEEOriginICMP, 11, 0, 0, "10.0.2.2"), want: true},
+		{name: "fragmentation needed", oob: extendedError(soEEOriginICMP, 3, 4, 1400, "10.0.2.2"), want: true, wantMTU: 1400},
+		{name: "raised locally", oob: extendedError(1, 11, 0, 0, "10.0.2.2"), want: false},
+		{name: "no control message", oob: nil, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &icmpConn{dgram: true, id: 4242, PacketConn: localAddrConn{}}
+			b := make([]byte, 1500)
+			n, peer, ok := c.queuedError(b, probe, tt.oob, net.ParseIP("10.9.9.9"))
+			if ok != tt.want {
+				t.Fatalf("rebuilt: %v, want %v", ok, tt.want)
+			}
+			if !ok {
+				return
+			}
+			if peer.String() != "10.0.2.2" {
+				t.Errorf("sent by %s, want 10.0.2.2", peer)
+			}
+			msg, err := icmp.ParseMessage(ProtocolIPv4ICMP, b[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seq, ok := answeredSeq(msg, 4242); !ok || seq != probeSeq(2, 7) {
+				t.Errorf("answers sequence %d (%v), want %d", seq, ok, probeSeq(2, 7))
+			}
+			if dest := quotedDestination(quotedPacket(msg)); !dest.Equal(net.ParseIP("10.9.9.9")) {
+				t.Errorf("quotes a probe to %s, want 10.9.9.9", dest)
+			}
+			if mtu := int(binary.BigEndian.Uint16(b[6:8])); mtu != tt.wantMTU {
+				t.Errorf("next-hop MTU %d, want %d", mtu, tt.wantMTU)
+			}
+		})
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errDatagramUnsupported = errors.New("datagram ICMP sockets are only supported on Linux, use -socket-mode raw")
+
+func openDatagramSocket(source string, useIPv6 bool) (*icmpConn, error) {
+	return nil, errDatagramUnsupported
+}
+
+func (c *icmpConn) readDatagram(b []byte) (int, net.Addr, error) {
+	return 0, nil, errDatagramUnsupported
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// hopDivergence describes the first hop where a live trace left the expected path
+type hopDivergence struct {
+	TTL      int
+	Expected string
+	Got      string
+}
+
+func (d hopDivergence) String() string {
+	return fmt.Sprintf("route changed at hop %d: expected %s, got %s", d.TTL, d.Expected, d.Got)
+}
+
+// Compares the live trace against the expected one up to untilHop (0 compares every hop).
+// Silent hops on either side are not evidence of a change and are skipped.
+func diffTraces(expected *TraceResult, live *TraceResult, untilHop int) *hopDivergence {
+	lastTTL := 0
+	for _, hop := range expected.Hops {
+		if hop.TTL > lastTTL {
+			lastTTL = hop.TTL
+		}
+	}
+	if untilHop > 0 && untilHop < lastTTL {
+		lastTTL = untilHop
+	}
+
+	for ttl := 1; ttl <= lastTTL; ttl++ {
+		want, wantOk := findHop(expected.Hops, ttl)
+		got, gotOk := findHop(live.Hops, ttl)
+
+		if wantOk && want.Reached && !(gotOk && got.Reached) {
+			return &hopDivergence{TTL: ttl, Expected: "destination", Got: describeHop(got, gotOk)}
+		}
+		if gotOk && got.Reached && !(wantOk && want.Reached) {
+			return &hopDivergence{TTL: ttl, Expected: describeHop(want, wantOk), Got: "destination"}
+		}
+		if !wantOk || !gotOk || !want.Responded() || !got.Responded() {
+			continue
+		}
+		if !sharesPeer(want, got) {
+			return &hopDivergence{TTL: ttl, Expected: describeHop(want, true), Got: describeHop(got, true)}
+		}
+	}
+	return nil
+}
+
+// Returns the hop probed with the given TTL
+func findHop(hopsArray []HopResult, ttl int) (HopResult, bool) {
+	for _, hop := range hopsArray {
+		if hop.TTL == ttl {
+			return hop, true
+		}
+	}
+	return HopResult{}, false
+}
+
+// Reports whether both hops have at least one responder in common
+func sharesPeer(a HopResult, b HopResult) bool {
+	for _, peerA := range uniquePeers(a.Peers) {
+		for _, peerB := range uniquePeers(b.Peers) {
+			if peerA == peerB {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func describeHop(hop HopResult, ok bool) string {
+	if !ok || !hop.Responded() {
+		return "*"
+	}
+	return strings.Join(uniquePeers(hop.Peers), ",")
+}
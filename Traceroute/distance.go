@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Hops probed past the distance guessed from the reply TTL, for return paths shorter than the way there
+const distanceSlack = 2
+
+// Returns the hop count a reply arriving with ttl suggests, assuming the sender
+// started from the usual initial TTL closest above it: 64, 128 or 255
+func hopsFromReplyTTL(ttl int) int {
+	var initial int = 255
+	for _, common := range []int{64, 128} {
+		if ttl <= common {
+			initial = common
+			break
+		}
+	}
+	return initial - ttl + 1
+}
+
+// Probes the destination once at the trace's full TTL and lowers the highest TTL probed
+// to the distance its reply suggests. Returns a note for the trace either way.
+func capToDestination(tracer *Tracer) string {
+	exchange, err := socketExchange(tracer, []int{MsgLength}, tracer.maxTTL, 1)
+	// The probe must not count as the first response of the trace that follows
+	tracer.answered = false
+	tracer.firstReply = time.Time{}
+
+	if err != nil || !isEchoReply(exchange.Type) || !exchange.TTLKnown {
+		return fmt.Sprintf("destination did not answer at TTL %d, probing up to it", tracer.maxTTL)
+	}
+	hops := hopsFromReplyTTL(exchange.ReplyTTL)
+	if hops+distanceSlack < tracer.maxTTL {
+		tracer.maxTTL = hops + distanceSlack
+	}
+	return fmt.Sprintf("destination replied with TTL %d, about %d hops away; probing up to TTL %d", exchange.ReplyTTL, hops, tracer.maxTTL)
+}
+
+// Returns the TTL of the first hop that reached the destination, the length of the forward path
+func forwardHops(result *TraceResult) int {
+	forward := 0
+	for _, hop := range result.Hops {
+		if hop.Reached && (forward == 0 || hop.TTL < forward) {
+			forward = hop.TTL
+		}
+	}
+	return forward
+}
+
+// Sends the destination an echo request at the trace's full TTL and estimates the hops of the
+// return path from the TTL its reply arrives with, as hopsFromReplyTTL guesses the initial TTL.
+// A destination starting from an uncommon initial TTL, e.g. 60, or replies rewritten on the way
+// give a wrong estimate, so a difference of the paths is only a hint of asymmetric routing.
+func reversePath(tracer *Tracer, forward int) string {
+	exchange, err := socketExchange(tracer, []int{MsgLength}, tracer.maxTTL, 1)
+	if err != nil || !isEchoReply(exchange.Type) || exchange.NonTargetEcho || !exchange.TTLKnown {
+		return fmt.Sprintf("reverse path: unavailable, the destination did not answer an echo request at TTL %d", tracer.maxTTL)
+	}
+	reverse := hopsFromReplyTTL(exchange.ReplyTTL)
+	symmetry := "symmetric"
+	if reverse != forward {
+		symmetry = "asymmetric"
+	}
+	return fmt.Sprintf("forward: %d hops, reverse: ~%d hops (%s, reply TTL %d)", forward, reverse, symmetry, exchange.ReplyTTL)
+}
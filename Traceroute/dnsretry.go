@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// Wait before the first retry of a transient resolution failure, doubled for every further one
+var dnsRetryBackoff = 250 * time.Millisecond
+
+// Resolves addresses; replaced by tests
+var resolveIPAddr = net.ResolveIPAddr
+
+// Resolves addr, retrying up to retries times while the failure is transient, such as a
+// timeout or SERVFAIL. A name that does not exist fails at once. Waiting ends early with
+// the last error when ctx is cancelled.
+func resolveWithRetries(ctx context.Context, network string, addr string, retries int) (*net.IPAddr, error) {
+	backoff := dnsRetryBackoff
+	for attempt := 0; ; attempt++ {
+		destination, err := resolveIPAddr(network, addr)
+		if err == nil || attempt >= retries || !transientDNSError(err) {
+			return destination, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// Reports whether another lookup may succeed: the resolver timed out or the server failed,
+// as opposed to answering that the name does not exist
+func transientDNSError(err error) bool {
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.IsNotFound {
+		return false
+	}
+	return dnsErr.IsTimeout || dnsErr.IsTemporary
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	errServFail = &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}
+	errTimeout  = &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}
+	errNXDomain = &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}
+)
+
+// Makes resolving fail with errorsArray in turn and succeed afterwards, returning the count of lookups
+func scriptedResolver(t *testing.T, backoff time.Duration, errorsArray ...error) *int {
+	savedResolve, savedBackoff := resolveIPAddr, dnsRetryBackoff
+	t.Cleanup(func() { resolveIPAddr, dnsRetryBackoff = savedResolve, savedBackoff })
+	dnsRetryBackoff = backoff
+
+	calls := new(int)
+	resolveIPAddr = func(network, addr string) (*net.IPAddr, error) {
+		*calls++
+		if *calls <= len(errorsArray) {
+			return nil, errorsArray[*calls-1]
+		}
+		return ip4("10.9.9.9"), nil
+	}
+	return calls
+}
+
+func TestResolveWithRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		errorsArray []error
+		retries     int
+		wantCalls   int
+		wantErr     error
+		// Least time the retries waited with a backoff of 5ms
+		wantWait time.Duration
+	}{
+		{name: "resolved at once", retries: 3, wantCalls: 1},
+		{name: "no retries", errorsArray: []error{errServFail}, retries: 0, wantCalls: 1, wantErr: errServFail},
+		{name: "SERVFAIL retried", errorsArray: []error{errServFail, errServFail}, retries: 3, wantCalls: 3, wantWait: 15 * time.Millisecond},
+		{name: "timeout retried", errorsArray: []error{errTimeout}, retries: 1, wantCalls: 2, wantWait: 5 * time.Millisecond},
+		{name: "out of retries", errorsArray: []error{errTimeout, errServFail, errTimeout}, retries: 2, wantCalls: 3, wantErr: errTimeout},
+		{name: "name does not exist", errorsArray: []error{errNXDomain}, retries: 5, wantCalls: 1, wantErr: errNXDomain},
+		{name: "not a DNS error", errorsArray: []error{errors.New("invalid address")}, retries: 5, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := scriptedResolver(t, 5*time.Millisecond, tt.errorsArray...)
+			start := time.Now()
+			destination, err := resolveWithRetries(context.Background(), "ip4", "example.com", tt.retries)
+			elapsed := time.Since(start)
+
+			if *calls != tt.wantCalls {
+				t.Errorf("resolved %d times, want %d", *calls, tt.wantCalls)
+			}
+			wantFailure := tt.wantCalls <= len(tt.errorsArray)
+			if (err != nil) != wantFailure {
+				t.Fatalf("got error %v, want one: %v", err, wantFailure)
+			}
+			if tt.wantErr != nil && err != tt.wantErr {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && destination.String() != "10.9.9.9" {
+				t.Errorf("resolved to %v, want 10.9.9.9", destination)
+			}
+			if elapsed < tt.wantWait {
+				t.Errorf("retried after %v, want a backoff of at least %v", elapsed, tt.wantWait)
+			}
+		})
+	}
+}
+
+func TestResolveWithRetriesCancelled(t *testing.T) {
+	calls := scriptedResolver(t, time.Hour, errTimeout, errTimeout)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := resolveWithRetries(ctx, "ip4", "example.com", 5)
+	if err != errTimeout {
+		t.Errorf("got error %v, want the last lookup's %v", err, errTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waited %v for the backoff after cancelling", elapsed)
+	}
+	if *calls != 1 {
+		t.Errorf("resolved %d times, want once", *calls)
+	}
+}
+
+func TestTransientDNSError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "SERVFAIL", err: errServFail, want: true},
+		{name: "timeout", err: errTimeout, want: true},
+		{name: "wrapped timeout", err: &net.OpError{Op: "dial", Err: errTimeout}, want: true},
+		{name: "name does not exist", err: errNXDomain, want: false},
+		{name: "not found though temporary", err: &net.DNSError{Err: "no such host", IsNotFound: true, IsTemporary: true}, want: false},
+		{name: "permanent failure", err: &net.DNSError{Err: "refused"}, want: false},
+		{name: "other error", err: errors.New("invalid address"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transientDNSError(tt.err); got != tt.want {
+				t.Errorf("transientDNSError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
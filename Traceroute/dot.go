@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Node every path of the graph starts from
+const dotSource = "source"
+
+// dotEdge accumulates the RTTs of every trace that went from one address to the next
+type dotEdge struct {
+	From, To string
+	total    time.Duration
+	samples  int
+}
+
+// dotGraph merges the paths of many traces into one topology, a node per hop address
+type dotGraph struct {
+	nodesArray   []string
+	destinations map[string]bool
+	edgesArray   []*dotEdge
+	edges        map[[2]string]*dotEdge
+}
+
+func newDotGraph() *dotGraph {
+	return &dotGraph{destinations: make(map[string]bool), edges: make(map[[2]string]*dotEdge)}
+}
+
+// Adds the path of a trace. Silent hops are skipped, so an edge may span them, and a hop
+// answered by several addresses links each of them to each address of the next answering hop.
+func (g *dotGraph) add(result *TraceResult) {
+	previousArray := []string{dotSource}
+	for _, hop := range result.Hops {
+		if !hop.Responded() {
+			continue
+		}
+		_, avg, _ := rttStats(hop.RTTs)
+		peersArray := uniquePeers(hop.Peers)
+		for _, peer := range peersArray {
+			g.node(peer)
+			if hop.Reached {
+				g.destinations[peer] = true
+			}
+			for _, previous := range previousArray {
+				g.edge(previous, peer, avg, len(hop.RTTs))
+			}
+		}
+		previousArray = peersArray
+	}
+}
+
+func (g *dotGraph) node(addr string) {
+	for _, node := range g.nodesArray {
+		if node == addr {
+			return
+		}
+	}
+	g.nodesArray = append(g.nodesArray, addr)
+}
+
+// Adds samples RTTs averaging avg to the edge between the two addresses
+func (g *dotGraph) edge(from string, to string, avg time.Duration, samples int) {
+	edge, ok := g.edges[[2]string{from, to}]
+	if !ok {
+		edge = &dotEdge{From: from, To: to}
+		g.edges[[2]string{from, to}] = edge
+		g.edgesArray = append(g.edgesArray, edge)
+	}
+	edge.total += avg * time.Duration(samples)
+	edge.samples += samples
+}
+
+func (g *dotGraph) String() string {
+	var b strings.Builder
+	b.WriteString("digraph traceroute {\n")
+	b.WriteString("  rankdir=LR;\n")
+	fmt.Fprintf(&b, "  %q [shape=box];\n", dotSource)
+	for _, node := range g.nodesArray {
+		shape := "ellipse"
+		if g.destinations[node] {
+			shape = "doublecircle"
+		}
+		fmt.Fprintf(&b, "  %q [shape=%s];\n", node, shape)
+	}
+	for _, edge := range g.edgesArray {
+		if edge.samples == 0 {
+			fmt.Fprintf(&b, "  %q -> %q;\n", edge.From, edge.To)
+			continue
+		}
+		avg := edge.total / time.Duration(edge.samples)
+		fmt.Fprintf(&b, "  %q -> %q [label=%q];\n", edge.From, edge.To, formatMillis(avg, 2)+"ms")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Writes the graph to the file, for rendering with e.g. dot -Tsvg
+func (g *dotGraph) save(path string) error {
+	return os.WriteFile(path, []byte(g.String()), 0644)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Enricher looks up extra data about a hop address, such as its name or origin AS, as key/value
+// annotations for -enrichers to merge into the hop. An address the enricher knows nothing about
+// gets an empty map rather than an error. Enrich may block: the pipeline gives up on it after
+// -resolve-timeout, or once -enrich-timeout ends the lookups, and caches what it returns per address.
+type Enricher interface {
+	Enrich(ip net.IP) (map[string]string, error)
+}
+
+// Enrichers -enrichers selects by name, all added with registerEnricher
+var enrichers = struct {
+	sync.Mutex
+	m map[string]Enricher
+}{m: make(map[string]Enricher)}
+
+// The built-in enrichers. Host names and the origins of -geo are looked up through them too,
+// so registering another under their name changes every output using them.
+func init() {
+	registerEnricher("ptr", ptrEnricher{})
+	registerEnricher("asn", originEnricher{})
+	registerEnricher("geoip", countryEnricher{})
+}
+
+// Makes an enricher selectable by name with -enrichers, e.g. a lookup in an inventory database
+// by code embedding the tracer; a built-in one of the same name is replaced
+func registerEnricher(name string, enricher Enricher) {
+	enrichers.Lock()
+	defer enrichers.Unlock()
+	enrichers.m[name] = enricher
+}
+
+// Returns the enricher registered under name
+func lookupEnricher(name string) (Enricher, bool) {
+	enrichers.Lock()
+	defer enrichers.Unlock()
+	enricher, ok := enrichers.m[name]
+	return enricher, ok
+}
+
+// Parses the comma separated names of -enrichers, in the order they run
+func parseEnrichers(text string) ([]string, error) {
+	var namesArray []string
+	for _, name := range strings.Split(text, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := lookupEnricher(name); !ok {
+			enrichers.Lock()
+			var knownArray []string
+			for known := range enrichers.m {
+				knownArray = append(knownArray, known)
+			}
+			enrichers.Unlock()
+			sort.Strings(knownArray)
+			return nil, fmt.Errorf("unknown enricher %q in -enrichers, known are %s", name, strings.Join(knownArray, ", "))
+		}
+		namesArray = append(namesArray, name)
+	}
+	return namesArray, nil
+}
+
+// Enrichers parsed from -enrichers, none when it is not given
+var enricherList []string
+
+// Returns the values the enricher registered under name found for ip, nil when it failed or there is none
+func enrichedValues(name string, ip net.IP) map[string]string {
+	enricher, ok := lookupEnricher(name)
+	if !ok || ip == nil {
+		return nil
+	}
+	values, err := enrichAddress(name, enricher, ip)
+	if err != nil {
+		return nil
+	}
+	return values
+}
+
+// Returns the names of a hop address from the "ptr" enricher, its PTR names unless another replaced it
+func peerNames(addr string) []string {
+	names := enrichedValues("ptr", net.ParseIP(addr))["ptr"]
+	if names == "" {
+		return nil
+	}
+	return strings.Split(names, ",")
+}
+
+// ptrEnricher annotates an address with its PTR names, as "ptr", comma separated
+type ptrEnricher struct{}
+
+func (ptrEnricher) Enrich(ip net.IP) (map[string]string, error) {
+	names := lookupPTR(ip.String())
+	// Not cached either, so a later trace resolves the address again
+	if len(names) == 0 && enrichmentExpired() {
+		return nil, fmt.Errorf("PTR lookup of %s stopped by -enrich-timeout", ip)
+	}
+	if len(names) == 0 {
+		return map[string]string{}, nil
+	}
+	return map[string]string{"ptr": strings.Join(names, ",")}, nil
+}
+
+// originEnricher annotates a public address with the AS announcing it and its prefix, as "asn" and "prefix"
+type originEnricher struct{}
+
+func (originEnricher) Enrich(ip net.IP) (map[string]string, error) {
+	if !isPublicIP(ip) {
+		return map[string]string{}, nil
+	}
+	info, err := lookupOrigin(ip)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"asn": info.ASN, "prefix": info.Prefix}, nil
+}
+
+// countryEnricher annotates a public address with the country its prefix is registered in, as
+// "country". There is no geolocation database to ask, so this is the registry's country.
+type countryEnricher struct{}
+
+func (countryEnricher) Enrich(ip net.IP) (map[string]string, error) {
+	if !isPublicIP(ip) {
+		return map[string]string{}, nil
+	}
+	info, err := lookupOrigin(ip)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"country": info.Country}, nil
+}
+
+// enrichEntry is one enricher's lookup of one address; done is closed once it has completed
+type enrichEntry struct {
+	done   chan struct{}
+	values map[string]string
+	err    error
+}
+
+// enrichCache holds the lookups of every enricher by enricher name and address. Failed lookups
+// are dropped once they complete, so the next hop with the address tries again, and a lookup
+// in flight is waited for rather than repeated.
+var enrichCache = struct {
+	sync.Mutex
+	entries map[string]*enrichEntry
+}{entries: make(map[string]*enrichEntry)}
+
+// Runs the named enricher over ip through the cache, waiting at most -resolve-timeout. A lookup
+// given up on keeps running and fills the cache for later traces when it completes.
+func enrichAddress(name string, enricher Enricher, ip net.IP) (map[string]string, error) {
+	key := name + " " + ip.String()
+	enrichCache.Lock()
+	entry, ok := enrichCache.entries[key]
+	if !ok {
+		entry = &enrichEntry{done: make(chan struct{})}
+		enrichCache.entries[key] = entry
+		go func() {
+			values, err := enricher.Enrich(ip)
+			enrichCache.Lock()
+			entry.values, entry.err = values, err
+			if err != nil {
+				delete(enrichCache.entries, key)
+			}
+			enrichCache.Unlock()
+			close(entry.done)
+		}()
+	}
+	enrichCache.Unlock()
+
+	// A completed lookup is returned even once -enrich-timeout has ended
+	select {
+	case <-entry.done:
+		return entry.values, entry.err
+	default:
+	}
+	timer := time.NewTimer(*resolveTimeout)
+	defer timer.Stop()
+	select {
+	case <-entry.done:
+		return entry.values, entry.err
+	case <-timer.C:
+		return nil, fmt.Errorf("%s lookup of %s took longer than %v", name, ip, *resolveTimeout)
+	case <-enrichmentContext().Done():
+		return nil, fmt.Errorf("%s lookup of %s stopped by -enrich-timeout", name, ip)
+	}
+}
+
+// Runs the enrichers over the first responder of every answering hop, as annotateOrigins looks up
+// origins, and merges what they found into the hop's annotations. On a key set by several enrichers
+// the one listed first wins, and an enricher failing only leaves out its own keys. Hops are looked
+// up ResolveWorkers at a time.
+func enrichHops(result *TraceResult, namesArray []string) {
+	slots := make(chan struct{}, ResolveWorkers)
+	var wg sync.WaitGroup
+	for i := range result.Hops {
+		hop := &result.Hops[i]
+		if !hop.Responded() {
+			continue
+		}
+		ipAddr, ok := hop.Peers[0].(*net.IPAddr)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(hop *HopResult, ip net.IP) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			hop.Annotations = annotate(ip, namesArray)
+		}(hop, ipAddr.IP)
+	}
+	wg.Wait()
+}
+
+// Merges the annotations of the enrichers for one address, nil when none found anything
+func annotate(ip net.IP, namesArray []string) map[string]string {
+	var annotations map[string]string
+	for _, name := range namesArray {
+		enricher, ok := lookupEnricher(name)
+		if !ok {
+			continue
+		}
+		values, err := enrichAddress(name, enricher, ip)
+		if err != nil {
+			continue
+		}
+		for key, value := range values {
+			if annotations == nil {
+				annotations = make(map[string]string)
+			}
+			if _, set := annotations[key]; !set {
+				annotations[key] = value
+			}
+		}
+	}
+	return annotations
+}
+
+// Returns a hop's annotations as key=value pairs sorted by key, for the text output
+func annotationsString(annotations map[string]string) string {
+	var keysArray []string
+	for key := range annotations {
+		keysArray = append(keysArray, key)
+	}
+	sort.Strings(keysArray)
+	var pairsArray []string
+	for _, key := range keysArray {
+		pairsArray = append(pairsArray, key+"="+annotations[key])
+	}
+	return strings.Join(pairsArray, " ")
+}
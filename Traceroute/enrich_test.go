@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeEnricher answers every address with the same values or error, counting its lookups
+type fakeEnricher struct {
+	values map[string]string
+	err    error
+	calls  int32
+}
+
+func (f *fakeEnricher) Enrich(ip net.IP) (map[string]string, error) {
+	atomic.AddInt32(&f.calls, 1)
+	return f.values, f.err
+}
+
+// Registers the enricher under name until the test ends, restoring one it replaced
+func useEnricher(t *testing.T, name string, enricher Enricher) {
+	saved, replaced := lookupEnricher(name)
+	registerEnricher(name, enricher)
+	t.Cleanup(func() {
+		enrichers.Lock()
+		defer enrichers.Unlock()
+		if replaced {
+			enrichers.m[name] = saved
+		} else {
+			delete(enrichers.m, name)
+		}
+	})
+}
+
+func TestEnrichHops(t *testing.T) {
+	down := errors.New("inventory down")
+	tests := []struct {
+		name string
+		// Enrichers in the order -enrichers lists them
+		enrichersArray []*fakeEnricher
+		want           map[string]string
+	}{
+		{"one", []*fakeEnricher{{values: map[string]string{"site": "dc1"}}}, map[string]string{"site": "dc1"}},
+		{"first listed wins", []*fakeEnricher{
+			{values: map[string]string{"site": "dc1", "rack": "r1"}},
+			{values: map[string]string{"site": "dc2", "owner": "net"}},
+		}, map[string]string{"site": "dc1", "rack": "r1", "owner": "net"}},
+		{"later ones fill in", []*fakeEnricher{
+			{values: map[string]string{}},
+			{values: map[string]string{"site": "dc2"}},
+		}, map[string]string{"site": "dc2"}},
+		{"failing one left out", []*fakeEnricher{
+			{err: down, values: map[string]string{"site": "stale"}},
+			{values: map[string]string{"owner": "net"}},
+		}, map[string]string{"owner": "net"}},
+		{"all failing", []*fakeEnricher{{err: down}, {err: down}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetEnrichCache()
+			defer resetEnrichCache()
+			var namesArray []string
+			for i, enricher := range tt.enrichersArray {
+				name := "test" + string(rune('a'+i))
+				useEnricher(t, name, enricher)
+				namesArray = append(namesArray, name)
+			}
+			// The hops are enriched at once, so each gets its own address
+			hops := func() TraceResult {
+				return TraceResult{Hops: []HopResult{
+					{TTL: 1, Sent: 3, Peers: []net.Addr{ip4("192.0.2.1")}, RTTs: []time.Duration{time.Millisecond}},
+					{TTL: 2, Sent: 3},
+					{TTL: 3, Sent: 3, Peers: []net.Addr{ip4("192.0.2.3")}, RTTs: []time.Duration{time.Millisecond}},
+				}}
+			}
+			result := hops()
+
+			enrichHops(&result, namesArray)
+			if !reflect.DeepEqual(result.Hops[0].Annotations, tt.want) || !reflect.DeepEqual(result.Hops[2].Annotations, tt.want) {
+				t.Errorf("annotated %v and %v, want %v", result.Hops[0].Annotations, result.Hops[2].Annotations, tt.want)
+			}
+			if result.Hops[1].Annotations != nil {
+				t.Errorf("silent hop annotated with %v", result.Hops[1].Annotations)
+			}
+
+			// A later trace through the same addresses reuses the values, while failures are looked up again
+			again := hops()
+			enrichHops(&again, namesArray)
+			if !reflect.DeepEqual(again.Hops[0].Annotations, tt.want) {
+				t.Errorf("annotated %v the second time, want %v", again.Hops[0].Annotations, tt.want)
+			}
+			for i, enricher := range tt.enrichersArray {
+				want := int32(2)
+				if enricher.err != nil {
+					want = 4
+				}
+				if calls := atomic.LoadInt32(&enricher.calls); calls != want {
+					t.Errorf("enricher %d called %d times, want %d", i+1, calls, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRegisteredEnrichersReplaceBuiltins(t *testing.T) {
+	tests := []struct {
+		name string
+		// Name the enricher is registered under
+		registered string
+		enricher   *fakeEnricher
+		// The outputs using the enricher
+		names   []string
+		asn     string
+		country string
+	}{
+		{"ptr", "ptr", &fakeEnricher{values: map[string]string{"ptr": "core1.dc1,core1-alias.dc1"}}, []string{"core1.dc1", "core1-alias.dc1"}, "", ""},
+		{"asn", "asn", &fakeEnricher{values: map[string]string{"asn": "64500", "prefix": "10.0.0.0/8"}}, nil, "64500", ""},
+		{"geoip", "geoip", &fakeEnricher{values: map[string]string{"country": "FR"}}, nil, "", "FR"},
+		// The failing lookup leaves the hop as it was without any origin
+		{"failing asn", "asn", &fakeEnricher{err: errors.New("whois down")}, nil, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offlineDNS(t, nil)
+			useEnricher(t, tt.registered, tt.enricher)
+			// A private address, which none of the built-in ones looks up
+			result := TraceResult{Hops: []HopResult{{TTL: 1, Sent: 1, Peers: []net.Addr{ip4("10.0.0.1")}, RTTs: []time.Duration{time.Millisecond}}}}
+
+			annotateOrigins(&result)
+			if names := peerNames("10.0.0.1"); !reflect.DeepEqual(names, tt.names) {
+				t.Errorf("got names %q, want %q", names, tt.names)
+			}
+			if hop := result.Hops[0]; hop.ASN != tt.asn || hop.Country != tt.country {
+				t.Errorf("got AS %q in %q, want %q in %q", hop.ASN, hop.Country, tt.asn, tt.country)
+			}
+		})
+	}
+}
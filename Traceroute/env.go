@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// Environment variables setting the key defaults as the flags do, for containers configured
+// through their environment. A flag given on the command line wins over its variable, which
+// wins over the built-in default; TRACEROUTE_SOCKET_FD is read on its own, see -socket-fd.
+var environmentFlags = []struct {
+	variable string
+	flag     string
+}{
+	{"TRACEROUTE_MAXTTL", "max-ttl"},
+	{"TRACEROUTE_PROBES", "probes"},
+	{"TRACEROUTE_TIMEOUT", "timeout"},
+	{"TRACEROUTE_PROBE_SIZES", "probe-sizes"},
+}
+
+// Sets the flags of the set that were not given on the command line from their environment
+// variable, if lookup finds one that is not empty. The value is parsed as the flag's own, so the
+// checks of main apply to it alike; a value the flag cannot parse is reported with its variable.
+func applyEnvironment(flags *flag.FlagSet, lookup func(string) (string, bool)) error {
+	given := givenFlags(flags)
+	for _, entry := range environmentFlags {
+		value, ok := lookup(entry.variable)
+		if !ok || value == "" || given[entry.flag] {
+			continue
+		}
+		if err := flags.Set(entry.flag, value); err != nil {
+			return fmt.Errorf("%s: invalid value %q for -%s: %v", entry.variable, value, entry.flag, err)
+		}
+	}
+	return nil
+}
+
+// Returns the names of the flags of the set given on the command line, whatever their value
+func givenFlags(flags *flag.FlagSet) map[string]bool {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	return given
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplyEnvironment(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		// Wanted values after the environment was applied, or the error
+		maxTTL  int
+		probes  int
+		timeout time.Duration
+		sizes   string
+		wantErr string
+	}{
+		{name: "defaults", maxTTL: 64, probes: 3, timeout: time.Second},
+		{name: "every variable", env: map[string]string{"TRACEROUTE_MAXTTL": "20", "TRACEROUTE_PROBES": "5", "TRACEROUTE_TIMEOUT": "2s", "TRACEROUTE_PROBE_SIZES": "56,1400"},
+			maxTTL: 20, probes: 5, timeout: 2 * time.Second, sizes: "56,1400"},
+		{name: "flags win", env: map[string]string{"TRACEROUTE_MAXTTL": "20", "TRACEROUTE_TIMEOUT": "2s"}, args: []string{"-max-ttl", "9"},
+			maxTTL: 9, probes: 3, timeout: 2 * time.Second},
+		{name: "flag given its default", env: map[string]string{"TRACEROUTE_PROBES": "5"}, args: []string{"-probes", "3"},
+			maxTTL: 64, probes: 3, timeout: time.Second},
+		{name: "empty variable", env: map[string]string{"TRACEROUTE_MAXTTL": ""}, maxTTL: 64, probes: 3, timeout: time.Second},
+		{name: "unrelated variable", env: map[string]string{"TRACEROUTE_TTL": "5"}, maxTTL: 64, probes: 3, timeout: time.Second},
+		{name: "invalid number", env: map[string]string{"TRACEROUTE_PROBES": "many"},
+			wantErr: `TRACEROUTE_PROBES: invalid value "many" for -probes: parse error`},
+		{name: "duration without unit", env: map[string]string{"TRACEROUTE_TIMEOUT": "2"},
+			wantErr: `TRACEROUTE_TIMEOUT: invalid value "2" for -timeout: parse error`},
+		{name: "invalid value of a given flag", env: map[string]string{"TRACEROUTE_TIMEOUT": "2"}, args: []string{"-timeout", "3s"},
+			maxTTL: 64, probes: 3, timeout: 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := flag.NewFlagSet("traceroute", flag.ContinueOnError)
+			maxTTL := flags.Int("max-ttl", MaxTTL, "")
+			probes := flags.Int("probes", AttemptsCount, "")
+			timeout := flags.Duration("timeout", time.Second, "")
+			sizes := flags.String("probe-sizes", "", "")
+			if err := flags.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			err := applyEnvironment(flags, func(variable string) (string, bool) {
+				value, ok := tt.env[variable]
+				return value, ok
+			})
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *maxTTL != tt.maxTTL || *probes != tt.probes || *timeout != tt.timeout || *sizes != tt.sizes {
+				t.Errorf("got -max-ttl %d -probes %d -timeout %v -probe-sizes %q, want %d %d %v %q",
+					*maxTTL, *probes, *timeout, *sizes, tt.maxTTL, tt.probes, tt.timeout, tt.sizes)
+			}
+		})
+	}
+}
+
+func TestGivenFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want map[string]bool
+	}{
+		{"none", nil, map[string]bool{}},
+		// -probes 3 is the default, and given all the same
+		{"default value", []string{"-probes", "3", "-adaptive-probes"}, map[string]bool{"probes": true, "adaptive-probes": true}},
+		{"other value", []string{"-max-probes", "4"}, map[string]bool{"max-probes": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := flag.NewFlagSet("traceroute", flag.ContinueOnError)
+			flags.Int("probes", AttemptsCount, "")
+			flags.Bool("adaptive-probes", false, "")
+			flags.Int("max-probes", 2*AttemptsCount, "")
+			if err := flags.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if got := givenFlags(flags); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvironmentFlagsExist(t *testing.T) {
+	for _, entry := range environmentFlags {
+		if flag.Lookup(entry.flag) == nil {
+			t.Errorf("%s sets -%s, which is no flag", entry.variable, entry.flag)
+		}
+	}
+}
+
+func TestHopProbes(t *testing.T) {
+	tests := []struct {
+		name   string
+		probes int
+		// Answered probes, the ones beyond are lost
+		answered int
+	}{
+		{name: "default", probes: 3, answered: 3},
+		{name: "single probe", probes: 1, answered: 1},
+		{name: "more probes", probes: 7, answered: 7},
+		{name: "more probes with loss", probes: 5, answered: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, hopProbes, tt.probes)
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			conn := newFakeConn(func(probe fakeProbe) []fakeReply {
+				if probe.Number() >= tt.answered {
+					return nil
+				}
+				return []fakeReply{{Bytes: echoReply(probe), Peer: ip4("10.9.9.9")}}
+			})
+			hop := ping(newTracer(conn, ip4("10.9.9.9"), false), 1)
+			if hop.Sent != tt.probes || len(conn.sent()) != tt.probes {
+				t.Errorf("hop reports %d probes with %d sent, want %d", hop.Sent, len(conn.sent()), tt.probes)
+			}
+			if len(hop.RTTs) != tt.answered {
+				t.Errorf("%d RTTs, want %d", len(hop.RTTs), tt.answered)
+			}
+			// The RTT column keeps a slot for every probe
+			if column := rttsColumn(nil); len(column) != 2+tt.probes*rttWidth+tt.probes-1 {
+				t.Errorf("RTT column %q has no room for %d probes", column, tt.probes)
+			}
+		})
+	}
+}
+
+func TestMaxTTLDefault(t *testing.T) {
+	setFlag(t, defaultMaxTTL, 12)
+	if config := defaultConfig(); config.MaxTTL != 12 {
+		t.Errorf("targets traced up to TTL %d, want -max-ttl 12", config.MaxTTL)
+	}
+	if tracer := newTracer(newFakeConn(nil), ip4("10.9.9.9"), false); tracer.maxTTL != 12 {
+		t.Errorf("tracer probes up to TTL %d, want -max-ttl 12", tracer.maxTTL)
+	}
+}
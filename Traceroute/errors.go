@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Kinds of failure a trace or hop can end in. The errors returned by tracert and socketExchange
+// match them with errors.Is while keeping their own message and wrapping the underlying error.
+var (
+	// The socket could not be opened or a probe sent for lack of privileges, or a firewall prohibited it
+	ErrPermission = errors.New("permission denied")
+	// The target did not resolve to an address of the family probed
+	ErrResolve = errors.New("cannot resolve target")
+	// The local host or a router has no route to the destination
+	ErrNoRoute = errors.New("no route to destination")
+	// No reply arrived before the deadline of the hop
+	ErrTimeout = errors.New("timed out")
+)
+
+func (e *resolveError) Is(target error) bool {
+	return target == ErrResolve
+}
+
+func (e *unexpectedICMPError) Is(target error) bool {
+	switch target {
+	case ErrNoRoute:
+		return e.noRoute()
+	case ErrPermission:
+		return e.adminProhibited()
+	}
+	return false
+}
+
+// Reports whether the reply is a destination unreachable for want of a route to the network or host
+func (e *unexpectedICMPError) noRoute() bool {
+	switch e.Message.Type {
+	case ipv4.ICMPTypeDestinationUnreachable:
+		return e.Message.Code == 0 || e.Message.Code == 1 || e.Message.Code == 6 || e.Message.Code == 7
+	case ipv6.ICMPTypeDestinationUnreachable:
+		return e.Message.Code == 0 || e.Message.Code == 3
+	}
+	return false
+}
+
+func (e *savedError) Is(target error) bool {
+	return target == ErrTimeout && e.timeout
+}
+
+// socketError reports a probe socket that could not be opened
+type socketError struct {
+	Err error
+}
+
+func (e *socketError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *socketError) Unwrap() error {
+	return e.Err
+}
+
+func (e *socketError) Is(target error) bool {
+	return target == ErrPermission && errors.Is(e.Err, os.ErrPermission)
+}
+
+// sendError reports a probe the kernel refused to send
+type sendError struct {
+	Err error
+}
+
+func (e *sendError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *sendError) Unwrap() error {
+	return e.Err
+}
+
+func (e *sendError) Is(target error) bool {
+	switch target {
+	case ErrPermission:
+		return errors.Is(e.Err, os.ErrPermission)
+	case ErrNoRoute:
+		return errors.Is(e.Err, syscall.ENETUNREACH) || errors.Is(e.Err, syscall.EHOSTUNREACH)
+	}
+	return false
+}
+
+// timeoutError reports a hop whose reply did not arrive in time; it is still a net.Error
+// timing out, so isTimeout and the saved traces see it as before
+type timeoutError struct {
+	Err error
+}
+
+func (e *timeoutError) Error() string   { return e.Err.Error() }
+func (e *timeoutError) Unwrap() error   { return e.Err }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+func (e *timeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// Wraps a failed read of a reply, a deadline expiry as timeoutError
+func readError(err error) error {
+	if isTimeout(err) {
+		return &timeoutError{Err: err}
+	}
+	return err
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func unreachableError(typ icmp.Type, code int) error {
+	return &unexpectedICMPError{Message: &icmp.Message{Type: typ, Code: code, Body: &icmp.DstUnreach{}}, Peer: ip4("10.0.0.1")}
+}
+
+func TestErrorKinds(t *testing.T) {
+	kindsArray := []error{ErrPermission, ErrResolve, ErrNoRoute, ErrTimeout}
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "unresolvable target", err: fmt.Errorf("trace: %w", &resolveError{Target: "example.invalid", Err: errors.New("no such host")}), want: ErrResolve},
+		{name: "socket without privileges", err: &socketError{Err: &net.OpError{Op: "listen", Err: os.NewSyscallError("socket", syscall.EPERM)}}, want: ErrPermission},
+		{name: "socket failing otherwise", err: &socketError{Err: os.NewSyscallError("socket", syscall.EMFILE)}},
+		{name: "send prohibited", err: &sendError{Err: &net.OpError{Op: "write", Err: os.NewSyscallError("sendto", syscall.EACCES)}}, want: ErrPermission},
+		{name: "send without route", err: &sendError{Err: &net.OpError{Op: "write", Err: os.NewSyscallError("sendto", syscall.ENETUNREACH)}}, want: ErrNoRoute},
+		{name: "send to unreachable host", err: &sendError{Err: os.NewSyscallError("sendto", syscall.EHOSTUNREACH)}, want: ErrNoRoute},
+		{name: "send failing otherwise", err: &sendError{Err: os.NewSyscallError("sendto", syscall.EMSGSIZE)}},
+		{name: "network unreachable", err: unreachableError(ipv4.ICMPTypeDestinationUnreachable, 0), want: ErrNoRoute},
+		{name: "host unreachable", err: unreachableError(ipv4.ICMPTypeDestinationUnreachable, 1), want: ErrNoRoute},
+		{name: "port unreachable", err: unreachableError(ipv4.ICMPTypeDestinationUnreachable, 3)},
+		{name: "administratively prohibited", err: unreachableError(ipv4.ICMPTypeDestinationUnreachable, 13), want: ErrPermission},
+		{name: "IPv6 no route", err: unreachableError(ipv6.ICMPTypeDestinationUnreachable, 0), want: ErrNoRoute},
+		{name: "IPv6 prohibited", err: unreachableError(ipv6.ICMPTypeDestinationUnreachable, 1), want: ErrPermission},
+		{name: "IPv6 address unreachable", err: unreachableError(ipv6.ICMPTypeDestinationUnreachable, 3), want: ErrNoRoute},
+		{name: "read deadline", err: readError(&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}), want: ErrTimeout},
+		{name: "read failing otherwise", err: readError(os.NewSyscallError("recvfrom", syscall.EBADF))},
+		{name: "saved timeout", err: &savedError{text: "i/o timeout", timeout: true}, want: ErrTimeout},
+		{name: "saved error", err: &savedError{text: "connection refused"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, kind := range kindsArray {
+				if got := errors.Is(tt.err, kind); got != (kind == tt.want) {
+					t.Errorf("errors.Is(%v, %v) = %v", tt.err, kind, got)
+				}
+			}
+		})
+	}
+}
+
+func TestErrorsKeepTheirCause(t *testing.T) {
+	cause := os.NewSyscallError("sendto", syscall.ENETUNREACH)
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "socket error", err: &socketError{Err: cause}},
+		{name: "send error", err: &sendError{Err: cause}},
+		{name: "timeout error", err: &timeoutError{Err: cause}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.err.Error() != cause.Error() {
+				t.Errorf("message %q, want the cause's %q", tt.err, cause)
+			}
+			if !errors.Is(tt.err, syscall.ENETUNREACH) {
+				t.Error("cause not wrapped")
+			}
+		})
+	}
+
+	// A timeout is still seen as one by the code checking for net.Error timeouts
+	timeout := readError(&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded})
+	if !isTimeout(timeout) || !errors.Is(timeout, os.ErrDeadlineExceeded) {
+		t.Errorf("%v is no timeout", timeout)
+	}
+}
+
+// sendFailingConn is a fake network whose kernel refuses to send the probes
+type sendFailingConn struct {
+	*fakeConn
+	err error
+}
+
+func (c *sendFailingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return 0, c.err
+}
+
+func TestHopErrorKinds(t *testing.T) {
+	tests := []struct {
+		name string
+		conn probeConn
+		want error
+	}{
+		{name: "silent hop", conn: newFakeConn(fakePath("10.9.9.9", "")), want: ErrTimeout},
+		{name: "no route at a router", conn: newFakeConn(func(probe fakeProbe) []fakeReply {
+			return []fakeReply{{Bytes: destUnreachable(1, probe), Peer: ip4("10.0.0.1")}}
+		}), want: ErrNoRoute},
+		{name: "prohibited by a firewall", conn: newFakeConn(func(probe fakeProbe) []fakeReply {
+			return []fakeReply{{Bytes: destUnreachable(13, probe), Peer: ip4("10.0.0.1")}}
+		}), want: ErrPermission},
+		{name: "send refused", conn: &sendFailingConn{fakeConn: newFakeConn(nil), err: os.NewSyscallError("sendto", syscall.EPERM)}, want: ErrPermission},
+		{name: "no local route", conn: &sendFailingConn{fakeConn: newFakeConn(nil), err: os.NewSyscallError("sendto", syscall.ENETUNREACH)}, want: ErrNoRoute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			hop := ping(newTracer(tt.conn, ip4("10.9.9.9"), false), 1)
+			if !errors.Is(hop.Err, tt.want) {
+				t.Errorf("hop failed with %v, want %v", hop.Err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTraceErrorKinds(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		openErr error
+		want    error
+	}{
+		{name: "unresolvable target", target: "no-such-host.invalid", want: ErrResolve},
+		{name: "socket without privileges", target: "10.9.9.9", openErr: &socketError{Err: os.NewSyscallError("socket", syscall.EPERM)}, want: ErrPermission},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offlineDNS(t, nil)
+			setFlag(t, dnsRetries, 0)
+			saved := openTraceSocket
+			openTraceSocket = func(iface string, useIPv6 bool) (*icmpConn, error) {
+				if tt.openErr != nil {
+					return nil, tt.openErr
+				}
+				return &icmpConn{PacketConn: newFakeConn(fakePath("10.9.9.9"))}, nil
+			}
+			defer func() { openTraceSocket = saved }()
+
+			_, err := tracert(tt.target, traceConfig{MaxTTL: 4, Method: "icmp"}, &recordingReporter{})
+			if !errors.Is(err, tt.want) {
+				t.Errorf("trace failed with %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// fakeProbe is an echo request written to a fakeConn, with the TTL it was sent with
+type fakeProbe struct {
+	TTL   int
+	ID    int
+	Seq   int
+	Data  []byte
+	Bytes []byte
+	Dest  net.Addr
+}
+
+// Number of the probe within its hop, the low byte of its sequence number
+func (p fakeProbe) Number() int {
+	return p.Seq & 0xff
+}
+
+// fakeReply is a packet the fake network sends back, delay after the probe it answers was written
+type fakeReply struct {
+	Bytes []byte
+	Peer  net.Addr
+	Delay time.Duration
+
+	due time.Time
+}
+
+// fakeConn is a scripted network behind the socket of a trace, needing neither root nor a real network.
+// Every probe written is handed to script, which returns the packets the network answers it with: the
+// reply, nothing for a lost probe, or foreign packets for other traffic. Reads return them in the order
+// they are due, waiting for them as a socket does. A read times out once its deadline passes with nothing
+// due; a packet due after the deadline stays queued and arrives late.
+//
+// fakeConn is both a probeConn and a net.PacketConn, so it also serves as the socket below an icmpConn.
+type fakeConn struct {
+	script func(probe fakeProbe) []fakeReply
+
+	mu       sync.Mutex
+	ttl      int
+	deadline time.Time
+	probes   []fakeProbe
+	queue    []fakeReply
+	closes   int
+
+	// Closed and replaced whenever a reply is queued or the deadline moves, waking blocked reads
+	changed chan struct{}
+}
+
+func newFakeConn(script func(probe fakeProbe) []fakeReply) *fakeConn {
+	return &fakeConn{script: script, ttl: 64, changed: make(chan struct{})}
+}
+
+// Wakes the reads waiting for a reply or their deadline; c.mu must be held
+func (c *fakeConn) wake() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	probe := fakeProbe{Bytes: append([]byte(nil), b...), Dest: addr}
+	protocol := ProtocolIPv4ICMP
+	if len(b) > 0 && b[0] == byte(ipv6.ICMPTypeEchoRequest) {
+		protocol = ProtocolIPv6ICMP
+	}
+	if msg, err := icmp.ParseMessage(protocol, b); err == nil {
+		if echo, ok := msg.Body.(*icmp.Echo); ok {
+			probe.ID, probe.Seq, probe.Data = echo.ID, echo.Seq, echo.Data
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	probe.TTL = c.ttl
+	c.probes = append(c.probes, probe)
+	now := time.Now()
+	for _, reply := range c.script(probe) {
+		reply.due = now.Add(reply.Delay)
+		c.queue = append(c.queue, reply)
+	}
+	c.wake()
+	return len(b), nil
+}
+
+func (c *fakeConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		now := time.Now()
+		next := -1
+		for i, reply := range c.queue {
+			if next < 0 || reply.due.Before(c.queue[next].due) {
+				next = i
+			}
+		}
+		if next >= 0 && !c.queue[next].due.After(now) {
+			reply := c.queue[next]
+			c.queue = append(c.queue[:next], c.queue[next+1:]...)
+			c.mu.Unlock()
+			return copy(b, reply.Bytes), reply.Peer, nil
+		}
+		if !c.deadline.IsZero() && !now.Before(c.deadline) {
+			c.mu.Unlock()
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+
+		// Sleeps until the next packet is due or the deadline passes, whichever comes first
+		wakeAt := c.deadline
+		if next >= 0 && (wakeAt.IsZero() || c.queue[next].due.Before(wakeAt)) {
+			wakeAt = c.queue[next].due
+		}
+		changed := c.changed
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var fired <-chan time.Time
+		if !wakeAt.IsZero() {
+			timer = time.NewTimer(time.Until(wakeAt))
+			fired = timer.C
+		}
+		select {
+		case <-changed:
+		case <-fired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (c *fakeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	c.wake()
+	return nil
+}
+
+func (c *fakeConn) SetDeadline(t time.Time) error      { return c.SetReadDeadline(t) }
+func (c *fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+func (c *fakeConn) LocalAddr() net.Addr                { return ip4("0.0.0.0") }
+
+func (c *fakeConn) SetTTL(ttl int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
+	return nil
+}
+
+func (c *fakeConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closes++
+	return nil
+}
+
+// Returns the probes written so far
+func (c *fakeConn) sent() []fakeProbe {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]fakeProbe(nil), c.probes...)
+}
+
+// Returns how often the connection was closed
+func (c *fakeConn) closed() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closes
+}
+
+// Makes tracert run on a socket over conn until the test ends, returning how many sockets were opened
+func useFakeNetwork(t *testing.T, conn *fakeConn) *int {
+	opened := 0
+	saved := openTraceSocket
+	openTraceSocket = func(iface string, useIPv6 bool) (*icmpConn, error) {
+		opened++
+		return &icmpConn{PacketConn: conn}, nil
+	}
+	t.Cleanup(func() { openTraceSocket = saved })
+	return &opened
+}
+
+// Scripts a path through routers to dest: a probe whose TTL reaches routersArray[ttl-1] gets a
+// Time Exceeded from it, one reaching past them an echo reply from dest. An empty router is silent.
+func fakePath(dest string, routersArray ...string) func(probe fakeProbe) []fakeReply {
+	return func(probe fakeProbe) []fakeReply {
+		if probe.TTL > len(routersArray) {
+			return []fakeReply{{Bytes: echoReply(probe), Peer: ip4(dest)}}
+		}
+		router := routersArray[probe.TTL-1]
+		if router == "" {
+			return nil
+		}
+		return []fakeReply{{Bytes: timeExceeded(router, probe), Peer: ip4(router)}}
+	}
+}
+
+// Makes name lookups fail at once until the test ends, as they would without a network,
+// apart from the names given, which are answered from the cache. The enrichers' cache starts empty too.
+func offlineDNS(t *testing.T, names map[string][]string) {
+	saved := hopResolver
+	hopResolver = &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("no network in tests")
+	}}
+	ptrCache.Lock()
+	ptrCache.names = make(map[string][]string)
+	for addr, namesArray := range names {
+		ptrCache.names[addr] = namesArray
+	}
+	ptrCache.Unlock()
+	resetEnrichCache()
+	t.Cleanup(func() {
+		hopResolver = saved
+		ptrCache.Lock()
+		ptrCache.names = make(map[string][]string)
+		ptrCache.Unlock()
+		resetEnrichCache()
+	})
+}
+
+func resetEnrichCache() {
+	enrichCache.Lock()
+	enrichCache.entries = make(map[string]*enrichEntry)
+	enrichCache.Unlock()
+}
+
+// Runs fn with stdout and stderr redirected, returning what it wrote to each
+func captureOutput(t *testing.T, fn func()) (stdout string, stderr string) {
+	var outputs [2]strings.Builder
+	var writers [2]*os.File
+	var wg sync.WaitGroup
+	for i := range writers {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		writers[i] = writer
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			io.Copy(&outputs[i], reader)
+			reader.Close()
+		}(i)
+	}
+
+	saved := [2]*os.File{os.Stdout, os.Stderr}
+	os.Stdout, os.Stderr = writers[0], writers[1]
+	defer func() {
+		os.Stdout, os.Stderr = saved[0], saved[1]
+		writers[0].Close()
+		writers[1].Close()
+		wg.Wait()
+		stdout, stderr = outputs[0].String(), outputs[1].String()
+	}()
+	fn()
+	return
+}
+
+// Sets the flag to value until the test ends
+func setFlag[T any](t *testing.T, flag *T, value T) {
+	saved := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = saved })
+}
+
+func ip4(s string) *net.IPAddr {
+	return &net.IPAddr{IP: net.ParseIP(s).To4()}
+}
+
+// Returns an IPv4 header from src to dst of a datagram carrying payload, as an ICMP error quotes it
+func ipv4Header(src, dst string, ttl int, payload []byte) []byte {
+	header := make([]byte, ipv4.HeaderLen)
+	header[0] = 0x45
+	binary.BigEndian.PutUint16(header[2:4], uint16(ipv4.HeaderLen+len(payload)))
+	header[8] = byte(ttl)
+	header[9] = ProtocolIPv4ICMP
+	copy(header[12:16], net.ParseIP(src).To4())
+	copy(header[16:20], net.ParseIP(dst).To4())
+	return append(header, payload...)
+}
+
+// Returns the probe as the router dropping it quotes it: its IP header, sent from a local
+// address to the probe's destination, and the whole echo request
+func quoteProbe(probe fakeProbe) []byte {
+	dst := "192.0.2.1"
+	if ipAddr, ok := probe.Dest.(*net.IPAddr); ok {
+		dst = ipAddr.IP.String()
+	}
+	return ipv4Header("192.168.0.2", dst, 1, probe.Bytes)
+}
+
+// Returns the Time Exceeded router sends for the probe
+func timeExceeded(router string, probe fakeProbe) []byte {
+	return marshalICMP(icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Body: &icmp.TimeExceeded{Data: quoteProbe(probe)}})
+}
+
+// Returns the echo reply the destination sends for the probe
+func echoReply(probe fakeProbe) []byte {
+	return marshalICMP(icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: probe.ID, Seq: probe.Seq, Data: probe.Data}})
+}
+
+// Returns a Destination Unreachable with the given code for the probe
+func destUnreachable(code int, probe fakeProbe) []byte {
+	return marshalICMP(icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: code, Body: &icmp.DstUnreach{Data: quoteProbe(probe)}})
+}
+
+// Returns an echo reply to someone else's ping, which the raw socket sees all the same
+func foreignEcho() []byte {
+	return marshalICMP(icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 0xbeef, Seq: 7, Data: []byte("other")}})
+}
+
+func marshalICMP(msg icmp.Message) []byte {
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// recordingReporter keeps what a trace reports
+type recordingReporter struct {
+	mu     sync.Mutex
+	hops   []HopResult
+	notes  []string
+	result *TraceResult
+}
+
+func (r *recordingReporter) Start(target string, maxTTL int, traceID string) {}
+
+func (r *recordingReporter) Hop(hop HopResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hops = append(r.hops, hop)
+}
+
+func (r *recordingReporter) Note(text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notes = append(r.notes, text)
+}
+
+func (r *recordingReporter) End(result *TraceResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.result = result
+}
+
+// Reports whether a note containing text was reported
+func (r *recordingReporter) noted(text string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, note := range r.notes {
+		if strings.Contains(note, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFakeNetwork(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  func(probe fakeProbe) []fakeReply
+		timeout bool
+		peer    string
+	}{
+		{"time exceeded", fakePath("10.9.9.9", "10.0.0.1"), false, "10.0.0.1"},
+		{"echo reply", fakePath("10.9.9.9"), false, "10.9.9.9"},
+		{"lost", func(fakeProbe) []fakeReply { return nil }, true, ""},
+		{"later than the deadline", func(probe fakeProbe) []fakeReply {
+			return []fakeReply{{Bytes: echoReply(probe), Peer: ip4("10.9.9.9"), Delay: time.Second}}
+		}, true, ""},
+		{"foreign packet first", func(probe fakeProbe) []fakeReply {
+			return []fakeReply{{Bytes: foreignEcho(), Peer: ip4("10.5.5.5")}, {Bytes: echoReply(probe), Peer: ip4("10.9.9.9"), Delay: time.Millisecond}}
+		}, false, "10.9.9.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newFakeConn(tt.script)
+			setFlag(t, timeoutBase, 50*time.Millisecond)
+			setFlag(t, timeoutMax, 50*time.Millisecond)
+			tracer := newTracer(conn, ip4("10.9.9.9"), false)
+
+			hop := ping(tracer, 1)
+			if tt.timeout {
+				if !isTimeout(hop.Err) {
+					t.Fatalf("got %v, want a timeout", hop.Err)
+				}
+				return
+			}
+			if hop.Err != nil || len(hop.Peers) != tracer.probes {
+				t.Fatalf("got %d replies, error %v", len(hop.Peers), hop.Err)
+			}
+			if hop.Peers[0].String() != tt.peer {
+				t.Errorf("answered by %v, want %s", hop.Peers[0], tt.peer)
+			}
+			if len(conn.sent()) != tracer.probes {
+				t.Errorf("%d probes sent, want %d", len(conn.sent()), tracer.probes)
+			}
+		})
+	}
+}
+
+func TestFakeConnWaitsLikeASocket(t *testing.T) {
+	conn := newFakeConn(fakePath("10.9.9.9"))
+	probe := marshalICMP(icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: 1, Seq: 1}})
+	reply := make([]byte, 1500)
+
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(40 * time.Millisecond))
+	if _, _, err := conn.ReadFrom(reply); !isTimeout(err) {
+		t.Fatalf("read of an empty queue got %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("read of an empty queue timed out after %v, before its deadline", elapsed)
+	}
+
+	// A reply queued while a read waits is returned at once
+	start = time.Now()
+	conn.SetReadDeadline(start.Add(time.Second))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		conn.WriteTo(probe, ip4("10.9.9.9"))
+	}()
+	if _, peer, err := conn.ReadFrom(reply); err != nil || peer.String() != "10.9.9.9" {
+		t.Fatalf("got %v from %v, want the echo reply of 10.9.9.9", err, peer)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("reply queued after 20ms was read after %v", elapsed)
+	}
+}
+
+func TestTracertOnFakeNetwork(t *testing.T) {
+	conn := newFakeConn(fakePath("10.9.9.9", "10.0.0.1", "", "10.0.0.3"))
+	useFakeNetwork(t, conn)
+	setFlag(t, timeoutBase, 20*time.Millisecond)
+	setFlag(t, timeoutMax, 20*time.Millisecond)
+	setFlag(t, skipLossyPTR, true)
+
+	reporter := &recordingReporter{}
+	result, err := tracert("10.9.9.9", traceConfig{MaxTTL: 8, Method: "icmp"}, reporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Reached || len(result.Hops) != 4 {
+		t.Fatalf("reached %v in %d hops, want 4", result.Reached, len(result.Hops))
+	}
+	for i, want := range []string{"10.0.0.1", "", "10.0.0.3", "10.9.9.9"} {
+		hop := result.Hops[i]
+		if want == "" {
+			if hop.Responded() {
+				t.Errorf("hop %d answered by %v, want silent", hop.TTL, hop.Peers)
+			}
+			continue
+		}
+		if !hop.Responded() || hop.Peers[0].String() != want {
+			t.Errorf("hop %d answered by %v, want %s", hop.TTL, hop.Peers, want)
+		}
+	}
+}
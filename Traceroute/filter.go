@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/net/bpf"
+)
+
+// ICMP types let through the socket filter besides echo replies: the
+// errors that can quote one of our probes
+var (
+	filteredErrorTypesV4 = []uint32{3, 4, 5, 11, 12}
+	filteredErrorTypesV6 = []uint32{1, 2, 3, 4}
+)
+
+// Builds a classic BPF program that keeps ICMP errors and the echo replies
+// answering our probes, and drops every other ICMP packet in the kernel. An
+// echo reply answers them when it carries our identifier, or our payload cookie
+// after a NAT rewrote the identifier, as answeredSeq matches it. IPv4 raw
+// sockets see the IP header, IPv6 ones start at ICMPv6.
+func probeFilter(id int, useIPv6 bool) ([]bpf.RawInstruction, error) {
+	var program []bpf.Instruction
+	var echoReply uint32 = 0
+	errorTypes := filteredErrorTypesV4
+
+	if useIPv6 {
+		echoReply = 129
+		errorTypes = filteredErrorTypesV6
+		// X = 0, the ICMPv6 header starts the packet
+		program = append(program, bpf.LoadConstant{Dst: bpf.RegX, Val: 0})
+	} else {
+		// X = length of the IPv4 header
+		program = append(program, bpf.LoadMemShift{Off: 0})
+	}
+
+	// A = ICMP type
+	program = append(program, bpf.LoadIndirect{Off: 0, Size: 1})
+
+	// Every error type jumps to the accept at the end of the echo reply checks below
+	n := len(errorTypes)
+	for i, t := range errorTypes {
+		program = append(program, bpf.JumpIf{Cond: bpf.JumpEqual, Val: t, SkipTrue: uint8(n - i + 6)})
+	}
+	program = append(program,
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: echoReply, SkipFalse: 7},
+		// A = echo identifier
+		bpf.LoadIndirect{Off: 4, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(id), SkipTrue: 4},
+		// A = magic of the payload cookie, then the identifier it carries
+		bpf.LoadIndirect{Off: 8, Size: 4},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: binary.BigEndian.Uint32(cookieMagic), SkipFalse: 3},
+		bpf.LoadIndirect{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(id), SkipFalse: 1},
+		bpf.RetConstant{Val: 0xffff},
+		bpf.RetConstant{Val: 0},
+	)
+
+	return bpf.Assemble(program)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestProbeFilter(t *testing.T) {
+	const id = 0x1234
+	probe := fakeProbe{ID: id, Seq: probeSeq(3, 0), Data: append(probeCookie(id, probeSeq(3, 0)), make([]byte, 48)...)}
+	probe.Bytes = marshalICMP(icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: probe.ID, Seq: probe.Seq, Data: probe.Data}})
+	rewritten := probe
+	rewritten.ID = 0x5555
+
+	tests := []struct {
+		name   string
+		packet []byte
+		kept   bool
+	}{
+		{"echo reply", echoReply(probe), true},
+		{"echo reply after NAT rewrote the identifier", echoReply(rewritten), true},
+		{"echo reply to other traffic", foreignEcho(), false},
+		{"echo reply with another identifier and no cookie", echoReply(fakeProbe{ID: 0x5555, Seq: 1, Data: []byte("TRCX0000")}), false},
+		{"echo reply carrying another trace's cookie", echoReply(fakeProbe{ID: 0x5555, Seq: 1, Data: probeCookie(0x4321, 1)}), false},
+		{"time exceeded", timeExceeded("10.0.0.1", probe), true},
+		{"destination unreachable", destUnreachable(3, probe), true},
+		{"echo request", probe.Bytes, false},
+	}
+	program, err := probeFilter(id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instructions, ok := bpf.Disassemble(program)
+	if !ok {
+		t.Fatal("filter does not disassemble")
+	}
+	vm, err := bpf.NewVM(instructions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The raw IPv4 socket sees the IP header in front of the ICMP message
+			kept, err := vm.Run(ipv4Header("10.0.0.1", "192.168.0.2", 64, tt.packet))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (kept > 0) != tt.kept {
+				t.Errorf("kept %v, want %v", kept > 0, tt.kept)
+			}
+		})
+	}
+}
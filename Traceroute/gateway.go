@@ -0,0 +1,40 @@
+package main
+
+import "fmt"
+
+// Probes only TTL 1 and the full TTL, for a quick check of the gateway and the destination.
+// Returns whether the destination answered.
+func gatewayCheck(target targetSpec) (bool, error) {
+	destination, err := resolveTarget(target.Host)
+	if err != nil {
+		return false, &resolveError{Target: target.Host, Err: err}
+	}
+	connection, err := openSocket(*sourceIface, *useIPv6)
+	if err != nil {
+		return false, err
+	}
+	defer connection.Close()
+
+	tracer := newTracer(connection, destination, *useIPv6)
+	tracer.maxTTL = target.Config.MaxTTL
+
+	gateway := ping(tracer, 1)
+	switch {
+	case gateway.Reached:
+		fmt.Printf("gateway:     is the destination itself\n")
+	case gateway.Responded():
+		_, avg, _ := rttStats(gateway.RTTs)
+		fmt.Printf("gateway:     %s %s\n", createPeersString(gateway.Peers), humanDuration(avg))
+	default:
+		fmt.Printf("gateway:     no answer\n")
+	}
+
+	final := ping(tracer, tracer.maxTTL)
+	if !final.Reached {
+		fmt.Printf("destination: %s not reached\n", destination)
+		return false, nil
+	}
+	_, avg, _ := rttStats(final.RTTs)
+	fmt.Printf("destination: %s reached %s\n", destination, humanDuration(avg))
+	return true, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Dots separate the path components, so they and whitespace cannot appear inside one;
+// tag values may not hold the tag separators either
+var (
+	graphiteEscaper    = strings.NewReplacer(".", "_", ":", "_", " ", "_", "\t", "_", "\n", "_")
+	graphiteTagEscaper = strings.NewReplacer(";", "_", "~", "_", " ", "_", "\t", "_", "\n", "_")
+)
+
+// graphiteReporter writes Graphite plaintext lines per hop, timestamped when the hop completed:
+// <prefix>.<target>.ttl<NN>.loss and .rtt_ms, tagged with the trace ID
+type graphiteReporter struct {
+	prefix  string
+	target  string
+	traceID string
+}
+
+func (r *graphiteReporter) Start(target string, maxTTL int, traceID string) {
+	r.target = target
+	r.traceID = traceID
+}
+
+func (r *graphiteReporter) Hop(hop HopResult) {
+	path := fmt.Sprintf("%s.%s.ttl%02d", r.prefix, graphiteEscaper.Replace(r.target), hop.TTL)
+	timestamp := hop.Time.Unix()
+
+	var b strings.Builder
+	tags := ";trace_id=" + graphiteTagEscaper.Replace(r.traceID)
+	fmt.Fprintf(&b, "%s.loss%s %g %d\n", path, tags, lossPercent(hop.Sent, len(hop.RTTs)), timestamp)
+	if len(hop.RTTs) > 0 {
+		_, avg, _ := rttStats(hop.RTTs)
+		fmt.Fprintf(&b, "%s.rtt_ms%s %g %d\n", path, tags, float64(avg)/float64(time.Millisecond), timestamp)
+	}
+
+	if err := stdoutRecords.writeRecord([]byte(b.String())); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+}
+
+func (r *graphiteReporter) Note(text string) {
+	fmt.Fprintf(os.Stderr, "%s\n", text)
+}
+
+func (r *graphiteReporter) End(result *TraceResult) {}
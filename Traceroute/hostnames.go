@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+)
+
+// Locations of the IATA airport and metropolitan codes carriers most often put in router names.
+// Codes that are also network terms, such as LAN, MAN or AGG, are left out on purpose.
+var locationCodes = map[string]string{
+	"ams": "Amsterdam, NL", "arn": "Stockholm, SE", "ath": "Athens, GR", "atl": "Atlanta, US",
+	"bcn": "Barcelona, ES", "bkk": "Bangkok, TH", "bom": "Mumbai, IN", "bos": "Boston, US",
+	"bru": "Brussels, BE", "bts": "Bratislava, SK", "bud": "Budapest, HU", "cdg": "Paris, FR",
+	"chi": "Chicago, US", "cph": "Copenhagen, DK", "dca": "Washington, US", "del": "Delhi, IN",
+	"den": "Denver, US", "dfw": "Dallas, US", "dub": "Dublin, IE", "dus": "Dusseldorf, DE",
+	"dxb": "Dubai, AE", "ewr": "Newark, US", "eze": "Buenos Aires, AR", "fra": "Frankfurt, DE",
+	"gru": "Sao Paulo, BR", "gva": "Geneva, CH", "ham": "Hamburg, DE", "hel": "Helsinki, FI",
+	"hkg": "Hong Kong, HK", "iad": "Washington, US", "icn": "Seoul, KR", "ist": "Istanbul, TR",
+	"jfk": "New York, US", "jnb": "Johannesburg, ZA", "kix": "Osaka, JP", "lax": "Los Angeles, US",
+	"lhr": "London, GB", "lis": "Lisbon, PT", "lon": "London, GB", "lga": "New York, US",
+	"mad": "Madrid, ES", "mia": "Miami, US", "mil": "Milan, IT", "mrs": "Marseille, FR",
+	"msp": "Minneapolis, US", "muc": "Munich, DE", "mxp": "Milan, IT", "nrt": "Tokyo, JP",
+	"nyc": "New York, US", "ord": "Chicago, US", "osl": "Oslo, NO", "otp": "Bucharest, RO",
+	"par": "Paris, FR", "phx": "Phoenix, US", "prg": "Prague, CZ", "sea": "Seattle, US",
+	"sfo": "San Francisco, US", "sin": "Singapore, SG", "sjc": "San Jose, US", "sof": "Sofia, BG",
+	"sto": "Stockholm, SE", "syd": "Sydney, AU", "tpe": "Taipei, TW", "tyo": "Tokyo, JP",
+	"vie": "Vienna, AT", "waw": "Warsaw, PL", "was": "Washington, US", "yul": "Montreal, CA",
+	"yvr": "Vancouver, CA", "yyz": "Toronto, CA", "zrh": "Zurich, CH",
+}
+
+// Roles of the router naming tokens carriers commonly use. The short abbreviations are only
+// trusted followed by a number, e.g. cr1 or pe-2, where they rarely mean anything else.
+var (
+	roleWords = map[string]string{
+		"core": "core", "backbone": "core", "edge": "edge", "border": "border",
+		"agg": "aggregation", "aggr": "aggregation", "dist": "aggregation",
+		"peer": "peering", "peering": "peering", "transit": "transit",
+		"gateway": "gateway", "cpe": "customer", "cust": "customer", "customer": "customer",
+		"bras": "broadband", "bng": "broadband",
+	}
+	roleAbbreviations = map[string]string{
+		"cr": "core", "ccr": "core", "bb": "core", "bbr": "core",
+		"er": "edge", "pe": "edge", "br": "border", "ar": "aggregation",
+		"gw": "gateway", "ix": "peering",
+	}
+)
+
+// Returns the location and role a router name suggests, empty when it suggests neither. Only
+// the labels before the registered domain are looked at, as a provider's own name says nothing
+// of the router, and a label counts only when it is a known code or word, optionally numbered
+// like par01 or edge2; the first location and role found win.
+func nameHints(name string) (string, string) {
+	labelsArray := strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".")
+	// e.g. provider.net, or provider.co.uk
+	domainLabels := 2
+	if count := len(labelsArray); count >= 3 && len(labelsArray[count-1]) == 2 && len(labelsArray[count-2]) <= 3 {
+		domainLabels = 3
+	}
+	if len(labelsArray) <= domainLabels {
+		return "", ""
+	}
+
+	var location, role string
+	for _, label := range labelsArray[:len(labelsArray)-domainLabels] {
+		for _, token := range strings.FieldsFunc(label, func(r rune) bool { return r == '-' || r == '_' }) {
+			word, numbered := splitNumber(token)
+			if location == "" {
+				if city, ok := locationCodes[word]; ok && len(word) == 3 {
+					location = city
+					continue
+				}
+			}
+			if role == "" {
+				if kind, ok := roleWords[word]; ok {
+					role = kind
+				} else if kind, ok := roleAbbreviations[word]; ok && numbered {
+					role = kind
+				}
+			}
+		}
+	}
+	return location, role
+}
+
+// Splits a trailing number off a token, e.g. edge2 into edge, reporting whether there was one
+func splitNumber(token string) (string, bool) {
+	word := strings.TrimRight(token, "0123456789")
+	return word, word != token
+}
+
+// Returns the name hints of a hop's responders for the text output, e.g. "Paris, FR, edge",
+// one set per distinct hint of its names; names -fcrdns could not confirm are not trusted
+func hopNameHints(hop HopResult) string {
+	if !resolvesNames(hop) {
+		return ""
+	}
+	var hintsArray []string
+	seen := make(map[string]bool)
+	for _, peer := range uniquePeers(hop.Peers) {
+		for _, name := range peerNames(peer) {
+			if strings.HasSuffix(name, " (unconfirmed)") {
+				continue
+			}
+			location, role := nameHints(name)
+			var partsArray []string
+			for _, part := range []string{location, role} {
+				if part != "" {
+					partsArray = append(partsArray, part)
+				}
+			}
+			hint := strings.Join(partsArray, ", ")
+			if hint != "" && !seen[hint] {
+				seen[hint] = true
+				hintsArray = append(hintsArray, hint)
+			}
+		}
+	}
+	return strings.Join(hintsArray, " / ")
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// From RFC 792 and RFC 1812
+var icmpCodeNames = map[ipv4.ICMPType][]string{
+	ipv4.ICMPTypeDestinationUnreachable: {
+		"net unreachable", "host unreachable", "protocol unreachable", "port unreachable",
+		"fragmentation needed", "source route failed", "destination network unknown",
+		"destination host unknown", "source host isolated", "network administratively prohibited",
+		"host administratively prohibited", "network unreachable for TOS", "host unreachable for TOS",
+		"communication administratively prohibited", "host precedence violation", "precedence cutoff in effect",
+	},
+	ipv4.ICMPTypeTimeExceeded:     {"TTL exceeded in transit", "fragment reassembly time exceeded"},
+	ipv4.ICMPTypeRedirect:         {"redirect for network", "redirect for host", "redirect for TOS and network", "redirect for TOS and host"},
+	ipv4.ICMPTypeParameterProblem: {"pointer indicates the error", "missing a required option", "bad length"},
+}
+
+// From RFC 4443
+var icmpv6CodeNames = map[ipv6.ICMPType][]string{
+	ipv6.ICMPTypeDestinationUnreachable: {
+		"no route to destination", "communication administratively prohibited", "beyond scope of source address",
+		"address unreachable", "port unreachable", "source address failed ingress/egress policy", "reject route to destination",
+	},
+	ipv6.ICMPTypeTimeExceeded:     {"hop limit exceeded in transit", "fragment reassembly time exceeded"},
+	ipv6.ICMPTypeParameterProblem: {"erroneous header field", "unrecognized next header type", "unrecognized IPv6 option"},
+}
+
+// unexpectedICMPError reports a reply to our probe of a type the tracer does not process
+type unexpectedICMPError struct {
+	Message *icmp.Message
+	Peer    net.Addr
+}
+
+func (e *unexpectedICMPError) Error() string {
+	text := fmt.Sprintf("%s from %v", icmpTypeCodeString(e.Message), e.Peer)
+	if field := parameterProblemField(e.Message); field != "" {
+		text += ", " + field
+	}
+	if quoted := quotedPacket(e.Message); quoted != nil {
+		text += ", quoting " + describeQuoted(quoted)
+	}
+	return text
+}
+
+// Reports whether the reply is a destination unreachable sent by a filtering router or firewall
+func (e *unexpectedICMPError) adminProhibited() bool {
+	switch e.Message.Type {
+	case ipv4.ICMPTypeDestinationUnreachable:
+		return e.Message.Code == 9 || e.Message.Code == 10 || e.Message.Code == 13
+	case ipv6.ICMPTypeDestinationUnreachable:
+		return e.Message.Code == 1
+	}
+	return false
+}
+
+// Returns the type and code numbers of the message
+func icmpReply(msg *icmp.Message) ICMPReply {
+	reply := ICMPReply{Code: msg.Code}
+	switch t := msg.Type.(type) {
+	case ipv4.ICMPType:
+		reply.Type = int(t)
+	case ipv6.ICMPType:
+		reply.Type = int(t)
+	}
+	return reply
+}
+
+// Returns the ICMP type and code names, e.g. "destination unreachable (code 3, port unreachable)"
+func icmpTypeCodeString(msg *icmp.Message) string {
+	name := fmt.Sprint(msg.Type)
+	t, ok := msg.Type.(ipv4.ICMPType)
+	switch {
+	case t == ICMPTypeSourceQuench:
+		name = "source quench"
+	case ok && name == "<nil>":
+		name = fmt.Sprintf("type %d", int(t))
+	}
+
+	var names []string
+	if ok {
+		names = icmpCodeNames[t]
+	} else if t6, ok := msg.Type.(ipv6.ICMPType); ok {
+		names = icmpv6CodeNames[t6]
+	}
+
+	text := fmt.Sprintf("%s (code %d", name, msg.Code)
+	if msg.Code < len(names) {
+		text += ", " + names[msg.Code]
+	}
+	return text + ")"
+}
+
+// Decodes addresses, protocol and ports of a quoted IPv4 or IPv6 datagram
+func describeQuoted(data []byte) string {
+	var text string
+	var proto int
+	var payload []byte
+
+	if len(data) > 0 && data[0]>>4 == 6 {
+		header, err := ipv6.ParseHeader(data)
+		var ok bool
+		if err == nil {
+			proto, payload, ok = ipv6Payload(data)
+		}
+		if !ok {
+			return fmt.Sprintf("%d undecodable bytes", len(data))
+		}
+		text = fmt.Sprintf("%v -> %v", header.Src, header.Dst)
+	} else {
+		header, err := ipv4.ParseHeader(data)
+		if err != nil || len(data) < header.Len {
+			return fmt.Sprintf("%d undecodable bytes", len(data))
+		}
+		text = fmt.Sprintf("%v -> %v", header.Src, header.Dst)
+		proto = header.Protocol
+		payload = data[header.Len:]
+	}
+
+	switch proto {
+	case ProtocolIPv4ICMP, ProtocolIPv6ICMP:
+		text += " icmp"
+		if len(payload) >= 8 {
+			text += fmt.Sprintf(" type %d code %d id %d seq %d", payload[0], payload[1],
+				binary.BigEndian.Uint16(payload[4:6]), binary.BigEndian.Uint16(payload[6:8]))
+		}
+	case 6, 17:
+		text += map[int]string{6: " tcp", 17: " udp"}[proto]
+		if len(payload) >= 4 {
+			text += fmt.Sprintf(" port %d -> %d", binary.BigEndian.Uint16(payload[0:2]), binary.BigEndian.Uint16(payload[2:4]))
+		}
+	default:
+		text += fmt.Sprintf(" proto %d", proto)
+	}
+	return text
+}
+
+// headerField is a field of the IPv4 or IPv6 header by its first byte, for Parameter Problem pointers
+type headerField struct {
+	Offset int
+	Name   string
+}
+
+var (
+	ipv4FieldsArray = []headerField{{0, "version/header length"}, {1, "type of service"}, {2, "total length"}, {4, "identification"}, {6, "flags/fragment offset"}, {8, "TTL"}, {9, "protocol"}, {10, "header checksum"}, {12, "source address"}, {16, "destination address"}}
+	ipv6FieldsArray = []headerField{{0, "version/traffic class"}, {1, "traffic class/flow label"}, {4, "payload length"}, {6, "next header"}, {7, "hop limit"}, {8, "source address"}, {24, "destination address"}}
+)
+
+var ipv4OptionNames = map[byte]string{ipOptionEnd: "end of options", ipOptionNOP: "no-operation", 7: "Record Route", ipOptionTimestamp: "Timestamp", 130: "Security", 131: "Loose Source Route", 137: "Strict Source Route", 148: "Router Alert"}
+
+// Describes the header field a Parameter Problem points at in the quoted probe, e.g.
+// "pointer 20: Timestamp option (type 68)", or "" for other messages and pointer-less codes.
+// Routers send these mostly for IP options they reject, such as those of -timestamp-option.
+func parameterProblemField(msg *icmp.Message) string {
+	body, ok := msg.Body.(*icmp.ParamProb)
+	if !ok {
+		return ""
+	}
+	pointer := int(body.Pointer)
+
+	var name string
+	switch msg.Type {
+	case ipv4.ICMPTypeParameterProblem:
+		// Code 1, a missing option, has no pointer
+		if msg.Code == 1 {
+			return ""
+		}
+		name = ipv4FieldName(body.Data, pointer)
+	case ipv6.ICMPTypeParameterProblem:
+		name = ipv6FieldName(body.Data, pointer)
+	default:
+		return ""
+	}
+	return fmt.Sprintf("pointer %d: %s", pointer, name)
+}
+
+func ipv4FieldName(data []byte, pointer int) string {
+	headerLen := 20
+	if len(data) > 0 {
+		headerLen = int(data[0]&0x0f) << 2
+	}
+	if pointer < 20 {
+		return fieldAt(ipv4FieldsArray, pointer) + " field"
+	}
+	if pointer >= headerLen {
+		return fmt.Sprintf("byte %d of the payload", pointer-headerLen)
+	}
+
+	// Walks the options to the one holding the pointed byte
+	options := ipv4Options(data)
+	for i := 0; i < len(options); {
+		kind := options[i]
+		length := 1
+		if kind != ipOptionEnd && kind != ipOptionNOP {
+			if i+1 >= len(options) || options[i+1] < 2 {
+				break
+			}
+			length = int(options[i+1])
+		}
+		if pointer < 20+i+length {
+			option, ok := ipv4OptionNames[kind]
+			if !ok {
+				option = "unknown"
+			}
+			return fmt.Sprintf("%s option (type %d)", option, kind)
+		}
+		i += length
+	}
+	return fmt.Sprintf("byte %d of the options", pointer-20)
+}
+
+func ipv6FieldName(data []byte, pointer int) string {
+	if pointer < ipv6.HeaderLen {
+		return fieldAt(ipv6FieldsArray, pointer) + " field"
+	}
+	text := fmt.Sprintf("byte %d after the fixed header", pointer-ipv6.HeaderLen)
+	if pointer < len(data) {
+		text += fmt.Sprintf(" (value %d)", data[pointer])
+	}
+	return text
+}
+
+// Returns the name of the field starting at or before offset
+func fieldAt(fieldsArray []headerField, offset int) string {
+	name := fieldsArray[0].Name
+	for _, field := range fieldsArray {
+		if field.Offset <= offset {
+			name = field.Name
+		}
+	}
+	return name
+}
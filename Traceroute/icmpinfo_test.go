@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Returns the probe's quoted IPv4 header with the options added, as a router rejecting them quotes it
+func quoteWithOptions(probe fakeProbe, options ...byte) []byte {
+	quoted := quoteProbe(probe)
+	header := append([]byte(nil), quoted[:ipv4.HeaderLen]...)
+	header[0] = 0x40 | byte((ipv4.HeaderLen+len(options))>>2)
+	header = append(header, options...)
+	return append(header, quoted[ipv4.HeaderLen:]...)
+}
+
+func TestParameterProblemField(t *testing.T) {
+	probe := fakeProbe{Bytes: make([]byte, 16), Dest: ip4("10.9.9.9")}
+	withTimestamp := quoteWithOptions(probe, ipOptionTimestamp, 8, 5, 0, 0, 0, 0, 0)
+	withNOPs := quoteWithOptions(probe, ipOptionNOP, ipOptionNOP, 7, 6, 4, 0, 0, 0)
+	ipv6Quote := append(make([]byte, ipv6.HeaderLen), 58, 0, 1, 2)
+
+	tests := []struct {
+		name string
+		msg  *icmp.Message
+		want string
+	}{
+		{name: "TTL", msg: &icmp.Message{Type: ipv4.ICMPTypeParameterProblem, Body: &icmp.ParamProb{Pointer: 8, Data: quoteProbe(probe)}}, want: "pointer 8: TTL field"},
+		{name: "inside a field", msg: &icmp.Message{Type: ipv4.ICMPTypeParameterProblem, Body: &icmp.ParamProb{Pointer: 13, Data: quoteProbe(probe)}}, want: "pointer 13: source address field"},
+		{name: "timestamp option", msg: &icmp.Message{Type: ipv4.ICMPTypeParameterProblem, Body: &icmp.ParamProb{Pointer: 22, Data: withTimestamp}}, want: "pointer 22: Timestamp option (type 68)"},
+		{name: "option after no-operations", msg: &icmp.Message{Type: ipv4.ICMPTypeParameterProblem, Body: &icmp.ParamProb{Pointer: 23, Data: withNOPs}}, want: "pointer 23: Record Route option (type 7)"},
+		{name: "no-operation", msg: &icmp.Message{Type: ipv4.ICMPTypeParameterProblem, Body: &icmp.ParamProb{Pointer: 21, Data: withNOPs}}, want: "pointer 21: no-operation option (type 1)"},
+		{name: "payload", msg: &icmp.Message{Type: ipv4.ICMPTypeParameterProblem, Body: &icmp.ParamProb{Pointer: 30, Data: quoteProbe(probe)}}, want: "pointer 30: byte 10 of the payload"},
+		{name: "missing option", msg: &icmp.Message{Type: ipv4.ICMPTypeParameterProblem, Code: 1, Body: &icmp.ParamProb{Pointer: 8, Data: quoteProbe(probe)}}, want: ""},
+		{name: "IPv6 hop limit", msg: &icmp.Message{Type: ipv6.ICMPTypeParameterProblem, Body: &icmp.ParamProb{Pointer: 7, Data: ipv6Quote}}, want: "pointer 7: hop limit field"},
+		{name: "IPv6 extension header", msg: &icmp.Message{Type: ipv6.ICMPTypeParameterProblem, Code: 1, Body: &icmp.ParamProb{Pointer: 40, Data: ipv6Quote}}, want: "pointer 40: byte 0 after the fixed header (value 58)"},
+		{name: "IPv6 past the quote", msg: &icmp.Message{Type: ipv6.ICMPTypeParameterProblem, Body: &icmp.ParamProb{Pointer: 60, Data: ipv6Quote}}, want: "pointer 60: byte 20 after the fixed header"},
+		{name: "other message", msg: &icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Body: &icmp.TimeExceeded{Data: quoteProbe(probe)}}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parameterProblemField(tt.msg); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParameterProblemOnTrace(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []byte
+		pointer int
+		want    string
+	}{
+		{name: "rejected option", options: []byte{ipOptionTimestamp, 4, 5, 0}, pointer: 22, want: "pointer 22: Timestamp option (type 68)"},
+		{name: "rejected header field", pointer: 8, want: "pointer 8: TTL field"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			conn := newFakeConn(func(probe fakeProbe) []fakeReply {
+				msg := icmp.Message{Type: ipv4.ICMPTypeParameterProblem, Body: &icmp.ParamProb{Pointer: uintptr(tt.pointer), Data: quoteWithOptions(probe, tt.options...)}}
+				return []fakeReply{{Bytes: marshalICMP(msg), Peer: ip4("10.0.0.254")}}
+			})
+			hop := ping(newTracer(conn, ip4("10.9.9.9"), false), 1)
+
+			var icmpErr *unexpectedICMPError
+			if !errors.As(hop.Err, &icmpErr) {
+				t.Fatalf("got error %v, want an unexpected ICMP message", hop.Err)
+			}
+			if text := hop.Err.Error(); !strings.Contains(text, "from 10.0.0.254, "+tt.want) {
+				t.Errorf("error %q does not name %q", text, tt.want)
+			}
+			if hop.Reached {
+				t.Error("a Parameter Problem reached the destination")
+			}
+		})
+	}
+}
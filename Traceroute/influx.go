@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Escaping rules of the InfluxDB line protocol
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+// influxReporter writes one line protocol point per hop, timestamped when the hop completed
+type influxReporter struct {
+	measurement string
+	target      string
+	traceID     string
+}
+
+func (r *influxReporter) Start(target string, maxTTL int, traceID string) {
+	r.target = target
+	r.traceID = traceID
+}
+
+func (r *influxReporter) Hop(hop HopResult) {
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(r.measurement))
+	fmt.Fprintf(&b, ",target=%s,trace_id=%s,ttl=%d", tagEscaper.Replace(r.target), tagEscaper.Replace(r.traceID), hop.TTL)
+	// Tags cannot be empty, so a silent hop has no peer tag
+	if len(hop.Peers) > 0 {
+		fmt.Fprintf(&b, ",peer=%s", tagEscaper.Replace(hop.Peers[0].String()))
+	}
+
+	fmt.Fprintf(&b, " loss=%g", lossPercent(hop.Sent, len(hop.RTTs)))
+	if len(hop.RTTs) > 0 {
+		_, avg, _ := rttStats(hop.RTTs)
+		fmt.Fprintf(&b, ",rtt_ms=%g", float64(avg)/float64(time.Millisecond))
+	}
+	fmt.Fprintf(&b, " %d\n", hop.Time.UnixNano())
+
+	if err := stdoutRecords.writeRecord([]byte(b.String())); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+}
+
+func (r *influxReporter) Note(text string) {
+	fmt.Fprintf(os.Stderr, "%s\n", text)
+}
+
+func (r *influxReporter) End(result *TraceResult) {}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Prints every interface with its state and addresses so a value for -i can be picked
+func printInterfaces() error {
+	interfacesArray, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+
+	for _, iface := range interfacesArray {
+		var flagsArray []string
+		if iface.Flags&net.FlagUp != 0 {
+			flagsArray = append(flagsArray, "up")
+		} else {
+			flagsArray = append(flagsArray, "down")
+		}
+		if iface.Flags&net.FlagLoopback != 0 {
+			flagsArray = append(flagsArray, "loopback")
+		}
+
+		fmt.Printf("%-16s [%s]\n", iface.Name, strings.Join(flagsArray, ","))
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			family := "IPv6"
+			if ipNet.IP.To4() != nil {
+				family = "IPv4"
+			}
+			fmt.Printf("%16s %s %s\n", "", family, ipNet.String())
+		}
+	}
+	return nil
+}
+
+// Looks up the named interface and its addresses; replaced by tests
+var lookupInterface = func(name string) (*net.Interface, []net.Addr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	return iface, addrs, nil
+}
+
+// Reports whether the interface is a tunnel, such as GRE or WireGuard: point-to-point,
+// or without a link layer address while not the loopback
+func isTunnel(iface *net.Interface) bool {
+	if iface.Flags&net.FlagPointToPoint != 0 {
+		return true
+	}
+	return len(iface.HardwareAddr) == 0 && iface.Flags&net.FlagLoopback == 0
+}
+
+// Reports whether the named interface is an existing tunnel
+func tunnelInterface(name string) bool {
+	iface, _, err := lookupInterface(name)
+	return err == nil && isTunnel(iface)
+}
+
+// Returns the first IPv4 (or global IPv6) address of the named interface
+func interfaceAddr(name string, useIPv6 bool) (net.IP, error) {
+	iface, addrs, err := lookupInterface(name)
+	if err != nil {
+		return nil, err
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("interface %s is down", name)
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if !useIPv6 && ipNet.IP.To4() != nil {
+			return ipNet.IP.To4(), nil
+		}
+		if useIPv6 && ipNet.IP.To4() == nil && !ipNet.IP.IsLinkLocalUnicast() {
+			return ipNet.IP, nil
+		}
+	}
+	// Probes leave a tunnel only from an address of its own, the underlay one would not be routed through it
+	kind := "interface"
+	if isTunnel(iface) {
+		kind = "tunnel interface"
+	}
+	if useIPv6 {
+		return nil, fmt.Errorf("%s %s has no global IPv6 address to probe from", kind, name)
+	}
+	return nil, fmt.Errorf("%s %s has no IPv4 address to probe from", kind, name)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// fakeInterface is an interface of the fake host, with its addresses
+type fakeInterface struct {
+	iface *net.Interface
+	addrs []net.Addr
+}
+
+func ipNet(cidr string) *net.IPNet {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	network.IP = ip
+	return network
+}
+
+var fakeInterfaces = map[string]fakeInterface{
+	"wg0": {&net.Interface{Name: "wg0", Flags: net.FlagUp | net.FlagPointToPoint},
+		[]net.Addr{ipNet("fe80::1/64"), ipNet("10.66.0.2/32"), ipNet("fd00:66::2/64")}},
+	"gre1": {&net.Interface{Name: "gre1", Flags: net.FlagUp | net.FlagPointToPoint, HardwareAddr: net.HardwareAddr{10, 0, 0, 1}},
+		[]net.Addr{ipNet("fe80::2/64")}},
+	"tun0": {&net.Interface{Name: "tun0", Flags: net.FlagUp}, []net.Addr{ipNet("10.8.0.6/24")}},
+	"wg1":  {&net.Interface{Name: "wg1", Flags: net.FlagPointToPoint}, []net.Addr{ipNet("10.67.0.2/32")}},
+	"eth0": {&net.Interface{Name: "eth0", Flags: net.FlagUp | net.FlagBroadcast, HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}},
+		[]net.Addr{ipNet("192.0.2.1/24")}},
+	"lo": {&net.Interface{Name: "lo", Flags: net.FlagUp | net.FlagLoopback}, []net.Addr{ipNet("127.0.0.1/8")}},
+}
+
+// Makes the interfaces of the host those of fakeInterfaces
+func useFakeInterfaces(t *testing.T) {
+	saved := lookupInterface
+	t.Cleanup(func() { lookupInterface = saved })
+	lookupInterface = func(name string) (*net.Interface, []net.Addr, error) {
+		fake, ok := fakeInterfaces[name]
+		if !ok {
+			return nil, nil, errors.New("route ip+net: no such network interface")
+		}
+		return fake.iface, fake.addrs, nil
+	}
+}
+
+func TestTunnelInterface(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "wg0", want: true},
+		{name: "gre1", want: true},
+		{name: "tun0", want: true},
+		{name: "wg1", want: true},
+		{name: "eth0", want: false},
+		{name: "lo", want: false},
+		{name: "missing0", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeInterfaces(t)
+			if got := tunnelInterface(tt.name); got != tt.want {
+				t.Errorf("tunnelInterface(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInterfaceAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		iface   string
+		useIPv6 bool
+		want    string
+		wantErr string
+	}{
+		{name: "tunnel address", iface: "wg0", want: "10.66.0.2"},
+		{name: "tunnel global IPv6 address", iface: "wg0", useIPv6: true, want: "fd00:66::2"},
+		{name: "tunnel without IPv4", iface: "gre1", wantErr: "tunnel interface gre1 has no IPv4 address to probe from"},
+		{name: "tunnel with only link-local IPv6", iface: "gre1", useIPv6: true, wantErr: "tunnel interface gre1 has no global IPv6 address to probe from"},
+		{name: "tunnel down", iface: "wg1", wantErr: "interface wg1 is down"},
+		{name: "ethernet", iface: "eth0", want: "192.0.2.1"},
+		{name: "ethernet without IPv6", iface: "eth0", useIPv6: true, wantErr: "interface eth0 has no global IPv6 address to probe from"},
+		{name: "missing interface", iface: "missing0", wantErr: "route ip+net: no such network interface"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeInterfaces(t)
+			ip, err := interfaceAddr(tt.iface, tt.useIPv6)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got %v, %v, want error %q", ip, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || ip.String() != tt.want {
+				t.Errorf("got %v, %v, want %s", ip, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenConfigBindsTunnels(t *testing.T) {
+	tests := []struct {
+		name        string
+		iface       string
+		mark        int
+		wantControl bool
+	}{
+		{name: "no interface", wantControl: false},
+		{name: "ethernet", iface: "eth0", wantControl: false},
+		{name: "tunnel", iface: "wg0", wantControl: true},
+		{name: "fwmark", mark: 7, wantControl: true},
+		{name: "tunnel and fwmark", iface: "wg0", mark: 7, wantControl: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeInterfaces(t)
+			setFlag(t, sourceIface, tt.iface)
+			setFlag(t, socketMark, tt.mark)
+			if got := listenConfig().Control != nil; got != tt.wantControl {
+				t.Errorf("socket control set: %v, want %v", got, tt.wantControl)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+)
+
+// Sets IPv4 header options on every probe sent
+func (c *icmpConn) setIPOptions(options []byte) error {
+	rawConn, err := c.PacketConn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptString(int(fd), syscall.IPPROTO_IP, syscall.IP_OPTIONS, string(options))
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func (c *icmpConn) setIPOptions(options []byte) error {
+	return errors.New("setting IP options is only supported on Linux")
+}
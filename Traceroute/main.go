@@ -2,31 +2,207 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv4"
 )
 
 const (
-	AttemptsCount = 3
-	MaxTTL = 64
-	MaxWaitSec = 4
-	MsgLength = 56
+	AttemptsCount   = 3
+	MaxTTL          = 64
+	MaxWaitSec      = 1
+	MsgLength       = 56
+	MaxFinalSamples = 100
 
 	// From https://godoc.org/golang.org/x/net/internal/iana
 	ProtocolIPv4ICMP = 1
+	ProtocolIPv6ICMP = 58
+	ProtocolUDP      = 17
 )
 
-func buildEchoRequest(t icmp.Type, size int) ([]byte, error) {
+var (
+	finalSamples   = flag.Int("final-samples", 0, "extra RTT samples to the destination after it is reached (0 disables)")
+	useIPv4        = flag.Bool("4", false, "trace over IPv4, the default")
+	useIPv6        = flag.Bool("6", false, "trace over IPv6")
+	bpfFilter      = flag.Bool("bpf-filter", false, "drop unrelated ICMP packets in the kernel with a BPF socket filter")
+	sourceIface    = flag.String("i", "", "source interface to send probes from")
+	socketMark     = flag.Int("mark", 0, "set this fwmark (SO_MARK) on the probe sockets for policy routing with ip rule; Linux, needs CAP_NET_ADMIN (0 leaves it unset)")
+	socketFD       = flag.Int("socket-fd", -1, "probe through this already open raw ICMP socket descriptor instead of opening one; TRACEROUTE_SOCKET_FD sets it too")
+	socketMode     = flag.String("socket-mode", "auto", "ICMP socket to probe with: raw (needs root or CAP_NET_RAW), dgram (unprivileged ping socket, Linux) or auto, dgram when allowed and raw otherwise")
+	outputTemplate = flag.String("template", "", "render hops through a text/template: a built-in name (default, mtr), @file or the template text")
+	saveFile       = flag.String("save", "", "write the trace as JSON to the file")
+	dotFile        = flag.String("dot", "", "write the paths of all targets as one Graphviz DOT graph to the file, a node per hop address and edges labeled with the average RTT")
+	outputDir      = flag.String("output-dir", "", "write the trace of every target as JSON to its own file, named after the target, in this directory (created if missing)")
+	replayFile     = flag.String("replay", "", "render the traces saved with -save or -binary instead of tracing, through the chosen output format")
+	replayRate     = flag.Float64("replay-rate", 0, "with -replay, keep the original pacing of the hops sped up by this factor, e.g. 1 for real time or 2 for twice as fast (0 shows them at once)")
+	expectFile     = flag.String("expect", "", "compare the trace against a saved one and exit with 1 if the route changed")
+	dnsRetries     = flag.Int("dns-retries", 0, "retry resolving a target this many times, waiting twice as long each time from 250ms, when the lookup failed transiently (timeout, SERVFAIL); names that do not exist fail at once")
+	batchWorkers   = flag.Int("batch-concurrency", 1, "trace up to this many targets at once, each on its own socket, still showing them in the order given")
+	failFast       = flag.Bool("fail-fast", false, "stop at the first target that cannot be resolved instead of tracing the rest")
+	expectUntilHop = flag.Int("expect-until-hop", 0, "with -expect, only compare hops up to this TTL (0 compares all)")
+	jsonOutput     = flag.Bool("json", false, "print each trace as a JSON document when it ends")
+	prettyJSON     = flag.Bool("json-pretty", true, "indent the JSON documents of -json, -save and -output-dir for reading; -json-pretty=false writes each on a single line (-jsonl lines are always compact)")
+	binaryOutput   = flag.Bool("binary", false, "write each trace to stdout in a compact versioned binary format when it ends, several times smaller than -json; read it back with -replay or -expect")
+	jsonlOutput    = flag.Bool("jsonl", false, "stream one JSON object per hop as it completes (NDJSON)")
+	influxOutput   = flag.Bool("influx", false, "print one InfluxDB line protocol point per hop")
+	influxName     = flag.String("influx-measurement", "traceroute", "with -influx, the measurement name of the points")
+	rttBars        = flag.Bool("rtt-bars", false, "after the trace, draw a bar per hop scaled to the slowest hop's RTT (terminals only)")
+	graphiteOutput = flag.Bool("graphite", false, "print Graphite plaintext lines with the loss and RTT of every hop")
+	graphitePrefix = flag.String("graphite-prefix", "traceroute", "with -graphite, the path the metrics are put under")
+	traceIDFlag    = flag.String("trace-id", "", "tag every output record and the header with this ID (default a new random UUID per trace)")
+	rttPrecision   = flag.Int("precision", -1, "show every RTT and duration of the text, template, -compact, -dot and -tui output as milliseconds with this many decimals; -1 keeps three significant digits (JSON and metrics keep full precision)")
+	maxHopPeers    = flag.Int("max-hop-peers", 32, "with -tui and -verify-path-stability, keep at most this many distinct responders per hop and count replies from further ones as untracked (0 keeps all)")
+	maxTotalPeers  = flag.Int("max-total-peers", 1024, "with -tui and -verify-path-stability, keep at most this many distinct responders over all hops (0 keeps all)")
+	markRepeats    = flag.Bool("mark-repeated-hops", false, "print \"(same as above)\" instead of the responders of a hop answered by exactly the addresses of the hop before it")
+	responderTally = flag.Bool("responder-counts", false, "show how many probes of a hop each of several responders answered, e.g. 10.0.0.1 (2/3), which reveals load-balancer splits; counted in the JSON output and over the runs of -verify-path-stability too")
+	noHeader       = flag.Bool("no-header", false, "do not print the \"Tracing route to\" line before each trace")
+	markdownOutput = flag.Bool("markdown", false, "print each trace as a GitHub-flavored Markdown table (Hop | Address | Host | RTT | Loss) when it ends, for pasting into tickets and wikis")
+	compactOutput  = flag.Bool("compact", false, "print a single key=value line per trace when it ends")
+	compactMaxPath = flag.Int("compact-max-path", 0, "with -compact, list at most this many hops in path= (0 lists all)")
+	templateTrace  = flag.Bool("template-trace", false, "with -template, render the whole TraceResult once instead of every hop")
+	listInterfaces = flag.Bool("list-interfaces", false, "print usable source interfaces and exit")
+	schemaOutput   = flag.Bool("print-schema", false, "print the JSON Schema of the -json and -jsonl output and exit")
+	selfTestOnly   = flag.Bool("self-test", false, "check whether raw and datagram ICMP sockets can probe, with an echo request to the loopback address, and exit 0 when raw ones work, 6 when only datagram ones do and 7 when neither does")
+	probeOrder     = flag.String("probe-ttl-order", "ascending", "order the TTLs are probed in: ascending, descending or random")
+	randomSeed     = flag.Int64("seed", 0, "seed of the randomized probing decisions, such as -probe-ttl-order random, for repeatable runs; 0 seeds from the clock")
+	parallelTTLs   = flag.Int("parallel", 1, "probe this many TTLs at once, each with its own socket")
+	bisect         = flag.Bool("bisect", false, "find the hop count to the destination by doubling the TTL instead of walking every hop")
+	bisectFill     = flag.Bool("bisect-fill", false, "with -bisect, probe the intermediate hops once the distance is known")
+
+	destinationFirst = flag.Bool("probe-destination-first", false, "probe the destination once at full TTL first and, when it answers, stop at the hop count its reply TTL suggests")
+
+	probeInterval = flag.Duration("interval", 0, "wait between the probes of a hop (0 sends them back to back)")
+	spaceAdapt    = flag.Bool("probe-spacing-adaptive", false, "when a hop answers some probes but loses at least -spacing-loss of them, probe it again with the -interval doubled until every probe is answered, up to -max-probe-spacing, and keep that spacing for the rest of the trace (hop by hop traces only)")
+	spaceMax      = flag.Duration("max-probe-spacing", time.Second, "with -probe-spacing-adaptive, the widest spacing the probes are backed off to")
+	spaceLoss     = flag.Float64("spacing-loss", 0.3, "with -probe-spacing-adaptive, the share of a hop's probes, 0 to 1, that must be lost for it to look rate-limited")
+	preciseTiming = flag.Bool("precise-timing", false, "busy-wait the end of -interval and pin the thread for steadier LAN timing (costs CPU)")
+	timeoutBase   = flag.Duration("timeout", MaxWaitSec*time.Second, "time to wait for the reply to each probe, so a silent hop takes -probes times as long")
+	timeoutPerHop = flag.Duration("timeout-per-hop", 0, "extra wait added per TTL, so distant hops get more patience")
+	timeoutMax    = flag.Duration("timeout-max", 0, "upper bound for the scaled timeout (0 means no bound)")
+	arpRetry      = flag.Bool("arp-retry", false, "send a timed out first probe once more while no hop has answered yet (ARP resolution)")
+	probeSizes    = flag.String("probe-sizes", "", "comma separated payload sizes the probes of a hop cycle through, e.g. 56,512,1400, with the RTTs shown per size")
+	defaultMaxTTL = flag.Int("max-ttl", MaxTTL, "highest TTL probed, unless a -targets line sets maxttl=N for its destination")
+	hopProbes     = flag.Int("probes", AttemptsCount, "probes sent to every hop, 1 to 10")
+	egressRate    = flag.String("rate", "", "send the probes of all traces together at no more than this rate: packets per second, e.g. 20 or 20pps, or bytes per second, e.g. 64kB/s (empty sends them unlimited)")
+	confirmProbes = flag.Int("min-ttl-confirm", 0, "when every probe of a hop times out, send this many more before reporting it silent")
+	adaptive      = flag.Bool("adaptive-probes", false, "send fewer probes to hops answering every probe with steady RTTs and more to hops losing probes or varying, within -min-probes and -max-probes")
+	minProbes     = flag.Int("min-probes", 1, "with -adaptive-probes, the fewest probes sent to a hop; a hop answering none of them is reported silent")
+	maxProbes     = flag.Int("max-probes", 2*AttemptsCount, "with -adaptive-probes, the most probes sent to a lossy or varying hop")
+
+	resolveTimeout = flag.Duration("resolve-timeout", 2*time.Second, "give up reverse resolving a hop after this long")
+	enrichTimeout  = flag.Duration("enrich-timeout", 0, "once the probing ends, give the name and origin lookups of a trace this long in total and show the hops left unresolved by address (0 waits for every lookup)")
+	hopDNSServers  = flag.String("hop-dns-servers", "", "comma separated DNS servers (ip or ip:port) for hop names and origin lookups instead of the system resolver")
+	fcrdns         = flag.Bool("fcrdns", false, "tag hop names that do not resolve back to the hop's address as (unconfirmed)")
+	showNameHints  = flag.Bool("name-hints", false, "note the location and role router names suggest, e.g. par01 for Paris or edge2 for an edge router, next to their hops in the text output")
+	resolveAfter   = flag.Bool("resolve-after", false, "resolve hop names concurrently while tracing and print the hops when the trace ends")
+	skipLossyPTR   = flag.Bool("no-reverse-partial-hops", false, "do not resolve the names of hops that left some probes unanswered, to spare lookups on lossy paths")
+	hostnameWidth  = flag.Int("hop-hostname-width", 0, "cut hop names to this many characters, ending in an ellipsis, and pad the peers so the text columns line up (0 keeps full names)")
+
+	gatewayOnly   = flag.Bool("gateway-only", false, "only probe TTL 1 and the full TTL and report the gateway and destination RTTs")
+	stabilityRuns = flag.Int("verify-path-stability", 0, "trace this many times back to back and print how often each hop was answered by the same address (0 disables)")
+	stableRuns    = flag.Int("exit-after-destination-rtt-stable", 0, "trace repeatedly until this many consecutive runs reach the destination over the same path with its RTT within -stable-rtt-tolerance, then exit 0, or exit 8 after -stable-max-runs (0 disables)")
+	stableJitter  = flag.Duration("stable-rtt-tolerance", 5*time.Millisecond, "with -exit-after-destination-rtt-stable, how far the destination RTT may move from the first run of the stable streak")
+	stableMaxRuns = flag.Int("stable-max-runs", 30, "with -exit-after-destination-rtt-stable, give up after this many runs")
+	stableEvery   = flag.Duration("stable-interval", time.Second, "with -exit-after-destination-rtt-stable, wait this long between runs")
+	compareUDP    = flag.Bool("compare-udp", false, "trace with ICMP and then with UDP and print both paths side by side, marking the hops that differ")
+	udpRotate     = flag.Bool("udp-rotate-source", false, "with -compare-udp, keep the destination port and send the probes of a hop from different source ports, each one flow across all TTLs, to map load-balanced paths")
+	udpSourcePort = flag.Int("sport", 0, "with -compare-udp, send the UDP probes from this source port, and with -udp-rotate-source the flows from it and the ports after it (0 lets the system pick)")
+	watchInterval = flag.Duration("watch", 0, "only probe the destination, once per this interval, and print its RTT until Ctrl-C")
+
+	sweepMode    = flag.Bool("sweep", false, "treat targets as CIDR prefixes and print the hop count of every address")
+	sweepWorkers = flag.Int("sweep-workers", 8, "with -sweep, how many addresses are probed at once")
+	sweepLarge   = flag.Bool("sweep-large", false, "with -sweep, allow prefixes of up to 65536 addresses instead of 256")
+
+	otlpEndpoint = flag.String("otlp-endpoint", "", "export every trace as OpenTelemetry spans to this OTLP/HTTP URL, e.g. http://localhost:4318/v1/traces")
+
+	resolveOnce       = flag.Bool("resolve-once", false, "resolve every target only for its first trace and reuse the address for repeated traces (-tui resolving again still looks it up)")
+	reresolveInterval = flag.Duration("reresolve", 0, "with -tui, resolve the target again this often and restart when its address changed (0 never; SIGHUP forces it)")
+
+	tuiMode = flag.Bool("tui", false, "keep tracing and show the live path full-screen, like mtr (needs a terminal)")
+
+	probeTOS   = flag.Int("tos", 0, "TOS byte of the probes (traffic class on IPv6); DSCP is its upper 6 bits")
+	verifyDSCP = flag.Bool("verify-dscp", false, "report whether the destination's replies came back with the DSCP of -tos")
+
+	timestampOpt = flag.Bool("timestamp-option", false, "ask routers to record their address and clock in the IPv4 Timestamp option and print what they recorded (Linux; many routers ignore it)")
+
+	echoCode     = flag.Int("echo-code", 0, "ICMP code of the echo requests (0-255, 0 is the standard)")
+	stampPayload = flag.Bool("payload-timestamp", false, "carry the send time in the echo payload and time echo replies from the copy they return, falling back to the locally kept send time when it comes back altered")
+	terminalFlag = flag.String("terminal-codes", "", "comma separated ICMP type/code pairs of the traced family, or bare types for any code, that count as reaching the destination besides echo replies, e.g. 3/3,3/13 (default port unreachable)")
+
+	strictMatch   = flag.Bool("strict-reply-match", false, "only accept replies to the very probe waited for, with its payload intact, and count everything else as foreign")
+	rejectMangled = flag.Bool("reject-mangled", false, "ignore echo replies whose payload differs from the probe's instead of only counting them")
+
+	verbose    = flag.Bool("v", false, "print diagnostic details such as duplicated or reordered replies")
+	jsonRaw    = flag.Bool("json-raw", false, "add the ICMP type and code number of every answer to the hops of the JSON output (-json, -jsonl, -save)")
+	wallClock  = flag.Bool("wall-clock", false, "record when every answered probe was sent and received by the wall clock, for matching packet captures (JSON, or text with -v)")
+	printBytes = flag.Bool("print-sent-bytes", false, "dump every ICMP message sent and received, in hex, to stderr")
+
+	bestMethod = flag.String("best", "min", "latency shown as a hop's best: min, or trimmed (mean without the lowest and highest sample)")
+
+	allowUnreached   = flag.Bool("allow-unreached", false, "exit with status 0 even when the destination was not reached (otherwise 3)")
+	requireDestMatch = flag.Bool("require-destination-match", false, "only count the destination as reached when every reply of the hop came from its exact resolved address")
+
+	blackHoleSize = flag.Int("blackhole-size", 0, "also probe every hop with DF packets of this many bytes to find MTU black holes (Linux)")
+
+	sizeSweep           = flag.Bool("size-sweep", false, "binary-search the largest DF probe every answering hop still answers (Linux)")
+	sizeSweepHop        = flag.Int("size-sweep-hop", 0, "with -size-sweep, only search at this TTL (0 searches every hop)")
+	sizeSweepMax        = flag.Int("size-sweep-max", 9000, "with -size-sweep, the largest packet size tried in bytes")
+	sizeSweepIterations = flag.Int("size-sweep-iterations", 12, "with -size-sweep, the most probe sizes tried per hop")
+
+	abortOnFirewall = flag.Bool("abort-on-firewall", false, "stop the trace when a hop answers administratively prohibited")
+
+	targetsFile = flag.String("targets", "", "file with one destination per line, optionally followed by maxttl=N and method=icmp")
+
+	geoLookup     = flag.Bool("geo", false, "annotate public hops with origin AS and registry country (Team Cymru DNS)")
+	markCountries = flag.Bool("country-markers", false, "print where the path enters another country; implies -geo")
+	enricherNames = flag.String("enrichers", "", "comma separated lookups annotating the first responder of every hop after the trace: ptr, asn, geoip or ones registered by embedding code")
+	showASPath    = flag.Bool("as-path", false, "print the autonomous systems the path crosses and how many; implies -geo")
+
+	rateLimitGuard     = flag.Bool("min-rtt-guard", false, "flag hops whose latency looks inflated by ICMP rate limiting")
+	rateLimitMargin    = flag.Duration("rate-limit-margin", 5*time.Millisecond, "with -min-rtt-guard, how much slower than a later hop a hop must be")
+	rateLimitVariation = flag.Float64("rate-limit-variation", 0.5, "with -min-rtt-guard, stddev/mean ratio above which a hop counts as erratic")
+	latencyThreshold   = flag.Duration("latency-alert", 0, "exit with status 4 when a hop's best RTT is above this, naming the first such hop (0 disables)")
+	latencyUntilHop    = flag.Int("latency-alert-until-hop", 0, "with -latency-alert, only check hops up to this TTL (0 checks all)")
+	overallLoss        = flag.Float64("fail-on-loss", -1, "exit with status 5 when more than this percentage of all probes was lost (negative disables)")
+	hopLoss            = flag.Float64("fail-on-hop-loss", -1, "exit with status 5 when an answering intermediate hop lost more than this percentage of its probes (negative disables)")
+	destinationLoss    = flag.Float64("fail-on-destination-loss", -1, "exit with status 5 when the destination lost more than this percentage of its probes, all of them when unreached (negative disables)")
+	classifyBottleneck = flag.Bool("classify-bottleneck", false, "after the trace, print the largest latency increase between responding hops")
+	natBoundary        = flag.Bool("nat-boundary", false, "after the trace, print where the path goes from private (RFC 1918, CGNAT) to public addresses, the likely NAT/egress point")
+	aggregateHops      = flag.Bool("aggregate-networks", false, "after the trace, print the networks the path crosses, merging consecutive hops of one -aggregate-prefix network, with the TTLs each covers")
+	aggregatePrefix4   = flag.Int("aggregate-prefix", 24, "with -aggregate-networks, the prefix length IPv4 hops are grouped by")
+	aggregatePrefix6   = flag.Int("aggregate-prefix6", 48, "with -aggregate-networks, the prefix length IPv6 hops are grouped by")
+	countDistinct      = flag.Bool("count-distinct-hops", false, "after the trace, print how many distinct addresses answered against the hops probed")
+	classifyRoles      = flag.Bool("hop-roles", false, "after the trace, note whether each responding hop is likely a router, firewall, load balancer or the endpoint, from administratively prohibited replies, echo replies for the destination, addresses repeating without a growing RTT and several responders per TTL; with -compare-udp too")
+	measureSkew        = flag.Bool("measure-clock-skew", false, "once the destination is reached, send it an ICMP Timestamp request and print how far its clock is off the local one (IPv4, millisecond resolution)")
+	reverseHops        = flag.Bool("reverse-hops", false, "once the destination is reached, estimate the hops of the return path from the TTL of its echo reply and compare them to the forward hops")
+	checkPorts         = flag.String("ports", "", "after the trace, connect to these TCP ports of the destination at full TTL, e.g. 22,80,443 or 8000-8010, and report which answer with a SYN-ACK or RST and which are filtered (at most 64)")
+	portWorkers        = flag.Int("ports-workers", 4, "with -ports, how many ports are connected to at once")
+)
+
+// Builds an echo request with a payload of size bytes, starting with the probe's cookie
+// and, when sent is set and there is room for it, the send time
+func buildEchoRequest(t icmp.Type, code int, id int, size int, seq int, sent time.Time) ([]byte, error) {
 	var buf bytes.Buffer
 
+	if size >= cookieLength {
+		buf.Write(probeCookie(id, seq))
+	}
+	if !sent.IsZero() && size >= cookieLength+stampLength {
+		buf.Write(probeStamp(sent))
+	}
+
 	dataChunk := []byte("DATA")
 
-	for count := size / len(dataChunk); count > 0; count-- {
+	for count := (size - buf.Len()) / len(dataChunk); count > 0; count-- {
 		buf.Write(dataChunk)
 	}
 
@@ -36,10 +212,10 @@ func buildEchoRequest(t icmp.Type, size int) ([]byte, error) {
 
 	msg := icmp.Message{
 		Type: t,
-		Code: 0,
+		Code: code,
 		Body: &icmp.Echo{
-			ID:   os.Getpid() & 0xffff,
-			Seq:  1,
+			ID:   id,
+			Seq:  seq,
 			Data: buf.Bytes(),
 		},
 	}
@@ -47,84 +223,347 @@ func buildEchoRequest(t icmp.Type, size int) ([]byte, error) {
 	return msg.Marshal(nil)
 }
 
-func socketExchange(destination *net.IPAddr, b []byte, ttl int, attempts int) ([]time.Duration, []net.Addr, *ipv4.ICMPType, error) {
-	var err error
+// exchangeResult holds the replies to the probes of one hop
+type exchangeResult struct {
+	RTTs  []time.Duration
+	Peers []net.Addr
+	Type  icmp.Type
 
-	// Creates listening socket
-	var connection net.PacketConn
-	connection, err = net.ListenPacket("ip4:icmp", "0.0.0.0")
-	if err != nil {
-		return []time.Duration{}, []net.Addr{}, nil, err
-	}
-	defer connection.Close()
+	// The first probe timed out and was sent again, see Tracer.arpRetry
+	Retried bool
 
-	// Configures connection
-	err = connection.SetReadDeadline(time.Now().Add(MaxWaitSec * time.Second))
-	if err != nil {
-		return []time.Duration{0}, []net.Addr{}, nil, err
-	}
+	// An echo reply came from an address other than the destination
+	NonTargetEcho bool
+
+	// Replies to probes already answered, and replies to an earlier probe than the one waited for
+	Duplicates int
+	Reordered  int
+
+	// Echo replies whose payload differs from the one sent
+	Mangled int
+
+	// Replies that filled the whole read buffer and may have been cut short
+	Truncated int
+
+	// Code of the last echo reply, normally the one sent
+	ReplyCode int
+
+	// Redirect and Source Quench messages about our probes, which answer nothing
+	Advisories []string
+
+	// TOS byte of the last echo reply, when the connection can read it
+	ReplyTOS int
+	TOSKnown bool
+
+	// Payload size of every answered probe
+	Sizes []int
+
+	// Wall-clock send and receive times of the answered probes, with -wall-clock
+	Timings []ProbeTiming
+
+	// ICMP type and code of every answer, with -json-raw
+	Replies []ICMPReply
+
+	// Description of the last -terminal-codes message received, which counts as reaching the destination
+	TerminalReply string
+
+	// TTL of the last echo reply when it arrived, when the connection can read it
+	ReplyTTL int
+	TTLKnown bool
+
+	// Timestamp option entries of the last reply, see -timestamp-option
+	Timestamps        []routerTimestamp
+	TimestampOverflow int
+}
+
+// Sends probes through the trace's socket, the i-th with a payload of sizesArray[i % len(sizesArray)] bytes;
+// the socket is owned and closed by the caller. A probe not answered in time counts as lost, and
+// the exchange only fails on a timeout when no probe was answered.
+func socketExchange(tracer *Tracer, sizesArray []int, ttl int, attempts int) (exchangeResult, error) {
+	var err error
+	connection := tracer.conn
 
 	// Sets TTL
-	p := ipv4.NewPacketConn(connection)
-	p.SetTTL(ttl)
+	err = connection.SetTTL(ttl)
+	if err != nil {
+		return exchangeResult{}, err
+	}
 
-	var durationsArray []time.Duration
-	var peersArray []net.Addr
+	var result exchangeResult
+	var unexpected *unexpectedICMPError
+	var lastErr error
 	var peer net.Addr
 	var msg *icmp.Message
 	var reply []byte
 	var replyLength int
-	var t ipv4.ICMPType = ipv4.ICMPTypeTimeExceeded
+	var received time.Time
+
+	defer pinThread(tracer.precise)()
+	var lastSend time.Time
+	firstSend := time.Now()
+
+	answered := make(map[int]bool)
+	// Packets sent by probe number, as replies to earlier probes are checked against their own
+	sent := make(map[int][]byte)
+
+	for i := 0; i < attempts; i++ {
+		if i > 0 && tracer.interval > 0 {
+			waitUntil(lastSend.Add(tracer.interval), tracer.precise)
+		}
+		probe := tracer.sent
+		tracer.sent++
+		tracer.counters.Sent++
+		size := sizesArray[i%len(sizesArray)]
+
+		// An echo request is its payload behind an 8 byte header. Waiting for -rate comes
+		// before the send time is taken, which must not include it.
+		if _, err := egressLimit.wait(tracer.ctx, 8+size); err != nil {
+			return exchangeResult{}, err
+		}
+
+		var stamp time.Time
+		if tracer.stampPayload {
+			stamp = time.Now()
+		}
+		b, err := buildEchoRequest(tracer.echoRequestType(), tracer.echoCode, tracer.id, size, probeSeq(ttl, probe), stamp)
+		if err != nil {
+			return exchangeResult{}, err
+		}
+
+		if *printBytes {
+			dumpPacket("sent to", b, tracer.dest)
+		}
+		sent[probe&0xff] = b
 
-	for i := 0; i<attempts; i++ {
 		start := time.Now()
+		lastSend = start
 
-		n, err := connection.WriteTo(b, destination)
+		n, err := connection.WriteTo(b, tracer.dest)
 		if err != nil {
-			return []time.Duration{0}, []net.Addr{}, nil, err
+			return exchangeResult{}, &sendError{Err: err}
 		} else if n != len(b) {
-			return []time.Duration{0}, []net.Addr{}, nil, fmt.Errorf("got %v; want %v", n, len(b))
+			return exchangeResult{}, fmt.Errorf("got %v; want %v", n, len(b))
+		}
+		// Every probe gets the whole timeout, so neither -rate nor the spacing eat into it
+		if err := connection.SetReadDeadline(start.Add(tracer.timeout(ttl))); err != nil {
+			return exchangeResult{}, err
+		}
+
+		// The socket sees every ICMP packet of the host, so replies to
+		// other traffic and late replies to earlier hops are skipped
+		reply = make([]byte, replyBufferSize(size))
+		for {
+			replyLength, peer, err = connection.ReadFrom(reply)
+			if err != nil {
+				break
+			}
+			received = time.Now()
+			if *printBytes {
+				dumpPacket("received from", reply[:replyLength], peer)
+			}
+
+			// Parses ICMP message
+			msg, err = icmp.ParseMessage(tracer.protocol(), reply[:replyLength])
+			if err != nil {
+				tracer.counters.Foreign++
+				continue
+			}
+			seq, ok := answeredSeq(msg, tracer.id)
+			number := seq & 0xff
+			packet, known := sent[number]
+			if !ok || seq>>8 != ttl&0xff || (*strictMatch && !isAdvisory(msg.Type) && (!known || !exactMatch(msg, packet, tracer.dest))) {
+				tracer.counters.Foreign++
+				continue
+			}
+			if replyTruncated(connection, replyLength, reply) {
+				result.Truncated++
+			}
+			// Advice to the sender, not a sign of the TTL expiring, so the answer is still awaited
+			if isAdvisory(msg.Type) {
+				result.Advisories = append(result.Advisories, fmt.Sprintf("%s from %v", icmpTypeCodeString(msg), peer))
+				continue
+			}
+
+			// A reply echoing other data than the probe it answers carried is corrupted or forged
+			if body, ok := msg.Body.(*icmp.Echo); ok && known && !bytes.Equal(body.Data, packet[8:]) {
+				result.Mangled++
+				if *rejectMangled {
+					continue
+				}
+			}
+			if answered[number] {
+				result.Duplicates++
+				tracer.counters.Duplicates++
+				continue
+			}
+			answered[number] = true
+			if number == probe&0xff {
+				break
+			}
+			// A late reply to a probe given up on, e.g. the one retried for ARP
+			result.Reordered++
 		}
 
-		reply = make([]byte, 1500)
-		replyLength, peer, err = connection.ReadFrom(reply)
 		if err != nil {
-			return []time.Duration{0}, []net.Addr{}, nil, err
+			if isTimeout(err) {
+				tracer.counters.Timeouts++
+			}
+			// The very first probe to a new next-hop can be lost while the
+			// kernel resolves ARP, so it is sent once more before giving up
+			if i == 0 && !result.Retried && tracer.arpRetry && !tracer.answered && isTimeout(err) {
+				result.Retried = true
+				i--
+				continue
+			}
+			if !isTimeout(err) {
+				return exchangeResult{}, readError(err)
+			}
+			// Lost, as udpHop counts it; the replies to the other probes are kept
+			lastErr = readError(err)
+			continue
 		}
 
-		duration := time.Since(start)
+		// Taken right after the read so parsing is not part of the RTT
+		duration := received.Sub(start)
+		// The send time the reply carries back is only trusted when it falls within this exchange
+		if body, ok := msg.Body.(*icmp.Echo); ok && tracer.stampPayload {
+			if sent, ok := payloadStamp(body.Data); ok && !sent.Before(firstSend) && !sent.After(received) {
+				duration = received.Sub(sent)
+			}
+		}
+		if !tracer.answered {
+			tracer.firstReply = received
+		}
+		tracer.answered = true
+		tracer.counters.Replies++
 
-		durationsArray = append(durationsArray,duration)
-		peersArray = append(peersArray,peer)
+		result.RTTs = append(result.RTTs, duration)
+		result.Peers = append(result.Peers, peer)
+		result.Sizes = append(result.Sizes, size)
+		if *wallClock {
+			// Round drops the monotonic reading, which only the RTT above needs
+			result.Timings = append(result.Timings, ProbeTiming{Sent: start.Round(0), Received: received.Round(0)})
+		}
+		if *jsonRaw {
+			result.Replies = append(result.Replies, icmpReply(msg))
+		}
 
-		// Parses ICMP message
-		msg, err = icmp.ParseMessage(ProtocolIPv4ICMP, reply[:replyLength])
-		if err != nil {
-			return []time.Duration{0}, []net.Addr{}, nil, err
+		if isEchoReply(msg.Type) {
+			result.ReplyCode = msg.Code
+			if receiver, ok := connection.(tosReceiver); ok {
+				result.ReplyTOS, result.TOSKnown = receiver.receivedTOS()
+			}
+			if receiver, ok := connection.(ttlReceiver); ok {
+				result.ReplyTTL, result.TTLKnown = receiver.receivedTTL()
+			}
+		}
+		if receiver, ok := connection.(optionsReceiver); ok && *timestampOpt {
+			// An echo reply carries the option back; an ICMP error quotes the probe's header as it was when dropped
+			options := receiver.receivedOptions()
+			if !isEchoReply(msg.Type) {
+				options = ipv4Options(quotedPacket(msg))
+			}
+			result.Timestamps, result.TimestampOverflow = parseTimestamps(options)
 		}
 
-		if msg.Type == ipv4.ICMPTypeEchoReply {
-			t = ipv4.ICMPTypeEchoReply
+		switch {
+		case isEchoReply(msg.Type) && !sameIP(peer, tracer.dest):
+			// Misconfigured or NATing devices answer echoes meant for someone else,
+			// which must not end the trace
+			result.NonTargetEcho = true
+		case isEchoReply(msg.Type):
+			result.Type = msg.Type
+		case isTimeExceeded(msg.Type):
+		case isTerminalReply(tracer.terminalCodes, msg):
+			result.Type = msg.Type
+			result.TerminalReply = icmpTypeCodeString(msg)
+		default:
+			result.Type = msg.Type
+			result.TerminalReply = ""
+			unexpected = &unexpectedICMPError{Message: msg, Peer: peer}
 		}
 	}
 
-	switch t {
-	case ipv4.ICMPTypeEchoReply:
+	if len(result.RTTs) == 0 && lastErr != nil {
+		return exchangeResult{}, lastErr
+	}
+
+	switch {
+	case isEchoReply(result.Type):
 		// Reached destination
-		return durationsArray, peersArray, &t, nil
-	case ipv4.ICMPTypeTimeExceeded:
+		return result, nil
+	case result.Type == nil || isTimeExceeded(result.Type):
 		// TTL Exceeded
-		return durationsArray, peersArray, &t, nil
+		return result, nil
+	case result.TerminalReply != "":
+		// Counts as the destination, see -terminal-codes
+		return result, nil
+	case isParameterProblem(result.Type):
+		// Mostly a router rejecting the IP options of the probe; the error names the field pointed at
+		return exchangeResult{}, unexpected
 	default:
-		// Invalid ICMPType
-		return []time.Duration{0}, []net.Addr{}, nil, fmt.Errorf("got %+v from %v; Invalid ICMPType", msg, peer)
+		// ICMPType we do not process, reported with its decoded contents
+		return exchangeResult{}, unexpected
+	}
+}
+
+// Room in the reply buffer beyond the probe's payload: an IP header with options, and an ICMP
+// error quoting a packet as large as a common MTU along with its RFC 4884 extension objects
+const replyOverhead = 1500
+
+// Returns the size of the buffer replies to a probe with a payload of size bytes are read into;
+// an echo reply reassembled from fragments is as large as the probe was
+func replyBufferSize(size int) int {
+	return size + replyOverhead
+}
+
+// Reports whether the last reply read filled the whole buffer, so the kernel may have cut it short
+func replyTruncated(connection probeConn, length int, buffer []byte) bool {
+	if receiver, ok := connection.(truncationReceiver); ok {
+		return receiver.truncated()
 	}
+	return length == len(buffer)
+}
+
+// Reports whether err is a read deadline expiry
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
 }
 
 func createPeersString(peersArray []net.Addr) string {
+	return formatPeers(peersArray, true)
+}
+
+// Returns the peers of a hop, named unless the hop lost probes and -no-reverse-partial-hops is given;
+// with -responder-counts a hop answered by several addresses gets the share of its probes each answered
+func hopPeersString(hop HopResult) string {
+	if *responderTally && len(uniquePeers(hop.Peers)) > 1 {
+		var partsArray []string
+		for _, responder := range probeTally(hop.Peers) {
+			partsArray = append(partsArray, fmt.Sprintf("%s (%d/%d)", peerLabel(responder.Address, resolvesNames(hop)), responder.Probes, hop.Sent))
+		}
+		return "[" + strings.Join(partsArray, "  ") + "]"
+	}
+	return formatPeers(hop.Peers, resolvesNames(hop))
+}
+
+// Reports whether the names of the hop's peers are looked up; a hop nobody answered has nothing to look up
+func resolvesNames(hop HopResult) bool {
+	if len(hop.Peers) == 0 {
+		return false
+	}
+	return !*skipLossyPTR || len(hop.RTTs) >= hop.Sent
+}
+
+func formatPeers(peersArray []net.Addr, resolve bool) string {
+	if len(peersArray) == 0 {
+		return "[*]"
+	}
+
 	var peersAreIdentical bool = true
-	for i := 0; i<len(peersArray)-1; i++ {
-		if peersArray[i].String() != peersArray[i+1].String(){
+	for i := 0; i < len(peersArray)-1; i++ {
+		if peersArray[i].String() != peersArray[i+1].String() {
 			peersAreIdentical = false
 		}
 	}
@@ -134,72 +573,971 @@ func createPeersString(peersArray []net.Addr) string {
 	}
 
 	var buffStr string = "["
-	for i := 0; i<len(peersArray);i++ {
-		ptr, _ := net.LookupAddr(peersArray[0].String())
-		var ptrStr string = ""
-		if len(ptr)>0{
-			ptrStr = " ("
-			for j := 0; j<len(ptr); j++ {
-				ptrStr = ptrStr + ptr[j][:len(ptr[j])-1] + "  "
-			}
-			ptrStr = ptrStr[:len(ptrStr)-2]
-			ptrStr = ptrStr + ")"
-		}
-		buffStr = buffStr + peersArray[i].String() + ptrStr + "  "
+	for i := 0; i < len(peersArray); i++ {
+		buffStr = buffStr + peerLabel(peersArray[i].String(), resolve) + "  "
 	}
 	buffStr = buffStr[:len(buffStr)-2]
 	buffStr = buffStr + "]"
 	return buffStr
 }
 
-func ping(dest *net.IPAddr, ttl int) bool {
-	msg, _ := buildEchoRequest(ipv4.ICMPTypeEcho,MsgLength)
-	durationsArray, peersArray, t, err := socketExchange(dest, msg, ttl, AttemptsCount)
+// Returns a peer followed by its names in parentheses, when resolve is set and it has any
+func peerLabel(peer string, resolve bool) string {
+	var ptr []string
+	if resolve {
+		ptr = peerNames(peer)
+	}
+	var ptrStr string = ""
+	if len(ptr) > 0 {
+		ptrStr = " ("
+		for j := 0; j < len(ptr); j++ {
+			ptrStr = ptrStr + fitHostname(ptr[j]) + "  "
+		}
+		ptrStr = ptrStr[:len(ptrStr)-2]
+		ptrStr = ptrStr + ")"
+	}
+	return peer + ptrStr
+}
+
+func ping(tracer *Tracer, ttl int) HopResult {
+	var exchange exchangeResult
+	var err error
+	sent := tracer.probes
+	if tracer.maxProbes > 0 {
+		exchange, sent, err = adaptiveExchange(tracer, ttl)
+	} else {
+		exchange, err = socketExchange(tracer, tracer.payloadSizes(), ttl, tracer.probes)
+	}
 
+	// A rate-limiting router drops a burst of probes just like real loss,
+	// so a hop gets the confirmation probes before it is reported silent
+	confirmed := false
+	if isTimeout(err) && tracer.confirmProbes > 0 {
+		exchange, err = socketExchange(tracer, tracer.payloadSizes(), ttl, tracer.confirmProbes)
+		sent += tracer.confirmProbes
+		confirmed = err == nil
+	}
+
+	hop := HopResult{TTL: ttl, Sent: sent, Err: err, Time: time.Now(), Confirmed: confirmed}
+	var unexpected *unexpectedICMPError
+	if *jsonRaw && errors.As(err, &unexpected) {
+		hop.Replies = []ICMPReply{icmpReply(unexpected.Message)}
+	}
 	if err == nil {
-		if t != nil {
-			switch *t {
-			case ipv4.ICMPTypeEchoReply:
-				fmt.Printf("%3d %13s     Reached  %s\n", ttl, durationsArray, createPeersString(peersArray))
-				return true
-			case ipv4.ICMPTypeTimeExceeded:
-				fmt.Printf("%3d %13s   TTLExc at  %s\n", ttl, durationsArray, createPeersString(peersArray))
-				return false
-			default:
-				return false
+		hop.RTTs = exchange.RTTs
+		hop.Peers = exchange.Peers
+		hop.Reached = isEchoReply(exchange.Type) || exchange.TerminalReply != ""
+		hop.TerminalReply = exchange.TerminalReply
+		hop.ARPRetry = exchange.Retried
+		hop.NonTargetEcho = exchange.NonTargetEcho && !hop.Reached
+		hop.Duplicates = exchange.Duplicates
+		hop.Reordered = exchange.Reordered
+		hop.Mangled = exchange.Mangled
+		hop.Truncated = exchange.Truncated
+		hop.ReplyCode = exchange.ReplyCode
+		hop.Advisories = exchange.Advisories
+		hop.ReplyTOS = exchange.ReplyTOS
+		hop.TOSKnown = exchange.TOSKnown
+		hop.Timestamps = exchange.Timestamps
+		hop.Timings = exchange.Timings
+		hop.Replies = exchange.Replies
+		if len(tracer.probeSizes) > 0 {
+			hop.Sizes = exchange.Sizes
+		}
+		hop.TimestampOverflow = exchange.TimestampOverflow
+		if exchange.Retried {
+			hop.Sent++
+		}
+		// Only a hop answered by the destination alone counts as reaching it
+		if *requireDestMatch && hop.Reached {
+			for _, peer := range hop.Peers {
+				if !sameIP(peer, tracer.dest) {
+					hop.Reached = false
+					hop.Err = &destinationMismatchError{Expected: tracer.dest, Actual: peer}
+					break
+				}
 			}
 		}
-	} else {
-		fmt.Printf("%3d ERROR\n", ttl)
-		return false
 	}
-	return false
+	return hop
+}
+
+// destinationMismatchError reports, with -require-destination-match, a hop
+// where the destination answered some probes and another address the rest
+type destinationMismatchError struct {
+	Expected *net.IPAddr
+	Actual   net.Addr
+}
+
+func (e *destinationMismatchError) Error() string {
+	return fmt.Sprintf("destination mismatch: expected %v, got a reply from %v", e.Expected, e.Actual)
+}
+
+// resolveError reports a target whose address could not be resolved
+type resolveError struct {
+	Target string
+	Err    error
+}
+
+func (e *resolveError) Error() string {
+	return fmt.Sprintf("invalid address: %v", e.Err)
+}
+
+func (e *resolveError) Unwrap() error {
+	return e.Err
+}
+
+// Addresses of the targets resolved so far, reused with -resolve-once
+var (
+	resolvedMutex   sync.Mutex
+	resolvedTargets = make(map[string]*net.IPAddr)
+)
+
+// Resolves addr in the address family selected by -6; with -resolve-once only its first trace does
+func resolveTarget(addr string) (*net.IPAddr, error) {
+	if *resolveOnce {
+		resolvedMutex.Lock()
+		destination, ok := resolvedTargets[addr]
+		resolvedMutex.Unlock()
+		if ok {
+			return destination, nil
+		}
+	}
+	return lookupTarget(addr)
 }
 
-func tracert(addr string) {
-	fmt.Printf("Tracing route to %s with MaxTTL = %d\n", addr, MaxTTL)
+// Resolves addr even when an address is known, replacing the one -resolve-once reuses
+func lookupTarget(addr string) (*net.IPAddr, error) {
+	var network string = "ip4"
+	if *useIPv6 {
+		network = "ip6"
+	}
+	destination, err := resolveWithRetries(context.Background(), network, addr, *dnsRetries)
+	if err != nil {
+		return nil, err
+	}
+	resolvedMutex.Lock()
+	resolvedTargets[addr] = destination
+	resolvedMutex.Unlock()
+	return destination, nil
+}
 
-	destination, err := net.ResolveIPAddr("ip4", addr)
+func tracert(addr string, config traceConfig, reporter Reporter) (*TraceResult, error) {
+	return tracertContext(context.Background(), addr, config, reporter)
+}
+
+// Traces addr like tracert until ctx is done. A cancelled trace stops probing after the hop in
+// progress and returns the hops so far with the error of ctx.
+func tracertContext(ctx context.Context, addr string, config traceConfig, reporter Reporter) (*TraceResult, error) {
+	traceID := nextTraceID()
+	reporter.Start(addr, config.MaxTTL, traceID)
 
+	destination, err := resolveTarget(addr)
 	if err != nil {
-		fmt.Printf("Invalid address %s\n", addr)
-		return
+		reporter.Note(fmt.Sprintf("Invalid address %s", addr))
+		return nil, &resolveError{Target: addr, Err: err}
+	}
+
+	// One socket serves the whole trace and is closed exactly once when it ends
+	connection, err := openTraceSocket(*sourceIface, *useIPv6)
+	if err != nil {
+		reporter.Note(fmt.Sprintf("Cannot open socket: %v", err))
+		return nil, err
+	}
+	defer connection.Close()
+	var source *net.IPAddr
+	if *verbose {
+		if ip, err := sourceAddress(connection, destination); err == nil {
+			source = &net.IPAddr{IP: ip}
+			reporter.Note(fmt.Sprintf("probing from %s through a %s", ip, connection.mode()))
+		} else {
+			reporter.Note(fmt.Sprintf("probing through a %s, source address unknown: %v", connection.mode(), err))
+		}
+	}
+
+	tracer := newTracer(connection, destination, *useIPv6)
+	tracer.ctx = ctx
+	tracer.maxTTL = config.MaxTTL
+
+	// Names resolved while probing, e.g. by -resolve-after, count against -enrich-timeout only once it ends
+	lookups := startEnrichment()
+	defer lookups.end()
+
+	// Replies are still matched in userspace, so the filter is only an optimization
+	if *bpfFilter {
+		if err := connection.attachFilter(tracer.id); err != nil {
+			reporter.Note(fmt.Sprintf("BPF filter unavailable, filtering in userspace: %v", err))
+		}
+	}
+
+	if *probeTOS != 0 {
+		if err := connection.setTOS(*probeTOS); err != nil {
+			reporter.Note(fmt.Sprintf("Cannot set TOS: %v", err))
+		}
+	}
+	if *verifyDSCP {
+		if err := connection.enableTOS(); err != nil {
+			reporter.Note(fmt.Sprintf("Cannot read the TOS of replies: %v", err))
+		}
+	}
+	if *timestampOpt {
+		if err := connection.setIPOptions(timestampOption()); err != nil {
+			reporter.Note(fmt.Sprintf("Cannot set the Timestamp option: %v", err))
+		} else {
+			connection.enableOptions()
+		}
+	}
+
+	var blackHoles *blackHoleDetector
+	var sizeSweepping bool = false
+	if *blackHoleSize > 0 || *sizeSweep {
+		if err := connection.setDontFragment(); err != nil {
+			reporter.Note(fmt.Sprintf("Cannot set DF, MTU black hole detection and size sweep disabled: %v", err))
+		} else {
+			if *blackHoleSize > 0 {
+				blackHoles = &blackHoleDetector{size: *blackHoleSize}
+			}
+			sizeSweepping = *sizeSweep
+		}
+	}
+
+	if *destinationFirst {
+		if err := connection.enableTTL(); err != nil {
+			reporter.Note(fmt.Sprintf("Cannot read the TTL of replies: %v", err))
+		} else {
+			reporter.Note(capToDestination(tracer))
+		}
+	}
+
+	result := TraceResult{Target: addr, TraceID: traceID, Destination: destination, Source: source}
+	traceStart := time.Now()
+	firstReply := &tracer.firstReply
+	if *bisect {
+		bisectTrace(tracer, &result, reporter)
+	} else if *parallelTTLs > 1 || *probeOrder != "ascending" {
+		// Hops out of order are only reported once all are known
+		ttlsArray, _ := ttlOrder(*probeOrder, tracer.maxTTL)
+		workers := *parallelTTLs
+		if workers < 1 {
+			workers = 1
+		}
+		earliest, err := concurrentTrace(ctx, destination, ttlsArray, tracer.maxTTL, workers, &result, reporter)
+		if err != nil {
+			reporter.Note(fmt.Sprintf("Cannot open socket: %v", err))
+			return nil, err
+		}
+		firstReply = &earliest
+		if !result.Reached {
+			reporter.Note(unreachedVerdict(&result, tracer.maxTTL))
+		}
+	} else {
+		var spacing *spacingBackoff
+		if *spaceAdapt {
+			spacing = &spacingBackoff{max: *spaceMax, loss: *spaceLoss}
+		}
+		for i := 1; i <= tracer.maxTTL && ctx.Err() == nil; i++ {
+			var hop HopResult
+			var backoffNote string
+			if spacing != nil {
+				hop, backoffNote = spacing.probe(tracer, i)
+			} else {
+				hop = ping(tracer, i)
+			}
+			reporter.Hop(hop)
+			if backoffNote != "" {
+				reporter.Note(backoffNote)
+			}
+			result.Hops = append(result.Hops, hop)
+			if blackHoles != nil {
+				if note := blackHoles.check(tracer, hop); note != "" {
+					reporter.Note(note)
+				}
+			}
+			if sizeSweepping && hop.Responded() && (*sizeSweepHop == 0 || *sizeSweepHop == hop.TTL) {
+				reporter.Note(sizeSweepNote(tracer, hop))
+			}
+			if hop.Reached {
+				result.Reached = true
+				break
+			}
+			var mismatch *destinationMismatchError
+			if errors.As(hop.Err, &mismatch) {
+				break
+			}
+			var icmpErr *unexpectedICMPError
+			if *abortOnFirewall && errors.As(hop.Err, &icmpErr) && icmpErr.adminProhibited() {
+				reporter.Note(fmt.Sprintf("blocked by firewall at hop %d (%v)", hop.TTL, icmpErr.Peer))
+				break
+			}
+		}
+		if !result.Reached && len(result.Hops) == tracer.maxTTL {
+			reporter.Note(unreachedVerdict(&result, tracer.maxTTL))
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return &result, err
+	}
+
+	lookups.limit(*enrichTimeout)
+
+	if *verifyDSCP {
+		reporter.Note(dscpVerdict(&result, *probeTOS))
+	}
+
+	if !firstReply.IsZero() {
+		result.FirstResponse = firstReply.Sub(traceStart)
+		reporter.Note(fmt.Sprintf("first hop response after %s", humanDuration(result.FirstResponse)))
+	} else {
+		reporter.Note("first hop response: NA")
+	}
+
+	if *rateLimitGuard {
+		for _, hop := range markRateLimited(result.Hops, rateLimitParams{Margin: *rateLimitMargin, MaxVariation: *rateLimitVariation}) {
+			reporter.Note(fmt.Sprintf("hop %d %s looks ICMP rate-limited; its latency is probably not a bottleneck", hop.TTL, createPeersString(hop.Peers)))
+		}
+	}
+
+	if *classifyRoles {
+		for _, role := range markRoles(result.Hops, nil) {
+			reporter.Note(role.String())
+		}
+	}
+
+	if *classifyBottleneck {
+		if step, ok := largestLatencyStep(result.Hops, rateLimitParams{Margin: *rateLimitMargin, MaxVariation: *rateLimitVariation}); ok {
+			reporter.Note(step.String())
+		} else {
+			reporter.Note("largest latency increase: none (fewer than two responding hops, or no rise)")
+		}
 	}
 
-	for i := 1; i <= MaxTTL; i++ {
-		if ping(destination, i) {
+	if *natBoundary {
+		if boundary, ok := findEgressBoundary(result.Hops); ok {
+			reporter.Note(boundary.String())
+		} else {
+			reporter.Note("NAT/egress boundary: none seen (no responding private hop followed by a public one)")
+		}
+	}
+
+	if *aggregateHops {
+		spansArray := aggregateNetworks(result.Hops, *aggregatePrefix4, *aggregatePrefix6)
+		reporter.Note(fmt.Sprintf("networks crossed: %d", len(spansArray)))
+		for _, span := range spansArray {
+			reporter.Note("  " + span.String())
+		}
+	}
+
+	if *countDistinct {
+		reporter.Note(fmt.Sprintf("%d distinct responding addresses over %d hops", result.DistinctHops(), len(result.Hops)))
+	}
+
+	if *geoLookup || *markCountries || *showASPath {
+		annotateOrigins(&result)
+	}
+	if *showASPath {
+		pathArray, distinct := asPath(&result)
+		reporter.Note(fmt.Sprintf("AS path: %s (%d distinct)", strings.Join(pathArray, " > "), distinct))
+	}
+	if *markCountries {
+		for _, marker := range countryMarkers(&result) {
+			reporter.Note(marker.String())
+		}
+	}
+	if len(enricherList) > 0 {
+		enrichHops(&result, enricherList)
+		for _, hop := range result.Hops {
+			if len(hop.Annotations) > 0 {
+				reporter.Note(fmt.Sprintf("hop %d %v: %s", hop.TTL, hop.Peers[0], annotationsString(hop.Annotations)))
+			}
+		}
+	}
+
+	if result.Reached && *finalSamples > 0 {
+		sampleDestination(tracer, *finalSamples, reporter)
+	}
+	if result.Reached && *measureSkew {
+		measureClockSkew(tracer, reporter)
+	}
+	if result.Reached && *reverseHops {
+		if err := connection.enableTTL(); err != nil {
+			reporter.Note(fmt.Sprintf("reverse path: unavailable, cannot read the TTL of replies: %v", err))
+		} else {
+			reporter.Note(reversePath(tracer, forwardHops(&result)))
+		}
+	}
+	// Unlike the checks above the ports are worth connecting to when the destination ignores echo requests
+	if len(portsList) > 0 {
+		result.Ports = probePorts(tracer.dest, portsList, *portWorkers, *timeoutBase)
+		for _, port := range result.Ports {
+			reporter.Note(port.String())
+		}
+		reporter.Note(portsSummary(tracer.dest, result.Ports))
+	}
+
+	if enrichmentExpired() {
+		reporter.Note(fmt.Sprintf("name and origin lookups stopped after %v; unresolved hops are shown by address", *enrichTimeout))
+	}
+
+	result.Counters.add(tracer.counters)
+	reporter.Note(result.Counters.String())
+
+	reporter.End(&result)
+	return &result, nil
+}
+
+// Tells whether the destination's echo replies kept the DSCP of the probes.
+// Replies are sent with the TOS the destination copies from the request, so a different DSCP means remarking on the path.
+func dscpVerdict(result *TraceResult, tos int) string {
+	if !result.Reached || len(result.Hops) == 0 {
+		return "DSCP: unknown (destination not reached)"
+	}
+	hop := result.Hops[len(result.Hops)-1]
+	if !hop.TOSKnown {
+		return "DSCP: unknown"
+	}
+	if sent, got := tos>>2, hop.ReplyTOS>>2; sent != got {
+		return fmt.Sprintf("DSCP: remarked to %d (sent %d)", got, sent)
+	}
+	return fmt.Sprintf("DSCP: preserved (%d)", tos>>2)
+}
+
+// Explains a trace that used up every TTL: the path either went silent, or its last answer came from elsewhere
+func unreachedVerdict(result *TraceResult, maxTTL int) string {
+	verdict := fmt.Sprintf("destination not reached within %d hops", maxTTL)
+	for i := len(result.Hops) - 1; i >= 0; i-- {
+		hop := result.Hops[i]
+		if hop.Responded() {
+			return fmt.Sprintf("%s; last answer from hop %d %s, which is not the destination", verdict, hop.TTL, createPeersString(hop.Peers))
+		}
+		// An ICMP error such as net unreachable is an answer too, and likely why the trace got no further
+		var icmpErr *unexpectedICMPError
+		if errors.As(hop.Err, &icmpErr) && icmpErr.Peer != nil {
+			return fmt.Sprintf("%s; last answer from hop %d %s, %s", verdict, hop.TTL, createPeersString([]net.Addr{icmpErr.Peer}), icmpTypeCodeString(icmpErr.Message))
+		}
+	}
+	return verdict + "; no hop answered"
+}
+
+// Doubles the TTL until the destination replies, then narrows the distance down by binary search
+func bisectTrace(tracer *Tracer, result *TraceResult, reporter Reporter) {
+	var low, high int = 0, 0
+	probe := func(ttl int) bool {
+		hop := ping(tracer, ttl)
+		reporter.Hop(hop)
+		result.Hops = append(result.Hops, hop)
+		return hop.Reached
+	}
+
+	for ttl := 1; ; ttl *= 2 {
+		if ttl > tracer.maxTTL {
+			ttl = tracer.maxTTL
+		}
+		if probe(ttl) {
+			high = ttl
 			break
 		}
+		low = ttl
+		if ttl == tracer.maxTTL {
+			reporter.Note(fmt.Sprintf("destination not reached within %d hops", tracer.maxTTL))
+			return
+		}
+	}
+
+	// Destination is beyond low and reached at high
+	for high-low > 1 {
+		middle := (low + high) / 2
+		if probe(middle) {
+			high = middle
+		} else {
+			low = middle
+		}
+	}
+
+	result.Reached = true
+	reporter.Note(fmt.Sprintf("destination distance: %d hops", high))
+
+	if *bisectFill {
+		for i := 1; i < high; i++ {
+			if !hasHop(result.Hops, i) {
+				probe(i)
+			}
+		}
+	}
+
+	// Probes past the distance are only search steps
+	var hopsArray []HopResult
+	for _, hop := range result.Hops {
+		if hop.TTL <= high {
+			hopsArray = append(hopsArray, hop)
+		}
+	}
+	sortHops(hopsArray)
+	result.Hops = hopsArray
+}
+
+// Takes extra RTT measurements to the destination only, with TTL high enough to reach it
+func sampleDestination(tracer *Tracer, samples int, reporter Reporter) {
+	if samples > MaxFinalSamples {
+		samples = MaxFinalSamples
+	}
+
+	exchange, err := socketExchange(tracer, []int{MsgLength}, tracer.maxTTL, samples)
+	if err != nil || !isEchoReply(exchange.Type) {
+		reporter.Note("destination RTT: unavailable")
+		return
 	}
 
-	fmt.Printf("Ended tracert\n")
+	min, avg, max := rttStats(exchange.RTTs)
+	reporter.Note(fmt.Sprintf("destination RTT: min/avg/max = %s/%s/%s (%d samples)", humanDuration(min), humanDuration(avg), humanDuration(max), len(exchange.RTTs)))
 }
 
 func main() {
-	if len(os.Args) == 2 {
-		var input string = os.Args[1]
-		tracert(input)
-	} else {
-		fmt.Printf("Input 1 parameter(adress)\n")
+	flag.Usage = func() { printUsage(flag.CommandLine.Output()) }
+	flag.Parse()
+	// Taken before the environment sets flags, which only stand in for defaults
+	given := givenFlags(flag.CommandLine)
+	if err := applyEnvironment(flag.CommandLine, os.LookupEnv); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(2)
+	}
+
+	if *listInterfaces {
+		if err := printInterfaces(); err != nil {
+			fmt.Printf("Cannot list interfaces: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *selfTestOnly {
+		os.Exit(selfTest(*sourceIface, *useIPv6))
+	}
+	if *schemaOutput {
+		if err := printSchema(); err != nil {
+			fmt.Printf("Cannot print the schema: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *blackHoleSize != 0 && (*blackHoleSize <= echoOverheadIPv6 || *blackHoleSize > 65535) {
+		fmt.Printf("-blackhole-size must be between %d and 65535\n", echoOverheadIPv6+1)
+		os.Exit(2)
+	}
+	if *randomSeed != 0 {
+		seedRandom(*randomSeed)
+	}
+	if _, err := ttlOrder(*probeOrder, 1); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(2)
+	}
+	if *probeTOS < 0 || *probeTOS > 255 {
+		fmt.Printf("-tos must be between 0 and 255\n")
+		os.Exit(2)
+	}
+	if *echoCode < 0 || *echoCode > 255 {
+		fmt.Printf("-echo-code must be between 0 and 255\n")
+		os.Exit(2)
+	}
+	if *terminalFlag != "" {
+		codesArray, err := parseTerminalCodes(*terminalFlag)
+		if err != nil {
+			fmt.Printf("-terminal-codes: %v\n", err)
+			os.Exit(2)
+		}
+		terminalCodes = codesArray
+	}
+	if *socketFD < 0 && os.Getenv("TRACEROUTE_SOCKET_FD") != "" {
+		fd, err := strconv.Atoi(os.Getenv("TRACEROUTE_SOCKET_FD"))
+		if err != nil || fd < 0 {
+			fmt.Printf("TRACEROUTE_SOCKET_FD must be a descriptor number\n")
+			os.Exit(2)
+		}
+		*socketFD = fd
+	}
+	if *aggregatePrefix4 < 0 || *aggregatePrefix4 > 32 || *aggregatePrefix6 < 0 || *aggregatePrefix6 > 128 {
+		fmt.Printf("-aggregate-prefix must be between 0 and 32, -aggregate-prefix6 between 0 and 128\n")
+		os.Exit(2)
+	}
+	if *rttPrecision < -1 || *rttPrecision > 9 {
+		fmt.Printf("-precision takes 0 to 9 decimals\n")
+		os.Exit(2)
+	}
+	if *maxHopPeers < 0 || *maxTotalPeers < 0 {
+		fmt.Printf("-max-hop-peers and -max-total-peers must not be negative\n")
+		os.Exit(2)
+	}
+	if *batchWorkers < 1 {
+		fmt.Printf("-batch-concurrency must be at least 1\n")
+		os.Exit(2)
+	}
+	if *dnsRetries < 0 {
+		fmt.Printf("-dns-retries must not be negative\n")
+		os.Exit(2)
+	}
+	if *replayRate < 0 || (*replayRate > 0 && *replayFile == "") {
+		fmt.Printf("-replay-rate takes a factor of 0 or more and needs -replay\n")
+		os.Exit(2)
+	}
+	if *useIPv4 && *useIPv6 {
+		fmt.Printf("-4 and -6 are mutually exclusive\n")
+		os.Exit(2)
+	}
+	switch *socketMode {
+	case "auto", "raw", "dgram":
+	default:
+		fmt.Printf("-socket-mode must be auto, raw or dgram\n")
+		os.Exit(2)
+	}
+	if *socketMode == "dgram" && (*socketFD >= 0 || needsRawSocket()) {
+		fmt.Printf("-socket-mode dgram cannot be used with -socket-fd, -compare-udp, -verify-dscp, -timestamp-option, -probe-destination-first, -measure-clock-skew or -reverse-hops, which need a raw socket\n")
+		os.Exit(2)
+	}
+	if *udpRotate && !*compareUDP {
+		fmt.Printf("-udp-rotate-source only applies to the UDP trace of -compare-udp\n")
+		os.Exit(2)
+	}
+	if *udpSourcePort != 0 && !*compareUDP {
+		fmt.Printf("-sport only applies to the UDP trace of -compare-udp\n")
+		os.Exit(2)
+	}
+	// With -udp-rotate-source every flow takes the next port
+	lastSourcePort := *udpSourcePort
+	if *udpRotate {
+		lastSourcePort += *hopProbes - 1
+	}
+	if *udpSourcePort < 0 || lastSourcePort > 65535 {
+		fmt.Printf("-sport must be between 1 and %d\n", 65535-(lastSourcePort-*udpSourcePort))
+		os.Exit(2)
+	}
+	if *socketMark < 0 || int64(*socketMark) > 0xffffffff {
+		fmt.Printf("-mark must be between 0 and 4294967295\n")
+		os.Exit(2)
+	}
+	if *socketMark != 0 && *socketFD >= 0 {
+		fmt.Printf("-mark cannot be set on an inherited -socket-fd; let the helper that opens it set SO_MARK\n")
+		os.Exit(2)
+	}
+	// Sockets duplicated from one descriptor share its receive queue, so no two may read at once
+	if *socketFD >= 0 && (*parallelTTLs > 1 || (*sweepMode && *sweepWorkers > 1) || *batchWorkers > 1) {
+		fmt.Printf("-socket-fd provides a single socket; use -parallel 1, -sweep-workers 1 and -batch-concurrency 1\n")
+		os.Exit(2)
+	}
+	if *probeSizes != "" {
+		for _, field := range strings.Split(*probeSizes, ",") {
+			size, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || size < 0 || size > 65000 {
+				fmt.Printf("-probe-sizes takes payload sizes between 0 and 65000, got %q\n", field)
+				os.Exit(2)
+			}
+			cycledSizes = append(cycledSizes, size)
+		}
+	}
+	if *hostnameWidth < 0 {
+		fmt.Printf("-hop-hostname-width must not be negative\n")
+		os.Exit(2)
+	}
+	if *defaultMaxTTL < 1 || *defaultMaxTTL > 255 {
+		fmt.Printf("-max-ttl must be between 1 and 255\n")
+		os.Exit(2)
+	}
+	if *hopProbes < 1 || *hopProbes > 10 {
+		fmt.Printf("-probes must be between 1 and 10\n")
+		os.Exit(2)
+	}
+	if *enricherNames != "" {
+		namesArray, err := parseEnrichers(*enricherNames)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(2)
+		}
+		enricherList = namesArray
+	}
+	if *checkPorts != "" {
+		portsArray, err := parsePorts(*checkPorts)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(2)
+		}
+		portsList = portsArray
+	}
+	if *portWorkers < 1 || *portWorkers > 16 {
+		fmt.Printf("-ports-workers must be between 1 and 16\n")
+		os.Exit(2)
+	}
+	if *egressRate != "" {
+		limit, err := parseRate(*egressRate)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(2)
+		}
+		egressLimit = limit
+	}
+	if *confirmProbes < 0 {
+		fmt.Printf("-min-ttl-confirm must not be negative\n")
+		os.Exit(2)
+	}
+	if *adaptive && given["probes"] {
+		fmt.Printf("-probes does not apply with -adaptive-probes, which sends between -min-probes and -max-probes\n")
+		os.Exit(2)
+	}
+	if (given["min-probes"] || given["max-probes"]) && !*adaptive {
+		fmt.Printf("-min-probes and -max-probes only apply with -adaptive-probes\n")
+		os.Exit(2)
+	}
+	if *minProbes < 1 || *maxProbes < *minProbes {
+		fmt.Printf("-min-probes must be at least 1 and -max-probes not below it\n")
+		os.Exit(2)
+	}
+	if *timestampOpt && *useIPv6 {
+		fmt.Printf("-timestamp-option is an IPv4 option and cannot be used with -6\n")
+		os.Exit(2)
+	}
+	if *stableRuns < 0 || (*stableRuns > 0 && *stableMaxRuns < *stableRuns) {
+		fmt.Printf("-exit-after-destination-rtt-stable must not be negative, and -stable-max-runs not below it\n")
+		os.Exit(2)
+	}
+	if *spaceAdapt && (*spaceLoss <= 0 || *spaceLoss > 1 || *spaceMax < *probeInterval) {
+		fmt.Printf("-spacing-loss must be above 0 and at most 1, and -max-probe-spacing not below -interval\n")
+		os.Exit(2)
+	}
+	if *stableJitter < 0 || *stableEvery < 0 {
+		fmt.Printf("-stable-rtt-tolerance and -stable-interval must not be negative\n")
+		os.Exit(2)
+	}
+	if *stableRuns > 0 && *stabilityRuns > 0 {
+		fmt.Printf("-exit-after-destination-rtt-stable and -verify-path-stability cannot be combined\n")
+		os.Exit(2)
+	}
+
+	if *hopDNSServers != "" {
+		resolver, err := newHopResolver(*hopDNSServers)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(2)
+		}
+		hopResolver = resolver
+	}
+
+	reporter, err := newReporter()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(2)
+	}
+	// Replaying stays local, so it is not exported with -otlp-endpoint
+	if *replayFile != "" {
+		if err := replayTraces(*replayFile, *replayRate, reporter); err != nil {
+			fmt.Printf("Cannot replay trace: %v\n", err)
+			os.Exit(2)
+		}
+		return
+	}
+	if *otlpEndpoint != "" {
+		reporter = newSpanReporter(reporter, *otlpEndpoint)
+	}
+
+	var expected *TraceResult
+	if *expectFile != "" {
+		var err error
+		expected, err = loadTrace(*expectFile)
+		if err != nil {
+			fmt.Printf("Cannot load expected trace: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	var targetsArray []targetSpec
+	for _, input := range flag.Args() {
+		target, err := parseTarget(input, defaultConfig())
+		if err != nil {
+			fmt.Printf("Invalid target: %v\n", err)
+			os.Exit(2)
+		}
+		targetsArray = append(targetsArray, target)
+	}
+	if *targetsFile != "" {
+		fileTargets, err := loadTargets(*targetsFile, defaultConfig())
+		if err != nil {
+			fmt.Printf("Cannot load targets: %v\n", err)
+			os.Exit(2)
+		}
+		targetsArray = append(targetsArray, fileTargets...)
+	}
+
+	if len(targetsArray) == 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "No target given\n\n")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *gatewayOnly {
+		var exitCode int = 0
+		for _, target := range targetsArray {
+			reached, err := gatewayCheck(target)
+			switch {
+			case err != nil:
+				fmt.Printf("Cannot check %s: %v\n", target.Host, err)
+				exitCode = 2
+			case !reached && !*allowUnreached && exitCode == 0:
+				exitCode = 3
+			}
+		}
+		os.Exit(exitCode)
+	}
+	if *stableRuns > 0 {
+		var exitCode int = 0
+		for _, target := range targetsArray {
+			code, err := waitStable(target, *stableRuns, *stableMaxRuns, *stableJitter, *stableEvery)
+			if err != nil {
+				fmt.Printf("Cannot trace %s: %v\n", target.Host, err)
+			}
+			if code > exitCode {
+				exitCode = code
+			}
+		}
+		os.Exit(exitCode)
+	}
+	if *stabilityRuns > 0 {
+		for _, target := range targetsArray {
+			if err := verifyStability(target, *stabilityRuns); err != nil {
+				fmt.Printf("Cannot trace %s: %v\n", target.Host, err)
+				os.Exit(2)
+			}
+		}
+		return
 	}
-}
\ No newline at end of file
+	if *compareUDP {
+		for _, target := range targetsArray {
+			if err := compareProtocols(target); err != nil {
+				fmt.Printf("Cannot compare %s: %v\n", target.Host, err)
+				os.Exit(2)
+			}
+		}
+		return
+	}
+	if *watchInterval > 0 {
+		if len(targetsArray) != 1 {
+			fmt.Printf("-watch takes a single target\n")
+			os.Exit(2)
+		}
+		if err := watch(targetsArray[0], *watchInterval); err != nil {
+			fmt.Printf("Cannot watch %s: %v\n", targetsArray[0].Host, err)
+			os.Exit(2)
+		}
+		return
+	}
+	if *sweepMode {
+		for _, target := range targetsArray {
+			if err := sweep(target.Host, target.Config, *sweepWorkers, *sweepLarge); err != nil {
+				fmt.Printf("Cannot sweep %s: %v\n", target.Host, err)
+				os.Exit(2)
+			}
+		}
+		return
+	}
+	if *tuiMode {
+		if len(targetsArray) != 1 {
+			fmt.Printf("-tui takes a single target\n")
+			os.Exit(2)
+		}
+		if stdoutIsTerminal() {
+			runTUI(targetsArray[0])
+			return
+		}
+	}
+	if len(targetsArray) > 1 && (*saveFile != "" || expected != nil) {
+		fmt.Printf("-save and -expect take a single target\n")
+		os.Exit(2)
+	}
+
+	var resultFiles *resultWriter
+	if *outputDir != "" {
+		if err := os.MkdirAll(*outputDir, 0755); err != nil {
+			fmt.Printf("Cannot create output directory: %v\n", err)
+			os.Exit(2)
+		}
+		resultFiles = newResultWriter(*outputDir)
+	}
+
+	var graph *dotGraph
+	if *dotFile != "" {
+		graph = newDotGraph()
+	}
+
+	var exitCode int = 0
+	var failuresArray []string
+	traces := newBatch(targetsArray, *batchWorkers, reporter)
+	traces.start()
+	for i, target := range targetsArray {
+		result, err := traces.result(i)
+		if err != nil {
+			failuresArray = append(failuresArray, fmt.Sprintf("%s: %v", target.Host, err))
+			if *failFast && errors.Is(err, ErrResolve) {
+				traces.stop()
+				break
+			}
+			continue
+		}
+
+		if *saveFile != "" {
+			if err := saveTrace(*saveFile, result); err != nil {
+				reporter.Note(fmt.Sprintf("Cannot save trace: %v", err))
+			}
+		}
+		if resultFiles != nil {
+			if err := resultFiles.save(result); err != nil {
+				reporter.Note(fmt.Sprintf("Cannot save trace: %v", err))
+			}
+		}
+		if graph != nil {
+			graph.add(result)
+		}
+
+		if expected != nil {
+			if divergence := diffTraces(expected, result, *expectUntilHop); divergence != nil {
+				reporter.Note(divergence.String())
+				exitCode = 1
+			} else {
+				reporter.Note("route matches " + *expectFile)
+			}
+		}
+
+		if *latencyThreshold > 0 {
+			if hop, rtt, ok := latencyAlert(result.Hops, *latencyThreshold, *latencyUntilHop, *bestMethod); ok {
+				reporter.Note(fmt.Sprintf("latency alert: hop %d %s has a best RTT of %s, above %s", hop.TTL, createPeersString(hop.Peers), humanDuration(rtt), humanDuration(*latencyThreshold)))
+				if exitCode == 0 {
+					exitCode = 4
+				}
+			}
+		}
+
+		for _, alert := range lossAlerts(result, lossThresholds{Overall: *overallLoss, Hop: *hopLoss, Destination: *destinationLoss}) {
+			reporter.Note(fmt.Sprintf("loss alert: %s", alert))
+			if exitCode == 0 {
+				exitCode = 5
+			}
+		}
+
+		if !result.Reached && !*allowUnreached && exitCode == 0 {
+			exitCode = 3
+		}
+	}
+
+	if resultFiles != nil {
+		resultFiles.summary()
+	}
+	if graph != nil {
+		if err := graph.save(*dotFile); err != nil {
+			reporter.Note(fmt.Sprintf("Cannot write graph: %v", err))
+		}
+	}
+
+	if len(failuresArray) > 0 {
+		if len(targetsArray) > 1 {
+			reporter.Note(fmt.Sprintf("%d of %d targets failed:", len(failuresArray), len(targetsArray)))
+			for _, failure := range failuresArray {
+				reporter.Note(fmt.Sprintf("  %s", failure))
+			}
+		}
+		os.Exit(2)
+	}
+	os.Exit(exitCode)
+}
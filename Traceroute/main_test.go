@@ -0,0 +1,590 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// Scripts a destination answering every probe but the lost ones, by number within the hop
+func lossyDestination(dest string, lostArray ...int) func(probe fakeProbe) []fakeReply {
+	return func(probe fakeProbe) []fakeReply {
+		for _, lost := range lostArray {
+			if probe.Number() == lost {
+				return nil
+			}
+		}
+		return []fakeReply{{Bytes: echoReply(probe), Peer: ip4(dest)}}
+	}
+}
+
+func TestSocketExchangeKeepsRepliesOfLossyHops(t *testing.T) {
+	tests := []struct {
+		name    string
+		lost    []int
+		replies int
+		timeout bool
+	}{
+		{"none lost", nil, 3, false},
+		{"first lost", []int{0}, 2, false},
+		{"middle lost", []int{1}, 2, false},
+		{"last lost", []int{2}, 2, false},
+		{"one answered", []int{0, 2}, 1, false},
+		{"all lost", []int{0, 1, 2}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			conn := newFakeConn(lossyDestination("10.9.9.9", tt.lost...))
+			tracer := newTracer(conn, ip4("10.9.9.9"), false)
+
+			hop := ping(tracer, 1)
+			if len(conn.sent()) != 3 {
+				t.Errorf("%d probes sent, want all 3", len(conn.sent()))
+			}
+			if tt.timeout {
+				if !isTimeout(hop.Err) || hop.Responded() {
+					t.Fatalf("got %v with %d replies, want a timeout", hop.Err, len(hop.RTTs))
+				}
+				return
+			}
+			if hop.Err != nil || len(hop.RTTs) != tt.replies || len(hop.Peers) != tt.replies {
+				t.Fatalf("got %d replies, error %v, want %d", len(hop.RTTs), hop.Err, tt.replies)
+			}
+			if !hop.Reached || hop.Sent != 3 {
+				t.Errorf("reached %v with %d sent, want reached with 3", hop.Reached, hop.Sent)
+			}
+			if tracer.counters.Timeouts != len(tt.lost) {
+				t.Errorf("%d timeouts counted, want %d", tracer.counters.Timeouts, len(tt.lost))
+			}
+		})
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		lost []int
+		// Timeouts the hop waits out
+		waits int
+	}{
+		{"answered", nil, 0},
+		{"one lost", []int{1}, 1},
+		{"silent", []int{0, 1, 2}, 3},
+	}
+	const timeout = 40 * time.Millisecond
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, timeout)
+			setFlag(t, timeoutMax, timeout)
+			tracer := newTracer(newFakeConn(lossyDestination("10.9.9.9", tt.lost...)), ip4("10.9.9.9"), false)
+
+			start := time.Now()
+			ping(tracer, 1)
+			want := time.Duration(tt.waits) * timeout
+			if elapsed := time.Since(start); elapsed < want || elapsed > want+timeout/2 {
+				t.Errorf("hop took %v, want %v", elapsed, want)
+			}
+		})
+	}
+}
+
+func TestMangledReplies(t *testing.T) {
+	tests := []struct {
+		name string
+		// Reply of the destination to each probe
+		reply    func(probe fakeProbe) fakeReply
+		arpRetry bool
+		reject   bool
+		mangled  int
+		replies  int
+	}{
+		{"intact", func(probe fakeProbe) fakeReply {
+			return fakeReply{Bytes: echoReply(probe)}
+		}, false, false, 0, 3},
+		// The first probe is answered while the one sent again for ARP is awaited
+		{"late reply to the retried probe", func(probe fakeProbe) fakeReply {
+			if probe.Number() == 0 {
+				return fakeReply{Bytes: echoReply(probe), Delay: 30 * time.Millisecond}
+			}
+			return fakeReply{Bytes: echoReply(probe), Delay: 15 * time.Millisecond}
+		}, true, false, 0, 3},
+		{"payload rewritten", rewrittenEcho, false, false, 3, 3},
+		// Every reply is dropped, so the hop times out
+		{"payload rewritten and rejected", rewrittenEcho, false, true, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			setFlag(t, rejectMangled, tt.reject)
+			conn := newFakeConn(func(probe fakeProbe) []fakeReply {
+				reply := tt.reply(probe)
+				reply.Peer = ip4("10.9.9.9")
+				return []fakeReply{reply}
+			})
+			tracer := newTracer(conn, ip4("10.9.9.9"), false)
+			tracer.arpRetry = tt.arpRetry
+
+			hop := ping(tracer, 1)
+			if hop.Mangled != tt.mangled || len(hop.RTTs) != tt.replies {
+				t.Errorf("got %d mangled of %d replies, want %d of %d", hop.Mangled, len(hop.RTTs), tt.mangled, tt.replies)
+			}
+		})
+	}
+}
+
+// Answers the probe with its payload overwritten, as a broken middlebox would
+func rewrittenEcho(probe fakeProbe) fakeReply {
+	data := make([]byte, len(probe.Data))
+	return fakeReply{Bytes: marshalICMP(icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: probe.ID, Seq: probe.Seq, Data: data}})}
+}
+
+func TestARPRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		arpRetry bool
+		// A hop of the trace answered before
+		answered bool
+		// Probes lost by number, counted over the retry too
+		lost    []int
+		retried bool
+		sent    int
+		replies int
+	}{
+		{"first lost", true, false, []int{0}, true, 4, 3},
+		{"first lost without -arp-retry", false, false, []int{0}, false, 3, 2},
+		{"first lost after a hop answered", true, true, []int{0}, false, 3, 2},
+		{"none lost", true, false, nil, false, 3, 3},
+		{"retry lost too", true, false, []int{0, 1}, true, 4, 2},
+		{"later probe lost", true, false, []int{1}, false, 3, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			conn := newFakeConn(lossyDestination("10.9.9.9", tt.lost...))
+			tracer := newTracer(conn, ip4("10.9.9.9"), false)
+			tracer.arpRetry = tt.arpRetry
+			tracer.answered = tt.answered
+
+			hop := ping(tracer, 1)
+			if hop.Err != nil || hop.ARPRetry != tt.retried || hop.Sent != tt.sent || len(hop.RTTs) != tt.replies {
+				t.Errorf("got retried %v, %d sent, %d replies, error %v; want %v, %d, %d", hop.ARPRetry, hop.Sent, len(hop.RTTs), hop.Err, tt.retried, tt.sent, tt.replies)
+			}
+			if len(conn.sent()) != tt.sent {
+				t.Errorf("%d probes written, want %d", len(conn.sent()), tt.sent)
+			}
+		})
+	}
+}
+
+func TestEchoReplyFromIntermediate(t *testing.T) {
+	tests := []struct {
+		name string
+		// Address echoing the probes at each TTL, "" for a Time Exceeded from 10.0.0.<ttl>
+		echoesArray []string
+		statusArray []string
+		reached     bool
+	}{
+		{"destination", []string{"", "10.9.9.9"}, []string{"ttl-exceeded", "reached"}, true},
+		{"intermediate before the destination", []string{"", "10.0.0.2", "10.9.9.9"}, []string{"ttl-exceeded", "non-target-echo", "reached"}, true},
+		{"only intermediates", []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, []string{"non-target-echo", "non-target-echo", "non-target-echo"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			offlineDNS(t, nil)
+			useFakeNetwork(t, newFakeConn(func(probe fakeProbe) []fakeReply {
+				echo := tt.echoesArray[probe.TTL-1]
+				if echo == "" {
+					router := fmt.Sprintf("10.0.0.%d", probe.TTL)
+					return []fakeReply{{Bytes: timeExceeded(router, probe), Peer: ip4(router)}}
+				}
+				return []fakeReply{{Bytes: echoReply(probe), Peer: ip4(echo)}}
+			}))
+
+			result, err := tracert("10.9.9.9", traceConfig{MaxTTL: len(tt.echoesArray), Method: "icmp"}, &recordingReporter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var statusArray []string
+			for _, hop := range result.Hops {
+				statusArray = append(statusArray, hop.Status())
+			}
+			if !reflect.DeepEqual(statusArray, tt.statusArray) || result.Reached != tt.reached {
+				t.Errorf("got hops %v, reached %v; want %v, %v", statusArray, result.Reached, tt.statusArray, tt.reached)
+			}
+		})
+	}
+}
+
+func TestAbortOnFirewall(t *testing.T) {
+	tests := []struct {
+		name  string
+		abort bool
+		// Code of the Destination Unreachable hop 2 sends
+		code    int
+		hops    int
+		stopped bool
+	}{
+		{"communication prohibited", true, 13, 2, true},
+		{"network prohibited", true, 9, 2, true},
+		{"host prohibited", true, 10, 2, true},
+		{"host unreachable", true, 1, 3, false},
+		{"without -abort-on-firewall", false, 13, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			setFlag(t, abortOnFirewall, tt.abort)
+			offlineDNS(t, nil)
+			useFakeNetwork(t, newFakeConn(func(probe fakeProbe) []fakeReply {
+				switch probe.TTL {
+				case 1:
+					return []fakeReply{{Bytes: timeExceeded("10.0.0.1", probe), Peer: ip4("10.0.0.1")}}
+				case 2:
+					return []fakeReply{{Bytes: destUnreachable(tt.code, probe), Peer: ip4("10.0.0.2")}}
+				}
+				return []fakeReply{{Bytes: echoReply(probe), Peer: ip4("10.9.9.9")}}
+			}))
+
+			reporter := &recordingReporter{}
+			result, err := tracert("10.9.9.9", traceConfig{MaxTTL: 5, Method: "icmp"}, reporter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stopped := reporter.noted("blocked by firewall at hop 2 (10.0.0.2)")
+			if len(result.Hops) != tt.hops || stopped != tt.stopped {
+				t.Errorf("got %d hops, stopped %v; want %d, %v", len(result.Hops), stopped, tt.hops, tt.stopped)
+			}
+		})
+	}
+}
+
+func TestDuplicateAndReorderedReplies(t *testing.T) {
+	tests := []struct {
+		name   string
+		script func(probe fakeProbe) []fakeReply
+		// Counts of the hop and the replies taken for other traffic
+		duplicates int
+		reordered  int
+		foreign    int
+		replies    int
+	}{
+		{"in order", func(probe fakeProbe) []fakeReply {
+			return []fakeReply{{Bytes: echoReply(probe), Peer: ip4("10.9.9.9")}}
+		}, 0, 0, 0, 3},
+		// The duplicate of the last probe is still queued when the hop ends
+		{"every reply twice", func(probe fakeProbe) []fakeReply {
+			reply := fakeReply{Bytes: echoReply(probe), Peer: ip4("10.9.9.9")}
+			return []fakeReply{reply, reply}
+		}, 2, 0, 0, 3},
+		// The first probe times out, and its reply arrives while the second is awaited
+		{"first reply late", func(probe fakeProbe) []fakeReply {
+			reply := fakeReply{Bytes: echoReply(probe), Peer: ip4("10.9.9.9"), Delay: 15 * time.Millisecond}
+			if probe.Number() == 0 {
+				reply.Delay = 30 * time.Millisecond
+			}
+			return []fakeReply{reply}
+		}, 0, 1, 0, 2},
+		{"reply to the previous hop", func(probe fakeProbe) []fakeReply {
+			earlier := probe
+			earlier.Seq = probeSeq(probe.TTL-1, probe.Number())
+			return []fakeReply{{Bytes: echoReply(earlier), Peer: ip4("10.9.9.9")}, {Bytes: echoReply(probe), Peer: ip4("10.9.9.9"), Delay: time.Millisecond}}
+		}, 0, 0, 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			tracer := newTracer(newFakeConn(tt.script), ip4("10.9.9.9"), false)
+
+			hop := ping(tracer, 2)
+			if hop.Err != nil || hop.Duplicates != tt.duplicates || hop.Reordered != tt.reordered || len(hop.RTTs) != tt.replies {
+				t.Errorf("got %d duplicates, %d reordered, %d replies, error %v; want %d, %d, %d", hop.Duplicates, hop.Reordered, len(hop.RTTs), hop.Err, tt.duplicates, tt.reordered, tt.replies)
+			}
+			if tracer.counters.Foreign != tt.foreign {
+				t.Errorf("%d replies taken for other traffic, want %d", tracer.counters.Foreign, tt.foreign)
+			}
+		})
+	}
+}
+
+func TestMangledRepliesOnTrace(t *testing.T) {
+	tests := []struct {
+		name    string
+		rewrite bool
+		reject  bool
+		reached bool
+		notes   string
+	}{
+		{"intact", false, false, true, ""},
+		{"rewritten", true, false, true, "  (3 replies with altered payload)"},
+		{"rewritten and rejected", true, true, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			setFlag(t, rejectMangled, tt.reject)
+			offlineDNS(t, nil)
+			// A middlebox behind the first router rewrites the payload of the destination's replies
+			useFakeNetwork(t, newFakeConn(func(probe fakeProbe) []fakeReply {
+				if probe.TTL == 1 {
+					return []fakeReply{{Bytes: timeExceeded("10.0.0.1", probe), Peer: ip4("10.0.0.1")}}
+				}
+				reply := fakeReply{Bytes: echoReply(probe)}
+				if tt.rewrite {
+					reply = rewrittenEcho(probe)
+				}
+				reply.Peer = ip4("10.9.9.9")
+				return []fakeReply{reply}
+			}))
+
+			result, err := tracert("10.9.9.9", traceConfig{MaxTTL: 2, Method: "icmp"}, &recordingReporter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			last := result.Hops[len(result.Hops)-1]
+			if result.Reached != tt.reached || hopNotes(last) != tt.notes {
+				t.Errorf("reached %v with notes %q, want %v with %q", result.Reached, hopNotes(last), tt.reached, tt.notes)
+			}
+			if result.Hops[0].Mangled != 0 {
+				t.Errorf("Time Exceeded counted as %d altered replies", result.Hops[0].Mangled)
+			}
+		})
+	}
+}
+
+// Returns a host Redirect to gateway or a Source Quench for the probe, which quote it behind 4 bytes
+func advisory(typ ipv4.ICMPType, gateway string, probe fakeProbe) []byte {
+	data := append(append([]byte(nil), ip4(gateway).IP...), quoteProbe(probe)...)
+	code := 0
+	if typ == ipv4.ICMPTypeRedirect {
+		code = 1
+	}
+	return marshalICMP(icmp.Message{Type: typ, Code: code, Body: &icmp.RawBody{Data: data}})
+}
+
+func TestAdvisoriesAreNotAnswers(t *testing.T) {
+	tests := []struct {
+		name string
+		// Sent ahead of the answer, nil for no answer at all
+		typ    ipv4.ICMPType
+		answer func(probe fakeProbe) []byte
+		// The answer ends the hop with that many RTTs
+		replies int
+		notes   string
+	}{
+		{"redirect before Time Exceeded", ipv4.ICMPTypeRedirect, func(probe fakeProbe) []byte {
+			return timeExceeded("10.0.0.1", probe)
+		}, 3, "  (redirect (code 1, redirect for host) from 10.0.0.1)"},
+		{"source quench before the echo reply", ICMPTypeSourceQuench, echoReply, 3, "  (source quench (code 0) from 10.0.0.1)"},
+		{"source quench alone", ICMPTypeSourceQuench, nil, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			setFlag(t, verbose, true)
+			conn := newFakeConn(func(probe fakeProbe) []fakeReply {
+				repliesArray := []fakeReply{{Bytes: advisory(tt.typ, "10.0.0.254", probe), Peer: ip4("10.0.0.1")}}
+				if tt.answer != nil {
+					repliesArray = append(repliesArray, fakeReply{Bytes: tt.answer(probe), Peer: ip4("10.0.0.1"), Delay: time.Millisecond})
+				}
+				return repliesArray
+			})
+			tracer := newTracer(conn, ip4("10.9.9.9"), false)
+
+			hop := ping(tracer, 1)
+			if len(hop.RTTs) != tt.replies {
+				t.Fatalf("got %d replies, error %v, want %d", len(hop.RTTs), hop.Err, tt.replies)
+			}
+			if tt.replies == 0 {
+				if !isTimeout(hop.Err) {
+					t.Errorf("got %v, want the hop timed out", hop.Err)
+				}
+				return
+			}
+			if len(hop.Advisories) != 3 {
+				t.Errorf("got advisories %q, want one per probe", hop.Advisories)
+			}
+			if notes := hopNotes(hop); !strings.Contains(notes, tt.notes) {
+				t.Errorf("notes %q lack %q", notes, tt.notes)
+			}
+		})
+	}
+}
+
+func TestConfirmSilentHops(t *testing.T) {
+	tests := []struct {
+		name    string
+		confirm int
+		// Probe numbers lost, the confirmation probes following on from the first three
+		lost      []int
+		sent      int
+		replies   int
+		confirmed bool
+	}{
+		{"silent without -min-ttl-confirm", 0, []int{0, 1, 2}, 3, 0, false},
+		{"answering the confirmation probes", 2, []int{0, 1, 2}, 5, 2, true},
+		{"silent through the confirmation probes", 2, []int{0, 1, 2, 3, 4}, 5, 0, false},
+		{"partly answered", 2, []int{0}, 3, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			conn := newFakeConn(lossyDestination("10.9.9.9", tt.lost...))
+			tracer := newTracer(conn, ip4("10.9.9.9"), false)
+			tracer.confirmProbes = tt.confirm
+
+			hop := ping(tracer, 1)
+			if hop.Sent != tt.sent || len(conn.sent()) != tt.sent || len(hop.RTTs) != tt.replies || hop.Confirmed != tt.confirmed {
+				t.Errorf("got %d sent, %d replies, confirmed %v; want %d, %d, %v", hop.Sent, len(hop.RTTs), hop.Confirmed, tt.sent, tt.replies, tt.confirmed)
+			}
+			if (tt.replies == 0) != isTimeout(hop.Err) {
+				t.Errorf("got error %v", hop.Err)
+			}
+			if note := "(answered only the confirmation probes)"; strings.Contains(hopNotes(hop), note) != tt.confirmed {
+				t.Errorf("notes %q, want %q: %v", hopNotes(hop), note, tt.confirmed)
+			}
+		})
+	}
+}
+
+func TestProbeSizesCycle(t *testing.T) {
+	tests := []struct {
+		name  string
+		sizes []int
+		// Probes lost by number
+		lost    []int
+		written []int
+		// Sizes of the answered probes, in the order of their RTTs
+		answered []int
+	}{
+		{"default size", nil, nil, []int{MsgLength, MsgLength, MsgLength}, nil},
+		{"one per probe", []int{56, 512, 1400}, nil, []int{56, 512, 1400}, []int{56, 512, 1400}},
+		{"cycled", []int{100, 200}, nil, []int{100, 200, 100}, []int{100, 200, 100}},
+		{"large one lost", []int{56, 512, 1400}, []int{2}, []int{56, 512, 1400}, []int{56, 512}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			conn := newFakeConn(lossyDestination("10.9.9.9", tt.lost...))
+			tracer := newTracer(conn, ip4("10.9.9.9"), false)
+			tracer.probeSizes = tt.sizes
+
+			hop := ping(tracer, 1)
+			var written []int
+			for _, probe := range conn.sent() {
+				written = append(written, len(probe.Data))
+			}
+			if !reflect.DeepEqual(written, tt.written) {
+				t.Errorf("wrote payloads of %v bytes, want %v", written, tt.written)
+			}
+			if !reflect.DeepEqual(hop.Sizes, tt.answered) || (hop.Sizes != nil && len(hop.Sizes) != len(hop.RTTs)) {
+				t.Errorf("got sizes %v for %d RTTs, want %v", hop.Sizes, len(hop.RTTs), tt.answered)
+			}
+			if len(tt.answered) > 0 && !strings.Contains(hopNotes(hop), fmt.Sprintf("(by size: %dB ", tt.answered[0])) {
+				t.Errorf("notes %q lack the RTTs by size", hopNotes(hop))
+			}
+		})
+	}
+}
+
+// Returns a Time Exceeded quoting the probe followed by extra bytes of extension objects
+func timeExceededWithExtensions(router string, probe fakeProbe, extra int) []byte {
+	data := append(quoteProbe(probe), make([]byte, extra)...)
+	return marshalICMP(icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Body: &icmp.TimeExceeded{Data: data}})
+}
+
+func TestTruncatedReplies(t *testing.T) {
+	// A Time Exceeded holds 8 bytes of ICMP header and the 20 bytes of the quoted IP header
+	// besides the probe, which leaves this much room for extensions in the read buffer
+	room := replyOverhead - 8 - ipv4.HeaderLen - 8
+	tests := []struct {
+		name  string
+		sizes []int
+		// Bytes of extension objects after the quoted probe, or -1 for an echo reply
+		extra         int
+		wantTruncated int
+	}{
+		{name: "plain reply", extra: 0, wantTruncated: 0},
+		{name: "extensions that fit", extra: room - 1, wantTruncated: 0},
+		{name: "extensions filling the buffer", extra: room, wantTruncated: 3},
+		{name: "extensions beyond the buffer", extra: 3000, wantTruncated: 3},
+		{name: "echo reply of a large probe", sizes: []int{1400, 8000}, extra: -1, wantTruncated: 0},
+		{name: "large probes quoted with extensions", sizes: []int{1400, 8000}, extra: room, wantTruncated: 3},
+	}
+	for _, tt := range tests {
+		for _, socket := range []bool{false, true} {
+			name := tt.name
+			if socket {
+				name += " through the socket"
+			}
+			t.Run(name, func(t *testing.T) {
+				setFlag(t, timeoutBase, 20*time.Millisecond)
+				setFlag(t, timeoutMax, 20*time.Millisecond)
+				conn := newFakeConn(func(probe fakeProbe) []fakeReply {
+					if tt.extra < 0 {
+						return []fakeReply{{Bytes: echoReply(probe), Peer: ip4("10.9.9.9")}}
+					}
+					return []fakeReply{{Bytes: timeExceededWithExtensions("10.0.0.1", probe, tt.extra), Peer: ip4("10.0.0.1")}}
+				})
+				var connection probeConn = conn
+				if socket {
+					connection = &icmpConn{PacketConn: conn}
+				}
+				tracer := newTracer(connection, ip4("10.9.9.9"), false)
+				tracer.probeSizes = tt.sizes
+
+				hop := ping(tracer, 2)
+				if hop.Err != nil || len(hop.RTTs) != 3 {
+					t.Fatalf("truncated replies not matched: %d RTTs, error %v", len(hop.RTTs), hop.Err)
+				}
+				if hop.Truncated != tt.wantTruncated {
+					t.Errorf("%d replies flagged truncated, want %d", hop.Truncated, tt.wantTruncated)
+				}
+				note := fmt.Sprintf("(%d replies larger than the read buffer, possibly incomplete)", tt.wantTruncated)
+				if got := strings.Contains(hopNotes(hop), note); got != (tt.wantTruncated > 0) {
+					t.Errorf("notes %q, want %q: %v", hopNotes(hop), note, tt.wantTruncated > 0)
+				}
+			})
+		}
+	}
+}
+
+func TestUnreachedVerdict(t *testing.T) {
+	netUnreachable := &unexpectedICMPError{Message: &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 0, Body: &icmp.DstUnreach{}}, Peer: ip4("21.4.2.51")}
+	tests := []struct {
+		name string
+		hops []HopResult
+		want string
+	}{
+		{"silent", []HopResult{{TTL: 1, Sent: 3, Err: ErrTimeout}, {TTL: 2, Sent: 3, Err: ErrTimeout}},
+			"destination not reached within 2 hops; no hop answered"},
+		{"answered by a router", []HopResult{{TTL: 1, Sent: 3, RTTs: []time.Duration{time.Millisecond}, Peers: addrs("192.0.2.1")}, {TTL: 2, Sent: 3, Err: ErrTimeout}},
+			"destination not reached within 2 hops; last answer from hop 1 [192.0.2.1], which is not the destination"},
+		{"net unreachable", []HopResult{{TTL: 1, Sent: 3, RTTs: []time.Duration{time.Millisecond}, Peers: addrs("192.0.2.1")}, {TTL: 2, Sent: 3, Err: netUnreachable}},
+			"destination not reached within 2 hops; last answer from hop 2 [21.4.2.51], destination unreachable (code 0, net unreachable)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offlineDNS(t, nil)
+			if got := unreachedVerdict(&TraceResult{Hops: tt.hops}, 2); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
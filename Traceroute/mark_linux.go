@@ -0,0 +1,26 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Returns the control function that sets SO_MARK on a socket as it is created, so that its
+// packets are routed by the fwmark rules (ip rule add fwmark ...) from the first one. Needs CAP_NET_ADMIN.
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+		})
+		if err != nil {
+			return err
+		}
+		if sockErr != nil {
+			return fmt.Errorf("cannot set SO_MARK %d: %v", mark, sockErr)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Characters that would end a table cell or start inline markup when they appear in a
+// host name or an error, escaped with a backslash as GitHub-flavored Markdown reads them
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, "|", `\|`, "*", `\*`, "_", `\_`, "`", "\\`", "<", `\<`, ">", `\>`, "[", `\[`, "]", `\]`)
+
+// markdownReporter prints each trace as a GitHub-flavored Markdown table when it ends, with a title
+// line naming the destination and when the trace started, for pasting into tickets and wikis
+type markdownReporter struct {
+	started time.Time
+}
+
+func (r *markdownReporter) Start(target string, maxTTL int, traceID string) {
+	r.started = time.Now()
+}
+
+func (r *markdownReporter) Hop(hop HopResult) {}
+
+func (r *markdownReporter) Note(text string) {
+	fmt.Fprintf(os.Stderr, "%s\n", text)
+}
+
+func (r *markdownReporter) End(result *TraceResult) {
+	fmt.Print(markdownTable(result, r.started))
+}
+
+// Renders the trace as a title line and a table of Hop | Address | Host | RTT | Loss, one row per
+// hop; a hop answered by several addresses lists them on separate lines of its cells
+func markdownTable(result *TraceResult, started time.Time) string {
+	var b strings.Builder
+	title := markdownEscaper.Replace(result.Target)
+	if result.Destination != nil && result.Destination.String() != result.Target {
+		title += " (" + result.Destination.String() + ")"
+	}
+	fmt.Fprintf(&b, "### Traceroute to %s, %s\n\n", title, started.Format("2006-01-02 15:04:05 MST"))
+	b.WriteString("| Hop | Address | Host | RTT | Loss |\n")
+	b.WriteString("|----:|:--------|:-----|----:|-----:|\n")
+
+	for _, hop := range result.Hops {
+		address, host, rtt := `\*`, "", ""
+		var icmpErr *unexpectedICMPError
+		switch {
+		case hop.Responded():
+			var hostsArray []string
+			named := false
+			for _, peer := range uniquePeers(hop.Peers) {
+				var names []string
+				if resolvesNames(hop) {
+					names = peerNames(peer)
+				}
+				named = named || len(names) > 0
+				hostsArray = append(hostsArray, markdownEscaper.Replace(strings.Join(names, ", ")))
+			}
+			address = strings.Join(uniquePeers(hop.Peers), "<br>")
+			// The lines of the two cells match up, so addresses without a name keep an empty line
+			if named {
+				host = strings.Join(hostsArray, "<br>")
+			}
+			_, avg, _ := rttStats(hop.RTTs)
+			rtt = humanDuration(avg)
+		case errors.As(hop.Err, &icmpErr):
+			address = icmpErr.Peer.String()
+			rtt = markdownEscaper.Replace(icmpTypeCodeString(icmpErr.Message))
+		}
+		loss := "-"
+		if hop.Sent > 0 {
+			loss = fmt.Sprintf("%.0f%%", lossPercent(hop.Sent, len(hop.RTTs)))
+		}
+		fmt.Fprintf(&b, "| %d | %s | %s | %s | %s |\n", hop.TTL, address, host, rtt, loss)
+	}
+
+	lastTTL := 0
+	if len(result.Hops) > 0 {
+		lastTTL = result.Hops[len(result.Hops)-1].TTL
+	}
+	if result.Reached {
+		fmt.Fprintf(&b, "\nDestination reached in %s.\n\n", hopsString(lastTTL))
+	} else {
+		fmt.Fprintf(&b, "\nDestination not reached within %d hops.\n\n", lastTTL)
+	}
+	return b.String()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestMarkdownTable(t *testing.T) {
+	started := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+	ms := time.Millisecond
+	tests := []struct {
+		name   string
+		result TraceResult
+		want   string
+	}{
+		{"reached", TraceResult{Target: "example.net", Destination: &net.IPAddr{IP: net.ParseIP("10.9.9.9")}, Reached: true, Hops: []HopResult{
+			{TTL: 1, Sent: 3, Peers: []net.Addr{ip4("10.0.0.1"), ip4("10.0.0.1"), ip4("10.0.0.1")}, RTTs: []time.Duration{ms, 2 * ms, 3 * ms}},
+			{TTL: 2, Sent: 3, Peers: []net.Addr{ip4("10.0.0.2"), ip4("10.0.0.3")}, RTTs: []time.Duration{4 * ms, 6 * ms}},
+			{TTL: 3, Sent: 3, Err: &timeoutError{Err: os.ErrDeadlineExceeded}},
+			{TTL: 4, Sent: 3, Peers: []net.Addr{ip4("10.9.9.9")}, RTTs: []time.Duration{9 * ms}, Reached: true},
+		}}, "### Traceroute to example.net (10.9.9.9), 2026-03-01 12:30:00 UTC\n\n" +
+			"| Hop | Address | Host | RTT | Loss |\n" +
+			"|----:|:--------|:-----|----:|-----:|\n" +
+			"| 1 | 10.0.0.1 | gw.example\\_lan | 2ms | 0% |\n" +
+			"| 2 | 10.0.0.2<br>10.0.0.3 | <br>core\\|3 | 5ms | 33% |\n" +
+			"| 3 | \\* |  |  | 100% |\n" +
+			"| 4 | 10.9.9.9 |  | 9ms | 67% |\n" +
+			"\nDestination reached in 4 hops.\n\n"},
+		{"unreached", TraceResult{Target: "10.9.9.9", Destination: &net.IPAddr{IP: net.ParseIP("10.9.9.9")}, Hops: []HopResult{
+			{TTL: 1, Sent: 3, Err: &unexpectedICMPError{Message: &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 13}, Peer: ip4("10.0.0.1")}},
+			{TTL: 2},
+		}}, "### Traceroute to 10.9.9.9, 2026-03-01 12:30:00 UTC\n\n" +
+			"| Hop | Address | Host | RTT | Loss |\n" +
+			"|----:|:--------|:-----|----:|-----:|\n" +
+			"| 1 | 10.0.0.1 |  | " + markdownEscaper.Replace(icmpTypeCodeString(&icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 13})) + " | 100% |\n" +
+			"| 2 | \\* |  |  | - |\n" +
+			"\nDestination not reached within 2 hops.\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offlineDNS(t, map[string][]string{"10.0.0.1": {"gw.example_lan"}, "10.0.0.3": {"core|3"}, "10.0.0.2": nil, "10.9.9.9": nil})
+			if got := markdownTable(&tt.result, started); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Source Quench is deprecated by RFC 6633 and has no constant in x/net
+const ICMPTypeSourceQuench ipv4.ICMPType = 4
+
+// IPv6 Next Header values of the extension headers we can step over
+const (
+	ipv6HopByHop    = 0
+	ipv6Routing     = 43
+	ipv6Fragment    = 44
+	ipv6AuthHeader  = 51
+	ipv6DestOptions = 60
+)
+
+// Probe payloads start with this marker followed by the probe's identifier and sequence number,
+// so replies are still matched when a NAT rewrote the identifier in the ICMP header
+var cookieMagic = []byte("TRCK")
+
+const cookieLength = 8
+
+// With -payload-timestamp the cookie is followed by the send time, in nanoseconds since stampEpoch.
+// The monotonic clock of the epoch keeps the RTT taken from it immune to wall clock steps.
+const stampLength = 8
+
+var stampEpoch = time.Now()
+
+// Last echo identifier handed out; they count up from the process ID
+var lastEchoID = uint32(os.Getpid())
+
+// Returns a new ICMP identifier for echo requests. Every Tracer takes its own,
+// so traces running side by side in the process never match each other's replies.
+func echoID() int {
+	return int(atomic.AddUint32(&lastEchoID, 1) & 0xffff)
+}
+
+// Returns the payload cookie of the probe with the given identifier and sequence number
+func probeCookie(id int, seq int) []byte {
+	cookie := make([]byte, cookieLength)
+	copy(cookie, cookieMagic)
+	binary.BigEndian.PutUint16(cookie[4:6], uint16(id))
+	binary.BigEndian.PutUint16(cookie[6:8], uint16(seq))
+	return cookie
+}
+
+// Returns the identifier and sequence number of the cookie an echo payload starts with
+func payloadCookie(data []byte) (int, int, bool) {
+	if len(data) < cookieLength || !bytes.Equal(data[:len(cookieMagic)], cookieMagic) {
+		return 0, 0, false
+	}
+	return int(binary.BigEndian.Uint16(data[4:6])), int(binary.BigEndian.Uint16(data[6:8])), true
+}
+
+// Returns the payload bytes carrying the send time
+func probeStamp(sent time.Time) []byte {
+	stamp := make([]byte, stampLength)
+	binary.BigEndian.PutUint64(stamp, uint64(sent.Sub(stampEpoch)))
+	return stamp
+}
+
+// Returns the send time an echo payload carries after its cookie
+func payloadStamp(data []byte) (time.Time, bool) {
+	if _, _, ok := payloadCookie(data); !ok || len(data) < cookieLength+stampLength {
+		return time.Time{}, false
+	}
+	return stampEpoch.Add(time.Duration(binary.BigEndian.Uint64(data[cookieLength:]))), true
+}
+
+// Reports whether the peer is the given address
+func sameIP(peer net.Addr, addr *net.IPAddr) bool {
+	ipAddr, ok := peer.(*net.IPAddr)
+	return ok && addr != nil && ipAddr.IP.Equal(addr.IP)
+}
+
+func isEchoReply(t icmp.Type) bool {
+	return t == ipv4.ICMPTypeEchoReply || t == ipv6.ICMPTypeEchoReply
+}
+
+func isAdvisory(t icmp.Type) bool {
+	return t == ipv4.ICMPTypeRedirect || t == ICMPTypeSourceQuench
+}
+
+func isTimeExceeded(t icmp.Type) bool {
+	return t == ipv4.ICMPTypeTimeExceeded || t == ipv6.ICMPTypeTimeExceeded
+}
+
+func isParameterProblem(t icmp.Type) bool {
+	return t == ipv4.ICMPTypeParameterProblem || t == ipv6.ICMPTypeParameterProblem
+}
+
+// Echo sequence numbers carry the TTL in the high byte and the probe number within the hop in the low byte
+func probeSeq(ttl int, probe int) int {
+	return (ttl&0xff)<<8 | probe&0xff
+}
+
+// Returns the sequence number of our echo request with the given identifier that msg answers
+func answeredSeq(msg *icmp.Message, id int) (int, bool) {
+	if body, ok := msg.Body.(*icmp.Echo); ok {
+		if !isEchoReply(msg.Type) || body.ID == id {
+			return body.Seq, isEchoReply(msg.Type)
+		}
+		if cookieID, seq, ok := payloadCookie(body.Data); ok && cookieID == id {
+			return seq, true
+		}
+		return body.Seq, false
+	}
+	return quotedEchoSeq(quotedPacket(msg), id)
+}
+
+// Reports whether msg answers exactly the probe, as -strict-reply-match requires: an echo reply must carry the probe's
+// identifier, sequence number and payload, and an ICMP error must quote a probe to dest matching it as far as quoted
+func exactMatch(msg *icmp.Message, probe []byte, dest *net.IPAddr) bool {
+	if body, ok := msg.Body.(*icmp.Echo); ok {
+		return body.Seq == int(binary.BigEndian.Uint16(probe[6:8])) && bytes.Equal(body.Data, probe[8:])
+	}
+
+	data := quotedPacket(msg)
+	quoted, ok := quotedICMP(data)
+	if !ok || len(quoted) < 8 || !quotedDestination(data).Equal(dest.IP) {
+		return false
+	}
+	length := len(quoted)
+	if length > len(probe) {
+		length = len(probe)
+	}
+	// Type, code and checksum are left out, the rest is what we sent
+	return bytes.Equal(quoted[4:length], probe[4:length])
+}
+
+// Returns the destination address of a quoted IPv4 or IPv6 datagram, or nil
+func quotedDestination(data []byte) net.IP {
+	switch {
+	case len(data) >= ipv4.HeaderLen && data[0]>>4 == 4:
+		return net.IP(data[16:20])
+	case len(data) >= ipv6.HeaderLen && data[0]>>4 == 6:
+		return net.IP(data[24:40])
+	}
+	return nil
+}
+
+// Returns the original datagram quoted by an ICMP error message, or nil
+func quotedPacket(msg *icmp.Message) []byte {
+	switch body := msg.Body.(type) {
+	case *icmp.TimeExceeded:
+		return body.Data
+	case *icmp.DstUnreach:
+		return body.Data
+	case *icmp.ParamProb:
+		return body.Data
+	case *icmp.PacketTooBig:
+		return body.Data
+	case *icmp.RawBody:
+		// Redirect and Source Quench keep 4 more bytes before the quote
+		if (msg.Type == ipv4.ICMPTypeRedirect || msg.Type == ICMPTypeSourceQuench) && len(body.Data) > 4 {
+			return body.Data[4:]
+		}
+	}
+	return nil
+}
+
+// Checks the original datagram quoted by an ICMP error, an IP header followed by
+// at least the first 8 bytes of our echo request, and returns its sequence number.
+// Routers quoting more than 8 bytes also return the payload cookie, which names the probe
+// even when the identifier was rewritten on the way.
+func quotedEchoSeq(data []byte, id int) (int, bool) {
+	quoted, ok := quotedICMP(data)
+	if !ok || len(quoted) < 8 {
+		return 0, false
+	}
+	isEcho := quoted[0] == byte(ipv4.ICMPTypeEcho) || quoted[0] == byte(ipv6.ICMPTypeEchoRequest)
+	if isEcho && int(binary.BigEndian.Uint16(quoted[4:6])) != id {
+		if cookieID, seq, ok := payloadCookie(quoted[8:]); ok && cookieID == id {
+			return seq, true
+		}
+	}
+	return int(binary.BigEndian.Uint16(quoted[6:8])), isEcho && int(binary.BigEndian.Uint16(quoted[4:6])) == id
+}
+
+// Returns the ICMP message carried by a quoted IPv4 or IPv6 datagram
+func quotedICMP(data []byte) ([]byte, bool) {
+	if len(data) == 0 {
+		return nil, false
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < ipv4.HeaderLen {
+			return nil, false
+		}
+		headerLen := int(data[0]&0x0f) << 2
+		if data[9] != ProtocolIPv4ICMP || len(data) < headerLen {
+			return nil, false
+		}
+		return data[headerLen:], true
+	case 6:
+		proto, payload, ok := ipv6Payload(data)
+		if !ok || proto != ProtocolIPv6ICMP {
+			return nil, false
+		}
+		return payload, true
+	}
+	return nil, false
+}
+
+// Walks the Next Header chain of an IPv6 datagram past its extension
+// headers and returns the upper-layer protocol and payload
+func ipv6Payload(data []byte) (int, []byte, bool) {
+	if len(data) < ipv6.HeaderLen {
+		return 0, nil, false
+	}
+
+	next := int(data[6])
+	rest := data[ipv6.HeaderLen:]
+	for {
+		var length int
+		switch next {
+		case ipv6HopByHop, ipv6Routing, ipv6DestOptions:
+			if len(rest) < 2 {
+				return 0, nil, false
+			}
+			length = (int(rest[1]) + 1) * 8
+		case ipv6Fragment:
+			length = 8
+		case ipv6AuthHeader:
+			if len(rest) < 2 {
+				return 0, nil, false
+			}
+			length = (int(rest[1]) + 2) * 4
+		default:
+			return next, rest, true
+		}
+
+		if len(rest) < length {
+			return 0, nil, false
+		}
+		next = int(rest[0])
+		rest = rest[length:]
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+// Returns a Time Exceeded quoting an IPv6 echo request behind the extension headers of chain, the
+// last one cut to cut bytes when cut is not 0, and followed by an upper-layer header of protocol
+func timeExceededIPv6(chain []int, protocol int, cut int) []byte {
+	probe := marshalICMP(icmp.Message{Type: ipv6.ICMPTypeEchoRequest, Body: &icmp.Echo{ID: 77, Seq: 5<<8 | 2, Data: []byte("payload")}})
+	header := make([]byte, ipv6.HeaderLen)
+	header[0] = 0x60
+	headers := append(append([]int(nil), chain...), protocol)
+	header[6] = byte(headers[0])
+	data := header
+	for i, kind := range chain {
+		extension := make([]byte, 8)
+		if kind == ipv6AuthHeader {
+			// 12 bytes: the length counts 4 byte units minus 2
+			extension = make([]byte, 12)
+			extension[1] = 1
+		}
+		extension[0] = byte(headers[i+1])
+		if cut > 0 && i == len(chain)-1 {
+			extension = extension[:cut]
+		}
+		data = append(data, extension...)
+	}
+	if cut == 0 {
+		data = append(data, probe...)
+	}
+	b, err := (&icmp.Message{Type: ipv6.ICMPTypeTimeExceeded, Body: &icmp.TimeExceeded{Data: data}}).Marshal(nil)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestIPv6ExtensionHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		chain    []int
+		protocol int
+		cut      int
+		matched  bool
+	}{
+		{"none", nil, ProtocolIPv6ICMP, 0, true},
+		{"hop-by-hop", []int{ipv6HopByHop}, ProtocolIPv6ICMP, 0, true},
+		{"routing and destination options", []int{ipv6Routing, ipv6DestOptions}, ProtocolIPv6ICMP, 0, true},
+		{"fragment", []int{ipv6Fragment}, ProtocolIPv6ICMP, 0, true},
+		{"authentication", []int{ipv6HopByHop, ipv6AuthHeader}, ProtocolIPv6ICMP, 0, true},
+		{"truncated extension header", []int{ipv6HopByHop, ipv6Routing}, ProtocolIPv6ICMP, 1, false},
+		{"not a probe of ours", []int{ipv6DestOptions}, 17, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := icmp.ParseMessage(ProtocolIPv6ICMP, timeExceededIPv6(tt.chain, tt.protocol, tt.cut))
+			if err != nil {
+				t.Fatal(err)
+			}
+			seq, ok := answeredSeq(msg, 77)
+			if ok != tt.matched || (ok && seq != 5<<8|2) {
+				t.Errorf("matched %v with sequence %#x, want %v with 0x502", ok, seq, tt.matched)
+			}
+		})
+	}
+}
+
+func TestTracersMatchOnlyTheirOwnReplies(t *testing.T) {
+	tests := []struct {
+		name string
+		// The other tracer's replies, with its identifier, arrive ahead of ours
+		crossed bool
+		foreign int
+	}{
+		{"alone", false, 0},
+		{"beside another tracer", true, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			other := newTracer(nil, ip4("10.9.9.9"), false)
+			conn := newFakeConn(func(probe fakeProbe) []fakeReply {
+				var repliesArray []fakeReply
+				if tt.crossed {
+					// The other tracer's probe carries its identifier in the payload cookie too
+					crossed := probe
+					crossed.ID = other.id
+					crossed.Data = append(probeCookie(other.id, probe.Seq), probe.Data[cookieLength:]...)
+					repliesArray = append(repliesArray, fakeReply{Bytes: echoReply(crossed), Peer: ip4("10.9.9.9")})
+				}
+				return append(repliesArray, fakeReply{Bytes: echoReply(probe), Peer: ip4("10.9.9.9"), Delay: time.Millisecond})
+			})
+			tracer := newTracer(conn, ip4("10.9.9.9"), false)
+			if tracer.id == other.id {
+				t.Fatalf("both tracers use identifier %d", tracer.id)
+			}
+
+			hop := ping(tracer, 1)
+			if len(hop.RTTs) != 3 || hop.Duplicates != 0 || tracer.counters.Foreign != tt.foreign {
+				t.Errorf("got %d replies, %d duplicates, %d foreign; want 3, 0, %d", len(hop.RTTs), hop.Duplicates, tracer.counters.Foreign, tt.foreign)
+			}
+		})
+	}
+}
+
+func TestStrictReplyMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer func(probe fakeProbe) fakeReply
+		// Replies taken with and without -strict-reply-match
+		strict int
+		loose  int
+	}{
+		{"exact Time Exceeded", func(probe fakeProbe) fakeReply {
+			return fakeReply{Bytes: timeExceeded("10.0.0.1", probe), Peer: ip4("10.0.0.1")}
+		}, 3, 3},
+		{"exact echo reply", func(probe fakeProbe) fakeReply {
+			return fakeReply{Bytes: echoReply(probe), Peer: ip4("10.9.9.9")}
+		}, 3, 3},
+		{"echo reply after NAT rewrote the identifier", func(probe fakeProbe) fakeReply {
+			probe.ID ^= 0x5555
+			return fakeReply{Bytes: echoReply(probe), Peer: ip4("10.9.9.9")}
+		}, 3, 3},
+		{"echo reply with another payload", func(probe fakeProbe) fakeReply {
+			reply := rewrittenEcho(probe)
+			reply.Peer = ip4("10.9.9.9")
+			return reply
+		}, 0, 3},
+		{"Time Exceeded quoting another destination", func(probe fakeProbe) fakeReply {
+			probe.Dest = ip4("10.1.1.1")
+			return fakeReply{Bytes: timeExceeded("10.0.0.1", probe), Peer: ip4("10.0.0.1")}
+		}, 0, 3},
+	}
+	for _, tt := range tests {
+		for _, strict := range []bool{true, false} {
+			name := tt.name
+			if strict {
+				name += " with -strict-reply-match"
+			}
+			t.Run(name, func(t *testing.T) {
+				setFlag(t, timeoutBase, 20*time.Millisecond)
+				setFlag(t, timeoutMax, 20*time.Millisecond)
+				setFlag(t, strictMatch, strict)
+				tracer := newTracer(newFakeConn(func(probe fakeProbe) []fakeReply {
+					return []fakeReply{tt.answer(probe)}
+				}), ip4("10.9.9.9"), false)
+
+				want := tt.loose
+				if strict {
+					want = tt.strict
+				}
+				hop := ping(tracer, 1)
+				if len(hop.RTTs) != want || tracer.counters.Foreign != 3-want {
+					t.Errorf("took %d replies, dropped %d, want %d taken", len(hop.RTTs), tracer.counters.Foreign, want)
+				}
+			})
+		}
+	}
+}
+
+func TestPayloadCookieMatchesRewrittenReplies(t *testing.T) {
+	// Rewrites the identifier of a probe as a NAT on the way out would
+	natted := func(probe fakeProbe) fakeProbe {
+		probe.ID ^= 0x5555
+		probe.Bytes = append([]byte(nil), probe.Bytes...)
+		binary.BigEndian.PutUint16(probe.Bytes[4:6], uint16(probe.ID))
+		return probe
+	}
+	tests := []struct {
+		name    string
+		answer  func(probe fakeProbe) []byte
+		matched bool
+	}{
+		{"echo reply", func(probe fakeProbe) []byte { return echoReply(natted(probe)) }, true},
+		{"Time Exceeded quoting the payload", func(probe fakeProbe) []byte { return timeExceeded("10.0.0.1", natted(probe)) }, true},
+		{"Time Exceeded quoting 8 bytes", func(probe fakeProbe) []byte {
+			probe = natted(probe)
+			probe.Bytes = probe.Bytes[:8]
+			return timeExceeded("10.0.0.1", probe)
+		}, false},
+		{"another tracer's cookie", func(probe fakeProbe) []byte {
+			probe = natted(probe)
+			probe.Data = append(probeCookie(probe.ID, probe.Seq), probe.Data[cookieLength:]...)
+			return echoReply(probe)
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			tracer := newTracer(newFakeConn(func(probe fakeProbe) []fakeReply {
+				return []fakeReply{{Bytes: tt.answer(probe), Peer: ip4("10.0.0.1")}}
+			}), ip4("10.9.9.9"), false)
+
+			hop := ping(tracer, 1)
+			if matched := len(hop.RTTs) == 3; matched != tt.matched {
+				t.Errorf("matched %d of 3 replies, error %v; want all matched: %v", len(hop.RTTs), hop.Err, tt.matched)
+			}
+		})
+	}
+}
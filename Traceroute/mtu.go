@@ -0,0 +1,38 @@
+package main
+
+import "fmt"
+
+// Binary-searches the largest DF probe, up to max bytes, that still gets an answer from the hop at ttl.
+// The search starts from the size of the regular probes, which the hop answered, and stops after iterations probes.
+// Returns the size and whether the search converged within the iterations.
+func largestForwardable(tracer *Tracer, ttl int, max int, iterations int) (int, bool) {
+	overhead := echoOverheadIPv4
+	if tracer.ipv6 {
+		overhead = echoOverheadIPv6
+	}
+
+	// low is known to pass, high is known to fail (or just beyond the search range)
+	low, high := overhead+MsgLength, max+1
+	for i := 0; i < iterations && high-low > 1; i++ {
+		middle := (low + high) / 2
+		if probeLarge(tracer, ttl, middle) == largeAnswered {
+			low = middle
+		} else {
+			high = middle
+		}
+	}
+	return low, high-low <= 1
+}
+
+// Returns the note about the size estimate of one hop
+func sizeSweepNote(tracer *Tracer, hop HopResult) string {
+	size, exact := largestForwardable(tracer, hop.TTL, *sizeSweepMax, *sizeSweepIterations)
+	if !exact {
+		return fmt.Sprintf("hop %d %s: forwards DF probes of at least %d bytes (search stopped after %d probes)",
+			hop.TTL, createPeersString(hop.Peers), size, *sizeSweepIterations)
+	}
+	if size == *sizeSweepMax {
+		return fmt.Sprintf("hop %d %s: forwards DF probes of %d bytes, the search maximum", hop.TTL, createPeersString(hop.Peers), size)
+	}
+	return fmt.Sprintf("hop %d %s: largest forwardable DF probe is %d bytes", hop.TTL, createPeersString(hop.Peers), size)
+}
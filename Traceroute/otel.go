@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// OTLP span kind and status codes, from opentelemetry-proto trace.proto
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOK         = 1
+	otlpStatusError      = 2
+)
+
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]string{"stringValue": value}}
+}
+
+// OTLP/JSON carries 64-bit integers as strings
+func intAttribute(key string, value int64) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]string{"intValue": strconv.FormatInt(value, 10)}}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func randomID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// spanReporter wraps another reporter and exports the trace as OpenTelemetry spans over OTLP/HTTP JSON:
+// one root span per traceroute, a child span per hop and a grandchild span per answered probe.
+// Only send and receive times of whole hops are known, so a hop spans from the end of the
+// previous one and every probe span starts with its hop.
+type spanReporter struct {
+	next     Reporter
+	endpoint string
+
+	traceID string
+	rootID  string
+	start   time.Time
+	last    time.Time
+	spans   []otlpSpan
+}
+
+func newSpanReporter(next Reporter, endpoint string) *spanReporter {
+	return &spanReporter{next: next, endpoint: endpoint}
+}
+
+func (r *spanReporter) Start(target string, maxTTL int, traceID string) {
+	r.traceID = randomID(16)
+	r.rootID = randomID(8)
+	r.start = time.Now()
+	r.last = r.start
+	r.spans = nil
+	r.next.Start(target, maxTTL, traceID)
+}
+
+func (r *spanReporter) Hop(hop HopResult) {
+	span := otlpSpan{TraceID: r.traceID, SpanID: randomID(8), ParentSpanID: r.rootID,
+		Name: fmt.Sprintf("hop %d", hop.TTL), Kind: otlpSpanKindInternal, Start: unixNano(r.last), End: unixNano(hop.Time)}
+	span.Attributes = []otlpAttribute{
+		intAttribute("traceroute.ttl", int64(hop.TTL)),
+		intAttribute("traceroute.sent", int64(hop.Sent)),
+		intAttribute("traceroute.received", int64(len(hop.RTTs))),
+		stringAttribute("traceroute.status", hop.Status()),
+	}
+	if len(hop.Peers) > 0 {
+		span.Attributes = append(span.Attributes, stringAttribute("net.peer.ip", hop.Peers[0].String()))
+	}
+	span.Status.Code = otlpStatusOK
+	if hop.Err != nil {
+		span.Status.Code = otlpStatusError
+	}
+	r.spans = append(r.spans, span)
+
+	for i, rtt := range hop.RTTs {
+		probe := otlpSpan{TraceID: r.traceID, SpanID: randomID(8), ParentSpanID: span.SpanID,
+			Name: fmt.Sprintf("probe %d", i+1), Kind: otlpSpanKindInternal, Start: unixNano(r.last), End: unixNano(r.last.Add(rtt))}
+		probe.Attributes = []otlpAttribute{intAttribute("traceroute.rtt_ns", int64(rtt))}
+		if i < len(hop.Peers) {
+			probe.Attributes = append(probe.Attributes, stringAttribute("net.peer.ip", hop.Peers[i].String()))
+		}
+		probe.Status.Code = otlpStatusOK
+		r.spans = append(r.spans, probe)
+	}
+
+	r.last = hop.Time
+	r.next.Hop(hop)
+}
+
+func (r *spanReporter) Note(text string) {
+	r.next.Note(text)
+}
+
+func (r *spanReporter) End(result *TraceResult) {
+	root := otlpSpan{TraceID: r.traceID, SpanID: r.rootID, Name: "traceroute " + result.Target,
+		Kind: otlpSpanKindInternal, Start: unixNano(r.start), End: unixNano(time.Now())}
+	root.Attributes = []otlpAttribute{
+		stringAttribute("traceroute.target", result.Target),
+		stringAttribute("traceroute.trace_id", result.TraceID),
+		intAttribute("traceroute.hops", int64(len(result.Hops))),
+	}
+	if result.Destination != nil {
+		root.Attributes = append(root.Attributes, stringAttribute("net.peer.ip", result.Destination.String()))
+	}
+	root.Status.Code = otlpStatusOK
+	if !result.Reached {
+		root.Status.Code = otlpStatusError
+	}
+
+	if err := r.export(append([]otlpSpan{root}, r.spans...)); err != nil {
+		fmt.Printf("Cannot export spans: %v\n", err)
+	}
+	r.next.End(result)
+}
+
+func (r *spanReporter) export(spansArray []otlpSpan) error {
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{stringAttribute("service.name", "traceroute")},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "traceroute"},
+				"spans": spansArray,
+			}},
+		}},
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Post(r.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// resultWriter saves the trace of every target of a batch to its own file under -output-dir
+type resultWriter struct {
+	dir          string
+	writtenArray []string
+	used         map[string]bool
+}
+
+func newResultWriter(dir string) *resultWriter {
+	return &resultWriter{dir: dir, used: make(map[string]bool)}
+}
+
+// Saves the trace as <target>.json; a target traced again, e.g. listed twice with different
+// settings, gets a numbered file instead of overwriting the first one
+func (w *resultWriter) save(result *TraceResult) error {
+	name := targetFileName(result.Target)
+	path := filepath.Join(w.dir, name+".json")
+	for i := 2; w.used[path]; i++ {
+		path = filepath.Join(w.dir, fmt.Sprintf("%s-%d.json", name, i))
+	}
+	w.used[path] = true
+
+	if err := saveTrace(path, result); err != nil {
+		return err
+	}
+	w.writtenArray = append(w.writtenArray, path)
+	return nil
+}
+
+// Prints the files written by the batch
+func (w *resultWriter) summary() {
+	fmt.Printf("wrote %d trace files to %s\n", len(w.writtenArray), w.dir)
+	for _, path := range w.writtenArray {
+		fmt.Printf("  %s\n", path)
+	}
+}
+
+// Turns a target into a file name, replacing everything but letters, digits, dots and dashes,
+// such as the colons of IPv6 addresses and path separators, with underscores
+func targetFileName(target string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, target)
+	// Names made of dots only would climb out of the directory
+	if strings.Trim(name, ".") == "" {
+		name = strings.Repeat("_", len(name))
+	}
+	if name == "" {
+		name = "_"
+	}
+	return name
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Reporter renders a trace as it progresses
+type Reporter interface {
+	Start(target string, maxTTL int, traceID string)
+	Hop(hop HopResult)
+	// Remarks about the trace, such as the verdict or analysis results
+	Note(text string)
+	End(result *TraceResult)
+}
+
+// Picks the reporter for the output flags
+func newReporter() (Reporter, error) {
+	var selected int = 0
+	for _, set := range []bool{*outputTemplate != "", *jsonOutput, *jsonlOutput, *influxOutput, *graphiteOutput, *compactOutput, *binaryOutput, *markdownOutput} {
+		if set {
+			selected++
+		}
+	}
+	if selected > 1 {
+		return nil, fmt.Errorf("-template, -json, -jsonl, -influx, -graphite, -compact, -binary and -markdown are mutually exclusive")
+	}
+	if *bestMethod != "min" && *bestMethod != "trimmed" {
+		return nil, fmt.Errorf("-best must be min or trimmed")
+	}
+
+	switch {
+	case *outputTemplate != "":
+		templateReporter, err := newTemplateReporter(*outputTemplate, *templateTrace)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid template: %v", err)
+		}
+		return templateReporter, nil
+	case *jsonOutput:
+		return jsonReporter{}, nil
+	case *jsonlOutput:
+		return &jsonlReporter{}, nil
+	case *influxOutput:
+		return &influxReporter{measurement: *influxName}, nil
+	case *graphiteOutput:
+		return &graphiteReporter{prefix: *graphitePrefix}, nil
+	case *compactOutput:
+		return &compactReporter{maxPath: *compactMaxPath}, nil
+	case *binaryOutput:
+		return &binaryReporter{encoder: newBinaryEncoder(os.Stdout)}, nil
+	case *markdownOutput:
+		return &markdownReporter{}, nil
+	default:
+		return &textReporter{}, nil
+	}
+}
+
+// textReporter prints the classic human readable output.
+// With -resolve-after it holds the hops back until the names resolved meanwhile are cached.
+type textReporter struct {
+	prefetcher *ptrPrefetcher
+	hopsArray  []HopResult
+
+	// Last hop printed, for -mark-repeated-hops
+	previous *HopResult
+}
+
+// Structured reporters never print a header; this one does unless -no-header is given
+func (r *textReporter) Start(target string, maxTTL int, traceID string) {
+	if !*noHeader {
+		fmt.Printf("Tracing route to %s with MaxTTL = %d, trace %s\n", target, maxTTL, traceID)
+	}
+	if *resolveAfter {
+		r.prefetcher = newPTRPrefetcher(ResolveWorkers)
+		r.hopsArray = nil
+	}
+	r.previous = nil
+}
+
+func (r *textReporter) Hop(hop HopResult) {
+	if r.prefetcher == nil {
+		r.print(hop)
+		return
+	}
+	if resolvesNames(hop) {
+		r.prefetcher.add(hop.Peers)
+	}
+	r.hopsArray = append(r.hopsArray, hop)
+}
+
+func (r *textReporter) Note(text string) {
+	r.flush()
+	fmt.Printf("%s\n", text)
+}
+
+func (r *textReporter) End(result *TraceResult) {
+	r.flush()
+	// Bars only make sense to a reader, not in a file or pipe
+	if *rttBars && stdoutIsTerminal() {
+		printRTTBars(result.Hops)
+	}
+	fmt.Printf("Ended tracert\n")
+}
+
+// Prints the held back hops once their names are resolved
+func (r *textReporter) flush() {
+	if r.prefetcher == nil {
+		return
+	}
+	r.prefetcher.wait()
+	for _, hop := range r.hopsArray {
+		r.print(hop)
+	}
+	r.hopsArray = nil
+}
+
+func (r *textReporter) print(hop HopResult) {
+	repeated := *markRepeats && r.previous != nil && sameResponders(*r.previous, hop)
+	printHop(hop, repeated)
+	r.previous = &hop
+}
+
+// Reports whether the hop answered from exactly the addresses of the TTL before it, as seen behind
+// tunnels hiding their inner hops or in routing loops
+func sameResponders(previous HopResult, hop HopResult) bool {
+	if previous.TTL != hop.TTL-1 || !previous.Responded() || !hop.Responded() {
+		return false
+	}
+	previousArray, peersArray := uniquePeers(previous.Peers), uniquePeers(hop.Peers)
+	if len(previousArray) != len(peersArray) {
+		return false
+	}
+	for i := range peersArray {
+		if previousArray[i] != peersArray[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Prints the hop line; a repeated hop shows "(same as above)" instead of its responders
+func printHop(hop HopResult, repeated bool) {
+	peers := peersColumn(hop)
+	if repeated {
+		peers = "(same as above)"
+	}
+
+	var unexpected *unexpectedICMPError
+	var mismatch *destinationMismatchError
+	var saved *savedError
+	switch {
+	case errors.As(hop.Err, &unexpected):
+		fmt.Printf("%3d ERROR %v\n", hop.TTL, unexpected)
+	case errors.As(hop.Err, &mismatch):
+		fmt.Printf("%3d ERROR %v\n", hop.TTL, mismatch)
+	// Loaded hops keep only the text of their error, so show it
+	case errors.As(hop.Err, &saved) && !saved.timeout:
+		fmt.Printf("%3d ERROR %v\n", hop.TTL, saved)
+	case hop.Err != nil:
+		fmt.Printf("%3d ERROR\n", hop.TTL)
+	case hop.Reached:
+		fmt.Printf("%3d %s     Reached  %s%s\n", hop.TTL, rttsColumn(hop.RTTs), peers, hopNotes(hop))
+		fmt.Printf("    %s\n", destinationSummary(hop))
+	case hop.NonTargetEcho:
+		fmt.Printf("%3d %s   EchoRpl at  %s  (not the destination)%s\n", hop.TTL, rttsColumn(hop.RTTs), peers, hopNotes(hop))
+	case hop.Responded():
+		fmt.Printf("%3d %s   TTLExc at  %s%s\n", hop.TTL, rttsColumn(hop.RTTs), peers, hopNotes(hop))
+	}
+}
+
+// Returns the end-to-end latency of the hop that reached the destination, set apart from the per-probe RTTs
+func destinationSummary(hop HopResult) string {
+	_, avg, _ := rttStats(hop.RTTs)
+	return fmt.Sprintf("destination %s reached in %s: best %s, avg %s", hopPeersString(hop), hopsString(hop.TTL),
+		humanDuration(bestRTT(hop.RTTs, *bestMethod)), humanDuration(avg))
+}
+
+// Returns n with "hop" or "hops" after it
+func hopsString(n int) string {
+	if n == 1 {
+		return "1 hop"
+	}
+	return fmt.Sprintf("%d hops", n)
+}
+
+// Width of an RTT in the hop lines, enough for "999.9µs"
+const rttWidth = 7
+
+// Returns the RTTs of a hop in brackets, padded to -probes slots so the columns after them line up
+func rttsColumn(rttsArray []time.Duration) string {
+	var partsArray []string
+	for _, rtt := range rttsArray {
+		partsArray = append(partsArray, fmt.Sprintf("%*s", rttWidth, humanDuration(rtt)))
+	}
+	for len(partsArray) < *hopProbes {
+		partsArray = append(partsArray, strings.Repeat(" ", rttWidth))
+	}
+	return "[" + strings.Join(partsArray, " ") + "]"
+}
+
+// Formats a duration with three significant digits in the largest unit it reaches, e.g. 12.5µs, 340ms or 1.2s.
+// Unlike Duration.String the precision does not grow with the unit, so values of any size read alike.
+// With -precision every duration is shown in milliseconds with that many decimals instead.
+func humanDuration(d time.Duration) string {
+	if *rttPrecision >= 0 {
+		return formatMillis(d, *rttPrecision) + "ms"
+	}
+	if d < 0 {
+		return "-" + humanDuration(-d)
+	}
+	if d < time.Microsecond {
+		return fmt.Sprintf("%dns", d.Nanoseconds())
+	}
+
+	unitsArray := []struct {
+		size time.Duration
+		name string
+	}{{time.Microsecond, "µs"}, {time.Millisecond, "ms"}, {time.Second, "s"}}
+	for i, unit := range unitsArray {
+		last := i == len(unitsArray)-1
+		if !last && d >= unitsArray[i+1].size {
+			continue
+		}
+		value := float64(d) / float64(unit.size)
+		if last && value >= 1000 {
+			return strconv.FormatFloat(value, 'f', 0, 64) + unit.name
+		}
+		text := strconv.FormatFloat(value, 'g', 3, 64)
+		// 999.96 rounds up to 1e+03, which is 1 of the next unit; seconds have none
+		if strings.Contains(text, "e") {
+			if last {
+				return strconv.FormatFloat(value, 'f', 0, 64) + unit.name
+			}
+			return "1" + unitsArray[i+1].name
+		}
+		return text + unit.name
+	}
+	return d.String()
+}
+
+// Formats a duration as a number of milliseconds with the given decimals, or those of -precision when set
+func formatMillis(d time.Duration, decimals int) string {
+	if *rttPrecision >= 0 {
+		decimals = *rttPrecision
+	}
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', decimals, 64)
+}
+
+// Returns the peers of a hop, with -hop-hostname-width padded to the width of a single named peer
+func peersColumn(hop HopResult) string {
+	peers := hopPeersString(hop)
+	if *hostnameWidth == 0 {
+		return peers
+	}
+	var addressWidth int = len("255.255.255.255")
+	if *useIPv6 {
+		addressWidth = len("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")
+	}
+	return fmt.Sprintf("%-*s", len("[ ()]")+addressWidth+*hostnameWidth, peers)
+}
+
+// Cuts a hop name to -hop-hostname-width characters, marking the cut with an ellipsis
+func fitHostname(name string) string {
+	runes := []rune(name)
+	if *hostnameWidth == 0 || len(runes) <= *hostnameWidth {
+		return name
+	}
+	return string(runes[:*hostnameWidth-1]) + "…"
+}
+
+// Returns remarks printed after the peers of a hop
+func hopNotes(hop HopResult) string {
+	var notes string
+	if hop.ARPRetry {
+		notes += "  (first probe lost, likely ARP)"
+	}
+	if hop.Confirmed {
+		notes += "  (answered only the confirmation probes)"
+	}
+	if hop.TerminalReply != "" {
+		notes += "  (reached on " + hop.TerminalReply + ")"
+	} else if (hop.Reached || hop.NonTargetEcho) && hop.ReplyCode != *echoCode {
+		notes += fmt.Sprintf("  (echo reply code %d, sent %d)", hop.ReplyCode, *echoCode)
+	}
+	if len(hop.Timestamps) > 0 || hop.TimestampOverflow > 0 {
+		notes += "  (timestamps: " + timestampsString(hop.Timestamps, hop.TimestampOverflow) + ")"
+	}
+	if hop.Mangled > 0 {
+		notes += fmt.Sprintf("  (%d replies with altered payload)", hop.Mangled)
+	}
+	if hop.Truncated > 0 {
+		notes += fmt.Sprintf("  (%d replies larger than the read buffer, possibly incomplete)", hop.Truncated)
+	}
+	if *showNameHints {
+		if hints := hopNameHints(hop); hints != "" {
+			notes += "  (name suggests " + hints + ")"
+		}
+	}
+	if *verbose {
+		for _, advisory := range hop.Advisories {
+			notes += "  (" + advisory + ")"
+		}
+	}
+	if len(hop.Sizes) > 0 {
+		notes += "  (by size: " + sizeRTTs(hop) + ")"
+	}
+	if *verbose && len(hop.Timings) > 0 {
+		var timesArray []string
+		for _, timing := range hop.Timings {
+			timesArray = append(timesArray, timing.Sent.Format("15:04:05.000000")+">"+timing.Received.Format("15:04:05.000000"))
+		}
+		notes += "  (sent>received " + strings.Join(timesArray, " ") + ")"
+	}
+	if *verbose && hop.Duplicates+hop.Reordered > 0 {
+		notes += fmt.Sprintf("  (%d duplicate, %d reordered replies)", hop.Duplicates, hop.Reordered)
+	}
+	return notes
+}
+
+// Returns the average RTT of each payload size of a hop, in the order the sizes were first answered
+func sizeRTTs(hop HopResult) string {
+	var sizesArray []int
+	rtts := make(map[int][]time.Duration)
+	for i, size := range hop.Sizes {
+		if _, ok := rtts[size]; !ok {
+			sizesArray = append(sizesArray, size)
+		}
+		rtts[size] = append(rtts[size], hop.RTTs[i])
+	}
+
+	var partsArray []string
+	for _, size := range sizesArray {
+		_, avg, _ := rttStats(rtts[size])
+		partsArray = append(partsArray, fmt.Sprintf("%dB %s", size, humanDuration(avg)))
+	}
+	return strings.Join(partsArray, ", ")
+}
+
+// Built-in templates selectable by name with -template
+var namedTemplates = map[string]string{
+	"default": `{{printf "%3d" .TTL}} {{if .Err}}ERROR{{else}}{{rtts .RTTs}} {{if .Reached}}Reached{{else}}TTLExc at{{end}} {{peers .Peers}}{{end}}`,
+	"mtr":     `{{printf "%3d." .TTL}} {{printf "%-40s" (peers .Peers)}} {{printf "%5.1f%%" (loss .)}} {{printf "%4d" .Sent}} {{printf "%8s" (ms (last .RTTs))}} {{printf "%8s" (ms (avg .RTTs))}} {{printf "%8s" (ms (best .RTTs))}} {{printf "%8s" (ms (worst .RTTs))}}`,
+}
+
+var templateFuncs = template.FuncMap{
+	"peers": func(peersArray []net.Addr) string {
+		if len(peersArray) == 0 {
+			return "???"
+		}
+		return strings.Join(uniquePeers(peersArray), " ")
+	},
+	"rtts":     rttsColumn,
+	"duration": humanDuration,
+	"ms": func(d time.Duration) string {
+		return formatMillis(d, 2)
+	},
+	"loss": func(hop HopResult) float64 {
+		return lossPercent(hop.Sent, len(hop.RTTs))
+	},
+	"last": func(durationsArray []time.Duration) time.Duration {
+		if len(durationsArray) == 0 {
+			return 0
+		}
+		return durationsArray[len(durationsArray)-1]
+	},
+	"best": func(durationsArray []time.Duration) time.Duration {
+		return bestRTT(durationsArray, *bestMethod)
+	},
+	"avg": func(durationsArray []time.Duration) time.Duration {
+		_, avg, _ := rttStats(durationsArray)
+		return avg
+	},
+	"worst": func(durationsArray []time.Duration) time.Duration {
+		_, _, max := rttStats(durationsArray)
+		return max
+	},
+}
+
+// templateReporter renders every hop, or the whole trace at its end, through a user template
+type templateReporter struct {
+	tmpl  *template.Template
+	trace bool
+}
+
+// Parses the -template value: a built-in name, @file or the template text itself
+func newTemplateReporter(value string, trace bool) (*templateReporter, error) {
+	text, ok := namedTemplates[value]
+	if !ok {
+		text = value
+		if strings.HasPrefix(value, "@") {
+			data, err := os.ReadFile(value[1:])
+			if err != nil {
+				return nil, err
+			}
+			text = string(data)
+		}
+	}
+
+	tmpl, err := template.New("output").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	// Executes once against an empty result so unknown fields fail at startup
+	var sample interface{} = HopResult{}
+	if trace {
+		sample = &TraceResult{}
+	}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, err
+	}
+	return &templateReporter{tmpl: tmpl, trace: trace}, nil
+}
+
+func (r *templateReporter) Start(target string, maxTTL int, traceID string) {}
+
+func (r *templateReporter) Hop(hop HopResult) {
+	if !r.trace {
+		r.render(hop)
+	}
+}
+
+func (r *templateReporter) Note(text string) {
+	fmt.Fprintf(os.Stderr, "%s\n", text)
+}
+
+func (r *templateReporter) End(result *TraceResult) {
+	if r.trace {
+		r.render(result)
+	}
+}
+
+func (r *templateReporter) render(data interface{}) {
+	var buf strings.Builder
+	if err := r.tmpl.Execute(&buf, data); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	text := buf.String()
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	fmt.Print(text)
+}
+
+// jsonReporter prints the whole TraceResult as one JSON document
+type jsonReporter struct{}
+
+func (jsonReporter) Start(target string, maxTTL int, traceID string) {}
+
+func (jsonReporter) Hop(hop HopResult) {}
+
+// Notes go to stderr so stdout stays a valid document
+func (jsonReporter) Note(text string) {
+	fmt.Fprintf(os.Stderr, "%s\n", text)
+}
+
+func (jsonReporter) End(result *TraceResult) {
+	data, err := marshalTrace(result)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	os.Stdout.Write(append(data, '\n'))
+}
+
+// jsonlRecord is one line of -jsonl output
+type jsonlRecord struct {
+	Target  string `json:"target"`
+	TraceID string `json:"trace_id"`
+	hopJSON
+}
+
+// jsonlReporter streams a JSON object per hop, one per line
+type jsonlReporter struct {
+	target  string
+	traceID string
+}
+
+func (r *jsonlReporter) Start(target string, maxTTL int, traceID string) {
+	r.target = target
+	r.traceID = traceID
+}
+
+func (r *jsonlReporter) Hop(hop HopResult) {
+	data, err := json.Marshal(jsonlRecord{Target: r.target, TraceID: r.traceID, hopJSON: hop.toJSON()})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+
+	if err := stdoutRecords.writeRecord(data); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+}
+
+func (r *jsonlReporter) Note(text string) {
+	fmt.Fprintf(os.Stderr, "%s\n", text)
+}
+
+func (r *jsonlReporter) End(result *TraceResult) {}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHumanDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0ns"},
+		{999 * time.Nanosecond, "999ns"},
+		{time.Microsecond, "1µs"},
+		{12500 * time.Nanosecond, "12.5µs"},
+		{999960 * time.Nanosecond, "1ms"},
+		{340 * time.Millisecond, "340ms"},
+		{1234567 * time.Microsecond, "1.23s"},
+		{999400 * time.Millisecond, "999s"},
+		{999700 * time.Millisecond, "1000s"},
+		{999999 * time.Millisecond, "1000s"},
+		{1000 * time.Second, "1000s"},
+		{1500 * time.Second, "1500s"},
+		{-2 * time.Millisecond, "-2ms"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := humanDuration(tt.d); got != tt.want {
+				t.Errorf("humanDuration(%d) = %q, want %q", tt.d, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatMillis(t *testing.T) {
+	tests := []struct {
+		name      string
+		precision int
+		d         time.Duration
+		decimals  int
+		want      string
+	}{
+		{name: "caller's decimals", precision: -1, d: 12345678, decimals: 2, want: "12.35"},
+		{name: "sub-millisecond", precision: -1, d: 65 * time.Microsecond, decimals: 2, want: "0.07"},
+		{name: "no decimals", precision: -1, d: 12345678, decimals: 0, want: "12"},
+		{name: "-precision overrides", precision: 3, d: 12345678, decimals: 2, want: "12.346"},
+		{name: "-precision 0", precision: 0, d: 12545678, decimals: 2, want: "13"},
+		{name: "-precision 9", precision: 9, d: 1, decimals: 2, want: "0.000001000"},
+		{name: "negative", precision: -1, d: -1500 * time.Microsecond, decimals: 1, want: "-1.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, rttPrecision, tt.precision)
+			if got := formatMillis(tt.d, tt.decimals); got != tt.want {
+				t.Errorf("formatMillis(%d, %d) = %q, want %q", tt.d, tt.decimals, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrecisionOfDurations(t *testing.T) {
+	tests := []struct {
+		name      string
+		precision int
+		d         time.Duration
+		duration  string
+		ms        string
+	}{
+		{name: "significant digits", precision: -1, d: 12345678, duration: "12.3ms", ms: "12.35"},
+		{name: "microseconds", precision: -1, d: 65 * time.Microsecond, duration: "65µs", ms: "0.07"},
+		{name: "three decimals", precision: 3, d: 12345678, duration: "12.346ms", ms: "12.346"},
+		{name: "microseconds in milliseconds", precision: 3, d: 65 * time.Microsecond, duration: "0.065ms", ms: "0.065"},
+		{name: "seconds in milliseconds", precision: 1, d: 2 * time.Second, duration: "2000.0ms", ms: "2000.0"},
+		{name: "negative", precision: 3, d: -1500 * time.Microsecond, duration: "-1.500ms", ms: "-1.500"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, rttPrecision, tt.precision)
+			if got := humanDuration(tt.d); got != tt.duration {
+				t.Errorf("humanDuration(%d) = %q, want %q", tt.d, got, tt.duration)
+			}
+			ms := templateFuncs["ms"].(func(time.Duration) string)
+			if got := ms(tt.d); got != tt.ms {
+				t.Errorf("ms %d = %q, want %q", tt.d, got, tt.ms)
+			}
+			if got := tuiMs(tt.d); got != tt.ms {
+				t.Errorf("tuiMs(%d) = %q, want %q", tt.d, got, tt.ms)
+			}
+			// JSON keeps full precision
+			data, err := json.Marshal(HopResult{TTL: 1, RTTs: []time.Duration{tt.d}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), strconv.FormatInt(int64(tt.d), 10)) {
+				t.Errorf("JSON %s lost the precision of %d", data, tt.d)
+			}
+		})
+	}
+}
+
+func TestDestinationSummary(t *testing.T) {
+	tests := []struct {
+		ttl  int
+		want string
+	}{
+		{1, "destination [10.9.9.9] reached in 1 hop: best 1ms, avg 1ms"},
+		{4, "destination [10.9.9.9] reached in 4 hops: best 1ms, avg 1ms"},
+	}
+	for _, tt := range tests {
+		offlineDNS(t, nil)
+		hop := HopResult{TTL: tt.ttl, Sent: 1, RTTs: []time.Duration{time.Millisecond}, Peers: addrs("10.9.9.9"), Reached: true}
+		if got := destinationSummary(hop); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
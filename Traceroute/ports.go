@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Ports parsed from -ports, none when it is not given
+var portsList []int
+
+// At most this many ports are checked per trace, so a long list or range cannot turn a trace into a port scan
+const maxPorts = 64
+
+// How a destination port answered the connection of -ports
+const (
+	// SYN-ACK; the connection is closed right away
+	portOpen = "open"
+	// RST, which the destination itself sends, so it is reached on that port all the same
+	portClosed = "closed"
+	// No answer before the timeout, as a firewall dropping the SYN leaves it
+	portFiltered = "filtered"
+	// An ICMP error, such as host unreachable or administratively prohibited
+	portUnreachable = "unreachable"
+)
+
+// portReach is the outcome of one port of -ports
+type portReach struct {
+	Port  int           `json:"port"`
+	State string        `json:"state"`
+	RTT   time.Duration `json:"rtt_ns,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// Reports whether the port's answer came from the destination
+func (p portReach) Reachable() bool {
+	return p.State == portOpen || p.State == portClosed
+}
+
+func (p portReach) String() string {
+	switch p.State {
+	case portOpen:
+		return fmt.Sprintf("port %d: open, SYN-ACK after %s", p.Port, humanDuration(p.RTT))
+	case portClosed:
+		return fmt.Sprintf("port %d: closed, RST after %s (destination reachable)", p.Port, humanDuration(p.RTT))
+	case portFiltered:
+		return fmt.Sprintf("port %d: filtered, no answer", p.Port)
+	}
+	return fmt.Sprintf("port %d: unreachable, %s", p.Port, p.Error)
+}
+
+// Parses a -ports list of ports and ranges, e.g. 22,80,443 or 8000-8010, in the order given and
+// without repeats
+func parsePorts(text string) ([]int, error) {
+	var portsArray []int
+	seen := make(map[int]bool)
+	for _, field := range strings.Split(text, ",") {
+		field = strings.TrimSpace(field)
+		first, last := field, field
+		if i := strings.Index(field, "-"); i > 0 {
+			first, last = field[:i], field[i+1:]
+		}
+		low, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("-ports takes ports and ranges such as 22,80,443 or 8000-8010, got %q", field)
+		}
+		high, err := strconv.Atoi(last)
+		if err != nil || low < 1 || high > 65535 || high < low {
+			return nil, fmt.Errorf("-ports takes ports and ranges such as 22,80,443 or 8000-8010, got %q", field)
+		}
+		for port := low; port <= high; port++ {
+			if seen[port] {
+				continue
+			}
+			seen[port] = true
+			portsArray = append(portsArray, port)
+			if len(portsArray) > maxPorts {
+				return nil, fmt.Errorf("-ports checks at most %d ports", maxPorts)
+			}
+		}
+	}
+	return portsArray, nil
+}
+
+// Connects to every port of the destination at full TTL, at most workers at a time, and returns
+// the outcomes in the order of portsArray. The connections leave through the options of the probe
+// sockets and count against -rate, each as one probe of a bare SYN.
+func probePorts(dest *net.IPAddr, portsArray []int, workers int, timeout time.Duration) []portReach {
+	dialer := &net.Dialer{Timeout: timeout, Control: listenConfig().Control}
+	if *sourceIface != "" {
+		if source, err := probeSource(*sourceIface, dest.IP.To4() == nil); err == nil {
+			dialer.LocalAddr, _ = net.ResolveTCPAddr("tcp", net.JoinHostPort(source, "0"))
+		}
+	}
+
+	results := make([]portReach, len(portsArray))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(portsArray); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = probePort(dialer, dest, portsArray[i])
+			}
+		}()
+	}
+	for i := range portsArray {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+// Connects to one port and classifies the answer
+func probePort(dialer *net.Dialer, dest *net.IPAddr, port int) portReach {
+	result := portReach{Port: port}
+	if _, err := egressLimit.wait(context.Background(), 40); err != nil {
+		result.State, result.Error = portUnreachable, err.Error()
+		return result
+	}
+
+	start := time.Now()
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(dest.String(), strconv.Itoa(port)))
+	result.RTT = time.Since(start)
+	var netErr net.Error
+	switch {
+	case err == nil:
+		conn.Close()
+		result.State = portOpen
+	case errors.Is(err, syscall.ECONNREFUSED):
+		result.State = portClosed
+	case errors.As(err, &netErr) && netErr.Timeout():
+		result.State, result.RTT = portFiltered, 0
+	default:
+		result.State, result.RTT = portUnreachable, 0
+		result.Error = err.Error()
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Err != nil {
+			result.Error = opErr.Err.Error()
+		}
+	}
+	return result
+}
+
+// Returns the summary line of the ports, e.g. "ports: 2 of 3 reach 10.0.0.1 (22, 443), 80 filtered"
+func portsSummary(dest *net.IPAddr, portsArray []portReach) string {
+	var reachedArray, filteredArray, unreachableArray []string
+	for _, port := range portsArray {
+		switch {
+		case port.Reachable():
+			reachedArray = append(reachedArray, strconv.Itoa(port.Port))
+		case port.State == portFiltered:
+			filteredArray = append(filteredArray, strconv.Itoa(port.Port))
+		default:
+			unreachableArray = append(unreachableArray, strconv.Itoa(port.Port))
+		}
+	}
+	text := fmt.Sprintf("ports: %d of %d reach %s", len(reachedArray), len(portsArray), dest)
+	if len(reachedArray) > 0 {
+		text += " (" + strings.Join(reachedArray, ", ") + ")"
+	}
+	if len(filteredArray) > 0 {
+		text += ", " + strings.Join(filteredArray, ", ") + " filtered"
+	}
+	if len(unreachableArray) > 0 {
+		text += ", " + strings.Join(unreachableArray, ", ") + " unreachable"
+	}
+	return text
+}
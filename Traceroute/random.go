@@ -0,0 +1,28 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Source of every randomized probing decision, seeded with -seed so a run can be repeated.
+// OTLP span IDs stay on crypto/rand since they must not repeat across runs.
+var (
+	randomMutex  sync.Mutex
+	randomSource = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Restarts the shared source from seed
+func seedRandom(seed int64) {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+	randomSource = rand.New(rand.NewSource(seed))
+}
+
+// Returns a random permutation of 0 to n-1 drawn from the shared source
+func randomPerm(n int) []int {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+	return randomSource.Perm(n)
+}
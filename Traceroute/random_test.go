@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Returns the TTLs a random order trace probes with the shared source seeded with seed
+func seededProbeOrder(t *testing.T, seed int64) []int {
+	seedRandom(seed)
+	conn := newFakeConn(fakePath("10.9.9.9", "", "", "", "", "", "", ""))
+	useFakeNetwork(t, conn)
+	if _, err := tracert("10.9.9.9", traceConfig{MaxTTL: 8, Method: "icmp"}, &recordingReporter{}); err != nil {
+		t.Fatal(err)
+	}
+	var probed []int
+	for _, probe := range conn.sent() {
+		if len(probed) == 0 || probed[len(probed)-1] != probe.TTL {
+			probed = append(probed, probe.TTL)
+		}
+	}
+	return probed
+}
+
+func TestSeedRepeatsRandomOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		seeds [2]int64
+		same  bool
+	}{
+		{"same seed", [2]int64{42, 42}, true},
+		{"another seed", [2]int64{42, 43}, false},
+		{"negative seed", [2]int64{-7, -7}, true},
+	}
+	saved := randomSource
+	defer func() { randomSource = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			setFlag(t, probeOrder, "random")
+			offlineDNS(t, nil)
+
+			first, second := seededProbeOrder(t, tt.seeds[0]), seededProbeOrder(t, tt.seeds[1])
+			if len(first) != 8 || reflect.DeepEqual(first, second) != tt.same {
+				t.Errorf("seeds %v probed %v and %v, want the same order: %v", tt.seeds, first, second, tt.same)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the probes sent by every trace of the run, those of -batch-concurrency
+// included, to a rate of packets or bytes per second. The bucket holds one probe's worth of
+// tokens, so the probes are spread out evenly and never leave in a burst above the rate.
+type tokenBucket struct {
+	mutex sync.Mutex
+
+	// Tokens added per second; a probe takes one token, or one per byte with perByte
+	rate    float64
+	perByte bool
+
+	// When the bucket has refilled the tokens taken so far
+	next time.Time
+}
+
+// Limit parsed from -rate, nil when probes are not limited
+var egressLimit *tokenBucket
+
+// Parses a -rate value: a number of packets per second, optionally ending in pps,
+// or of bytes per second ending in B/s, kB/s or MB/s
+func parseRate(text string) (*tokenBucket, error) {
+	unitsArray := []struct {
+		suffix  string
+		factor  float64
+		perByte bool
+	}{
+		{"kB/s", 1000, true},
+		{"MB/s", 1000 * 1000, true},
+		{"B/s", 1, true},
+		{"pps", 1, false},
+	}
+	number, factor, perByte := text, 1.0, false
+	for _, unit := range unitsArray {
+		if strings.HasSuffix(text, unit.suffix) {
+			number, factor, perByte = strings.TrimSuffix(text, unit.suffix), unit.factor, unit.perByte
+			break
+		}
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("-rate takes a positive number of packets per second, e.g. 20 or 20pps, or of bytes per second, e.g. 500B/s, 64kB/s or 1MB/s, got %q", text)
+	}
+	return &tokenBucket{rate: rate * factor, perByte: perByte}, nil
+}
+
+// Waits until a probe of length bytes may be sent, or ctx is done. Returns how long it waited;
+// callers set their reply deadline once the probe is sent, so the wait does not count against the timeout.
+func (b *tokenBucket) wait(ctx context.Context, length int) (time.Duration, error) {
+	if b == nil {
+		return 0, nil
+	}
+	cost := 1.0
+	if b.perByte {
+		cost = float64(length)
+	}
+
+	// The tokens are taken right away, so probes of concurrent traces queue up in turn
+	b.mutex.Lock()
+	now := time.Now()
+	at := b.next
+	if at.Before(now) {
+		at = now
+	}
+	b.next = at.Add(time.Duration(cost / b.rate * float64(time.Second)))
+	b.mutex.Unlock()
+
+	delay := at.Sub(now)
+	if delay <= 0 {
+		return 0, nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return delay, nil
+	case <-ctx.Done():
+		return time.Since(now), ctx.Err()
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedProbes(t *testing.T) {
+	tests := []struct {
+		name      string
+		rate      float64
+		cancelled bool
+	}{
+		{"spaced by the limit", 20, false},
+		{"cancelled while waiting", 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 50*time.Millisecond)
+			setFlag(t, timeoutMax, 50*time.Millisecond)
+			setFlag(t, &egressLimit, &tokenBucket{rate: tt.rate})
+			tracer := newTracer(newFakeConn(fakePath("10.9.9.9")), ip4("10.9.9.9"), false)
+			tracer.stampPayload = true
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			tracer.ctx = ctx
+			if tt.cancelled {
+				// The bucket is drained, so the first probe already waits a second
+				egressLimit.next = time.Now().Add(time.Second)
+				time.AfterFunc(20*time.Millisecond, cancel)
+			}
+
+			start := time.Now()
+			hop := ping(tracer, 1)
+			elapsed := time.Since(start)
+			if tt.cancelled {
+				if !errors.Is(hop.Err, context.Canceled) || elapsed > 500*time.Millisecond {
+					t.Fatalf("got %v after %v, want the wait cancelled", hop.Err, elapsed)
+				}
+				return
+			}
+			if hop.Err != nil || len(hop.RTTs) != 3 {
+				t.Fatalf("got %d replies, error %v", len(hop.RTTs), hop.Err)
+			}
+			if elapsed < 90*time.Millisecond {
+				t.Errorf("3 probes at 20pps took %v, want at least 100ms", elapsed)
+			}
+			// The send time in the payload is taken after the wait
+			for _, rtt := range hop.RTTs {
+				if rtt > 25*time.Millisecond {
+					t.Errorf("RTT %v includes the wait for the limit", rtt)
+				}
+			}
+		})
+	}
+}
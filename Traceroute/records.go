@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// recordWriter writes records to a stream, such as hop lines for a log shipper, each complete and
+// newline-terminated in a single write. Records are fully built before the write starts, so output
+// stops between records, never inside one, and concurrent writers cannot interleave their lines.
+type recordWriter struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+// Streaming reporters write their records to stdout through this writer
+var stdoutRecords = &recordWriter{out: os.Stdout}
+
+// Writes the record, adding the final newline when it lacks one. A short write is only retried for the rest,
+// which the os package already does for files, so a record is never repeated.
+func (w *recordWriter) writeRecord(record []byte) error {
+	if len(record) == 0 || record[len(record)-1] != '\n' {
+		record = append(record[:len(record):len(record)], '\n')
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for len(record) > 0 {
+		n, err := w.out.Write(record)
+		if err != nil {
+			return err
+		}
+		record = record[n:]
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// chunkWriter takes at most limit bytes per write, 0 for no limit, and records every write
+type chunkWriter struct {
+	limit       int
+	err         error
+	out         bytes.Buffer
+	writesArray []int
+}
+
+func (w *chunkWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.limit > 0 && len(b) > w.limit {
+		b = b[:w.limit]
+	}
+	w.writesArray = append(w.writesArray, len(b))
+	return w.out.Write(b)
+}
+
+func TestWriteRecord(t *testing.T) {
+	tests := []struct {
+		name   string
+		record string
+		limit  int
+		err    error
+		want   string
+		writes int
+	}{
+		{"terminated", "hop 1 10.0.0.1\n", 0, nil, "hop 1 10.0.0.1\n", 1},
+		{"newline added", "hop 1 10.0.0.1", 0, nil, "hop 1 10.0.0.1\n", 1},
+		{"empty", "", 0, nil, "\n", 1},
+		{"large", strings.Repeat("x", 1<<16), 0, nil, strings.Repeat("x", 1<<16) + "\n", 1},
+		{"short writes continue with the rest", "hop 1 10.0.0.1", 4, nil, "hop 1 10.0.0.1\n", 4},
+		{"failing writer", "hop 1 10.0.0.1", 0, errors.New("broken pipe"), "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &chunkWriter{limit: tt.limit, err: tt.err}
+			record := []byte(tt.record)
+			err := (&recordWriter{out: out}).writeRecord(record)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if out.out.String() != tt.want || len(out.writesArray) != tt.writes {
+				t.Errorf("wrote %q in %d writes, want %q in %d", out.out.String(), len(out.writesArray), tt.want, tt.writes)
+			}
+			if string(record) != tt.record {
+				t.Errorf("record changed to %q", record)
+			}
+		})
+	}
+}
+
+func TestWriteRecordConcurrently(t *testing.T) {
+	out := &chunkWriter{limit: 3}
+	writer := &recordWriter{out: out}
+	recordsArray := []string{"hop 1 10.0.0.1 1.2ms", "hop 2 10.0.0.2 3.4ms", "hop 3 10.0.0.3 5.6ms"}
+	var wg sync.WaitGroup
+	for _, record := range recordsArray {
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(record string) {
+				defer wg.Done()
+				writer.writeRecord([]byte(record))
+			}(record)
+		}
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(out.out.String(), "\n"), "\n")
+	if len(lines) != 60 {
+		t.Fatalf("got %d lines, want 60", len(lines))
+	}
+	for _, line := range lines {
+		if line != recordsArray[0] && line != recordsArray[1] && line != recordsArray[2] {
+			t.Errorf("records interleaved into %q", line)
+		}
+	}
+}
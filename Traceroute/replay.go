@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Renders the traces saved with -save, -output-dir or -binary through the reporter, as if they ran again
+func replayTraces(path string, rate float64, reporter Reporter) error {
+	resultsArray, err := loadTraces(path)
+	if err != nil {
+		return err
+	}
+	for _, result := range resultsArray {
+		replayTrace(result, rate, reporter)
+	}
+	return nil
+}
+
+// With rate 0 every hop is shown at once; otherwise the gaps between the stored completion
+// times of the hops are kept, divided by rate, so 2 replays twice as fast and 0.5 at half speed.
+func replayTrace(result *TraceResult, rate float64, reporter Reporter) {
+
+	// The saved trace does not keep its MaxTTL; an unreached one probed up to it
+	maxTTL := MaxTTL
+	if !result.Reached && len(result.Hops) > 0 {
+		maxTTL = result.Hops[len(result.Hops)-1].TTL
+	}
+	reporter.Start(result.Target, maxTTL, result.TraceID)
+
+	var previous time.Time
+	for _, hop := range result.Hops {
+		if rate > 0 && !previous.IsZero() && hop.Time.After(previous) {
+			time.Sleep(time.Duration(float64(hop.Time.Sub(previous)) / rate))
+		}
+		if !hop.Time.IsZero() {
+			previous = hop.Time
+		}
+		reporter.Hop(hop)
+	}
+
+	if result.FirstResponse > 0 {
+		reporter.Note(fmt.Sprintf("first hop response after %s", humanDuration(result.FirstResponse)))
+	} else {
+		reporter.Note("first hop response: NA")
+	}
+	reporter.Note(result.Counters.String())
+	reporter.End(result)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Parallel PTR lookups of -resolve-after
+const ResolveWorkers = 8
+
+// Resolver of PTR and origin lookups, the system one unless -hop-dns-servers is given
+var hopResolver = net.DefaultResolver
+
+// Builds a resolver asking the given comma separated servers, each an IP with an optional port
+func newHopResolver(servers string) (*net.Resolver, error) {
+	var addressesArray []string
+	for _, server := range strings.Split(servers, ",") {
+		server = strings.TrimSpace(server)
+		host, port, err := net.SplitHostPort(server)
+		if err != nil {
+			host, port = strings.Trim(server, "[]"), "53"
+		}
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("DNS server %q is not an IP address", server)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return nil, fmt.Errorf("DNS server %q has an invalid port", server)
+		}
+		addressesArray = append(addressesArray, net.JoinHostPort(host, port))
+	}
+
+	// Every new connection goes to the next server in turn
+	var next uint32 = 0
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			server := addressesArray[int(atomic.AddUint32(&next, 1)-1)%len(addressesArray)]
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}, nil
+}
+
+// enrichment is the context shared by the PTR and origin lookups of the running traces.
+// -enrich-timeout cancels it once the probing is over and the time is up, so lookups
+// in flight and the ones still to come give up together. Lookups do not know which
+// trace they serve, so traces running at once share it: it is only cancelled when
+// every one of them is past its limit, and a trace ending never cuts another one short.
+var enrichment = struct {
+	sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	timer  *time.Timer
+
+	// Traces started and not ended, how many of them have no limit yet, and the latest limit
+	running   int
+	unlimited int
+	deadline  time.Time
+}{}
+
+// enrichmentSession is the part of one trace in the shared lookup context
+type enrichmentSession struct {
+	limited bool
+	ended   bool
+}
+
+// Joins the trace to the shared lookup context, starting it when no other trace runs
+func startEnrichment() *enrichmentSession {
+	enrichment.Lock()
+	defer enrichment.Unlock()
+	// A trace starting after the running ones ran out of time gets a fresh context
+	if enrichment.running == 0 || enrichment.ctx.Err() != nil {
+		enrichment.ctx, enrichment.cancel = context.WithCancel(context.Background())
+		enrichment.deadline = time.Time{}
+	}
+	enrichment.running++
+	enrichment.unlimited++
+	return &enrichmentSession{}
+}
+
+// Gives the lookups of the trace timeout more, 0 for as long as it runs
+func (s *enrichmentSession) limit(timeout time.Duration) {
+	enrichment.Lock()
+	defer enrichment.Unlock()
+	if s.limited || s.ended || timeout <= 0 {
+		return
+	}
+	s.limited = true
+	enrichment.unlimited--
+	if deadline := time.Now().Add(timeout); deadline.After(enrichment.deadline) {
+		enrichment.deadline = deadline
+	}
+	armEnrichmentTimer()
+}
+
+// Leaves the shared lookup context, ending it when this was the last trace
+func (s *enrichmentSession) end() {
+	enrichment.Lock()
+	defer enrichment.Unlock()
+	if s.ended {
+		return
+	}
+	s.ended = true
+	enrichment.running--
+	if !s.limited {
+		enrichment.unlimited--
+	}
+	if enrichment.running > 0 {
+		armEnrichmentTimer()
+		return
+	}
+	if enrichment.timer != nil {
+		enrichment.timer.Stop()
+		enrichment.timer = nil
+	}
+	enrichment.cancel()
+	enrichment.ctx, enrichment.cancel = nil, nil
+}
+
+// Cancels the shared context at the latest limit once every running trace has one; called locked
+func armEnrichmentTimer() {
+	if enrichment.timer != nil {
+		enrichment.timer.Stop()
+		enrichment.timer = nil
+	}
+	if enrichment.unlimited > 0 || enrichment.deadline.IsZero() {
+		return
+	}
+	enrichment.timer = time.AfterFunc(time.Until(enrichment.deadline), enrichment.cancel)
+}
+
+// Returns the context lookups are made under, the trace's one while a trace runs
+func enrichmentContext() context.Context {
+	enrichment.Lock()
+	defer enrichment.Unlock()
+	if enrichment.ctx == nil {
+		return context.Background()
+	}
+	return enrichment.ctx
+}
+
+// Reports whether -enrich-timeout cut the lookups of the running trace short
+func enrichmentExpired() bool {
+	return enrichmentContext().Err() != nil
+}
+
+// ptrCache remembers the names of every address, failed lookups included, so each is resolved once.
+// Lookups of an address already in flight wait for that lookup instead of repeating it.
+var ptrCache = struct {
+	sync.Mutex
+	names   map[string][]string
+	pending map[string]chan struct{}
+}{names: make(map[string][]string), pending: make(map[string]chan struct{})}
+
+// Returns the PTR names of addr without their trailing dots, waiting at most -resolve-timeout.
+// A lookup cut short by -enrich-timeout is not cached, so a later trace resolves the address again.
+func lookupPTR(addr string) []string {
+	ptrCache.Lock()
+	if names, ok := ptrCache.names[addr]; ok {
+		ptrCache.Unlock()
+		return names
+	}
+	if done, ok := ptrCache.pending[addr]; ok {
+		ptrCache.Unlock()
+		<-done
+		return lookupPTR(addr)
+	}
+	done := make(chan struct{})
+	ptrCache.pending[addr] = done
+	ptrCache.Unlock()
+
+	shared := enrichmentContext()
+	ctx, cancel := context.WithTimeout(shared, *resolveTimeout)
+	defer cancel()
+	ptr, _ := hopResolver.LookupAddr(ctx, addr)
+	var names []string
+	for _, name := range ptr {
+		name = strings.TrimSuffix(name, ".")
+		if *fcrdns && !forwardConfirmed(ctx, name, addr) {
+			name += " (unconfirmed)"
+		}
+		names = append(names, name)
+	}
+
+	ptrCache.Lock()
+	if shared.Err() == nil {
+		ptrCache.names[addr] = names
+	}
+	delete(ptrCache.pending, addr)
+	ptrCache.Unlock()
+	close(done)
+	return names
+}
+
+// Reports whether name resolves back to addr, which anyone controlling the reverse zone cannot fake alone
+func forwardConfirmed(ctx context.Context, name string, addr string) bool {
+	ip := net.ParseIP(addr)
+	forward, err := hopResolver.LookupHost(ctx, name)
+	if err != nil || ip == nil {
+		return false
+	}
+	for _, candidate := range forward {
+		if ip.Equal(net.ParseIP(candidate)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ptrPrefetcher resolves addresses in the background with a bounded number of lookups at a time
+type ptrPrefetcher struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newPTRPrefetcher(workers int) *ptrPrefetcher {
+	return &ptrPrefetcher{slots: make(chan struct{}, workers)}
+}
+
+func (p *ptrPrefetcher) add(peersArray []net.Addr) {
+	for _, addr := range uniquePeers(peersArray) {
+		p.wg.Add(1)
+		go func(addr string) {
+			defer p.wg.Done()
+			p.slots <- struct{}{}
+			peerNames(addr)
+			<-p.slots
+		}(addr)
+	}
+}
+
+// Waits until every added address is in the cache; lookups are bounded by -resolve-timeout
+func (p *ptrPrefetcher) wait() {
+	p.wg.Wait()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Makes name lookups hang until they are given up on, as with an unresponsive DNS server
+func hangingDNS(t *testing.T) {
+	offlineDNS(t, nil)
+	hopResolver = &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}}
+}
+
+func TestEnrichTimeoutBoundsLookups(t *testing.T) {
+	tests := []struct {
+		name           string
+		enrichTimeout  time.Duration
+		resolveTimeout time.Duration
+		// The lookup takes about wait, and is cached when a -resolve-timeout ended it
+		wait   time.Duration
+		cached bool
+	}{
+		{"cut short by -enrich-timeout", 30 * time.Millisecond, 2 * time.Second, 30 * time.Millisecond, false},
+		{"bounded by -resolve-timeout", 0, 60 * time.Millisecond, 60 * time.Millisecond, true},
+		{"-resolve-timeout ends first", time.Second, 40 * time.Millisecond, 40 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hangingDNS(t)
+			setFlag(t, resolveTimeout, tt.resolveTimeout)
+			session := startEnrichment()
+			defer session.end()
+			session.limit(tt.enrichTimeout)
+
+			start := time.Now()
+			names := lookupPTR("192.0.2.7")
+			elapsed := time.Since(start)
+			if names != nil || elapsed < tt.wait || elapsed > tt.wait+300*time.Millisecond {
+				t.Errorf("got %q after %v, want nothing after %v", names, elapsed, tt.wait)
+			}
+			ptrCache.Lock()
+			_, cached := ptrCache.names["192.0.2.7"]
+			ptrCache.Unlock()
+			if cached != tt.cached {
+				t.Errorf("cached %v, want %v", cached, tt.cached)
+			}
+		})
+	}
+}
+
+func TestEnrichmentSharedByTraces(t *testing.T) {
+	first, second := startEnrichment(), startEnrichment()
+	first.limit(20 * time.Millisecond)
+	time.Sleep(40 * time.Millisecond)
+	if enrichmentExpired() {
+		t.Fatal("lookups cut short while a trace without a limit runs")
+	}
+	second.limit(20 * time.Millisecond)
+	time.Sleep(40 * time.Millisecond)
+	if !enrichmentExpired() {
+		t.Fatal("lookups not cut short once every trace ran out of time")
+	}
+	first.end()
+	second.end()
+
+	// A trace starting afterwards gets a fresh context
+	third := startEnrichment()
+	defer third.end()
+	if enrichmentExpired() {
+		t.Error("a new trace inherited the expired lookups")
+	}
+}
+
+func TestEnrichmentSessions(t *testing.T) {
+	tests := []struct {
+		name string
+		// Steps on two traces' sessions, after which the lookups must have expired or not
+		steps   func(first, second *enrichmentSession)
+		expired bool
+	}{
+		{name: "no limits", steps: func(first, second *enrichmentSession) {}, expired: false},
+		{name: "one trace limited", steps: func(first, second *enrichmentSession) {
+			first.limit(10 * time.Millisecond)
+		}, expired: false},
+		{name: "both traces limited", steps: func(first, second *enrichmentSession) {
+			first.limit(10 * time.Millisecond)
+			second.limit(20 * time.Millisecond)
+		}, expired: true},
+		{name: "the later limit wins", steps: func(first, second *enrichmentSession) {
+			first.limit(10 * time.Millisecond)
+			second.limit(time.Second)
+		}, expired: false},
+		{name: "limited trace ends", steps: func(first, second *enrichmentSession) {
+			first.limit(10 * time.Millisecond)
+			first.end()
+		}, expired: false},
+		{name: "unlimited trace ends", steps: func(first, second *enrichmentSession) {
+			first.limit(10 * time.Millisecond)
+			second.end()
+		}, expired: true},
+		{name: "limit after ending", steps: func(first, second *enrichmentSession) {
+			first.end()
+			first.limit(10 * time.Millisecond)
+		}, expired: false},
+		{name: "ended twice", steps: func(first, second *enrichmentSession) {
+			first.end()
+			first.end()
+			second.limit(10 * time.Millisecond)
+		}, expired: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, second := startEnrichment(), startEnrichment()
+			defer first.end()
+			defer second.end()
+			tt.steps(first, second)
+			time.Sleep(40 * time.Millisecond)
+			if enrichmentExpired() != tt.expired {
+				t.Errorf("lookups expired: %v, want %v", enrichmentExpired(), tt.expired)
+			}
+		})
+	}
+}
+
+// Traces running at once, each through its own socket, share the lookups, counters and output
+func TestConcurrentTraces(t *testing.T) {
+	tests := []struct {
+		name   string
+		traces int
+		setup  func(t *testing.T)
+	}{
+		{name: "sequential hops", traces: 16},
+		{name: "parallel hops", traces: 8, setup: func(t *testing.T) { setFlag(t, parallelTTLs, 3) }},
+		{name: "limited lookups", traces: 8, setup: func(t *testing.T) { setFlag(t, enrichTimeout, 5*time.Millisecond) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offlineDNS(t, map[string][]string{"10.0.0.1": {"gw.example."}})
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			if tt.setup != nil {
+				tt.setup(t)
+			}
+			saved := openTraceSocket
+			openTraceSocket = func(iface string, useIPv6 bool) (*icmpConn, error) {
+				return &icmpConn{PacketConn: newFakeConn(fakePath("10.9.9.9", "10.0.0.1", ""))}, nil
+			}
+			defer func() { openTraceSocket = saved }()
+
+			var wg sync.WaitGroup
+			for i := 0; i < tt.traces; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					reporter := &recordingReporter{}
+					result, err := tracert("10.9.9.9", traceConfig{MaxTTL: 5, Method: "icmp"}, reporter)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if !result.Reached || len(result.Hops) != 3 || len(reporter.hops) != 3 {
+						t.Errorf("reached %v in %d hops, %d reported", result.Reached, len(result.Hops), len(reporter.hops))
+					}
+					if _, err := json.Marshal(result); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
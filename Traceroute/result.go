@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+// HopResult is the outcome of probing a single TTL
+type HopResult struct {
+	TTL     int
+	Sent    int
+	RTTs    []time.Duration
+	Peers   []net.Addr
+	Reached bool
+	Err     error
+
+	// Payload sizes of the answered probes, in the order of RTTs, with -probe-sizes
+	Sizes []int
+
+	// Wall-clock times of the answered probes, in the order of RTTs, with -wall-clock
+	Timings []ProbeTiming
+
+	// Raw ICMP type and code of the answered probes, in the order of RTTs, with -json-raw;
+	// a hop that failed on an unexpected ICMP message has that message's only
+	Replies []ICMPReply
+
+	// UDP source ports of the answered probes, in the order of RTTs, with -udp-rotate-source
+	SourcePorts []int
+
+	// When the hop's probing completed
+	Time time.Time
+
+	// Echo replies came from an intermediate device instead of the destination
+	NonTargetEcho bool
+
+	// The first probe was lost and sent again, likely while ARP resolved the next hop
+	ARPRetry bool
+
+	// Every probe timed out and only the -min-ttl-confirm probes were answered
+	Confirmed bool
+
+	// Replies that arrived twice, or after a later probe had been sent
+	Duplicates int
+	Reordered  int
+
+	// Echo replies with a payload other than the one sent
+	Mangled int
+
+	// Replies that may have been cut short by the read buffer
+	Truncated int
+
+	// ICMP code of the last echo reply
+	ReplyCode int
+
+	// The -terminal-codes message that reached the destination instead of an echo reply
+	TerminalReply string
+
+	// Redirect and Source Quench messages received while probing
+	Advisories []string
+
+	// TOS byte of the last echo reply, read with -verify-dscp
+	ReplyTOS int
+	TOSKnown bool
+
+	// Timestamp option entries of the last reply, and how many routers had no room left, with -timestamp-option
+	Timestamps        []routerTimestamp
+	TimestampOverflow int
+
+	// Registry data of the first responder, set by annotateOrigins
+	ASN     string
+	Country string
+
+	// What the -enrichers found about the first responder, set by enrichHops
+	Annotations map[string]string
+
+	// Set by the post-trace analysis
+	RateLimited bool
+	// Likely role of the hop with -hop-roles, see markRoles
+	Role string
+}
+
+// ICMPReply is the type and code number of the ICMP message that answered a probe
+type ICMPReply struct {
+	Type int `json:"icmp_type"`
+	Code int `json:"icmp_code"`
+}
+
+// ProbeTiming is when a probe was sent and its reply received by the wall clock; RTTs come from the monotonic clock
+type ProbeTiming struct {
+	Sent     time.Time `json:"sent"`
+	Received time.Time `json:"received"`
+}
+
+// TraceResult collects the hops of one trace in TTL order
+type TraceResult struct {
+	Target      string
+	TraceID     string
+	Destination *net.IPAddr
+	Hops        []HopResult
+	Reached     bool
+
+	// Local address the probes left from, only looked up with -v
+	Source *net.IPAddr
+
+	// From the start of probing to the first reply of any hop, 0 when none replied
+	FirstResponse time.Duration
+
+	// Packets sent and received by all probes of the trace
+	Counters ProbeCounters
+
+	// Outcome of every port of -ports
+	Ports []portReach
+}
+
+// Returns how many distinct addresses answered the trace's hops. Silent hops are left out, and an address
+// answering several hops, e.g. where load-balanced paths collapse into one router, counts once.
+func (r *TraceResult) DistinctHops() int {
+	seen := make(map[string]bool)
+	for _, hop := range r.Hops {
+		for _, peer := range uniquePeers(hop.Peers) {
+			seen[peer] = true
+		}
+	}
+	return len(seen)
+}
+
+// ProbeCounters totals the probes of a trace and what came back on its socket
+type ProbeCounters struct {
+	Sent     int `json:"sent"`
+	Replies  int `json:"replies"`
+	Timeouts int `json:"timeouts"`
+	// Packets that answered none of the trace's probes, such as other hosts' ICMP traffic
+	Foreign    int `json:"foreign"`
+	Duplicates int `json:"duplicates"`
+}
+
+func (c *ProbeCounters) add(other ProbeCounters) {
+	c.Sent += other.Sent
+	c.Replies += other.Replies
+	c.Timeouts += other.Timeouts
+	c.Foreign += other.Foreign
+	c.Duplicates += other.Duplicates
+}
+
+func (c ProbeCounters) String() string {
+	return fmt.Sprintf("%d probes sent, %d replies, %d timeouts, %d foreign packets discarded, %d duplicates",
+		c.Sent, c.Replies, c.Timeouts, c.Foreign, c.Duplicates)
+}
+
+// Returns a one word summary of the hop: reached, non-target-echo, ttl-exceeded, timeout or error
+func (h HopResult) Status() string {
+	switch {
+	case h.Reached:
+		return "reached"
+	case h.NonTargetEcho:
+		return "non-target-echo"
+	case h.Responded():
+		return "ttl-exceeded"
+	case isTimeout(h.Err):
+		return "timeout"
+	default:
+		return "error"
+	}
+}
+
+// Returns true when at least one probe of the hop got a reply
+func (h HopResult) Responded() bool {
+	return h.Err == nil && len(h.Peers) > 0
+}
+
+// Orders hops by TTL
+func sortHops(hopsArray []HopResult) {
+	sort.Slice(hopsArray, func(i, j int) bool {
+		return hopsArray[i].TTL < hopsArray[j].TTL
+	})
+}
+
+// Drops the hops past the first one that reached the destination, which probes sent in parallel
+// to higher TTLs produce, and returns how many were dropped. hopsArray must be sorted by TTL.
+func collapseDestination(hopsArray []HopResult) ([]HopResult, int) {
+	for i, hop := range hopsArray {
+		if hop.Reached {
+			return hopsArray[:i+1], len(hopsArray) - i - 1
+		}
+	}
+	return hopsArray, 0
+}
+
+// Returns true when a hop with the given TTL was already probed
+func hasHop(hopsArray []HopResult, ttl int) bool {
+	for _, hop := range hopsArray {
+		if hop.TTL == ttl {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the distinct peer addresses in the order they replied
+func uniquePeers(peersArray []net.Addr) []string {
+	var unique []string
+	seen := make(map[string]bool)
+	for _, peer := range peersArray {
+		if !seen[peer.String()] {
+			seen[peer.String()] = true
+			unique = append(unique, peer.String())
+		}
+	}
+	return unique
+}
+
+// responderCount is how many probes of a hop one address answered
+type responderCount struct {
+	Address string `json:"address"`
+	Probes  int    `json:"probes"`
+}
+
+// Returns the probes answered by each distinct address, in the order they first answered
+func probeTally(peersArray []net.Addr) []responderCount {
+	var tally []responderCount
+	index := make(map[string]int)
+	for _, peer := range peersArray {
+		i, ok := index[peer.String()]
+		if !ok {
+			i = len(tally)
+			index[peer.String()] = i
+			tally = append(tally, responderCount{Address: peer.String()})
+		}
+		tally[i].Probes++
+	}
+	return tally
+}
+
+// hopJSON is the serialized form of HopResult
+type hopJSON struct {
+	TTL         int               `json:"ttl"`
+	Sent        int               `json:"sent"`
+	RTTs        []time.Duration   `json:"rtts_ns"`
+	Sizes       []int             `json:"sizes,omitempty"`
+	Timings     []ProbeTiming     `json:"timings,omitempty"`
+	SourcePorts []int             `json:"source_ports,omitempty"`
+	Replies     []ICMPReply       `json:"icmp,omitempty"`
+	Peers       []string          `json:"peers"`
+	Reached     bool              `json:"reached"`
+	Status      string            `json:"status"`
+	Time        time.Time         `json:"time"`
+	Error       string            `json:"error,omitempty"`
+	NonTarget   bool              `json:"non_target_echo,omitempty"`
+	ASN         string            `json:"asn,omitempty"`
+	Country     string            `json:"country,omitempty"`
+	ARPRetry    bool              `json:"arp_retry,omitempty"`
+	Confirmed   bool              `json:"confirmed,omitempty"`
+	Duplicates  int               `json:"duplicates,omitempty"`
+	Reordered   int               `json:"reordered,omitempty"`
+	Mangled     int               `json:"mangled,omitempty"`
+	Truncated   int               `json:"truncated,omitempty"`
+	Responders  []responderCount  `json:"responders,omitempty"`
+	ReplyCode   int               `json:"reply_code,omitempty"`
+	Terminal    string            `json:"terminal_reply,omitempty"`
+	Advisories  []string          `json:"advisories,omitempty"`
+	RateLimited bool              `json:"rate_limited,omitempty"`
+	Role        string            `json:"role,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+func (h HopResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.toJSON())
+}
+
+func (h HopResult) toJSON() hopJSON {
+	out := hopJSON{TTL: h.TTL, Sent: h.Sent, RTTs: h.RTTs, Sizes: h.Sizes, Timings: h.Timings, SourcePorts: h.SourcePorts, Replies: h.Replies, Reached: h.Reached, Status: h.Status(), Time: h.Time, NonTarget: h.NonTargetEcho, ASN: h.ASN, Country: h.Country, ARPRetry: h.ARPRetry, Confirmed: h.Confirmed, Duplicates: h.Duplicates, Reordered: h.Reordered, Mangled: h.Mangled, Truncated: h.Truncated, ReplyCode: h.ReplyCode, Terminal: h.TerminalReply, Advisories: h.Advisories, RateLimited: h.RateLimited, Role: h.Role, Annotations: h.Annotations}
+	out.RTTs = append([]time.Duration{}, h.RTTs...)
+	out.Peers = []string{}
+	for _, peer := range h.Peers {
+		out.Peers = append(out.Peers, peer.String())
+	}
+	if *responderTally {
+		out.Responders = probeTally(h.Peers)
+	}
+	if h.Err != nil {
+		out.Error = h.Err.Error()
+	}
+	return out
+}
+
+func (h *HopResult) UnmarshalJSON(data []byte) error {
+	var in hopJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	hop, err := in.toHop()
+	if err != nil {
+		return err
+	}
+	*h = hop
+	return nil
+}
+
+// Turns the serialized form back into a HopResult
+func (in hopJSON) toHop() (HopResult, error) {
+	h := HopResult{TTL: in.TTL, Sent: in.Sent, RTTs: in.RTTs, Sizes: in.Sizes, Timings: in.Timings, SourcePorts: in.SourcePorts, Replies: in.Replies, Reached: in.Reached, Time: in.Time, NonTargetEcho: in.NonTarget, ASN: in.ASN, Country: in.Country, ARPRetry: in.ARPRetry, Confirmed: in.Confirmed, Duplicates: in.Duplicates, Reordered: in.Reordered, Mangled: in.Mangled, Truncated: in.Truncated, ReplyCode: in.ReplyCode, TerminalReply: in.Terminal, Advisories: in.Advisories, RateLimited: in.RateLimited, Role: in.Role, Annotations: in.Annotations}
+	for _, peer := range in.Peers {
+		ip := net.ParseIP(peer)
+		if ip == nil {
+			return HopResult{}, fmt.Errorf("invalid peer address %q", peer)
+		}
+		h.Peers = append(h.Peers, &net.IPAddr{IP: ip})
+	}
+	if in.Error != "" {
+		h.Err = &savedError{text: in.Error, timeout: in.Status == "timeout"}
+	}
+	return h, nil
+}
+
+// savedError is the error of a loaded hop; it keeps whether the hop timed out, so a
+// replayed hop shows its timeout rather than a generic error
+type savedError struct {
+	text    string
+	timeout bool
+}
+
+func (e *savedError) Error() string   { return e.text }
+func (e *savedError) Timeout() bool   { return e.timeout }
+func (e *savedError) Temporary() bool { return false }
+
+// traceJSON is the serialized form of TraceResult
+type traceJSON struct {
+	Target      string      `json:"target"`
+	TraceID     string      `json:"trace_id"`
+	Destination string      `json:"destination"`
+	Source      string      `json:"source,omitempty"`
+	Hops        []HopResult `json:"hops"`
+	Reached     bool        `json:"reached"`
+
+	// Distinct addresses that answered, see DistinctHops; derived from the hops, so not read back
+	DistinctHops int `json:"distinct_hops"`
+
+	FirstResponse time.Duration `json:"first_response_ns,omitempty"`
+	Counters      ProbeCounters `json:"counters"`
+	Ports         []portReach   `json:"ports,omitempty"`
+}
+
+func (r TraceResult) MarshalJSON() ([]byte, error) {
+	out := traceJSON{Target: r.Target, TraceID: r.TraceID, Hops: r.Hops, Reached: r.Reached, DistinctHops: r.DistinctHops(), FirstResponse: r.FirstResponse, Counters: r.Counters, Ports: r.Ports}
+	if r.Destination != nil {
+		out.Destination = r.Destination.String()
+	}
+	if r.Source != nil {
+		out.Source = r.Source.String()
+	}
+	if out.Hops == nil {
+		out.Hops = []HopResult{}
+	}
+	return json.Marshal(out)
+}
+
+func (r *TraceResult) UnmarshalJSON(data []byte) error {
+	var in traceJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	*r = TraceResult{Target: in.Target, TraceID: in.TraceID, Hops: in.Hops, Reached: in.Reached, FirstResponse: in.FirstResponse, Counters: in.Counters, Ports: in.Ports}
+	if in.Destination != "" {
+		ip := net.ParseIP(in.Destination)
+		if ip == nil {
+			return fmt.Errorf("invalid destination address %q", in.Destination)
+		}
+		r.Destination = &net.IPAddr{IP: ip}
+	}
+	if in.Source != "" {
+		ip := net.ParseIP(in.Source)
+		if ip == nil {
+			return fmt.Errorf("invalid source address %q", in.Source)
+		}
+		r.Source = &net.IPAddr{IP: ip}
+	}
+	return nil
+}
+
+// Returns the JSON document of a trace, indented unless -json-pretty=false asks for a single line.
+// The -jsonl records are one object per line by definition, so they never go through here.
+func marshalTrace(result *TraceResult) ([]byte, error) {
+	if *prettyJSON {
+		return json.MarshalIndent(result, "", "  ")
+	}
+	return json.Marshal(result)
+}
+
+// Writes the trace as JSON to the file
+func saveTrace(path string, result *TraceResult) error {
+	data, err := marshalTrace(result)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Reads a trace written by saveTrace, or the first one of a -binary stream
+func loadTrace(path string) (*TraceResult, error) {
+	resultsArray, err := loadTraces(path)
+	if err != nil {
+		return nil, err
+	}
+	return resultsArray[0], nil
+}
+
+// Reads the trace of a JSON file, or every trace of a -binary stream
+func loadTraces(path string) ([]*TraceResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if isBinaryTrace(data) {
+		resultsArray, err := decodeBinaryTraces(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return resultsArray, nil
+	}
+	var result TraceResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return []*TraceResult{&result}, nil
+}
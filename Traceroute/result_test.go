@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceCounters(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   func(probe fakeProbe) []fakeReply
+		parallel int
+		want     ProbeCounters
+	}{
+		{"answered", fakePath("10.9.9.9", "10.0.0.1", "10.0.0.2"), 1, ProbeCounters{Sent: 9, Replies: 9}},
+		{"silent hop", fakePath("10.9.9.9", "10.0.0.1", ""), 1, ProbeCounters{Sent: 9, Replies: 6, Timeouts: 3}},
+		{"other traffic", func(probe fakeProbe) []fakeReply {
+			return append([]fakeReply{{Bytes: foreignEcho(), Peer: ip4("10.7.7.7")}}, fakePath("10.9.9.9", "10.0.0.1", "10.0.0.2")(probe)...)
+		}, 1, ProbeCounters{Sent: 9, Replies: 9, Foreign: 9}},
+		// The duplicate of a hop's last probe is read while the next hop is probed, and answers none of its probes
+		{"duplicated replies", func(probe fakeProbe) []fakeReply {
+			replies := fakePath("10.9.9.9", "10.0.0.1", "10.0.0.2")(probe)
+			return append(replies, replies...)
+		}, 1, ProbeCounters{Sent: 9, Replies: 9, Foreign: 2, Duplicates: 6}},
+		// Each worker counts on its own socket and the trace adds them up
+		{"parallel workers", fakePath("10.9.9.9", "10.0.0.1", "10.0.0.2"), 3, ProbeCounters{Sent: 9, Replies: 9}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			setFlag(t, parallelTTLs, tt.parallel)
+			offlineDNS(t, nil)
+			saved := openTraceSocket
+			openTraceSocket = func(iface string, useIPv6 bool) (*icmpConn, error) {
+				return &icmpConn{PacketConn: newFakeConn(tt.script)}, nil
+			}
+			defer func() { openTraceSocket = saved }()
+
+			reporter := &recordingReporter{}
+			result, err := tracert("10.9.9.9", traceConfig{MaxTTL: 3, Method: "icmp"}, reporter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Counters != tt.want {
+				t.Errorf("got %+v, want %+v", result.Counters, tt.want)
+			}
+			if !reporter.noted(tt.want.String()) {
+				t.Errorf("notes %q lack the counters", reporter.notes)
+			}
+		})
+	}
+}
+
+func addrs(ipsArray ...string) []net.Addr {
+	var peersArray []net.Addr
+	for _, ip := range ipsArray {
+		peersArray = append(peersArray, ip4(ip))
+	}
+	return peersArray
+}
+
+func TestProbeTally(t *testing.T) {
+	tests := []struct {
+		name  string
+		peers []net.Addr
+		want  []responderCount
+	}{
+		{name: "no replies", peers: nil, want: nil},
+		{name: "single responder", peers: addrs("10.0.0.1", "10.0.0.1", "10.0.0.1"), want: []responderCount{{"10.0.0.1", 3}}},
+		{name: "split", peers: addrs("10.0.0.1", "10.0.0.2", "10.0.0.1"), want: []responderCount{{"10.0.0.1", 2}, {"10.0.0.2", 1}}},
+		{name: "in order of the first answer", peers: addrs("10.0.0.3", "10.0.0.1", "10.0.0.2", "10.0.0.1"),
+			want: []responderCount{{"10.0.0.3", 1}, {"10.0.0.1", 2}, {"10.0.0.2", 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := probeTally(tt.peers); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponderCounts(t *testing.T) {
+	tests := []struct {
+		name       string
+		tally      bool
+		hop        HopResult
+		wantPeers  string
+		wantJSON   string
+		withoutKey bool
+	}{
+		{name: "split with -responder-counts", tally: true, hop: HopResult{TTL: 3, Sent: 3, Peers: addrs("10.0.0.1", "10.0.0.2", "10.0.0.1")},
+			wantPeers: "[10.0.0.1 (core1.example.net) (2/3)  10.0.0.2 (1/3)]",
+			wantJSON:  `"responders":[{"address":"10.0.0.1","probes":2},{"address":"10.0.0.2","probes":1}]`},
+		{name: "split with a lost probe", tally: true, hop: HopResult{TTL: 3, Sent: 3, Peers: addrs("10.0.0.2", "10.0.0.1")},
+			wantPeers: "[10.0.0.2 (1/3)  10.0.0.1 (core1.example.net) (1/3)]",
+			wantJSON:  `"responders":[{"address":"10.0.0.2","probes":1},{"address":"10.0.0.1","probes":1}]`},
+		{name: "single responder", tally: true, hop: HopResult{TTL: 3, Sent: 3, Peers: addrs("10.0.0.2", "10.0.0.2")},
+			wantPeers: "[10.0.0.2]",
+			wantJSON:  `"responders":[{"address":"10.0.0.2","probes":2}]`},
+		{name: "without -responder-counts", tally: false, hop: HopResult{TTL: 3, Sent: 3, Peers: addrs("10.0.0.1", "10.0.0.2", "10.0.0.1")},
+			wantPeers:  "[10.0.0.1 (core1.example.net)  10.0.0.2  10.0.0.1 (core1.example.net)]",
+			withoutKey: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offlineDNS(t, map[string][]string{"10.0.0.1": {"core1.example.net"}})
+			setFlag(t, responderTally, tt.tally)
+			if got := hopPeersString(tt.hop); got != tt.wantPeers {
+				t.Errorf("peers %q, want %q", got, tt.wantPeers)
+			}
+			data, err := json.Marshal(tt.hop)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.withoutKey {
+				if strings.Contains(string(data), `"responders"`) {
+					t.Errorf("JSON %s has responders without -responder-counts", data)
+				}
+			} else if !strings.Contains(string(data), tt.wantJSON) {
+				t.Errorf("JSON %s lacks %s", data, tt.wantJSON)
+			}
+		})
+	}
+}
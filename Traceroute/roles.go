@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Roles -hop-roles tells apart. Every one is a likelihood drawn from how the hop answered, never a certainty.
+const (
+	roleRouter       = "router"
+	roleFirewall     = "firewall"
+	roleLoadBalancer = "load-balancer"
+	roleEndpoint     = "endpoint"
+)
+
+// One address answering at least this many consecutive TTLs, its RTT growing by no more than
+// repeatedRTTGrowth over them, answers for the hops behind it rather than forwarding to them
+const (
+	repeatedHops      = 3
+	repeatedRTTGrowth = time.Millisecond
+)
+
+// hopRole is the role -hop-roles infers for one hop, with the evidence it rests on
+type hopRole struct {
+	TTL    int
+	Peer   string
+	Role   string
+	Reason string
+}
+
+func (r hopRole) String() string {
+	return fmt.Sprintf("hop %d %s: likely %s (%s)", r.TTL, r.Peer, r.Role, r.Reason)
+}
+
+// Infers the role of every hop that answered, sets it on the hops and returns it. The heuristics
+// are deliberately conservative, and the first one that applies wins:
+//   - an administratively prohibited destination unreachable is sent by a firewall
+//   - echo replies for the destination from another address come from a firewall or proxy in front of it
+//   - one address answering several consecutive TTLs without its RTT growing is a firewall answering
+//     for the hops behind it, as a router forwards those probes
+//   - a TTL answered by several addresses is load-balanced, by ECMP or a load balancer
+//   - the destination is the endpoint, and a single address sending TTL exceeded a router
+//
+// udpArray holds the hops of a UDP trace of the same path with -compare-udp, nil otherwise; a
+// hop filtering UDP probes while forwarding ICMP ones is a firewall too.
+func markRoles(hopsArray []HopResult, udpArray []HopResult) []hopRole {
+	repeated := repeatedResponders(hopsArray)
+	var rolesArray []hopRole
+	for i := range hopsArray {
+		hop := &hopsArray[i]
+		udpHop, _ := findHop(udpArray, hop.TTL)
+
+		role := hopRole{TTL: hop.TTL}
+		var icmpErr *unexpectedICMPError
+		switch {
+		case errors.As(hop.Err, &icmpErr) && icmpErr.adminProhibited():
+			role.Peer, role.Role = createPeersString([]net.Addr{icmpErr.Peer}), roleFirewall
+			role.Reason = "sent " + icmpTypeCodeString(icmpErr.Message)
+		case errors.As(udpHop.Err, &icmpErr) && icmpErr.adminProhibited():
+			role.Peer, role.Role = createPeersString([]net.Addr{icmpErr.Peer}), roleFirewall
+			role.Reason = "sent " + icmpTypeCodeString(icmpErr.Message) + " to UDP probes"
+		case !hop.Responded():
+			continue
+		case hop.NonTargetEcho:
+			role.Role, role.Reason = roleFirewall, "answered echo requests in place of the destination"
+		case repeated[hop.TTL] > 0:
+			role.Role = roleFirewall
+			role.Reason = fmt.Sprintf("answers %d consecutive TTLs without its RTT growing", repeated[hop.TTL])
+		case len(uniquePeers(hop.Peers)) > 1:
+			role.Role = roleLoadBalancer
+			role.Reason = fmt.Sprintf("%d addresses answer this TTL", len(uniquePeers(hop.Peers)))
+		case hop.Reached:
+			role.Role, role.Reason = roleEndpoint, "the destination answered"
+		default:
+			role.Role, role.Reason = roleRouter, "TTL exceeded from a single address"
+		}
+		if role.Peer == "" {
+			role.Peer = createPeersString(hop.Peers)
+		}
+		hop.Role = role.Role
+		rolesArray = append(rolesArray, role)
+	}
+	return rolesArray
+}
+
+// Returns the TTLs of every run of at least repeatedHops consecutive TTLs answered by the same single
+// address with an RTT that does not grow, with the length of their run
+func repeatedResponders(hopsArray []HopResult) map[int]int {
+	repeated := make(map[int]int)
+	var runArray []HopResult
+	flush := func() {
+		if len(runArray) >= repeatedHops {
+			firstMin, _, _ := rttStats(runArray[0].RTTs)
+			lastMin, _, _ := rttStats(runArray[len(runArray)-1].RTTs)
+			if lastMin-firstMin <= repeatedRTTGrowth {
+				for _, hop := range runArray {
+					repeated[hop.TTL] = len(runArray)
+				}
+			}
+		}
+		runArray = nil
+	}
+	for _, hop := range hopsArray {
+		if !hop.Responded() || hop.Reached || len(uniquePeers(hop.Peers)) != 1 {
+			flush()
+			continue
+		}
+		if len(runArray) > 0 {
+			last := runArray[len(runArray)-1]
+			if last.TTL != hop.TTL-1 || last.Peers[0].String() != hop.Peers[0].String() {
+				flush()
+			}
+		}
+		runArray = append(runArray, hop)
+	}
+	flush()
+	return repeated
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Types with their own JSON form, described instead of their fields
+var (
+	durationType  = reflect.TypeOf(time.Duration(0))
+	timeType      = reflect.TypeOf(time.Time{})
+	hopResultType = reflect.TypeOf(HopResult{})
+)
+
+// Prints a JSON Schema of the -json document, with the -jsonl record among its definitions
+func printSchema() error {
+	schema := typeSchema(reflect.TypeOf(traceJSON{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "TraceResult"
+	schema["$defs"] = map[string]interface{}{
+		"hop":          typeSchema(reflect.TypeOf(hopJSON{})),
+		"jsonl_record": typeSchema(reflect.TypeOf(jsonlRecord{})),
+	}
+
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(data, '\n'))
+	return err
+}
+
+// Derives the schema of a type from the way encoding/json serializes it
+func typeSchema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == hopResultType:
+		return map[string]interface{}{"$ref": "#/$defs/hop"}
+	case t == durationType:
+		return map[string]interface{}{"type": "integer", "description": "nanoseconds"}
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		required := []string{}
+		addFields(t, properties, &required)
+		return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+	}
+	return map[string]interface{}{}
+}
+
+// Adds the serialized fields of a struct, and of the structs it embeds, to an object schema
+func addFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if field.Anonymous && tag == "" {
+			addFields(field.Type, properties, required)
+			continue
+		}
+		if field.PkgPath != "" || tag == "-" {
+			continue
+		}
+
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = typeSchema(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTypeSchema(t *testing.T) {
+	tests := []struct {
+		name string
+		t    reflect.Type
+		want map[string]interface{}
+	}{
+		{"string", reflect.TypeOf(""), map[string]interface{}{"type": "string"}},
+		{"duration", reflect.TypeOf(time.Second), map[string]interface{}{"type": "integer", "description": "nanoseconds"}},
+		{"slice", reflect.TypeOf([]int{}), map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "integer"}}},
+		{"map", reflect.TypeOf(map[string]string{}), map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "string"}}},
+		{"map of slices", reflect.TypeOf(map[string][]float64{}), map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "number"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := typeSchema(tt.t); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// The annotations of a hop are an object of strings
+	properties := typeSchema(reflect.TypeOf(hopJSON{}))["properties"].(map[string]interface{})
+	if got := properties["annotations"]; !reflect.DeepEqual(got, tests[3].want) {
+		t.Errorf("annotations described as %v", got)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// Exit statuses of -self-test besides 0, which means raw sockets work
+const (
+	exitDatagramOnly = 6
+	exitNoProbing    = 7
+)
+
+// Checks, without a remote target, whether this host lets the tool probe: one echo request with
+// TTL 1 to the loopback address through a raw and through a datagram ICMP socket, bound as -i and
+// -mark would bind them. Prints the outcome of each and returns the exit status of the run.
+func selfTest(iface string, useIPv6 bool) int {
+	loopback := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	family := "IPv4"
+	if useIPv6 {
+		loopback, family = &net.IPAddr{IP: net.IPv6loopback}, "IPv6"
+	}
+	fmt.Printf("Self-test over %s, one echo request to %s\n", family, loopback)
+
+	source, err := probeSource(iface, useIPv6)
+	if err != nil {
+		fmt.Printf("cannot pick the source address: %v\n", err)
+		return exitNoProbing
+	}
+	raw := selfTestSocket("raw ICMP socket", loopback, useIPv6, func() (*icmpConn, error) {
+		return openRawSocket(source, useIPv6)
+	})
+	datagram := selfTestSocket("datagram ICMP socket", loopback, useIPv6, func() (*icmpConn, error) {
+		return openDatagramSocket(source, useIPv6)
+	})
+
+	// Where the probes of a trace leave from depends on the route to the target, so a documentation
+	// address stands in for one reached through the default route
+	other := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	if useIPv6 {
+		other = &net.IPAddr{IP: net.ParseIP("2001:db8::1")}
+	}
+	if iface != "" {
+		fmt.Printf("probes leave from %s, the address of %s\n", source, iface)
+	} else if ip, err := routeSource(other); err == nil {
+		fmt.Printf("probes to other hosts leave from %s\n", ip)
+	} else {
+		fmt.Printf("no route to other hosts: %v\n", err)
+	}
+
+	switch {
+	case raw:
+		fmt.Printf("probing works, with every option available\n")
+		return 0
+	case datagram:
+		fmt.Printf("probing works through datagram sockets only; %s\n", rawOnlyOptions)
+		return exitDatagramOnly
+	}
+	fmt.Printf("probing does not work: raw sockets need root or CAP_NET_RAW, datagram sockets a group in net.ipv4.ping_group_range\n")
+	return exitNoProbing
+}
+
+// Options a datagram socket cannot serve, as needsRawSocket lists them
+const rawOnlyOptions = "-compare-udp, -verify-dscp, -timestamp-option, -probe-destination-first, -measure-clock-skew and -reverse-hops need a raw socket"
+
+// Opens one kind of socket and sends an echo request with TTL 1 to the loopback address through it,
+// printing whether a reply came back; reports whether the socket can probe
+func selfTestSocket(kind string, loopback *net.IPAddr, useIPv6 bool, open func() (*icmpConn, error)) bool {
+	connection, err := open()
+	if err != nil {
+		fmt.Printf("%s: cannot open: %v\n", kind, err)
+		return false
+	}
+	defer connection.Close()
+
+	tracer := newTracer(connection, loopback, useIPv6)
+	tracer.arpRetry = false
+	exchange, err := socketExchange(tracer, []int{MsgLength}, 1, 1)
+	if err != nil {
+		fmt.Printf("%s: opened, but the echo request got no reply: %v\n", kind, err)
+		return false
+	}
+	if !isEchoReply(exchange.Type) {
+		fmt.Printf("%s: opened, but the echo request was answered by %v\n", kind, exchange.Type)
+		return false
+	}
+	fmt.Printf("%s: ok, echo reply from %v in %s\n", kind, exchange.Peers[0], humanDuration(exchange.RTTs[0]))
+	return true
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Exit status of -exit-after-destination-rtt-stable when the destination did not settle within -stable-max-runs
+const exitUnsettled = 8
+
+// settleRun is what -exit-after-destination-rtt-stable compares of one run, taken from a
+// pathStats that accumulated just that run
+type settleRun struct {
+	// Sorted responders of every TTL that answered
+	peers map[int]string
+	// TTL of the destination, 0 when it was not reached, and its average RTT
+	reachedAt int
+	rtt       time.Duration
+}
+
+func newSettleRun(stats *pathStats) settleRun {
+	run := settleRun{peers: make(map[int]string), reachedAt: stats.reachedAt}
+	for _, hop := range stats.sorted() {
+		if len(hop.Peers) == 0 {
+			continue
+		}
+		var peersArray []string
+		for _, peer := range hop.Peers {
+			peersArray = append(peersArray, peer.String())
+		}
+		sort.Strings(peersArray)
+		run.peers[hop.TTL] = strings.Join(peersArray, ", ")
+		if hop.TTL == stats.reachedAt {
+			run.rtt = hop.Avg()
+		}
+	}
+	return run
+}
+
+// Returns why the run does not match the reference run, empty when it does: the destination must
+// be as many hops away, every TTL answering in both runs must answer from the same addresses, and
+// the destination's average RTT must stay within tolerance of the reference. A TTL silent in one
+// of the runs is no change, as routers commonly limit the rate of their ICMP errors.
+func (run settleRun) differs(reference settleRun, tolerance time.Duration) string {
+	if run.reachedAt != reference.reachedAt {
+		return fmt.Sprintf("destination moved from %d to %d hops", reference.reachedAt, run.reachedAt)
+	}
+	for ttl := 1; ttl <= run.reachedAt; ttl++ {
+		before, answeredBefore := reference.peers[ttl]
+		after, answered := run.peers[ttl]
+		if answeredBefore && answered && before != after {
+			return fmt.Sprintf("hop %d changed from %s to %s", ttl, before, after)
+		}
+	}
+	if delta := run.rtt - reference.rtt; delta > tolerance || -delta > tolerance {
+		return fmt.Sprintf("destination RTT %s is more than %s from %s", humanDuration(run.rtt), humanDuration(tolerance), humanDuration(reference.rtt))
+	}
+	return ""
+}
+
+// Traces the target once per interval until the destination has been reached over the same path,
+// with its RTT within tolerance, for runs consecutive runs, printing every run and why a run broke
+// the streak. The first run of a streak is the one the others are compared with, so a slow drift
+// does not pass for stability. Returns 0 once the target is stable, and exitUnsettled when maxRuns
+// runs did not get there.
+func waitStable(target targetSpec, runs int, maxRuns int, tolerance time.Duration, interval time.Duration) (int, error) {
+	fmt.Printf("Waiting for %s to be stable over %d runs, destination RTT within %s, trying at most %d runs\n", target.Host, runs, humanDuration(tolerance), maxRuns)
+	var reference settleRun
+	var streak int = 0
+	var lastBreak string = ""
+	for i := 1; i <= maxRuns; i++ {
+		if i > 1 {
+			time.Sleep(interval)
+		}
+		reporter := &stabilityReporter{stats: newPathStats()}
+		if _, err := tracert(target.Host, target.Config, reporter); err != nil {
+			return 2, err
+		}
+		run := newSettleRun(reporter.stats)
+
+		line := fmt.Sprintf("run %d: ", i)
+		change := ""
+		switch {
+		case run.reachedAt == 0:
+			change = "destination not reached"
+			streak = 0
+		case streak == 0:
+			reference, streak = run, 1
+		default:
+			if change = run.differs(reference, tolerance); change != "" {
+				reference, streak = run, 1
+			} else {
+				streak++
+			}
+		}
+		if run.reachedAt > 0 {
+			line += fmt.Sprintf("%d hops, destination RTT %s, ", run.reachedAt, humanDuration(run.rtt))
+		}
+		if change != "" {
+			lastBreak = change
+			line += change + ", "
+		}
+		fmt.Printf("%sstable %d/%d\n", line, streak, runs)
+
+		if streak >= runs {
+			fmt.Printf("stable: %d consecutive runs reached %s in %d hops over the same path, RTT within %s of %s\n", runs, target.Host, reference.reachedAt, humanDuration(tolerance), humanDuration(reference.rtt))
+			return 0, nil
+		}
+	}
+	fmt.Printf("not stable after %d runs, the last %d of them stable; the streak last broke on: %s\n", maxRuns, streak, lastBreak)
+	return exitUnsettled, nil
+}
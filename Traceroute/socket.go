@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// probeConn is the part of the ICMP socket used by the tracer.
+// It is satisfied by icmpConn and by fake connections.
+type probeConn interface {
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	ReadFrom(b []byte) (int, net.Addr, error)
+	SetReadDeadline(t time.Time) error
+	SetTTL(ttl int) error
+	Close() error
+}
+
+// tosReceiver is implemented by connections that can tell the TOS byte of the last packet read
+type tosReceiver interface {
+	receivedTOS() (int, bool)
+}
+
+// ttlReceiver is implemented by connections that can tell the TTL (hop limit on IPv6) of the last packet read
+type ttlReceiver interface {
+	receivedTTL() (int, bool)
+}
+
+// truncationReceiver is implemented by connections that can tell whether the last packet read did not fit the buffer
+type truncationReceiver interface {
+	truncated() bool
+}
+
+// idAssigner is implemented by connections whose kernel sets the echo identifier of the probes
+type idAssigner interface {
+	assignedID() (int, bool)
+}
+
+// optionsReceiver is implemented by connections that can return the IPv4 options of the last packet read
+type optionsReceiver interface {
+	receivedOptions() []byte
+}
+
+// icmpConn is a raw or datagram ICMP socket shared by all probes of a trace
+type icmpConn struct {
+	net.PacketConn
+	p  *ipv4.PacketConn
+	p6 *ipv6.PacketConn
+
+	// A datagram socket needs no privileges, but the kernel sets the echo identifier to id,
+	// delivers only the replies carrying it and queues ICMP errors apart, see readDatagram
+	dgram bool
+	id    int
+
+	// With recvTOS set, reads keep the TOS byte (traffic class on IPv6) of the last packet
+	recvTOS bool
+	lastTOS int
+
+	// With recvOptions set, reads keep the IPv4 header options of the last packet
+	recvOptions bool
+	lastOptions []byte
+
+	// With recvTTL set, reads keep the TTL (hop limit on IPv6) of the last packet
+	recvTTL bool
+	lastTTL int
+
+	// The last packet read filled the whole buffer, so it may have been cut short
+	lastTruncated bool
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Creates listening socket, bound to the source interface when one is given.
+// With -socket-fd the inherited socket is used instead, as the helper that opened it bound it.
+// -socket-mode auto tries a datagram socket first and falls back to a raw one when the
+// system does not allow it or the trace needs what only a raw socket can read.
+// Failures are returned as socketError, which tells a lack of privileges apart.
+func openSocket(iface string, useIPv6 bool) (*icmpConn, error) {
+	connection, err := openProbeSocket(iface, useIPv6)
+	if err != nil {
+		return nil, &socketError{Err: err}
+	}
+	return connection, nil
+}
+
+// Opens the sockets of traces; tests replace it with one over a fake network
+var openTraceSocket = openSocket
+
+func openProbeSocket(iface string, useIPv6 bool) (*icmpConn, error) {
+	if *socketFD >= 0 {
+		return inheritedSocket(*socketFD, useIPv6)
+	}
+
+	source, err := probeSource(iface, useIPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	switch *socketMode {
+	case "dgram":
+		return openDatagramSocket(source, useIPv6)
+	case "auto":
+		if !needsRawSocket() {
+			if connection, err := openDatagramSocket(source, useIPv6); err == nil {
+				return connection, nil
+			}
+		}
+	}
+	return openRawSocket(source, useIPv6)
+}
+
+// Returns the address probe sockets are bound to: the one of the source interface when one is given,
+// else the wildcard address
+func probeSource(iface string, useIPv6 bool) (string, error) {
+	if iface == "" {
+		return wildcardSource(useIPv6)
+	}
+	ip, err := interfaceAddr(iface, useIPv6)
+	if err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+// Reports whether the options given need a raw socket: the UDP probes' errors and the IP header
+// fields of replies never reach a datagram socket
+func needsRawSocket() bool {
+	return *compareUDP || *verifyDSCP || *timestampOpt || *destinationFirst || *measureSkew || *reverseHops
+}
+
+func openRawSocket(source string, useIPv6 bool) (*icmpConn, error) {
+	var network string = "ip4:icmp"
+	if useIPv6 {
+		network = "ip6:ipv6-icmp"
+	}
+	connection, err := listenConfig().ListenPacket(context.Background(), network, source)
+	if err != nil {
+		return nil, err
+	}
+	if useIPv6 {
+		return &icmpConn{PacketConn: connection, p6: ipv6.NewPacketConn(connection)}, nil
+	}
+	return &icmpConn{PacketConn: connection, p: ipv4.NewPacketConn(connection)}, nil
+}
+
+// Returns how probe sockets are created, with -mark setting their fwmark and a tunnel given to -i
+// binding them to its device
+func listenConfig() *net.ListenConfig {
+	var controlsArray []func(network, address string, c syscall.RawConn) error
+	if *socketMark != 0 {
+		controlsArray = append(controlsArray, markControl(*socketMark))
+	}
+	if *sourceIface != "" && tunnelInterface(*sourceIface) {
+		controlsArray = append(controlsArray, deviceControl(*sourceIface))
+	}
+
+	var config net.ListenConfig
+	if len(controlsArray) > 0 {
+		config.Control = func(network, address string, c syscall.RawConn) error {
+			for _, control := range controlsArray {
+				if err := control(network, address, c); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return &config
+}
+
+// File of the descriptor given to -socket-fd. It is made once and kept for the whole run, as its
+// finalizer would close the descriptor the traces still duplicate.
+var (
+	inheritedMutex sync.Mutex
+	inheritedFile  *os.File
+)
+
+// Wraps a raw ICMP socket opened by a privileged helper and passed down as an open descriptor.
+// Every call returns a duplicate, so closing it after a trace keeps the descriptor usable for the next one.
+func inheritedSocket(fd int, useIPv6 bool) (*icmpConn, error) {
+	inheritedMutex.Lock()
+	if inheritedFile == nil {
+		inheritedFile = os.NewFile(uintptr(fd), "icmp socket")
+	}
+	file := inheritedFile
+	inheritedMutex.Unlock()
+	if file == nil {
+		return nil, fmt.Errorf("invalid socket descriptor %d", fd)
+	}
+	connection, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, fmt.Errorf("socket descriptor %d: %v", fd, err)
+	}
+
+	local, ok := connection.LocalAddr().(*net.IPAddr)
+	if !ok {
+		connection.Close()
+		return nil, fmt.Errorf("socket descriptor %d is not a raw IP socket", fd)
+	}
+	if (local.IP.To4() == nil) != useIPv6 {
+		connection.Close()
+		return nil, fmt.Errorf("socket descriptor %d is of the other address family than the trace (-6)", fd)
+	}
+	if useIPv6 {
+		return &icmpConn{PacketConn: connection, p6: ipv6.NewPacketConn(connection)}, nil
+	}
+	return &icmpConn{PacketConn: connection, p: ipv4.NewPacketConn(connection)}, nil
+}
+
+// Returns the local address the probes to destination leave from. A socket bound to the wildcard
+// address leaves it to routing, so a UDP socket is connected to the destination, which sends nothing,
+// and its address read back; it gets the fwmark of -mark and the tunnel binding of -i like the probes.
+func sourceAddress(connection *icmpConn, destination *net.IPAddr) (net.IP, error) {
+	var local net.IP
+	switch addr := connection.LocalAddr().(type) {
+	case *net.IPAddr:
+		local = addr.IP
+	case *net.UDPAddr:
+		local = addr.IP
+	}
+	if local != nil && !local.IsUnspecified() {
+		return local, nil
+	}
+	return routeSource(destination)
+}
+
+// Returns the local address routing picks for destination
+func routeSource(destination *net.IPAddr) (net.IP, error) {
+	network := "udp4"
+	if destination.IP.To4() == nil {
+		network = "udp6"
+	}
+	dialer := net.Dialer{Control: listenConfig().Control}
+	probe, err := dialer.Dial(network, net.JoinHostPort(destination.String(), "33434"))
+	if err != nil {
+		return nil, err
+	}
+	defer probe.Close()
+	return probe.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// Describes the kind of socket for -v
+func (c *icmpConn) mode() string {
+	switch {
+	case c.dgram:
+		return fmt.Sprintf("datagram ICMP socket (unprivileged, echo identifier %d)", c.id)
+	case *socketFD >= 0:
+		return fmt.Sprintf("raw ICMP socket inherited as descriptor %d", *socketFD)
+	}
+	return "raw ICMP socket"
+}
+
+func (c *icmpConn) assignedID() (int, bool) {
+	return c.id, c.dgram
+}
+
+// Sends like the embedded connection does; a datagram socket takes its destination as a UDP address
+func (c *icmpConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if ipAddr, ok := addr.(*net.IPAddr); ok && c.dgram {
+		addr = &net.UDPAddr{IP: ipAddr.IP, Zone: ipAddr.Zone}
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// Sets the TTL, or the hop limit on IPv6
+func (c *icmpConn) SetTTL(ttl int) error {
+	switch {
+	case c.p6 != nil:
+		return c.p6.SetHopLimit(ttl)
+	case c.p != nil:
+		return c.p.SetTTL(ttl)
+	}
+	// A connection that is no socket, such as the fake network of the tests, sets it itself
+	if setter, ok := c.PacketConn.(interface{ SetTTL(int) error }); ok {
+		return setter.SetTTL(ttl)
+	}
+	return fmt.Errorf("cannot set the TTL of a %T", c.PacketConn)
+}
+
+// Sets the TOS byte of outgoing probes, the traffic class on IPv6
+func (c *icmpConn) setTOS(tos int) error {
+	if c.p6 != nil {
+		return c.p6.SetTrafficClass(tos)
+	}
+	return c.p.SetTOS(tos)
+}
+
+// Makes ReadFrom record the TOS byte of every packet
+func (c *icmpConn) enableTOS() error {
+	if c.p6 != nil {
+		if err := c.p6.SetControlMessage(ipv6.FlagTrafficClass, true); err != nil {
+			return err
+		}
+	}
+	c.recvTOS = true
+	return nil
+}
+
+func (c *icmpConn) receivedTOS() (int, bool) {
+	return c.lastTOS, c.recvTOS
+}
+
+// Makes ReadFrom record the TTL of every packet
+func (c *icmpConn) enableTTL() error {
+	if c.p6 != nil {
+		if err := c.p6.SetControlMessage(ipv6.FlagHopLimit, true); err != nil {
+			return err
+		}
+	}
+	c.recvTTL = true
+	return nil
+}
+
+func (c *icmpConn) truncated() bool {
+	return c.lastTruncated
+}
+
+func (c *icmpConn) receivedTTL() (int, bool) {
+	return c.lastTTL, c.recvTTL
+}
+
+// Makes ReadFrom record the IPv4 options of every packet
+func (c *icmpConn) enableOptions() {
+	c.recvOptions = true
+}
+
+func (c *icmpConn) receivedOptions() []byte {
+	return c.lastOptions
+}
+
+// Reads a packet like the embedded connection does, recording its TOS byte, TTL and IPv4 options when enabled.
+// IPv4 has no control message for them, so the header is read along with the packet and stripped here.
+func (c *icmpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.dgram {
+		return c.readDatagram(b)
+	}
+	if !c.recvTOS && !c.recvOptions && !c.recvTTL {
+		n, peer, err := c.PacketConn.ReadFrom(b)
+		c.lastTruncated = n == len(b)
+		return n, peer, err
+	}
+	if c.p6 != nil {
+		n, cm, peer, err := c.p6.ReadFrom(b)
+		c.lastTruncated = n == len(b)
+		if err == nil && cm != nil {
+			c.lastTOS = cm.TrafficClass
+			c.lastTTL = cm.HopLimit
+		}
+		return n, peer, err
+	}
+
+	n, _, _, peer, err := c.PacketConn.(*net.IPConn).ReadMsgIP(b, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	// Checked before the header is stripped, which leaves room the reply did not have
+	c.lastTruncated = n == len(b)
+	if n >= ipv4.HeaderLen && b[0]>>4 == 4 {
+		headerLen := int(b[0]&0x0f) << 2
+		if headerLen <= n {
+			c.lastTOS = int(b[1])
+			c.lastTTL = int(b[8])
+			c.lastOptions = append([]byte{}, ipv4Options(b[:headerLen])...)
+			n = copy(b, b[headerLen:n])
+		}
+	}
+	return n, peer, nil
+}
+
+// Attaches the kernel packet filter for our probes' replies
+func (c *icmpConn) attachFilter(id int) error {
+	// A datagram socket already only gets the replies to its identifier
+	if c.dgram {
+		return nil
+	}
+	program, err := probeFilter(id, c.p6 != nil)
+	if err != nil {
+		return err
+	}
+	if c.p6 != nil {
+		return c.p6.SetBPF(program)
+	}
+	return c.p.SetBPF(program)
+}
+
+// Closes the socket; repeated calls return the result of the first one
+func (c *icmpConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.PacketConn.Close()
+	})
+	return c.closeErr
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+// Returns the address the socket listens on when no interface is given
+func wildcardSource(useIPv6 bool) (string, error) {
+	if useIPv6 {
+		return "::", nil
+	}
+	return "0.0.0.0", nil
+}
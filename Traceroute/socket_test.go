@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSocketClosedOncePerTrace(t *testing.T) {
+	tests := []struct {
+		name string
+		// Script of the network, nil when the trace fails before probing
+		script func(probe fakeProbe) []fakeReply
+		target string
+		// Opening the socket with this number fails, 0 when none fails
+		failOpen int
+		setup    func(t *testing.T)
+		wantErr  bool
+		opened   int
+	}{
+		{name: "reached", script: fakePath("10.9.9.9", "10.0.0.1"), target: "10.9.9.9", opened: 1},
+		{name: "not reached", script: fakePath("10.9.9.9", "", "", "", ""), target: "10.9.9.9", opened: 1},
+		{name: "blocked by firewall", script: func(probe fakeProbe) []fakeReply {
+			return []fakeReply{{Bytes: destUnreachable(13, probe), Peer: ip4("10.0.0.1")}}
+		}, target: "10.9.9.9", setup: func(t *testing.T) { setFlag(t, abortOnFirewall, true) }, opened: 1},
+		{name: "destination mismatch", script: func(probe fakeProbe) []fakeReply {
+			return []fakeReply{{Bytes: echoReply(probe), Peer: ip4("10.9.9.9")}, {Bytes: echoReply(probe), Peer: ip4("10.0.0.7"), Delay: time.Millisecond}}
+		}, target: "10.9.9.9", setup: func(t *testing.T) { setFlag(t, requireDestMatch, true) }, opened: 1},
+		{name: "unresolvable target", target: "no-such-host.invalid", wantErr: true, opened: 0},
+		{name: "socket fails to open", target: "10.9.9.9", failOpen: 1, wantErr: true, opened: 0},
+		{name: "worker socket fails to open", script: fakePath("10.9.9.9"), target: "10.9.9.9", failOpen: 3, setup: func(t *testing.T) {
+			setFlag(t, parallelTTLs, 4)
+		}, wantErr: true, opened: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			setFlag(t, dnsRetries, 0)
+			if tt.setup != nil {
+				tt.setup(t)
+			}
+
+			script := tt.script
+			if script == nil {
+				script = func(fakeProbe) []fakeReply { return nil }
+			}
+			var connsArray []*fakeConn
+			saved := openTraceSocket
+			openTraceSocket = func(iface string, useIPv6 bool) (*icmpConn, error) {
+				if len(connsArray)+1 == tt.failOpen {
+					return nil, &socketError{Err: errors.New("operation not permitted")}
+				}
+				conn := newFakeConn(script)
+				connsArray = append(connsArray, conn)
+				return &icmpConn{PacketConn: conn}, nil
+			}
+			defer func() { openTraceSocket = saved }()
+
+			_, err := tracert(tt.target, traceConfig{MaxTTL: 4, Method: "icmp"}, &recordingReporter{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			if len(connsArray) != tt.opened {
+				t.Fatalf("%d sockets opened, want %d", len(connsArray), tt.opened)
+			}
+			for i, conn := range connsArray {
+				if conn.closed() != 1 {
+					t.Errorf("socket %d closed %d times, want once", i+1, conn.closed())
+				}
+			}
+		})
+	}
+}
+
+func TestSocketCloseIsIdempotent(t *testing.T) {
+	conn := newFakeConn(nil)
+	connection := &icmpConn{PacketConn: conn}
+	for i := 0; i < 3; i++ {
+		if err := connection.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if conn.closed() != 1 {
+		t.Errorf("closed %d times, want once", conn.closed())
+	}
+}
+
+func TestInheritedDescriptorOutlivesTraces(t *testing.T) {
+	// A pipe is no socket, so every trace fails after wrapping the descriptor
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	defer r.Close()
+	defer func() { inheritedFile = nil }()
+
+	for i := 0; i < 3; i++ {
+		if _, err := inheritedSocket(int(r.Fd()), false); err == nil {
+			t.Fatal("a pipe was taken for a socket")
+		}
+	}
+	// Gives the finalizers of dropped files the chance to run
+	for i := 0; i < 5; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := w.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("descriptor closed behind the traces: %v", err)
+	}
+}
+
+func TestNeedsRawSocket(t *testing.T) {
+	tests := []struct {
+		name string
+		flag *bool
+		want bool
+	}{
+		{name: "plain trace", want: false},
+		{name: "compare-udp", flag: compareUDP, want: true},
+		{name: "verify-dscp", flag: verifyDSCP, want: true},
+		{name: "timestamp-option", flag: timestampOpt, want: true},
+		{name: "probe-destination-first", flag: destinationFirst, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.flag != nil {
+				setFlag(t, tt.flag, true)
+			}
+			if got := needsRawSocket(); got != tt.want {
+				t.Errorf("needsRawSocket() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// datagramConn is a fake network behind a datagram socket, whose kernel gives the probes its own identifier
+type datagramConn struct {
+	*fakeConn
+	id int
+}
+
+func (c *datagramConn) assignedID() (int, bool) { return c.id, true }
+
+func TestDatagramSocketIdentifier(t *testing.T) {
+	tests := []struct {
+		name   string
+		conn   probeConn
+		wantID int
+	}{
+		{name: "datagram socket", conn: &datagramConn{fakeConn: newFakeConn(fakePath("10.9.9.9")), id: 4242}, wantID: 4242},
+		{name: "raw socket", conn: &icmpConn{PacketConn: newFakeConn(nil)}, wantID: -1},
+		{name: "datagram icmpConn", conn: &icmpConn{PacketConn: newFakeConn(nil), dgram: true, id: 777}, wantID: 777},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracer := newTracer(tt.conn, ip4("10.9.9.9"), false)
+			if tt.wantID < 0 {
+				if tracer.id == 4242 || tracer.id == 777 {
+					t.Errorf("raw socket tracer took identifier %d", tracer.id)
+				}
+				return
+			}
+			if tracer.id != tt.wantID {
+				t.Fatalf("tracer identifier %d, want %d", tracer.id, tt.wantID)
+			}
+			conn, ok := tt.conn.(*datagramConn)
+			if !ok {
+				return
+			}
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			hop := ping(tracer, 3)
+			if !hop.Reached || len(hop.RTTs) != AttemptsCount {
+				t.Fatalf("replies to the kernel's identifier not matched: %+v", hop)
+			}
+			for _, probe := range conn.sent() {
+				if probe.ID != tt.wantID {
+					t.Errorf("probe sent with identifier %d, want %d", probe.ID, tt.wantID)
+				}
+			}
+		})
+	}
+}
+
+func TestDatagramSocketWrites(t *testing.T) {
+	tests := []struct {
+		name  string
+		dgram bool
+		want  string
+	}{
+		{name: "datagram socket", dgram: true, want: "*net.UDPAddr"},
+		{name: "raw socket", dgram: false, want: "*net.IPAddr"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newFakeConn(func(fakeProbe) []fakeReply { return nil })
+			connection := &icmpConn{PacketConn: conn, dgram: tt.dgram}
+			if _, err := connection.WriteTo([]byte{8, 0, 0, 0, 0, 1, 0, 1}, ip4("10.9.9.9")); err != nil {
+				t.Fatal(err)
+			}
+			dest := conn.sent()[0].Dest
+			if got := fmt.Sprintf("%T", dest); got != tt.want {
+				t.Errorf("sent to a %s, want a %s", got, tt.want)
+			}
+			if !strings.HasPrefix(dest.String(), "10.9.9.9") {
+				t.Errorf("sent to %s, want 10.9.9.9", dest)
+			}
+			// The kernel already filters the replies of a datagram socket
+			if tt.dgram {
+				if err := connection.attachFilter(1); err != nil {
+					t.Errorf("filter attached to a datagram socket: %v", err)
+				}
+			}
+		})
+	}
+}
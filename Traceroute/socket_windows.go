@@ -0,0 +1,27 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// Windows only delivers ICMP to raw sockets bound to a specific address, so the wildcard
+// is replaced by the address of the first interface that is up. Opening raw sockets
+// needs an elevated (Administrator) prompt.
+func wildcardSource(useIPv6 bool) (string, error) {
+	interfacesArray, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range interfacesArray {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if ip, err := interfaceAddr(iface.Name, useIPv6); err == nil {
+			return ip.String(), nil
+		}
+	}
+	return "", errors.New("no active interface to bind the ICMP socket to, pick one with -i")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Spacing the first backoff of -probe-spacing-adaptive raises back-to-back probes to
+const minBackoffSpacing = 10 * time.Millisecond
+
+// spacingBackoff spreads out the probes of a trace with -probe-spacing-adaptive once a hop shows
+// signs of ICMP rate limiting. Routers limit the ICMP errors they send, often to a small burst
+// followed by one per interval, so probes sent back to back lose their later replies while the
+// same probes spaced out are all answered. That recovery is what tells rate limiting from loss.
+type spacingBackoff struct {
+	// Spacing the backoff never goes above
+	max time.Duration
+	// Share of lost probes at which a partly answered hop looks rate-limited
+	loss float64
+}
+
+// Reports whether a hop that answered some of its probes lost at least the share given of them
+func rateLimitSigns(hop HopResult, loss float64) bool {
+	if !hop.Responded() || len(hop.RTTs) >= hop.Sent {
+		return false
+	}
+	return float64(hop.Sent-len(hop.RTTs)) >= loss*float64(hop.Sent)
+}
+
+// Probes a TTL like ping. When the hop looks rate-limited, it is probed again with the spacing of
+// its probes doubled, up to the maximum, until a spacing gets every probe answered; that spacing
+// is kept for the rest of the trace. When even the maximum does not, the loss is not down to rate
+// limiting and the spacing is left as it was. Returns the hop answered in full, if any, and a note
+// when the spacing was raised.
+func (b *spacingBackoff) probe(tracer *Tracer, ttl int) (HopResult, string) {
+	hop := ping(tracer, ttl)
+	start := tracer.interval
+	if !rateLimitSigns(hop, b.loss) {
+		return hop, ""
+	}
+	recovered := false
+	for !recovered && tracer.interval < b.max {
+		next := 2 * tracer.interval
+		if next < minBackoffSpacing {
+			next = minBackoffSpacing
+		}
+		if next > b.max {
+			next = b.max
+		}
+		tracer.interval = next
+		// Left as far apart from the last probe as from each other, so the limit the earlier
+		// probes ran into has passed
+		time.Sleep(next)
+		retry := ping(tracer, ttl)
+		if retry.Err == nil && len(retry.RTTs) >= retry.Sent {
+			hop, recovered = retry, true
+		}
+	}
+	if !recovered {
+		tracer.interval = start
+		return hop, ""
+	}
+	before := "back to back"
+	if start > 0 {
+		before = humanDuration(start) + " apart"
+	}
+	return hop, fmt.Sprintf("hop %d looks ICMP rate-limited: its replies recovered with probes %s apart instead of %s, which the following hops keep", ttl, humanDuration(tracer.interval), before)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Scripts a router at TTL 1 in front of dest that sends at most one Time Exceeded per every,
+// as routers limiting their ICMP errors do, and loses the probes numbered in lostArray anyway
+func rateLimitedRouter(dest string, every time.Duration, lostArray ...int) func(probe fakeProbe) []fakeReply {
+	var mutex sync.Mutex
+	var last time.Time
+	return func(probe fakeProbe) []fakeReply {
+		if probe.TTL > 1 {
+			return fakePath(dest)(probe)
+		}
+		for _, lost := range lostArray {
+			if probe.Number()%3 == lost {
+				return nil
+			}
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if now := time.Now(); now.Sub(last) >= every {
+			last = now
+			return fakePath(dest, "10.0.0.1")(probe)
+		}
+		return nil
+	}
+}
+
+func TestSpacingBackoff(t *testing.T) {
+	tests := []struct {
+		name      string
+		script    func(probe fakeProbe) []fakeReply
+		backedOff bool
+	}{
+		{"answers every probe", fakePath("10.9.9.9", "10.0.0.1"), false},
+		{"rate-limited", rateLimitedRouter("10.9.9.9", 30*time.Millisecond), true},
+		{"lossy however spaced", rateLimitedRouter("10.9.9.9", 0, 1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 50*time.Millisecond)
+			setFlag(t, timeoutMax, 50*time.Millisecond)
+			tracer := newTracer(newFakeConn(tt.script), ip4("10.9.9.9"), false)
+			backoff := &spacingBackoff{max: 80 * time.Millisecond, loss: 0.3}
+
+			hop, note := backoff.probe(tracer, 1)
+			if (note != "") != tt.backedOff {
+				t.Fatalf("got note %q, want a backoff: %v", note, tt.backedOff)
+			}
+			if !tt.backedOff {
+				if tracer.interval != 0 {
+					t.Errorf("spacing left at %v, want it restored", tracer.interval)
+				}
+				return
+			}
+			if tracer.interval < minBackoffSpacing || tracer.interval > backoff.max {
+				t.Errorf("spacing %v, want between %v and %v", tracer.interval, minBackoffSpacing, backoff.max)
+			}
+			if len(hop.RTTs) != hop.Sent {
+				t.Errorf("%d of %d probes answered after the backoff, want all", len(hop.RTTs), hop.Sent)
+			}
+
+			// The following hops keep the spacing
+			spacing := tracer.interval
+			if _, note := backoff.probe(tracer, 2); note != "" || tracer.interval != spacing {
+				t.Errorf("next hop got spacing %v and note %q, want %v kept", tracer.interval, note, spacing)
+			}
+		})
+	}
+}
+
+func TestRateLimitSigns(t *testing.T) {
+	replies := func(sent, answered int) HopResult {
+		hop := HopResult{Sent: sent}
+		for i := 0; i < answered; i++ {
+			hop.RTTs = append(hop.RTTs, time.Millisecond)
+			hop.Peers = append(hop.Peers, ip4("10.0.0.1"))
+		}
+		return hop
+	}
+	tests := []struct {
+		name string
+		hop  HopResult
+		loss float64
+		want bool
+	}{
+		{"all answered", replies(3, 3), 0.3, false},
+		{"none answered", replies(3, 0), 0.3, false},
+		{"one of three lost", replies(3, 2), 0.3, true},
+		{"one of three lost, higher threshold", replies(3, 2), 0.5, false},
+		{"two of three lost", replies(3, 1), 0.5, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rateLimitSigns(tt.hop, tt.loss); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
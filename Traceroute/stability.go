@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// stabilityReporter only accumulates the rounds of a repeated trace, printing nothing until they are done
+type stabilityReporter struct {
+	stats *pathStats
+}
+
+func (r *stabilityReporter) Start(target string, maxTTL int, traceID string) {
+	r.stats.Rounds++
+}
+
+func (r *stabilityReporter) Hop(hop HopResult) {
+	r.stats.add(hop)
+}
+
+func (r *stabilityReporter) Note(text string) {}
+
+func (r *stabilityReporter) End(result *TraceResult) {}
+
+// Traces the target runs times back to back and prints how steadily every hop
+// was answered by the same address, flagging the hops that changed between runs
+func verifyStability(target targetSpec, runs int) error {
+	reporter := &stabilityReporter{stats: newPathStats()}
+	for i := 0; i < runs; i++ {
+		if _, err := tracert(target.Host, target.Config, reporter); err != nil {
+			return err
+		}
+	}
+
+	rounds := reporter.stats.Rounds
+	fmt.Printf("Path stability to %s over %d runs\n", target.Host, rounds)
+	heading := "Responders (runs)"
+	if *responderTally {
+		heading = "Responders (runs, probes answered of sent)"
+	}
+	fmt.Printf("%3s %7s  %s\n", "TTL", "Stable", heading)
+	var total float64 = 0
+	var counted int = 0
+	for _, stats := range reporter.stats.sorted() {
+		// A hop silent in every run says nothing about which address answers it
+		if len(stats.Peers) == 0 {
+			fmt.Printf("%3d %7s  *\n", stats.TTL, "-")
+			continue
+		}
+		stability := stats.Stability(rounds)
+		total += stability
+		counted++
+
+		var respondersArray []string
+		for _, peer := range stats.Peers {
+			if *responderTally {
+				respondersArray = append(respondersArray, fmt.Sprintf("%v (%d, %d/%d)", peer, stats.AnsweredBy(peer), stats.ProbesBy(peer), stats.Sent))
+				continue
+			}
+			respondersArray = append(respondersArray, fmt.Sprintf("%v (%d)", peer, stats.AnsweredBy(peer)))
+		}
+		line := fmt.Sprintf("%3d %6.0f%%  %s%s", stats.TTL, stability, strings.Join(respondersArray, ", "), stats.untrackedNote())
+		if stability < 100 {
+			line += "  <- unstable"
+		}
+		fmt.Println(line)
+	}
+
+	if counted > 0 {
+		fmt.Printf("overall path stability: %.0f%%\n", total/float64(counted))
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Returns minimum, average and maximum of the durations
+func rttStats(durationsArray []time.Duration) (time.Duration, time.Duration, time.Duration) {
+	if len(durationsArray) == 0 {
+		return 0, 0, 0
+	}
+
+	var min, max, sum time.Duration = durationsArray[0], durationsArray[0], 0
+	for _, d := range durationsArray {
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+		sum += d
+	}
+	return min, sum / time.Duration(len(durationsArray)), max
+}
+
+// Returns the standard deviation of the durations
+func rttStdDev(durationsArray []time.Duration) time.Duration {
+	if len(durationsArray) < 2 {
+		return 0
+	}
+
+	_, avg, _ := rttStats(durationsArray)
+	var sum float64 = 0
+	for _, d := range durationsArray {
+		diff := float64(d - avg)
+		sum += diff * diff
+	}
+	return time.Duration(math.Sqrt(sum / float64(len(durationsArray))))
+}
+
+// Returns the mean of the durations without the single lowest and highest one.
+// With fewer than three samples nothing can be dropped and the minimum is returned.
+func rttTrimmedMean(durationsArray []time.Duration) time.Duration {
+	min, _, max := rttStats(durationsArray)
+	if len(durationsArray) < 3 {
+		return min
+	}
+
+	var sum time.Duration = 0
+	for _, d := range durationsArray {
+		sum += d
+	}
+	return (sum - min - max) / time.Duration(len(durationsArray)-2)
+}
+
+// Returns the latency shown as a hop's best, either the raw minimum or the trimmed mean
+func bestRTT(durationsArray []time.Duration, method string) time.Duration {
+	if method == "trimmed" {
+		return rttTrimmedMean(durationsArray)
+	}
+	min, _, _ := rttStats(durationsArray)
+	return min
+}
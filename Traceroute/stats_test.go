@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBestRTT(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name   string
+		rtts   []time.Duration
+		method string
+		want   time.Duration
+	}{
+		{"minimum", []time.Duration{5 * ms, 2 * ms, 9 * ms}, "min", 2 * ms},
+		{"trimmed drops a spike", []time.Duration{10 * ms, 11 * ms, 12 * ms, 200 * ms}, "trimmed", 11500 * time.Microsecond},
+		{"trimmed drops a lucky low sample", []time.Duration{1 * ms, 20 * ms, 22 * ms, 24 * ms}, "trimmed", 21 * ms},
+		{"trimmed of three is the median", []time.Duration{3 * ms, 100 * ms, 4 * ms}, "trimmed", 4 * ms},
+		{"trimmed of two is the minimum", []time.Duration{8 * ms, 6 * ms}, "trimmed", 6 * ms},
+		{"trimmed of one", []time.Duration{7 * ms}, "trimmed", 7 * ms},
+		{"no replies", nil, "trimmed", 0},
+		{"repeated extremes drop once", []time.Duration{5 * ms, 5 * ms, 9 * ms, 9 * ms}, "trimmed", 7 * ms},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bestRTT(tt.rtts, tt.method); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
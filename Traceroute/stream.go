@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// hopStream is a Reporter passing every hop of a trace on to a channel as it completes, for code
+// embedding the tracer that wants the hops without waiting for the trace or parsing its output.
+// Hops queue up without bound and are handed on by a goroutine of their own, so neither a slow
+// consumer nor one calling wait before reading holds the prober up, however many hops the trace
+// reports; once the context is cancelled further hops are dropped. The channel is closed exactly
+// once, when the trace has ended and every hop was handed on, or when the context is cancelled.
+type hopStream struct {
+	ctx  context.Context
+	hops chan HopResult
+
+	mutex sync.Mutex
+	queue []HopResult
+	ended bool
+	// Signalled when a hop is queued or the trace ends
+	wake chan struct{}
+
+	// Closed when the trace has ended, with its outcome set
+	done   chan struct{}
+	result *TraceResult
+	err    error
+}
+
+// Traces addr like tracert in the background and returns the channel its hops arrive on,
+// with a function waiting for the trace to end and returning its result. Cancelling ctx
+// stops the probing too.
+func streamTrace(ctx context.Context, addr string, config traceConfig) (<-chan HopResult, func() (*TraceResult, error)) {
+	stream := newHopStream(ctx)
+	go stream.run(func(reporter Reporter) (*TraceResult, error) {
+		return tracertContext(ctx, addr, config, reporter)
+	})
+	return stream.hops, stream.wait
+}
+
+func newHopStream(ctx context.Context) *hopStream {
+	stream := &hopStream{ctx: ctx, hops: make(chan HopResult), wake: make(chan struct{}, 1), done: make(chan struct{})}
+	go stream.forward()
+	return stream
+}
+
+// Runs the trace with the stream as its reporter and records its outcome
+func (s *hopStream) run(trace func(reporter Reporter) (*TraceResult, error)) {
+	s.result, s.err = trace(s)
+	s.mutex.Lock()
+	s.ended = true
+	s.mutex.Unlock()
+	s.signal()
+	close(s.done)
+}
+
+func (s *hopStream) wait() (*TraceResult, error) {
+	<-s.done
+	return s.result, s.err
+}
+
+// Hands the queued hops on to the channel, closing it once the trace has ended and the queue is empty
+func (s *hopStream) forward() {
+	defer close(s.hops)
+	for {
+		s.mutex.Lock()
+		if len(s.queue) == 0 {
+			ended := s.ended
+			s.mutex.Unlock()
+			if ended {
+				return
+			}
+			select {
+			case <-s.wake:
+			case <-s.ctx.Done():
+				return
+			}
+			continue
+		}
+		hop := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mutex.Unlock()
+
+		select {
+		case s.hops <- hop:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *hopStream) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *hopStream) Start(target string, maxTTL int, traceID string) {}
+
+func (s *hopStream) Hop(hop HopResult) {
+	if s.ctx.Err() != nil {
+		return
+	}
+	s.mutex.Lock()
+	s.queue = append(s.queue, hop)
+	s.mutex.Unlock()
+	s.signal()
+}
+
+func (s *hopStream) Note(text string) {}
+
+func (s *hopStream) End(result *TraceResult) {}
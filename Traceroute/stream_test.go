@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStreamTraceStopsWhenCancelled(t *testing.T) {
+	tests := []struct {
+		name     string
+		parallel int
+		// Hops read from the stream before cancelling; parallel traces report theirs at the end
+		before int
+	}{
+		{"sequential", 1, 2},
+		{"parallel", 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			setFlag(t, parallelTTLs, tt.parallel)
+			offlineDNS(t, nil)
+			// Two routers, then hops answering too late for every probe to time out
+			conn := newFakeConn(func(probe fakeProbe) []fakeReply {
+				router := fmt.Sprintf("10.0.0.%d", probe.TTL)
+				reply := fakeReply{Bytes: timeExceeded(router, probe), Peer: ip4(router)}
+				if probe.TTL > 2 {
+					reply.Delay = time.Hour
+				}
+				return []fakeReply{reply}
+			})
+			useFakeNetwork(t, conn)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			hops, wait := streamTrace(ctx, "10.9.9.9", traceConfig{MaxTTL: 30, Method: "icmp"})
+			for i := 0; i < tt.before; i++ {
+				if hop, ok := <-hops; !ok || hop.TTL != i+1 {
+					t.Fatalf("stream ended or gave hop %d before hop %d", hop.TTL, i+1)
+				}
+			}
+			if tt.before == 0 {
+				time.Sleep(50 * time.Millisecond)
+			}
+			cancel()
+			for range hops {
+			}
+
+			stopped := time.Now()
+			result, err := wait()
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("trace ended with %v, want it cancelled", err)
+			}
+			// Only the hops in progress are finished
+			if elapsed := time.Since(stopped); elapsed > 300*time.Millisecond {
+				t.Errorf("trace went on for %v after it was cancelled", elapsed)
+			}
+			if result == nil || len(result.Hops) >= 30 || len(conn.sent()) >= 90 {
+				t.Errorf("%d probes sent after cancelling, want the trace stopped", len(conn.sent()))
+			}
+		})
+	}
+}
+
+func TestStreamHoldsEveryHop(t *testing.T) {
+	// More hops than the trace has TTLs, as -bisect-fill and confirmation probes report
+	const reported = 100
+	stream := newHopStream(context.Background())
+	go stream.run(func(reporter Reporter) (*TraceResult, error) {
+		for ttl := 1; ttl <= reported; ttl++ {
+			reporter.Hop(HopResult{TTL: ttl})
+		}
+		return &TraceResult{}, nil
+	})
+
+	// Waiting for the trace before reading its hops must not block it
+	finished := make(chan struct{})
+	go func() {
+		stream.wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("trace blocked on hops nobody read yet")
+	}
+
+	got := 0
+	for hop := range stream.hops {
+		got++
+		if hop.TTL != got {
+			t.Fatalf("got hop %d as hop number %d", hop.TTL, got)
+		}
+	}
+	if got != reported {
+		t.Errorf("stream gave %d hops, want %d", got, reported)
+	}
+}
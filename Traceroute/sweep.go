@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Limits of a subnet sweep, in host bits of the prefix
+const (
+	SweepDefaultHostBits = 8
+	SweepMaxHostBits     = 16
+)
+
+// A host is given up after this many consecutive hops without an answer
+const SweepSilentHops = 3
+
+// Columns of the printed hop count matrix
+const sweepColumns = 16
+
+// Returns every address of the prefix, refusing ones larger than the sweep limits
+func sweepAddresses(cidr string, allowLarge bool) ([]net.IP, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := network.Mask.Size()
+	hostBits := bits - ones
+	if hostBits > SweepMaxHostBits || (hostBits > SweepDefaultHostBits && !allowLarge) {
+		return nil, fmt.Errorf("%s has %d addresses; sweeps are limited to /%d (/%d with -sweep-large)",
+			cidr, 1<<uint(hostBits), bits-SweepDefaultHostBits, bits-SweepMaxHostBits)
+	}
+
+	var addressesArray []net.IP
+	ip := append(net.IP(nil), network.IP...)
+	for i := 0; i < 1<<uint(hostBits); i++ {
+		addressesArray = append(addressesArray, append(net.IP(nil), ip...))
+		// Increments the address as a big endian number
+		for j := len(ip) - 1; j >= 0; j-- {
+			ip[j]++
+			if ip[j] != 0 {
+				break
+			}
+		}
+	}
+	return addressesArray, nil
+}
+
+// Walks the TTLs to dest without printing and returns its distance, 0 when it was not reached
+func hopCount(dest *net.IPAddr, config traceConfig, id int) (int, error) {
+	connection, err := openSocket(*sourceIface, *useIPv6)
+	if err != nil {
+		return 0, err
+	}
+	defer connection.Close()
+
+	tracer := newTracer(connection, dest, *useIPv6)
+	tracer.maxTTL = config.MaxTTL
+	// A datagram socket's identifier is set by the kernel and already its own
+	if _, assigned := connection.assignedID(); !assigned {
+		tracer.id = id
+	}
+
+	var silent int = 0
+	for ttl := 1; ttl <= tracer.maxTTL && silent < SweepSilentHops; ttl++ {
+		hop := ping(tracer, ttl)
+		if hop.Reached {
+			return ttl, nil
+		}
+		if hop.Responded() {
+			silent = 0
+		} else {
+			silent++
+		}
+	}
+	return 0, nil
+}
+
+// Measures the distance of every address of the prefix with a pool of workers and prints the matrix
+func sweep(cidr string, config traceConfig, workers int, allowLarge bool) error {
+	addressesArray, err := sweepAddresses(cidr, allowLarge)
+	if err != nil {
+		return err
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	counts := make([]int, len(addressesArray))
+	failed := make([]bool, len(addressesArray))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				// Every host gets its own echo identifier so the workers can tell their replies apart
+				count, err := hopCount(&net.IPAddr{IP: addressesArray[i]}, config, echoID())
+				counts[i] = count
+				failed[i] = err != nil
+			}
+		}()
+	}
+	for i := range addressesArray {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	fmt.Printf("Hop counts in %s (- not reached, E error):\n", cidr)
+	for row := 0; row < len(addressesArray); row += sweepColumns {
+		fmt.Printf("%-16s", addressesArray[row])
+		for i := row; i < row+sweepColumns && i < len(addressesArray); i++ {
+			switch {
+			case failed[i]:
+				fmt.Printf("  E")
+			case counts[i] == 0:
+				fmt.Printf("  -")
+			default:
+				fmt.Printf("%3d", counts[i])
+			}
+		}
+		fmt.Printf("\n")
+	}
+	return nil
+}
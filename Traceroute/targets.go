@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// traceConfig holds the settings that a targets file may override per destination
+type traceConfig struct {
+	MaxTTL int
+	Method string
+
+	// Port of a URL target, or the default one of its scheme; ICMP probes have no port, so only port-based methods use it
+	Port int
+}
+
+func defaultConfig() traceConfig {
+	return traceConfig{MaxTTL: *defaultMaxTTL, Method: "icmp"}
+}
+
+// targetSpec is one destination to trace together with its merged settings
+type targetSpec struct {
+	Host   string
+	Config traceConfig
+}
+
+// Default ports of the URL schemes a target may be given as
+var schemePorts = map[string]int{"http": 80, "https": 443, "ws": 80, "wss": 443, "ftp": 21, "ssh": 22}
+
+// Makes a target of a host, an IP or a URL such as https://example.com/path, of which only
+// the host and the port are kept; plain hosts and IPs, IPv6 ones included, are taken as they are
+func parseTarget(input string, config traceConfig) (targetSpec, error) {
+	if !strings.Contains(input, "://") {
+		return targetSpec{Host: input, Config: config}, nil
+	}
+
+	target, err := url.Parse(input)
+	if err != nil {
+		return targetSpec{}, fmt.Errorf("malformed URL %q: %v", input, err)
+	}
+	if target.Hostname() == "" {
+		return targetSpec{}, fmt.Errorf("URL %q has no host", input)
+	}
+	config.Port = schemePorts[strings.ToLower(target.Scheme)]
+	if target.Port() != "" {
+		// url.Parse only checks that the port is numeric
+		port, err := strconv.Atoi(target.Port())
+		if err != nil || port < 1 || port > 65535 {
+			return targetSpec{}, fmt.Errorf("URL %q has an invalid port", input)
+		}
+		config.Port = port
+	}
+	return targetSpec{Host: target.Hostname(), Config: config}, nil
+}
+
+// Reads one destination per line as "host [key=value ...]"; blank lines and # comments are skipped
+func loadTargets(path string, defaults traceConfig) ([]targetSpec, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var targetsArray []targetSpec
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		target, err := parseTargetLine(line, defaults)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+		}
+		targetsArray = append(targetsArray, target)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return targetsArray, nil
+}
+
+func parseTargetLine(line string, defaults traceConfig) (targetSpec, error) {
+	fields := strings.Fields(line)
+	target, err := parseTarget(fields[0], defaults)
+	if err != nil {
+		return target, err
+	}
+
+	for _, field := range fields[1:] {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return target, fmt.Errorf("expected key=value, got %q", field)
+		}
+		switch key {
+		case "maxttl":
+			ttl, err := strconv.Atoi(value)
+			if err != nil || ttl < 1 || ttl > 255 {
+				return target, fmt.Errorf("maxttl must be between 1 and 255, got %q", value)
+			}
+			target.Config.MaxTTL = ttl
+		case "method":
+			if value != "icmp" {
+				return target, fmt.Errorf("unsupported method %q", value)
+			}
+			target.Config.Method = value
+		default:
+			return target, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return target, nil
+}
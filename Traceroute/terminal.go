@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// terminalCode is an ICMP type and code that ends a trace as if the destination had answered;
+// a Code of -1 matches every code of the type
+type terminalCode struct {
+	Type int
+	Code int
+}
+
+// Terminal codes parsed from -terminal-codes, nil for the defaults of the traced family
+var terminalCodes []terminalCode
+
+// Without -terminal-codes only port unreachable, the answer of a destination to a UDP probe, ends a trace
+func defaultTerminalCodes(useIPv6 bool) []terminalCode {
+	if useIPv6 {
+		return []terminalCode{{Type: int(ipv6.ICMPTypeDestinationUnreachable), Code: 4}}
+	}
+	return []terminalCode{{Type: int(ipv4.ICMPTypeDestinationUnreachable), Code: 3}}
+}
+
+// Parses comma separated type/code pairs such as 3/3,3/13, or bare types matching any code
+func parseTerminalCodes(text string) ([]terminalCode, error) {
+	var codesArray []terminalCode
+	for _, field := range strings.Split(text, ",") {
+		field = strings.TrimSpace(field)
+		typeText, codeText, hasCode := strings.Cut(field, "/")
+		code := terminalCode{Code: -1}
+		var err error
+		if code.Type, err = strconv.Atoi(typeText); err != nil || code.Type < 0 || code.Type > 255 {
+			return nil, fmt.Errorf("invalid ICMP type in %q", field)
+		}
+		if hasCode {
+			if code.Code, err = strconv.Atoi(codeText); err != nil || code.Code < 0 || code.Code > 255 {
+				return nil, fmt.Errorf("invalid ICMP code in %q", field)
+			}
+		}
+		codesArray = append(codesArray, code)
+	}
+	return codesArray, nil
+}
+
+// Reports whether the message is one of the terminal codes
+func isTerminalReply(codesArray []terminalCode, msg *icmp.Message) bool {
+	reply := icmpReply(msg)
+	for _, code := range codesArray {
+		if code.Type == reply.Type && (code.Code == -1 || code.Code == reply.Code) {
+			return true
+		}
+	}
+	return false
+}
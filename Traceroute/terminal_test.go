@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTerminalCodes(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    []terminalCode
+		wantErr bool
+	}{
+		{"3/13", []terminalCode{{Type: 3, Code: 13}}, false},
+		{"3/13, 3/10", []terminalCode{{Type: 3, Code: 13}, {Type: 3, Code: 10}}, false},
+		{"3", []terminalCode{{Type: 3, Code: -1}}, false},
+		{"3/", nil, true},
+		{"x/1", nil, true},
+		{"256", nil, true},
+		{"3/-1", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got, err := parseTerminalCodes(tt.text)
+			if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, error %v; want %v, error: %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTerminalCodesEndTrace(t *testing.T) {
+	tests := []struct {
+		name  string
+		codes string
+		// Code of the Destination Unreachable the firewall at hop 2 sends
+		code int
+		hops int
+	}{
+		{"port unreachable by default", "", 3, 2},
+		{"prohibited is no destination by default", "", 13, 3},
+		{"listed code", "3/13", 13, 2},
+		{"other code of the type", "3/13", 10, 3},
+		{"bare type", "3", 10, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			offlineDNS(t, nil)
+			var codesArray []terminalCode
+			if tt.codes != "" {
+				var err error
+				if codesArray, err = parseTerminalCodes(tt.codes); err != nil {
+					t.Fatal(err)
+				}
+			}
+			setFlag(t, &terminalCodes, codesArray)
+			useFakeNetwork(t, newFakeConn(func(probe fakeProbe) []fakeReply {
+				switch probe.TTL {
+				case 1:
+					return []fakeReply{{Bytes: timeExceeded("10.0.0.1", probe), Peer: ip4("10.0.0.1")}}
+				case 2:
+					return []fakeReply{{Bytes: destUnreachable(tt.code, probe), Peer: ip4("10.0.0.2")}}
+				}
+				return []fakeReply{{Bytes: echoReply(probe), Peer: ip4("10.9.9.9")}}
+			}))
+
+			result, err := tracert("10.9.9.9", traceConfig{MaxTTL: 5, Method: "icmp"}, &recordingReporter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Reached || len(result.Hops) != tt.hops {
+				t.Fatalf("got %d hops, reached %v; want %d reached", len(result.Hops), result.Reached, tt.hops)
+			}
+			last := result.Hops[len(result.Hops)-1]
+			if terminal := tt.hops == 2; (last.TerminalReply != "") != terminal || strings.Contains(hopNotes(last), "(reached on ") != terminal {
+				t.Errorf("hop %d ended on %q with notes %q", last.TTL, last.TerminalReply, hopNotes(last))
+			}
+		})
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package main
+
+func terminalWidth() int {
+	return 0
+}
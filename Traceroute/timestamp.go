@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// IPv4 Timestamp option (RFC 791), with room for four address and timestamp pairs
+const (
+	ipOptionEnd       = 0
+	ipOptionNOP       = 1
+	ipOptionTimestamp = 68
+	tsAndAddress      = 1
+	tsOptionLength    = 4 + 4*8
+)
+
+// routerTimestamp is one entry a router recorded in the Timestamp option
+type routerTimestamp struct {
+	Addr net.IP
+
+	// Milliseconds since midnight UT, unless Standard is false and the router used its own clock
+	Millis   uint32
+	Standard bool
+}
+
+func (t routerTimestamp) String() string {
+	if !t.Standard {
+		return fmt.Sprintf("%v nonstandard %d", t.Addr, t.Millis)
+	}
+	return fmt.Sprintf("%v %s UT", t.Addr, time.Time{}.Add(time.Duration(t.Millis)*time.Millisecond).Format("15:04:05.000"))
+}
+
+// Returns an empty Timestamp option asking every router to record its address and time
+func timestampOption() []byte {
+	option := make([]byte, tsOptionLength)
+	option[0] = ipOptionTimestamp
+	option[1] = tsOptionLength
+	option[2] = 5
+	option[3] = tsAndAddress
+	return option
+}
+
+// Returns the entries of the Timestamp option among IPv4 header options, and how many routers could not record one
+func parseTimestamps(options []byte) ([]routerTimestamp, int) {
+	for len(options) > 0 {
+		switch options[0] {
+		case ipOptionEnd:
+			return nil, 0
+		case ipOptionNOP:
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || int(options[1]) < 2 || int(options[1]) > len(options) {
+			return nil, 0
+		}
+		option := options[:options[1]]
+		options = options[options[1]:]
+		// Only the address and timestamp format we send is understood
+		if option[0] != ipOptionTimestamp || len(option) < 4 || option[3]&0x0f != tsAndAddress {
+			continue
+		}
+
+		// The pointer is one-based and points past the last entry filled in
+		var timestampsArray []routerTimestamp
+		end := int(option[2]) - 1
+		if end > len(option) {
+			end = len(option)
+		}
+		for i := 4; i+8 <= end; i += 8 {
+			value := binary.BigEndian.Uint32(option[i+4 : i+8])
+			timestampsArray = append(timestampsArray, routerTimestamp{
+				Addr:     net.IP(append([]byte{}, option[i:i+4]...)),
+				Millis:   value &^ (1 << 31),
+				Standard: value&(1<<31) == 0,
+			})
+		}
+		return timestampsArray, int(option[3] >> 4)
+	}
+	return nil, 0
+}
+
+// Returns the options of an IPv4 header, or nil
+func ipv4Options(header []byte) []byte {
+	if len(header) < 20 || header[0]>>4 != 4 {
+		return nil
+	}
+	headerLen := int(header[0]&0x0f) << 2
+	if headerLen <= 20 || len(header) < headerLen {
+		return nil
+	}
+	return header[20:headerLen]
+}
+
+// Formats the timestamps of a hop
+func timestampsString(timestampsArray []routerTimestamp, overflow int) string {
+	var partsArray []string
+	for _, stamp := range timestampsArray {
+		partsArray = append(partsArray, stamp.String())
+	}
+	if overflow > 0 {
+		partsArray = append(partsArray, fmt.Sprintf("%d more not recorded", overflow))
+	}
+	return strings.Join(partsArray, ", ")
+}
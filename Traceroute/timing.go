@@ -0,0 +1,36 @@
+package main
+
+import (
+	"runtime"
+	"time"
+)
+
+// In precise mode the last spinWindow before a scheduled send is spent
+// busy-waiting instead of sleeping. The sleep wakeup can be late by the
+// scheduler's latency, spinning is not, at the cost of one CPU core kept
+// fully busy for up to spinWindow per probe.
+const spinWindow = 200 * time.Microsecond
+
+// Waits until the given moment
+func waitUntil(t time.Time, precise bool) {
+	if !precise {
+		time.Sleep(time.Until(t))
+		return
+	}
+
+	if d := time.Until(t) - spinWindow; d > 0 {
+		time.Sleep(d)
+	}
+	for time.Now().Before(t) {
+	}
+}
+
+// Pins the calling goroutine to its thread in precise mode so it is not
+// moved between threads while a probe is timed; the returned function undoes it.
+func pinThread(precise bool) func() {
+	if !precise {
+		return func() {}
+	}
+	runtime.LockOSThread()
+	return runtime.UnlockOSThread
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// Returns the ID a trace is tagged with: -trace-id for all of them, or a new random UUID per trace
+func nextTraceID() string {
+	if *traceIDFlag != "" {
+		return *traceIDFlag
+	}
+	return newUUID()
+}
+
+// Returns a version 4 UUID
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Tracer holds the state shared by all probes of one trace
+type Tracer struct {
+	conn probeConn
+	dest *net.IPAddr
+	ipv6 bool
+
+	// Context of the trace; the probes stop waiting for -rate once it is done
+	ctx context.Context
+
+	// Echo identifier of the probes, distinct for traces running side by side
+	id int
+
+	// ICMP code of the echo requests, see -echo-code
+	echoCode int
+
+	// Carries the send time in the payload of the probes, see -payload-timestamp
+	stampPayload bool
+
+	// ICMP messages besides echo replies that count as reaching the destination, see -terminal-codes
+	terminalCodes []terminalCode
+
+	// Highest TTL probed, -max-ttl unless the target overrides it
+	maxTTL int
+
+	// Reply timeout of each probe of a hop is timeoutBase + ttl*timeoutPerHop, capped at timeoutMax
+	timeoutBase   time.Duration
+	timeoutPerHop time.Duration
+	timeoutMax    time.Duration
+
+	// Spacing between the probes of a hop, kept with busy-waiting when precise
+	interval time.Duration
+	precise  bool
+
+	// Retries a timed out first probe while nothing in the trace has answered yet
+	arpRetry bool
+	answered bool
+
+	// Payload sizes the probes of a hop cycle through, see -probe-sizes
+	probeSizes []int
+
+	// Probes sent to every hop, see -probes
+	probes int
+
+	// Extra probes sent to a hop whose probes all timed out, see -min-ttl-confirm
+	confirmProbes int
+
+	// Bounds of the probes sent to a hop with -adaptive-probes, maxProbes is 0 without it
+	minProbes int
+	maxProbes int
+
+	// When the first reply of the trace was received
+	firstReply time.Time
+
+	// Probes sent so far; every probe, a retried one included, is numbered by it
+	sent int
+
+	// Packet totals of the trace for its summary
+	counters ProbeCounters
+}
+
+func newTracer(conn probeConn, dest *net.IPAddr, ipv6 bool) *Tracer {
+	tracer := &Tracer{
+		conn:          conn,
+		dest:          dest,
+		ipv6:          ipv6,
+		ctx:           context.Background(),
+		id:            echoID(),
+		echoCode:      *echoCode,
+		stampPayload:  *stampPayload,
+		terminalCodes: terminalCodes,
+		maxTTL:        *defaultMaxTTL,
+		timeoutBase:   *timeoutBase,
+		timeoutPerHop: *timeoutPerHop,
+		timeoutMax:    *timeoutMax,
+		interval:      *probeInterval,
+		precise:       *preciseTiming,
+		arpRetry:      *arpRetry,
+		probeSizes:    cycledSizes,
+		probes:        *hopProbes,
+		confirmProbes: *confirmProbes,
+	}
+	// The kernel replaces the identifier of echo requests sent through a datagram socket with its own
+	if assigner, ok := conn.(idAssigner); ok {
+		if id, ok := assigner.assignedID(); ok {
+			tracer.id = id
+		}
+	}
+	if *adaptive {
+		tracer.minProbes, tracer.maxProbes = *minProbes, *maxProbes
+	}
+	if tracer.terminalCodes == nil {
+		tracer.terminalCodes = defaultTerminalCodes(ipv6)
+	}
+	return tracer
+}
+
+// Payload sizes parsed from -probe-sizes
+var cycledSizes []int
+
+// Returns the payload sizes the probes of a hop are sent with, MsgLength unless -probe-sizes is given
+func (t *Tracer) payloadSizes() []int {
+	if len(t.probeSizes) == 0 {
+		return []int{MsgLength}
+	}
+	return t.probeSizes
+}
+
+// Returns how long to wait for the reply to each probe of the hop at ttl
+func (t *Tracer) timeout(ttl int) time.Duration {
+	timeout := t.timeoutBase + time.Duration(ttl)*t.timeoutPerHop
+	if t.timeoutMax > 0 && timeout > t.timeoutMax {
+		timeout = t.timeoutMax
+	}
+	return timeout
+}
+
+// Returns the ICMP protocol number of the trace's address family
+func (t *Tracer) protocol() int {
+	if t.ipv6 {
+		return ProtocolIPv6ICMP
+	}
+	return ProtocolIPv4ICMP
+}
+
+func (t *Tracer) echoRequestType() icmp.Type {
+	if t.ipv6 {
+		return ipv6.ICMPTypeEchoRequest
+	}
+	return ipv4.ICMPTypeEcho
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Returns the TTLs 1 to maxTTL in the order they are probed: ascending, descending or random
+func ttlOrder(strategy string, maxTTL int) ([]int, error) {
+	ttlsArray := make([]int, maxTTL)
+	switch strategy {
+	case "ascending":
+		for i := range ttlsArray {
+			ttlsArray[i] = i + 1
+		}
+	case "descending":
+		for i := range ttlsArray {
+			ttlsArray[i] = maxTTL - i
+		}
+	case "random":
+		for i, n := range randomPerm(maxTTL) {
+			ttlsArray[i] = n + 1
+		}
+	default:
+		return nil, fmt.Errorf("unknown TTL order %q, want ascending, descending or random", strategy)
+	}
+	return ttlsArray, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTTLOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		want     []int
+		wantErr  bool
+	}{
+		{"ascending", "ascending", []int{1, 2, 3, 4, 5}, false},
+		{"descending", "descending", []int{5, 4, 3, 2, 1}, false},
+		{"random", "random", nil, false},
+		{"unknown", "sideways", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttlsArray, err := ttlOrder(tt.strategy, 5)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			if tt.want != nil && !reflect.DeepEqual(ttlsArray, tt.want) {
+				t.Errorf("got %v, want %v", ttlsArray, tt.want)
+			}
+			// Every order probes each TTL once
+			if !tt.wantErr {
+				sorted := append([]int(nil), ttlsArray...)
+				sort.Ints(sorted)
+				if !reflect.DeepEqual(sorted, []int{1, 2, 3, 4, 5}) {
+					t.Errorf("order %v is no permutation of the TTLs", ttlsArray)
+				}
+			}
+		})
+	}
+}
+
+func TestTraceInTTLOrder(t *testing.T) {
+	tests := []struct {
+		order string
+		// TTLs of the probes in the order written
+		probed []int
+	}{
+		{"ascending", []int{1, 2, 3}},
+		{"descending", []int{5, 4, 3, 2, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			setFlag(t, timeoutBase, 20*time.Millisecond)
+			setFlag(t, timeoutMax, 20*time.Millisecond)
+			setFlag(t, probeOrder, tt.order)
+			offlineDNS(t, nil)
+			conn := newFakeConn(fakePath("10.9.9.9", "10.0.0.1", "10.0.0.2"))
+			useFakeNetwork(t, conn)
+
+			reporter := &recordingReporter{}
+			result, err := tracert("10.9.9.9", traceConfig{MaxTTL: 5, Method: "icmp"}, reporter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var probed []int
+			for _, probe := range conn.sent() {
+				if len(probed) == 0 || probed[len(probed)-1] != probe.TTL {
+					probed = append(probed, probe.TTL)
+				}
+			}
+			if !reflect.DeepEqual(probed, tt.probed) {
+				t.Errorf("probed TTLs %v, want %v", probed, tt.probed)
+			}
+			// Whatever the order, the hops are reported by TTL and end at the destination
+			var reported []int
+			for _, hop := range reporter.hops {
+				reported = append(reported, hop.TTL)
+			}
+			if !result.Reached || !reflect.DeepEqual(reported, []int{1, 2, 3}) {
+				t.Errorf("reported hops %v, reached %v; want 1 to 3 reached", reported, result.Reached)
+			}
+		})
+	}
+}
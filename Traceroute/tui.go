@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Pause between two rounds of the interactive mode
+const TUIRoundPause = time.Second
+
+// Widths of the loss and latency bars in characters
+const (
+	lossBarWidth    = 10
+	latencyBarWidth = 20
+)
+
+// tuiReporter redraws the accumulated path on every hop of a continuously repeated trace.
+// It only uses ANSI escapes, and commands are read a line at a time so no raw terminal mode is needed.
+type tuiReporter struct {
+	target  string
+	address string
+	stats   *pathStats
+	paused  bool
+	status  string
+}
+
+func (r *tuiReporter) Start(target string, maxTTL int, traceID string) {
+	r.stats.Rounds++
+	r.draw()
+}
+
+func (r *tuiReporter) Hop(hop HopResult) {
+	r.stats.add(hop)
+	r.draw()
+}
+
+func (r *tuiReporter) Note(text string) {
+	r.status = text
+}
+
+func (r *tuiReporter) End(result *TraceResult) {
+	r.draw()
+}
+
+func (r *tuiReporter) draw() {
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+
+	state := fmt.Sprintf("round %d", r.stats.Rounds)
+	if r.paused {
+		state = "paused"
+	}
+	fmt.Fprintf(&b, "Tracing %s [%s]  (%s)\n\n", r.target, r.address, state)
+	fmt.Fprintf(&b, "%4s %-32s %6s %5s %8s %8s %8s %8s  %-*s %s\n", "Hop", "Host", "Loss%", "Sent",
+		"Last", "Avg", "Best", "Worst", lossBarWidth, "Loss", "Latency")
+
+	hopsArray := r.stats.sorted()
+	var slowest time.Duration = 0
+	for _, stats := range hopsArray {
+		if stats.Avg() > slowest {
+			slowest = stats.Avg()
+		}
+	}
+
+	for _, stats := range hopsArray {
+		host := "???"
+		if len(stats.Peers) > 0 {
+			host = strings.Join(uniquePeers(stats.Peers), " ")
+		}
+		if stats.Untracked > 0 {
+			host += fmt.Sprintf(" +%d", stats.Untracked)
+		}
+		var latencyBar int = 0
+		if slowest > 0 {
+			latencyBar = int(float64(latencyBarWidth) * float64(stats.Avg()) / float64(slowest))
+		}
+		fmt.Fprintf(&b, "%3d. %-32s %5.1f%% %5d %8s %8s %8s %8s  %-*s %s\n", stats.TTL, host, stats.Loss(), stats.Sent,
+			tuiMs(stats.Last), tuiMs(stats.Avg()), tuiMs(stats.Best), tuiMs(stats.Worst),
+			lossBarWidth, strings.Repeat("#", int(stats.Loss()*lossBarWidth/100)), strings.Repeat("=", latencyBar))
+	}
+
+	if r.status != "" {
+		fmt.Fprintf(&b, "\n%s\n", r.status)
+	}
+	b.WriteString("\nCommands (then Enter): p pause/resume, t <host> change target, r reset, q quit\n")
+	fmt.Print(b.String())
+}
+
+func tuiMs(d time.Duration) string {
+	return formatMillis(d, 2)
+}
+
+// Applies a command line typed by the user; commands take effect between rounds
+func (r *tuiReporter) handle(command string, target *targetSpec) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return
+	}
+	r.status = ""
+	switch fields[0] {
+	case "p":
+		r.paused = !r.paused
+	case "r":
+		r.stats = newPathStats()
+	case "t":
+		if len(fields) != 2 {
+			r.status = "usage: t <host>"
+			break
+		}
+		target.Host = fields[1]
+		r.stats = newPathStats()
+	default:
+		r.status = fmt.Sprintf("unknown command %q", fields[0])
+	}
+	r.draw()
+}
+
+// Resolves host again; the statistics restart when it now has another address, or is another host
+func (r *tuiReporter) resolve(host string) {
+	destination, err := lookupTarget(host)
+	if err != nil {
+		r.status = fmt.Sprintf("cannot resolve %s: %v", host, err)
+		if host != r.target {
+			r.target, r.address = host, host
+		}
+		return
+	}
+
+	address := destination.String()
+	if host == r.target && r.address != "" && address != r.address {
+		r.status = fmt.Sprintf("%s moved from %s to %s, tracing restarted", host, r.address, address)
+		r.stats = newPathStats()
+	}
+	r.target, r.address = host, address
+}
+
+// Reports whether stdout is a terminal the interactive mode can draw on
+func stdoutIsTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Repeats the trace to target until the user quits, redrawing the accumulated path
+func runTUI(target targetSpec) {
+	commands := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			commands <- scanner.Text()
+		}
+		close(commands)
+	}()
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	// Rounds trace the address resolved last, so a changing DNS answer does not mix paths
+	reporter := &tuiReporter{stats: newPathStats()}
+	var resolvedAt time.Time
+	var forceResolve bool = false
+	for {
+		due := *reresolveInterval > 0 && time.Since(resolvedAt) >= *reresolveInterval
+		if target.Host != reporter.target || due || forceResolve {
+			reporter.resolve(target.Host)
+			resolvedAt = time.Now()
+			forceResolve = false
+		}
+
+		if !reporter.paused {
+			if _, err := tracert(reporter.address, target.Config, reporter); err != nil {
+				reporter.status = err.Error()
+				reporter.draw()
+			}
+		}
+
+		// A paused screen only waits for the next command
+		var nextRound <-chan time.Time
+		if !reporter.paused {
+			nextRound = time.After(TUIRoundPause)
+		}
+		select {
+		case command, ok := <-commands:
+			if !ok || strings.TrimSpace(command) == "q" {
+				return
+			}
+			reporter.handle(command, &target)
+		case <-hangups:
+			forceResolve = true
+		case <-nextRound:
+		}
+	}
+}
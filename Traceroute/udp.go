@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Destination port of the first UDP probe, the one classic traceroute uses;
+// every probe goes to the next port so the quoted header tells them apart
+const udpBasePort = 33434
+
+// udpSocket is one UDP socket probes are sent from
+type udpSocket struct {
+	conn net.PacketConn
+	p    *ipv4.PacketConn
+	p6   *ipv6.PacketConn
+	port int
+}
+
+func (s *udpSocket) setTTL(ttl int) error {
+	if s.p6 != nil {
+		return s.p6.SetHopLimit(ttl)
+	}
+	return s.p.SetTTL(ttl)
+}
+
+// udpProber sends UDP probes whose ICMP errors are read on the trace's raw ICMP socket.
+//
+// By default, like classic traceroute, every probe leaves from the same source port to the next
+// destination port, so load balancers hashing the ports may send each probe down another path.
+// With -udp-rotate-source the destination port stays fixed and the n-th probe of every hop leaves
+// from the n-th of several sockets: each source port is one flow kept across all TTLs, as Paris
+// traceroute keeps its single flow, so the flows map up to that many load-balanced paths.
+type udpProber struct {
+	socketsArray []*udpSocket
+	rotate       bool
+}
+
+// Opens the UDP sockets the probes are sent from, bound like the ICMP socket;
+// with rotate one per probe of a hop, else a single one. A nonzero sport binds
+// the first socket to that port and any further ones to the ports after it.
+func openUDPProber(iface string, useIPv6 bool, rotate bool, sport int) (*udpProber, error) {
+	network := "udp4"
+	if useIPv6 {
+		network = "udp6"
+	}
+	source, err := probeSource(iface, useIPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	prober := &udpProber{rotate: rotate}
+	count := 1
+	if rotate {
+		count = *hopProbes
+	}
+	for i := 0; i < count; i++ {
+		port := 0
+		if sport != 0 {
+			port = sport + i
+		}
+		connection, err := listenConfig().ListenPacket(context.Background(), network, net.JoinHostPort(source, strconv.Itoa(port)))
+		if err != nil {
+			prober.Close()
+			if port != 0 && errors.Is(err, syscall.EADDRINUSE) {
+				return nil, fmt.Errorf("source port %d is already in use by another socket; pick another -sport", port)
+			}
+			return nil, err
+		}
+		socket := &udpSocket{conn: connection, port: connection.LocalAddr().(*net.UDPAddr).Port}
+		if useIPv6 {
+			socket.p6 = ipv6.NewPacketConn(connection)
+		} else {
+			socket.p = ipv4.NewPacketConn(connection)
+		}
+		prober.socketsArray = append(prober.socketsArray, socket)
+	}
+	return prober, nil
+}
+
+func (u *udpProber) Close() error {
+	for _, socket := range u.socketsArray {
+		socket.conn.Close()
+	}
+	return nil
+}
+
+// Returns the socket and destination port of the probe-th probe of a hop, the sent-th of the trace
+func (u *udpProber) probe(probe int, sent int) (*udpSocket, int) {
+	if u.rotate {
+		return u.socketsArray[probe%len(u.socketsArray)], udpBasePort
+	}
+	return u.socketsArray[0], udpBasePort + sent
+}
+
+// Probes one TTL with UDP datagrams. Routers answer time exceeded as for echo requests,
+// and the destination answers port unreachable as nothing listens on the high ports,
+// which ends the trace like the other -terminal-codes.
+// Unlike socketExchange a lost probe does not give up the hop, the next one is still sent.
+// Replies are told apart by the source and destination port of the datagram they quote.
+func udpHop(tracer *Tracer, prober *udpProber, ttl int) HopResult {
+	hop := HopResult{TTL: ttl, Sent: tracer.probes}
+	defer func() { hop.Time = time.Now() }()
+
+	for _, socket := range prober.socketsArray {
+		if err := socket.setTTL(ttl); err != nil {
+			hop.Err = err
+			return hop
+		}
+	}
+
+	var lastErr error
+	payload := make([]byte, MsgLength)
+	reply := make([]byte, replyBufferSize(MsgLength))
+	for i := 0; i < tracer.probes; i++ {
+		socket, port := prober.probe(i, tracer.sent)
+		tracer.sent++
+		tracer.counters.Sent++
+
+		if _, err := egressLimit.wait(tracer.ctx, len(payload)); err != nil {
+			hop.Err = err
+			return hop
+		}
+		start := time.Now()
+		if _, err := socket.conn.WriteTo(payload, &net.UDPAddr{IP: tracer.dest.IP, Zone: tracer.dest.Zone, Port: port}); err != nil {
+			hop.Err = &sendError{Err: err}
+			return hop
+		}
+		if err := tracer.conn.SetReadDeadline(start.Add(tracer.timeout(ttl))); err != nil {
+			hop.Err = err
+			return hop
+		}
+
+		for {
+			replyLength, peer, err := tracer.conn.ReadFrom(reply)
+			if err != nil {
+				if isTimeout(err) {
+					tracer.counters.Timeouts++
+				}
+				lastErr = readError(err)
+				break
+			}
+			received := time.Now()
+
+			msg, err := icmp.ParseMessage(tracer.protocol(), reply[:replyLength])
+			if err != nil {
+				tracer.counters.Foreign++
+				continue
+			}
+			source, destination, ok := quotedUDPPorts(quotedPacket(msg))
+			if !ok || source != socket.port || destination != port {
+				tracer.counters.Foreign++
+				continue
+			}
+			tracer.counters.Replies++
+			if replyTruncated(tracer.conn, replyLength, reply) {
+				hop.Truncated++
+			}
+
+			switch {
+			case isTimeExceeded(msg.Type):
+			case isTerminalReply(tracer.terminalCodes, msg):
+				hop.Reached = true
+				hop.TerminalReply = icmpTypeCodeString(msg)
+			default:
+				hop.Err = &unexpectedICMPError{Message: msg, Peer: peer}
+				hop.Peers, hop.RTTs, hop.SourcePorts = nil, nil, nil
+				return hop
+			}
+			hop.RTTs = append(hop.RTTs, received.Sub(start))
+			hop.Peers = append(hop.Peers, peer)
+			if prober.rotate {
+				hop.SourcePorts = append(hop.SourcePorts, socket.port)
+			}
+			break
+		}
+	}
+
+	if len(hop.Peers) == 0 {
+		hop.Err = lastErr
+	}
+	return hop
+}
+
+// Returns the ports of the UDP datagram quoted by an ICMP error
+func quotedUDPPorts(data []byte) (int, int, bool) {
+	if len(data) == 0 {
+		return 0, 0, false
+	}
+
+	var udp []byte
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < ipv4.HeaderLen {
+			return 0, 0, false
+		}
+		headerLen := int(data[0]&0x0f) << 2
+		if data[9] != ProtocolUDP || len(data) < headerLen {
+			return 0, 0, false
+		}
+		udp = data[headerLen:]
+	case 6:
+		proto, payload, ok := ipv6Payload(data)
+		if !ok || proto != ProtocolUDP {
+			return 0, 0, false
+		}
+		udp = payload
+	}
+	if len(udp) < 4 {
+		return 0, 0, false
+	}
+	return int(binary.BigEndian.Uint16(udp[0:2])), int(binary.BigEndian.Uint16(udp[2:4])), true
+}
+
+// Traces the target with ICMP echo requests and then with UDP datagrams, and prints
+// both paths side by side, marking the hops where the protocols got different answers
+func compareProtocols(target targetSpec) error {
+	destination, err := resolveTarget(target.Host)
+	if err != nil {
+		return &resolveError{Target: target.Host, Err: err}
+	}
+	connection, err := openSocket(*sourceIface, *useIPv6)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	prober, err := openUDPProber(*sourceIface, *useIPv6, *udpRotate, *udpSourcePort)
+	if err != nil {
+		return err
+	}
+	defer prober.Close()
+
+	icmpTracer := newTracer(connection, destination, *useIPv6)
+	icmpTracer.maxTTL = target.Config.MaxTTL
+	icmpTrace := TraceResult{Target: target.Host, Destination: destination}
+	for ttl := 1; ttl <= icmpTracer.maxTTL && !icmpTrace.Reached; ttl++ {
+		hop := ping(icmpTracer, ttl)
+		icmpTrace.Hops = append(icmpTrace.Hops, hop)
+		icmpTrace.Reached = hop.Reached
+	}
+
+	udpTracer := newTracer(connection, destination, *useIPv6)
+	udpTrace := TraceResult{Target: target.Host, Destination: destination}
+	for ttl := 1; ttl <= icmpTracer.maxTTL && !udpTrace.Reached; ttl++ {
+		hop := udpHop(udpTracer, prober, ttl)
+		udpTrace.Hops = append(udpTrace.Hops, hop)
+		udpTrace.Reached = hop.Reached
+	}
+
+	printProtocolComparison(&icmpTrace, &udpTrace)
+	if *classifyRoles {
+		for _, role := range markRoles(icmpTrace.Hops, udpTrace.Hops) {
+			fmt.Println(role)
+		}
+	}
+	return nil
+}
+
+func printProtocolComparison(icmpTrace *TraceResult, udpTrace *TraceResult) {
+	fmt.Printf("Comparing ICMP and UDP routes to %s (%s)\n", icmpTrace.Target, icmpTrace.Destination)
+	fmt.Printf("%3s  %-40s  %s\n", "TTL", "ICMP", "UDP")
+
+	lastTTL := len(icmpTrace.Hops)
+	if len(udpTrace.Hops) > lastTTL {
+		lastTTL = len(udpTrace.Hops)
+	}
+	differing := 0
+	for ttl := 1; ttl <= lastTTL; ttl++ {
+		icmpResult, icmpOk := findHop(icmpTrace.Hops, ttl)
+		udpResult, udpOk := findHop(udpTrace.Hops, ttl)
+		marker := ""
+		if protocolsDiffer(icmpResult, icmpOk, udpResult, udpOk) {
+			marker = "  <- differs"
+			differing++
+		}
+		line := fmt.Sprintf("%3d  %-40s  %-40s%s", ttl, comparedHop(icmpResult, icmpOk), comparedHop(udpResult, udpOk), marker)
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+
+	// Flows reaching different routers at the same TTL went down different load-balanced paths
+	for _, hop := range udpTrace.Hops {
+		if len(hop.SourcePorts) == 0 || len(uniquePeers(hop.Peers)) < 2 {
+			continue
+		}
+		var flowsArray []string
+		for i, port := range hop.SourcePorts {
+			flowsArray = append(flowsArray, fmt.Sprintf("%d>%v", port, hop.Peers[i]))
+		}
+		fmt.Printf("hop %d UDP flows split: %s\n", hop.TTL, strings.Join(flowsArray, " "))
+	}
+
+	if differing == 0 {
+		fmt.Printf("both protocols got the same answers at every hop\n")
+		return
+	}
+	fmt.Printf("%d of %d hops answered differently\n", differing, lastTTL)
+	// Silent hops do not count as a route change, so this is where the routes themselves split
+	if divergence := diffTraces(icmpTrace, udpTrace, 0); divergence != nil {
+		fmt.Printf("routes diverge at hop %d: ICMP %s, UDP %s\n", divergence.TTL, divergence.Expected, divergence.Got)
+	}
+}
+
+// Reports whether the two probes of a TTL were answered differently: by one protocol only,
+// by disjoint routers, or as the destination by one of them
+func protocolsDiffer(a HopResult, aOk bool, b HopResult, bOk bool) bool {
+	aAnswered := aOk && a.Responded()
+	bAnswered := bOk && b.Responded()
+	if aAnswered != bAnswered {
+		return true
+	}
+	if !aAnswered {
+		// A timeout against an error still means one of the protocols got an answer
+		return aOk && bOk && a.Status() != b.Status()
+	}
+	return a.Reached != b.Reached || !sharesPeer(a, b)
+}
+
+// Returns a hop's responders and average RTT for the comparison table
+func comparedHop(hop HopResult, ok bool) string {
+	if !ok {
+		return ""
+	}
+	if !hop.Responded() {
+		var icmpErr *unexpectedICMPError
+		if errors.As(hop.Err, &icmpErr) {
+			return fmt.Sprintf("! %v %v", icmpErr.Peer, icmpErr.Message.Type)
+		}
+		return "*"
+	}
+	_, avg, _ := rttStats(hop.RTTs)
+	text := fmt.Sprintf("%s %s", describeHop(hop, true), humanDuration(avg))
+	if hop.Reached {
+		text += " (destination)"
+	}
+	return text
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// usageGroup is a section of the -h output listing related flags
+type usageGroup struct {
+	Title      string
+	FlagsArray []string
+}
+
+var usageGroups = []usageGroup{
+	{"Targets", []string{"targets", "4", "6", "resolve-once", "reresolve", "dns-retries", "fail-fast", "batch-concurrency"}},
+	{"Sockets", []string{"i", "socket-mode", "socket-fd", "mark", "bpf-filter"}},
+	{"Probing", []string{
+		"timeout", "timeout-per-hop", "timeout-max", "interval", "precise-timing", "arp-retry", "max-ttl", "probes", "rate", "min-ttl-confirm",
+		"probe-spacing-adaptive", "max-probe-spacing", "spacing-loss",
+		"adaptive-probes", "min-probes", "max-probes",
+		"probe-sizes", "tos", "echo-code", "payload-timestamp", "timestamp-option", "terminal-codes",
+		"strict-reply-match", "reject-mangled", "require-destination-match", "abort-on-firewall",
+	}},
+	{"Probing strategy", []string{"parallel", "probe-ttl-order", "seed", "bisect", "bisect-fill", "probe-destination-first", "final-samples"}},
+	{"Modes", []string{
+		"gateway-only", "verify-path-stability", "compare-udp", "udp-rotate-source", "sport", "watch",
+		"exit-after-destination-rtt-stable", "stable-rtt-tolerance", "stable-max-runs", "stable-interval",
+		"sweep", "sweep-workers", "sweep-large", "tui", "max-hop-peers", "max-total-peers", "replay", "replay-rate", "list-interfaces", "print-schema", "self-test",
+	}},
+	{"Path MTU", []string{"blackhole-size", "size-sweep", "size-sweep-hop", "size-sweep-max", "size-sweep-iterations"}},
+	{"Hop names and origins", []string{
+		"resolve-timeout", "enrich-timeout", "hop-dns-servers", "fcrdns", "name-hints", "resolve-after", "no-reverse-partial-hops",
+		"hop-hostname-width", "geo", "country-markers", "as-path", "enrichers",
+	}},
+	{"Output", []string{
+		"v", "no-header", "precision", "mark-repeated-hops", "responder-counts", "best", "rtt-bars", "template", "template-trace", "json", "json-pretty", "binary", "json-raw", "jsonl", "wall-clock",
+		"markdown", "compact", "compact-max-path", "influx", "influx-measurement", "graphite", "graphite-prefix", "trace-id",
+		"print-sent-bytes", "save", "output-dir", "dot", "otlp-endpoint",
+	}},
+	{"Analysis", []string{
+		"min-rtt-guard", "rate-limit-margin", "rate-limit-variation", "classify-bottleneck", "nat-boundary",
+		"aggregate-networks", "aggregate-prefix", "aggregate-prefix6", "count-distinct-hops", "hop-roles", "measure-clock-skew", "reverse-hops", "ports", "ports-workers", "verify-dscp",
+	}},
+	{"Exit status", []string{
+		"expect", "expect-until-hop", "allow-unreached", "latency-alert", "latency-alert-until-hop",
+		"fail-on-loss", "fail-on-hop-loss", "fail-on-destination-loss",
+	}},
+}
+
+var usageExamples = []string{
+	"traceroute example.com",
+	"traceroute -6 -timeout 500ms example.com",
+	"traceroute -json https://example.com/status > trace.json",
+	"traceroute -targets hosts.txt -output-dir traces",
+	"traceroute -expect trace.json example.com || echo route changed",
+	"traceroute -compare-udp -udp-rotate-source example.com",
+	"traceroute -latency-alert 50ms -fail-on-loss 10 example.com",
+}
+
+// Exit statuses for scripts, from the most to the least specific cause
+const usageExitCodes = `  0  every destination reached
+  1  the route differs from -expect
+  2  invalid usage, a target could not be resolved or traced
+  3  a destination was not reached (see -allow-unreached)
+  4  -latency-alert was exceeded
+  5  a -fail-on-loss threshold was exceeded
+  6  -self-test found only datagram sockets usable
+  7  -self-test found no socket usable
+  8  -exit-after-destination-rtt-stable gave up after -stable-max-runs`
+
+// Prints the flags by group, with their defaults, followed by examples; set as flag.Usage
+func printUsage(out io.Writer) {
+	fmt.Fprintf(out, "Usage: traceroute [flags] target...\n\n")
+	fmt.Fprintf(out, "Targets are host names, IP addresses or URLs, whose host is traced. Raw ICMP\n")
+	fmt.Fprintf(out, "sockets need root or CAP_NET_RAW; see -socket-mode for unprivileged probing.\n")
+
+	listed := make(map[string]bool)
+	for _, group := range usageGroups {
+		fmt.Fprintf(out, "\n%s:\n", group.Title)
+		for _, name := range group.FlagsArray {
+			if f := flag.Lookup(name); f != nil {
+				printFlagUsage(out, f)
+				listed[name] = true
+			}
+		}
+	}
+
+	// A flag left out of the groups is still shown
+	var otherArray []*flag.Flag
+	flag.VisitAll(func(f *flag.Flag) {
+		if !listed[f.Name] {
+			otherArray = append(otherArray, f)
+		}
+	})
+	if len(otherArray) > 0 {
+		fmt.Fprintf(out, "\nOther:\n")
+		for _, f := range otherArray {
+			printFlagUsage(out, f)
+		}
+	}
+
+	fmt.Fprintf(out, "\nExamples:\n")
+	for _, example := range usageExamples {
+		fmt.Fprintf(out, "  %s\n", example)
+	}
+	fmt.Fprintf(out, "\nExit status:\n%s\n", usageExitCodes)
+}
+
+// Prints a flag the way flag.PrintDefaults does
+func printFlagUsage(out io.Writer, f *flag.Flag) {
+	name, usage := flag.UnquoteUsage(f)
+	line := "  -" + f.Name
+	if name != "" {
+		line += " " + name
+	}
+	line += "\n    \t" + strings.ReplaceAll(usage, "\n", "\n    \t")
+	switch {
+	case f.DefValue == "" || f.DefValue == "0" || f.DefValue == "false" || f.DefValue == "0s":
+	case name == "string":
+		line += fmt.Sprintf(" (default %q)", f.DefValue)
+	default:
+		line += fmt.Sprintf(" (default %v)", f.DefValue)
+	}
+	fmt.Fprintln(out, line)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrintUsage(t *testing.T) {
+	var b bytes.Buffer
+	printUsage(&b)
+	out := b.String()
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "synopsis", want: "Usage: traceroute [flags] target...\n"},
+		{name: "group", want: "\nProbing:\n"},
+		{name: "boolean flag", want: "\n  -6\n    \ttrace over IPv6\n"},
+		{name: "typed flag", want: "\n  -timeout duration\n"},
+		{name: "string default", want: `(default "auto")`},
+		{name: "examples", want: "\nExamples:\n  traceroute example.com\n"},
+		{name: "exit status", want: "\nExit status:\n  0  every destination reached\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !strings.Contains(out, tt.want) {
+				t.Errorf("usage lacks %q", tt.want)
+			}
+		})
+	}
+}
+
+func TestUsageGroupsListEveryFlag(t *testing.T) {
+	grouped := make(map[string]bool)
+	for _, group := range usageGroups {
+		for _, name := range group.FlagsArray {
+			if grouped[name] {
+				t.Errorf("-%s listed twice", name)
+			}
+			if flag.Lookup(name) == nil {
+				t.Errorf("-%s in %s is no flag", name, group.Title)
+			}
+			grouped[name] = true
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if !grouped[f.Name] && !strings.HasPrefix(f.Name, "test.") {
+			t.Errorf("-%s is in no group", f.Name)
+		}
+	})
+}
+
+func TestPrintFlagUsage(t *testing.T) {
+	flags := flag.NewFlagSet("usage", flag.ContinueOnError)
+	flags.Bool("quiet", false, "print nothing")
+	flags.Bool("color", true, "color the output")
+	flags.String("name", "", "a `host` to trace")
+	flags.String("mode", "auto", "socket mode")
+	flags.Int("probes", 3, "probes per hop")
+	flags.Int("mark", 0, "fwmark")
+	flags.Duration("wait", time.Second, "time to wait")
+	flags.Duration("step", 0, "step")
+
+	tests := []struct {
+		flag string
+		want string
+	}{
+		{flag: "quiet", want: "  -quiet\n    \tprint nothing\n"},
+		{flag: "color", want: "  -color\n    \tcolor the output (default true)\n"},
+		{flag: "name", want: "  -name host\n    \ta host to trace\n"},
+		{flag: "mode", want: "  -mode string\n    \tsocket mode (default \"auto\")\n"},
+		{flag: "probes", want: "  -probes int\n    \tprobes per hop (default 3)\n"},
+		{flag: "mark", want: "  -mark int\n    \tfwmark\n"},
+		{flag: "wait", want: "  -wait duration\n    \ttime to wait (default 1s)\n"},
+		{flag: "step", want: "  -step duration\n    \tstep\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.flag, func(t *testing.T) {
+			var b bytes.Buffer
+			printFlagUsage(&b, flags.Lookup(tt.flag))
+			if b.String() != tt.want {
+				t.Errorf("got %q, want %q", b.String(), tt.want)
+			}
+		})
+	}
+}
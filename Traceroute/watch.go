@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// Sends one probe with full TTL to the destination every interval and prints its RTT until interrupted
+func watch(target targetSpec, interval time.Duration) error {
+	destination, err := resolveTarget(target.Host)
+	if err != nil {
+		return &resolveError{Target: target.Host, Err: err}
+	}
+	connection, err := openSocket(*sourceIface, *useIPv6)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	tracer := newTracer(connection, destination, *useIPv6)
+	tracer.maxTTL = target.Config.MaxTTL
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	fmt.Printf("Watching %s [%s] every %v, Ctrl-C to stop\n", target.Host, destination, interval)
+	var rttsArray []time.Duration
+	var sent int = 0
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		exchange, err := socketExchange(tracer, []int{MsgLength}, tracer.maxTTL, 1)
+		sent++
+		now := time.Now().Format("15:04:05.000")
+		switch {
+		case err != nil:
+			fmt.Printf("%s  lost  (%v)\n", now, err)
+		case !isEchoReply(exchange.Type):
+			fmt.Printf("%s  lost  (no reply from the destination)\n", now)
+		default:
+			rtt := exchange.RTTs[len(exchange.RTTs)-1]
+			rttsArray = append(rttsArray, rtt)
+			_, avg, _ := rttStats(rttsArray)
+			fmt.Printf("%s  %s  (avg %s)\n", now, humanDuration(rtt), humanDuration(avg))
+		}
+
+		select {
+		case <-interrupts:
+			min, avg, max := rttStats(rttsArray)
+			fmt.Printf("%d sent, %d received, %.1f%% loss, min/avg/max/stddev = %s/%s/%s/%s\n", sent, len(rttsArray),
+				100*float64(sent-len(rttsArray))/float64(sent), humanDuration(min), humanDuration(avg), humanDuration(max), humanDuration(rttStdDev(rttsArray)))
+			return nil
+		case <-ticker.C:
+		}
+	}
+}